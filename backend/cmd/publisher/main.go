@@ -1,54 +1,135 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"webrtc-streaming/internal/auth"
 	"webrtc-streaming/internal/config"
 	iceutils "webrtc-streaming/internal/ice"
+	"webrtc-streaming/internal/protocol"
+	"webrtc-streaming/internal/rtsp"
 	"webrtc-streaming/internal/video"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
 )
 
-func getKeys(m map[string]interface{}) []string {
-	keys := make([]string, 0, len(m))
-	for k := range m {
-		keys = append(keys, k)
-	}
-	return keys
-}
-
 type ViewerConnection struct {
-	clientID string
-	pc       *webrtc.PeerConnection
+	clientID   string
+	whep       bool   // Joined over WHEP: no signaling connection, our candidates went out in the answer
+	whepToken  string // Token the WHEP session was started with (auth required); only it can change the session
+	pc         *webrtc.PeerConnection
+	videoTrack *webrtc.TrackLocalStaticRTP // This viewer's own copy of the video track
+	mu         sync.Mutex                  // Guards connected/videoStarted and the layer state
+	connected  bool                        // The peer connection is up, so packets reach the viewer
+	// The viewer has been sent a frame start, or the cached keyframe; from then on it gets
+	// every packet of the live stream
+	videoStarted bool
+	// The cached keyframe went out: the live P-frames after it refer to frames the viewer never
+	// got, so nothing more is sent until the live stream's next keyframe
+	awaitingKeyframe bool
+	estimator        cc.BandwidthEstimator // GCC estimate of this viewer's bandwidth (nil without adaptive bitrate)
+	// Simulcast: the layer this viewer is sent and the one it should be switched to (at that
+	// layer's next keyframe), picked from its bandwidth estimate unless the viewer chose one
+	layer        int
+	targetLayer  int
+	autoLayer    bool
+	layerChanged time.Time // Last time targetLayer changed
+	// The layers have their own sequence numbers, so after a switch packets are renumbered to
+	// continue where the previous layer stopped
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
 }
 
 type Publisher struct {
 	viewers      map[string]*ViewerConnection // Track connections by client ID
 	viewersMu    sync.RWMutex                 // Mutex for concurrent access to viewers map
+	whepPending  int                          // WHEP offers being answered, counted against WHEP_MAX_SESSIONS (guarded by viewersMu)
 	wsConn       *websocket.Conn
-	wsConnMu     sync.RWMutex // Mutex for WebSocket connection
-	signalingURL string
-	track        *webrtc.TrackLocalStaticSample
+	wsConnMu     sync.RWMutex                   // Mutex for WebSocket connection (also guards clientID/resumeToken)
+	wsWriteMu    sync.Mutex                     // The WebSocket takes one writer at a time (offers, candidates and layer updates come from different goroutines)
+	stream       string                         // Stream (signaling room) this publisher serves
+	servers      []string                       // Signaling server URLs for our room, tried in turn on reconnect
+	serverIndex  int                            // The one we use (guarded by wsConnMu)
+	clientID     string                         // Our identity on the signaling server (from the welcome message)
+	resumeToken  string                         // Presented on reconnect to keep the same clientID
+	videoCodec   webrtc.RTPCodecCapability      // Codec of the video track each viewer gets
+	layers       []*videoLayer                  // Encodings of the video, highest first (one unless the source encodes renditions)
+	audioTrack   *webrtc.TrackLocalStaticSample // Opus track, nil when the source has no audio
 	capturer     *video.VideoCapturer
-	api          *webrtc.API
+	api          *webrtcAPI
 	webrtcConfig webrtc.Configuration
-	shouldStop   bool       // Flag to stop reconnection attempts
-	stopMu       sync.Mutex // Mutex for shouldStop flag
+	shouldStop   bool          // Flag to stop reconnection attempts
+	stopMu       sync.Mutex    // Mutex for shouldStop flag
+	done         chan struct{} // Closed with shouldStop, ends the wait between reconnection attempts
+	// Keyframe requests (PLI/FIR) from viewers, rate limited across all viewers of the stream
+	keyframeMu          sync.Mutex
+	lastKeyframe        time.Time // When the source was last asked for a keyframe
+	keyframeUnsupported bool      // The source can't force keyframes (logged once)
 }
 
-func NewPublisher() (*Publisher, error) {
-	// Get centralized WebRTC configuration (ICE/STUN/TURN)
-	webrtcConfig := iceutils.GetWebRTCConfiguration()
+// videoLayer is one encoding of a stream's video. Most sources have a single one; with
+// VIDEO_RENDITIONS the RTSP source encodes several resolutions (simulcast layers) and every
+// viewer is sent one of them.
+type videoLayer struct {
+	name       string // Rendition name, e.g. "540p" (empty with a single encoding)
+	height     int
+	bitrate    int                    // kbps
+	packetizer *video.FramePacketizer // Turns captured frames into RTP (nil when the source forwards RTP)
+	keyframes  *video.KeyframeCache   // Latest H.264 keyframe for late joiners (nil when disabled)
+	frameStart bool                   // The next packet starts a frame (the last one had the marker bit)
+}
+
+// webrtcAPI is the WebRTC API shared by the publishers of all streams
+// With adaptive bitrate it also hands out the bandwidth estimator the congestion controller
+// creates for each peer connection: the controller reports them through a single callback,
+// so peer connections are created one at a time (see newPeerConnection).
+type webrtcAPI struct {
+	*webrtc.API
+	estimatorMu sync.Mutex
+	estimator   cc.BandwidthEstimator // Set by the callback while NewPeerConnection runs
+}
 
+// newPeerConnection creates a peer connection and returns its bandwidth estimator
+// (nil when adaptive bitrate is off)
+func (a *webrtcAPI) newPeerConnection(configuration webrtc.Configuration) (*webrtc.PeerConnection, cc.BandwidthEstimator, error) {
+	a.estimatorMu.Lock()
+	defer a.estimatorMu.Unlock()
+
+	a.estimator = nil
+	pc, err := a.NewPeerConnection(configuration)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pc, a.estimator, nil
+}
+
+// newWebRTCAPI builds the WebRTC API shared by the publishers of all streams
+func newWebRTCAPI() (*webrtcAPI, error) {
 	// Create peer connection with proper codec support
 	mediaEngine := &webrtc.MediaEngine{}
 	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
@@ -57,44 +138,75 @@ func NewPublisher() (*Publisher, error) {
 
 	// H264 codec is already registered by RegisterDefaultCodecs()
 	// No need to manually register it
-	if config.AppConfig.Video.RTSPURL != "" {
-		log.Println("H264 codec support enabled for RTSP stream")
+
+	api := &webrtcAPI{}
+	interceptorRegistry := &interceptor.Registry{}
+
+	// Congestion control: GCC estimates each viewer's bandwidth from the TWCC feedback its
+	// browser sends about our packets (see selectLayers for what the estimates drive)
+	if videoConfig := config.AppConfig.Video; videoConfig.AdaptiveBitrate {
+		maxBitrate := maxEstimateKbps() * 1000
+		minBitrate := min(videoConfig.MinBitrate*1000, maxBitrate)
+		congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+			return gcc.NewSendSideBWE(
+				gcc.SendSideBWEInitialBitrate(maxBitrate),
+				gcc.SendSideBWEMinBitrate(minBitrate),
+				gcc.SendSideBWEMaxBitrate(maxBitrate),
+				// Packets still go out as soon as they are written - viewers switch renditions, nothing is paced
+				gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+			)
+		})
+		if err != nil {
+			return nil, err
+		}
+		congestionController.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+			api.estimator = estimator
+		})
+		interceptorRegistry.Add(congestionController)
+
+		// Transport-wide sequence numbers on every packet, for the TWCC feedback
+		if err := webrtc.ConfigureTWCCHeaderExtensionSender(mediaEngine, interceptorRegistry); err != nil {
+			return nil, err
+		}
+		log.Printf("📶 Adaptive bitrate enabled (%d-%d kbps)", minBitrate/1000, maxBitrate/1000)
 	}
 
-	// Create interceptor registry with low-latency buffering
 	// RegisterDefaultInterceptors already includes NACK and RTCP for optimal performance
-	interceptorRegistry := &interceptor.Registry{}
 	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
 		return nil, err
 	}
 
-	api := webrtc.NewAPI(
+	api.API = webrtc.NewAPI(
 		webrtc.WithMediaEngine(mediaEngine),
 		webrtc.WithInterceptorRegistry(interceptorRegistry),
 	)
+	return api, nil
+}
+
+// NewPublisher starts the source of one stream and prepares the track its viewers receive
+func NewPublisher(api *webrtcAPI, stream string, source video.VideoSource) (*Publisher, error) {
+	// Get centralized WebRTC configuration (ICE/STUN/TURN)
+	webrtcConfig := iceutils.GetWebRTCConfiguration()
 
-	capturer, err := video.NewVideoCapturer()
+	capturer, err := video.NewVideoCapturer(source)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create video capturer: %w", err)
 	}
 
 	publisher := &Publisher{
 		viewers:      make(map[string]*ViewerConnection),
-		signalingURL: fmt.Sprintf("ws://%s:%d/ws", config.AppConfig.SignalingServer.Host, config.AppConfig.SignalingServer.Port),
+		stream:       stream,
+		servers:      signalingURLs(stream),
 		capturer:     capturer,
 		api:          api,
 		webrtcConfig: webrtcConfig,
+		done:         make(chan struct{}),
 	}
 
 	// Determine codec based on video source
-	// Use H264 if RTSP is configured, otherwise VP8
-	mimeType := webrtc.MimeTypeVP8
-	if config.AppConfig.Video.RTSPURL != "" {
-		mimeType = webrtc.MimeTypeH264
-		log.Println("Using H264 codec for RTSP stream")
-	} else {
-		log.Println("Using VP8 codec for mock stream")
-	}
+	// RTSP and file sources produce H264, the test pattern produces VP8
+	mimeType := capturer.GetMimeType()
+	log.Printf("[%s] Using %s codec for video source", stream, mimeType)
 
 	// Create video track with proper codec configuration
 	codecCapability := webrtc.RTPCodecCapability{
@@ -107,61 +219,140 @@ func NewPublisher() (*Publisher, error) {
 		log.Println("Configured H264 track with 90000 Hz clock rate")
 	}
 
-	videoTrack, err := webrtc.NewTrackLocalStaticSample(
-		codecCapability,
-		"video",
-		"publisher",
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create video track: %w", err)
+	// Each viewer gets its own track (see createViewerConnection), so a new viewer can be sent
+	// the cached keyframe without it going to everyone else
+	publisher.videoCodec = codecCapability
+	publisher.layers = []*videoLayer{{frameStart: true}}
+	if renditions := capturer.Renditions(); len(renditions) > 1 {
+		publisher.layers = make([]*videoLayer, len(renditions))
+		for i, rendition := range renditions {
+			publisher.layers[i] = &videoLayer{
+				name:       rendition.Name,
+				height:     rendition.Height,
+				bitrate:    rendition.Bitrate,
+				frameStart: true,
+			}
+		}
+		log.Printf("📚 [%s] %d simulcast layers - each viewer is sent the one its connection carries", stream, len(renditions))
+	}
+	if mimeType == webrtc.MimeTypeH264 && config.AppConfig.Video.KeyframeCache {
+		for _, layer := range publisher.layers {
+			layer.keyframes = video.NewKeyframeCache()
+		}
+		log.Printf("🖼️ [%s] Late joiners start with the latest cached keyframe", stream)
+	}
+
+	// Sources that already receive RTP write their packets to the track as is; frames from
+	// every other source are packetized here, with RTP timestamps taken from their PTS
+	if capturer.RTP() != nil {
+		log.Printf("✅ [%s] Forwarding RTP on the video tracks with codec: %s", stream, mimeType)
+	} else {
+		clockRate := codecCapability.ClockRate
+		if clockRate == 0 {
+			clockRate = 90000 // Video RTP clock for H264 and VP8
+		}
+		for i, layer := range publisher.layers {
+			packetizer, err := video.NewFramePacketizer(mimeType, clockRate)
+			if err != nil {
+				return nil, err
+			}
+			if i > 0 {
+				packetizer.SyncWith(publisher.layers[0].packetizer)
+			}
+			layer.packetizer = packetizer
+		}
+		log.Printf("✅ [%s] Packetizing frames for the video tracks with codec: %s", stream, mimeType)
+	}
+	log.Printf("   A video track will be created for each viewer's peer connection")
+
+	// Camera audio goes out as a second track in the same media stream, so the browser
+	// plays both in sync (lip sync works per stream ID). The capturer started the source, so an
+	// RTSP camera has been probed and Audio() is nil when it sends no audio.
+	if capturer.Audio() != nil {
+		audioTrack, err := webrtc.NewTrackLocalStaticSample(
+			webrtc.RTPCodecCapability{
+				MimeType:  webrtc.MimeTypeOpus,
+				ClockRate: 48000,
+				Channels:  2,
+			},
+			"audio",
+			stream,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create audio track: %w", err)
+		}
+		publisher.audioTrack = audioTrack
+		log.Printf("✅ [%s] Created audio track with codec: %s", stream, webrtc.MimeTypeOpus)
 	}
-	publisher.track = videoTrack
-	log.Printf("✅ Created video track with codec: %s", mimeType)
-	log.Printf("   Track will be added to each viewer's peer connection")
 
 	return publisher, nil
 }
 
-// createViewerConnection creates a new peer connection for a viewer
-func (p *Publisher) createViewerConnection(clientID string) (*ViewerConnection, error) {
+// createViewerConnection creates a new peer connection for a viewer (whep: the viewer is a WHEP
+// player, see handleWHEP)
+func (p *Publisher) createViewerConnection(clientID string, whep bool) (*ViewerConnection, error) {
 	log.Printf("Creating new peer connection for viewer: %s", clientID)
 
 	// Create new peer connection
-	pc, err := p.api.NewPeerConnection(p.webrtcConfig)
+	pc, estimator, err := p.api.newPeerConnection(p.webrtcConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create peer connection: %w", err)
 	}
 
-	// Create a new track instance for this viewer (can reuse the same track data source)
-	// Actually, we can use the same track instance - TrackLocalStaticSample can be added to multiple PCs
-	sender, err := pc.AddTrack(p.track)
+	// Every viewer gets its own track: the stream is written to each of them, and a new viewer
+	// starts with the cached keyframe
+	videoTrack, err := webrtc.NewTrackLocalStaticRTP(
+		p.videoCodec,
+		"video",
+		p.stream, // Stream ID, so viewers can tell cameras apart
+	)
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("failed to create video track: %w", err)
+	}
+	sender, err := pc.AddTrack(videoTrack)
 	if err != nil {
 		pc.Close()
 		return nil, fmt.Errorf("failed to add track: %w", err)
 	}
 
-	// Handle RTCP packets from the receiver
-	go func() {
-		rtcpBuf := make([]byte, 1500)
-		for {
-			if _, _, rtcpErr := sender.Read(rtcpBuf); rtcpErr != nil {
-				if rtcpErr != io.EOF {
-					log.Printf("RTCP read error for viewer %s: %v", clientID, rtcpErr)
-				}
-				return
-			}
+	viewerConn := &ViewerConnection{
+		clientID:   clientID,
+		whep:       whep,
+		pc:         pc,
+		videoTrack: videoTrack,
+		estimator:  estimator,
+		autoLayer:  true,
+	}
+
+	// Handle RTCP packets from the receiver (keyframe requests go to the source)
+	go p.readVideoRTCP(sender, clientID)
+
+	if p.audioTrack != nil {
+		audioSender, err := pc.AddTrack(p.audioTrack)
+		if err != nil {
+			pc.Close()
+			return nil, fmt.Errorf("failed to add audio track: %w", err)
 		}
-	}()
+		go drainRTCP(audioSender, clientID)
+	}
 
-	// Set up ICE candidate handling
+	// Set up ICE candidate handling (a WHEP answer already carries our candidates)
 	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-		if candidate != nil {
+		if candidate != nil && !whep {
 			p.sendICECandidate(candidate, clientID)
 		}
 	})
 
 	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		log.Printf("📡 [%s] Peer connection state: %s", clientID, state.String())
+		viewerConn.mu.Lock()
+		viewerConn.connected = state == webrtc.PeerConnectionStateConnected
+		viewerConn.mu.Unlock()
+		if state == webrtc.PeerConnectionStateConnected && len(p.layers) > 1 {
+			// Tell the viewer which qualities it can pick from
+			go p.sendLayers(viewerConn)
+		}
 		if state == webrtc.PeerConnectionStateClosed {
 			// Only clean up when connection is explicitly closed
 			p.removeViewer(clientID)
@@ -251,12 +442,73 @@ func (p *Publisher) createViewerConnection(clientID string) (*ViewerConnection,
 		}
 	})
 
-	viewerConn := &ViewerConnection{
-		clientID: clientID,
-		pc:       pc,
+	return viewerConn, nil
+}
+
+// drainRTCP reads RTCP for a sender so the interceptors (NACK, reports) keep working
+func drainRTCP(sender *webrtc.RTPSender, clientID string) {
+	rtcpBuf := make([]byte, 1500)
+	for {
+		if _, _, rtcpErr := sender.Read(rtcpBuf); rtcpErr != nil {
+			if rtcpErr != io.EOF {
+				log.Printf("RTCP read error for viewer %s: %v", clientID, rtcpErr)
+			}
+			return
+		}
 	}
+}
 
-	return viewerConn, nil
+// readVideoRTCP reads RTCP for the video sender and asks the source for a keyframe when the
+// viewer sends a PLI or FIR (it joined mid-GOP or lost packets it couldn't recover with NACK)
+func (p *Publisher) readVideoRTCP(sender *webrtc.RTPSender, clientID string) {
+	for {
+		packets, _, rtcpErr := sender.ReadRTCP()
+		if rtcpErr != nil {
+			if rtcpErr != io.EOF {
+				log.Printf("RTCP read error for viewer %s: %v", clientID, rtcpErr)
+			}
+			return
+		}
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication:
+				p.requestKeyframe(clientID, "PLI")
+			case *rtcp.FullIntraRequest:
+				p.requestKeyframe(clientID, "FIR")
+			}
+		}
+	}
+}
+
+// requestKeyframe asks the source for a keyframe, at most once per VIDEO_KEYFRAME_MIN_INTERVAL
+// Forcing one restarts the test pattern's VP8 encoder, so requests from many viewers (or a
+// viewer repeating its PLI) inside the interval are served by the same keyframe.
+func (p *Publisher) requestKeyframe(clientID, kind string) {
+	interval := config.AppConfig.Video.KeyframeMinInterval
+	if interval <= 0 {
+		return
+	}
+
+	p.keyframeMu.Lock()
+	if p.keyframeUnsupported || time.Since(p.lastKeyframe) < interval {
+		p.keyframeMu.Unlock()
+		return
+	}
+	p.lastKeyframe = time.Now()
+	p.keyframeMu.Unlock()
+
+	log.Printf("🔑 [%s] Viewer %s asked for a keyframe (%s)", p.stream, clientID, kind)
+	go func() {
+		if p.capturer.RequestKeyframe() {
+			return
+		}
+		p.keyframeMu.Lock()
+		defer p.keyframeMu.Unlock()
+		if !p.keyframeUnsupported {
+			p.keyframeUnsupported = true
+			log.Printf("   [%s] This source can't force keyframes - viewers wait for the next one it sends", p.stream)
+		}
+	}()
 }
 
 func (p *Publisher) removeViewer(clientID string) {
@@ -272,7 +524,52 @@ func (p *Publisher) removeViewer(clientID string) {
 	}
 }
 
+// signalingURLs returns the WebSocket URLs of the signaling servers (SIGNALING_URLS, or the
+// one at SIGNALING_SERVER_HOST:SIGNALING_SERVER_PORT) for a stream's room
+func signalingURLs(stream string) []string {
+	serverConfig := config.AppConfig.SignalingServer
+	servers := serverConfig.URLs
+	if len(servers) == 0 {
+		servers = []string{fmt.Sprintf("ws://%s:%d/ws", serverConfig.Host, serverConfig.Port)}
+	}
+
+	urls := make([]string, 0, len(servers))
+	for _, server := range servers {
+		separator := "?"
+		if strings.Contains(server, "?") {
+			separator = "&"
+		}
+		urls = append(urls, server+separator+"room="+url.QueryEscape(stream))
+	}
+	return urls
+}
+
+// Connect connects to a signaling server and joins our stream, trying each of the servers
+// once, starting with the one we used last
 func (p *Publisher) Connect() error {
+	p.wsConnMu.RLock()
+	first := p.serverIndex
+	p.wsConnMu.RUnlock()
+
+	var errs []error
+	for i := range p.servers {
+		index := (first + i) % len(p.servers)
+		err := p.connectTo(p.servers[index])
+		if err == nil {
+			p.wsConnMu.Lock()
+			p.serverIndex = index
+			p.wsConnMu.Unlock()
+			return nil
+		}
+		if len(p.servers) > 1 {
+			log.Printf("⚠️ [%s] Signaling server %d of %d failed: %v", p.stream, index+1, len(p.servers), err)
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (p *Publisher) connectTo(signalingURL string) error {
 	// Close existing connection if any
 	p.wsConnMu.Lock()
 	if p.wsConn != nil {
@@ -281,9 +578,27 @@ func (p *Publisher) Connect() error {
 	}
 	p.wsConnMu.Unlock()
 
-	log.Println("Connecting to signaling server...")
+	log.Printf("Connecting to signaling server %s (room: %s)...", strings.Split(signalingURL, "?")[0], p.stream)
+	// Present our resume token (if we have one) so viewers keep addressing us by the same ID
+	dialURL := signalingURL
+	p.wsConnMu.RLock()
+	if p.resumeToken != "" {
+		dialURL += "&resumeToken=" + url.QueryEscape(p.resumeToken)
+	}
+	p.wsConnMu.RUnlock()
+
+	// Authenticate with a publisher token for our stream
+	header := http.Header{}
+	token, err := p.signalingToken()
+	if err != nil {
+		return fmt.Errorf("failed to get signaling token: %w", err)
+	}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+
 	// Connect to signaling server
-	conn, _, err := websocket.DefaultDialer.Dial(p.signalingURL, nil)
+	conn, _, err := websocket.DefaultDialer.Dial(dialURL, header)
 	if err != nil {
 		return fmt.Errorf("failed to connect to signaling server: %w", err)
 	}
@@ -292,7 +607,21 @@ func (p *Publisher) Connect() error {
 	p.wsConn = conn
 	p.wsConnMu.Unlock()
 
-	log.Println("Connected to signaling server")
+	log.Printf("Connected to signaling server (room: %s)", p.stream)
+
+	// Declare ourselves as the stream's publisher - the server only sends us viewer events after this
+	joinMsg := &protocol.Join{
+		Header: protocol.NewHeader(protocol.TypeJoin),
+		Role:   protocol.RolePublisher,
+		Stream: p.stream,
+	}
+	if err := p.sendMessage(joinMsg); err != nil {
+		conn.Close()
+		p.wsConnMu.Lock()
+		p.wsConn = nil
+		p.wsConnMu.Unlock()
+		return fmt.Errorf("failed to join stream: %w", err)
+	}
 
 	// Start reading messages
 	go p.readMessages()
@@ -305,6 +634,19 @@ func (p *Publisher) Connect() error {
 	return nil
 }
 
+// signalingToken returns the token to present to the signaling server: the configured
+// SIGNALING_TOKEN, or a fresh publisher token for our stream when only the secret is configured
+func (p *Publisher) signalingToken() (string, error) {
+	authConfig := config.AppConfig.Auth
+	if authConfig.Token != "" {
+		return authConfig.Token, nil
+	}
+	if authConfig.Secret == "" {
+		return "", nil
+	}
+	return auth.NewToken([]byte(authConfig.Secret), protocol.RolePublisher, p.stream, authConfig.TokenTTL)
+}
+
 // restartICEForViewer attempts to restart ICE by creating a new offer
 func (p *Publisher) restartICEForViewer(clientID string) error {
 	p.viewersMu.RLock()
@@ -314,6 +656,10 @@ func (p *Publisher) restartICEForViewer(clientID string) error {
 	if !exists || viewer.pc == nil {
 		return fmt.Errorf("viewer connection not found: %s", clientID)
 	}
+	if viewer.whep {
+		// There is no signaling connection to send an offer on
+		return fmt.Errorf("WHEP players restart ICE themselves")
+	}
 
 	// Create a new offer to restart ICE
 	log.Printf("🔄 [%s] Creating new offer to restart ICE...", clientID)
@@ -328,14 +674,7 @@ func (p *Publisher) restartICEForViewer(clientID string) error {
 	}
 
 	// Send the offer to restart ICE negotiation
-	offerMsg := map[string]interface{}{
-		"type":     "offer",
-		"clientId": clientID,
-		"offer": map[string]interface{}{
-			"type": offer.Type.String(),
-			"sdp":  offer.SDP,
-		},
-	}
+	offerMsg := newOfferMessage(clientID, offer)
 	if err := p.sendMessage(offerMsg); err != nil {
 		return fmt.Errorf("failed to send restart offer: %w", err)
 	}
@@ -366,15 +705,7 @@ func (p *Publisher) sendOffer(clientID string) error {
 
 	// Send offer through signaling server
 	log.Printf("[%s] Sending offer to viewer...", clientID)
-	// Serialize offer to match browser's RTCSessionDescription format
-	offerMsg := map[string]interface{}{
-		"type":     "offer",
-		"clientId": clientID,
-		"offer": map[string]interface{}{
-			"type": offer.Type.String(),
-			"sdp":  offer.SDP,
-		},
-	}
+	offerMsg := newOfferMessage(clientID, offer)
 	if err := p.sendMessage(offerMsg); err != nil {
 		return fmt.Errorf("failed to send offer: %w", err)
 	}
@@ -382,6 +713,58 @@ func (p *Publisher) sendOffer(clientID string) error {
 	return nil
 }
 
+// newOfferMessage addresses an SDP offer to a single viewer, in the browser's RTCSessionDescription format
+func newOfferMessage(clientID string, offer webrtc.SessionDescription) *protocol.Offer {
+	return &protocol.Offer{
+		Header: protocol.NewHeader(protocol.TypeOffer),
+		Routing: protocol.Routing{
+			ClientID:       clientID,
+			TargetClientID: clientID,
+		},
+		Offer: &protocol.SessionDescription{
+			Type: offer.Type.String(),
+			SDP:  offer.SDP,
+		},
+	}
+}
+
+// handleViewerConnected creates (or recreates) the peer connection for a viewer and sends it an offer
+func (p *Publisher) handleViewerConnected(clientID string) {
+	log.Printf("New viewer connected: %s, creating peer connection...", clientID)
+
+	// Check if a connection already exists for this client ID and clean it up
+	p.viewersMu.Lock()
+	if existingViewer, exists := p.viewers[clientID]; exists {
+		log.Printf("⚠️ Viewer %s already exists, cleaning up old connection first", clientID)
+		if existingViewer.pc != nil {
+			existingViewer.pc.Close()
+		}
+		delete(p.viewers, clientID)
+	}
+	p.viewersMu.Unlock()
+
+	// Create new peer connection for this viewer
+	viewerConn, err := p.createViewerConnection(clientID, false)
+	if err != nil {
+		log.Printf("❌ Failed to create peer connection for %s: %v", clientID, err)
+		return
+	}
+
+	// Store viewer connection
+	p.viewersMu.Lock()
+	p.viewers[clientID] = viewerConn
+	p.viewersMu.Unlock()
+
+	log.Printf("✅ Created peer connection for viewer: %s", clientID)
+	log.Printf("   Active viewers: %d", len(p.viewers))
+
+	// Send offer to the new viewer
+	if err := p.sendOffer(clientID); err != nil {
+		log.Printf("❌ Failed to send offer to %s: %v", clientID, err)
+		p.removeViewer(clientID)
+	}
+}
+
 func (p *Publisher) readMessages() {
 	// Set read deadline and pong handler
 	p.wsConnMu.RLock()
@@ -419,6 +802,8 @@ func (p *Publisher) readMessages() {
 		return nil
 	})
 
+	// How long a signaling server that is shutting down asked us to stay away
+	var retryAfter time.Duration
 	for {
 		p.wsConnMu.RLock()
 		conn = p.wsConn
@@ -451,74 +836,55 @@ func (p *Publisher) readMessages() {
 		}
 		p.wsConnMu.RUnlock()
 
-		var msg map[string]interface{}
-		if err := json.Unmarshal(message, &msg); err != nil {
-			log.Printf("Error unmarshaling message: %v", err)
+		// Decode into a typed message - a malformed frame is logged and skipped, never trusted
+		msg, err := protocol.Decode(message)
+		if err != nil {
+			log.Printf("⚠️ Ignoring invalid signaling message: %v", err)
 			continue
 		}
 
-		msgType, _ := msg["type"].(string)
-		log.Printf("📥 Received message type: %s (full message keys: %v)", msgType, getKeys(msg))
-
-		switch msgType {
-		case "viewer_connected":
-			// Extract client ID from message
-			clientID, ok := msg["clientId"].(string)
-			if !ok {
-				log.Printf("⚠️ viewer_connected message missing clientId")
-				continue
-			}
+		log.Printf("📥 Received message type: %s", msg.MessageType())
 
-			log.Printf("New viewer connected: %s, creating peer connection...", clientID)
-
-			// Check if a connection already exists for this client ID and clean it up
-			p.viewersMu.Lock()
-			if existingViewer, exists := p.viewers[clientID]; exists {
-				log.Printf("⚠️ Viewer %s already exists, cleaning up old connection first", clientID)
-				if existingViewer.pc != nil {
-					existingViewer.pc.Close()
+		switch m := msg.(type) {
+		case *protocol.Welcome:
+			p.wsConnMu.Lock()
+			p.clientID = m.ClientID
+			p.resumeToken = m.ResumeToken
+			p.wsConnMu.Unlock()
+			log.Printf("🪪 Signaling identity: %s (resumed: %v)", m.ClientID, m.Resumed)
+
+		case *protocol.Joined:
+			log.Printf("✅ Joined stream %s as %s", m.Stream, m.Role)
+
+			// Viewers that joined before we did are waiting for an offer. After a reconnect the
+			// list also has the viewers we are still streaming to - their connections are kept.
+			if len(m.Viewers) > 0 {
+				log.Printf("   %d viewer(s) already waiting", len(m.Viewers))
+				for _, clientID := range m.Viewers {
+					if p.viewerConnected(clientID) {
+						log.Printf("   [%s] Still connected, keeping its peer connection", clientID)
+						continue
+					}
+					p.handleViewerConnected(clientID)
 				}
-				delete(p.viewers, clientID)
-			}
-			p.viewersMu.Unlock()
-
-			// Create new peer connection for this viewer
-			viewerConn, err := p.createViewerConnection(clientID)
-			if err != nil {
-				log.Printf("❌ Failed to create peer connection for %s: %v", clientID, err)
-				continue
 			}
 
-			// Store viewer connection
-			p.viewersMu.Lock()
-			p.viewers[clientID] = viewerConn
-			p.viewersMu.Unlock()
-
-			log.Printf("✅ Created peer connection for viewer: %s", clientID)
-			log.Printf("   Active viewers: %d", len(p.viewers))
-
-			// Send offer to the new viewer
-			if err := p.sendOffer(clientID); err != nil {
-				log.Printf("❌ Failed to send offer to %s: %v", clientID, err)
-				p.removeViewer(clientID)
+		case *protocol.PeerEvent:
+			switch m.Type {
+			case protocol.TypeViewerConnected:
+				p.handleViewerConnected(m.ClientID)
+			case protocol.TypeViewerDisconnected:
+				log.Printf("Viewer left the stream: %s", m.ClientID)
+				p.removeViewer(m.ClientID)
 			}
 
-		case "answer":
-			log.Printf("📥 Received answer message, checking clientId...")
+		case *protocol.Answer:
 			// Get client ID to route to correct peer connection
-			// Try both clientId and fromClientId (signaling server might add fromClientId)
-			clientID, ok := msg["clientId"].(string)
-			if !ok {
-				// Try fromClientId as fallback
-				if fromClientID, ok2 := msg["fromClientId"].(string); ok2 {
-					clientID = fromClientID
-					ok = true
-					log.Printf("⚠️ Answer message missing clientId, using fromClientId: %s", clientID)
-				} else {
-					log.Printf("⚠️ Answer message missing both clientId and fromClientId, cannot route")
-					log.Printf("   Message keys: %v", getKeys(msg))
-					continue
-				}
+			// Prefer fromClientId (set by the signaling server) and fall back to clientId
+			clientID := m.Sender()
+			if clientID == "" {
+				log.Printf("⚠️ Answer message missing both clientId and fromClientId, cannot route")
+				continue
 			}
 
 			p.viewersMu.RLock()
@@ -531,19 +897,12 @@ func (p *Publisher) readMessages() {
 			}
 
 			log.Printf("📥 [%s] Received answer from viewer!", clientID)
-			answerSDP := msg["answer"].(map[string]interface{})
-			sdpStr, ok := answerSDP["sdp"].(string)
-			if !ok {
-				log.Printf("❌ [%s] Answer SDP is not a string: %T", clientID, answerSDP["sdp"])
-				continue
-			}
-
 			answer := webrtc.SessionDescription{
 				Type: webrtc.SDPTypeAnswer,
-				SDP:  sdpStr,
+				SDP:  m.Answer.SDP,
 			}
 
-			log.Printf("   [%s] Answer SDP length: %d bytes", clientID, len(sdpStr))
+			log.Printf("   [%s] Answer SDP length: %d bytes", clientID, len(answer.SDP))
 
 			// CRITICAL: Set remote description BEFORE adding ICE candidates
 			if err := viewer.pc.SetRemoteDescription(answer); err != nil {
@@ -564,21 +923,13 @@ func (p *Publisher) readMessages() {
 			log.Printf("   [%s] Current state: PC=%s, ICE=%s",
 				clientID, viewer.pc.ConnectionState().String(), viewer.pc.ICEConnectionState().String())
 
-		case "candidate":
+		case *protocol.Candidate:
 			// Get client ID to route to correct peer connection
-			// Try both clientId and fromClientId (signaling server adds fromClientId)
-			clientID, ok := msg["clientId"].(string)
-			if !ok {
-				// Try fromClientId as fallback
-				if fromClientID, ok2 := msg["fromClientId"].(string); ok2 {
-					clientID = fromClientID
-					ok = true
-					log.Printf("⚠️ Candidate message missing clientId, using fromClientId: %s", clientID)
-				} else {
-					log.Printf("⚠️ Candidate message missing both clientId and fromClientId, cannot route")
-					log.Printf("   Message keys: %v", getKeys(msg))
-					continue
-				}
+			// Prefer fromClientId (set by the signaling server) and fall back to clientId
+			clientID := m.Sender()
+			if clientID == "" {
+				log.Printf("⚠️ Candidate message missing both clientId and fromClientId, cannot route")
+				continue
 			}
 
 			p.viewersMu.RLock()
@@ -598,16 +949,11 @@ func (p *Publisher) readMessages() {
 			}
 
 			log.Printf("🧊 [%s] Received ICE candidate from viewer", clientID)
-			candidateMap := msg["candidate"].(map[string]interface{})
 			candidate := webrtc.ICECandidateInit{
-				Candidate: candidateMap["candidate"].(string),
-			}
-			if sdpMLineIndex, ok := candidateMap["sdpMLineIndex"].(float64); ok {
-				idx := uint16(sdpMLineIndex)
-				candidate.SDPMLineIndex = &idx
-			}
-			if sdpMid, ok := candidateMap["sdpMid"].(string); ok {
-				candidate.SDPMid = &sdpMid
+				Candidate:        m.Candidate.Candidate,
+				SDPMid:           m.Candidate.SDPMid,
+				SDPMLineIndex:    m.Candidate.SDPMLineIndex,
+				UsernameFragment: m.Candidate.UsernameFragment,
 			}
 
 			// Extract candidate type for logging
@@ -630,31 +976,102 @@ func (p *Publisher) readMessages() {
 			} else {
 				log.Printf("✅ [%s] Added remote ICE candidate (%s)", clientID, candidateType)
 			}
+
+		case *protocol.SelectLayer:
+			p.selectLayer(m.Sender(), m.Layer)
+
+		case *protocol.ServerShutdown:
+			// The server closes the connection right after this
+			retryAfter = time.Duration(m.RetryAfterMs) * time.Millisecond
+			if len(p.servers) > 1 {
+				// Another server can take us straight away
+				p.wsConnMu.Lock()
+				p.serverIndex = (p.serverIndex + 1) % len(p.servers)
+				p.wsConnMu.Unlock()
+				retryAfter = 0
+			}
+			log.Printf("📴 [%s] Signaling server is shutting down (%s)", p.stream, m.Reason)
+
+		case *protocol.Error:
+			log.Printf("⚠️ Signaling error (%s): %s", m.Code, m.Message)
+
+			switch m.Code {
+			case protocol.ErrorCodeForbidden:
+				log.Printf("❌ Our token does not allow publishing stream %s - check SIGNALING_TOKEN", p.stream)
+			case protocol.ErrorCodeStreamHasPublisher:
+				log.Printf("❌ Another publisher is already serving stream %s - viewers will not be sent to us", p.stream)
+			case protocol.ErrorCodeUnsupportedVersion:
+				log.Printf("❌ Signaling server rejected protocol version %d - check that both ends are up to date", protocol.Version)
+			case protocol.ErrorCodeTargetNotFound:
+				// The viewer we were talking to is gone - drop its peer connection
+				if m.TargetClientID != "" {
+					p.removeViewer(m.TargetClientID)
+				}
+			}
 		}
 	}
 
 	// After loop exits, try to reconnect if not stopped
-	p.stopMu.Lock()
-	shouldReconnect := !p.shouldStop
-	p.stopMu.Unlock()
+	// The viewers' peer connections don't go through the signaling server, so they keep
+	// streaming in the meantime
+	if !p.stopped() {
+		p.reconnect(retryAfter)
+	}
+}
+
+// reconnect keeps trying the signaling servers until one takes us back or the publisher is
+// closed. The wait doubles after every round of failures, from SIGNALING_RECONNECT_MIN_DELAY up
+// to SIGNALING_RECONNECT_MAX_DELAY, and is jittered so publishers that lost the same server
+// don't all come back at the same moment. A server that shut down may have told us when to
+// come back (after); that replaces the first delay.
+func (p *Publisher) reconnect(after time.Duration) {
+	serverConfig := config.AppConfig.SignalingServer
+	delay := max(serverConfig.ReconnectMinDelay, 100*time.Millisecond)
+	maxDelay := max(serverConfig.ReconnectMaxDelay, delay)
+
+	for attempt := 1; ; attempt++ {
+		// Somewhere between half the delay and the full delay
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		if attempt == 1 && after > 0 {
+			wait = after + time.Duration(rand.Int63n(int64(delay/2)+1))
+		}
+		log.Printf("🔄 [%s] Reconnecting to signaling in %v (attempt %d)...", p.stream, wait.Round(time.Millisecond), attempt)
+		select {
+		case <-p.done:
+			return
+		case <-time.After(wait):
+		}
 
-	if shouldReconnect {
-		log.Printf("🔄 Attempting to reconnect to signaling server in 2 seconds...")
-		time.Sleep(2 * time.Second)
-		if err := p.Connect(); err != nil {
-			log.Printf("❌ Reconnection failed: %v, will retry in 5 seconds...", err)
-			time.Sleep(5 * time.Second)
-			// Retry once more, then let it fail silently (could add exponential backoff)
-			if err := p.Connect(); err != nil {
-				log.Printf("❌ Reconnection failed again: %v", err)
+		err := p.Connect()
+		if err == nil {
+			if p.stopped() {
+				// Closed while we were connecting
+				p.closeSignaling()
+				return
 			}
-		} else {
-			log.Printf("✅ Successfully reconnected to signaling server")
+			log.Printf("✅ [%s] Reconnected to signaling after %d attempt(s)", p.stream, attempt)
+			return
 		}
+		log.Printf("❌ [%s] Reconnection failed: %v", p.stream, err)
+		delay = min(delay*2, maxDelay)
 	}
 }
 
-func (p *Publisher) sendMessage(msg map[string]interface{}) error {
+func (p *Publisher) stopped() bool {
+	p.stopMu.Lock()
+	defer p.stopMu.Unlock()
+	return p.shouldStop
+}
+
+// viewerConnected reports whether we have a working peer connection to the viewer
+func (p *Publisher) viewerConnected(clientID string) bool {
+	p.viewersMu.RLock()
+	viewer, exists := p.viewers[clientID]
+	p.viewersMu.RUnlock()
+	return exists && viewer.pc != nil && viewer.pc.ConnectionState() == webrtc.PeerConnectionStateConnected
+}
+
+func (p *Publisher) sendMessage(msg protocol.Message) error {
 	p.wsConnMu.RLock()
 	conn := p.wsConn
 	p.wsConnMu.RUnlock()
@@ -669,6 +1086,8 @@ func (p *Publisher) sendMessage(msg map[string]interface{}) error {
 	}
 
 	// Set write deadline
+	p.wsWriteMu.Lock()
+	defer p.wsWriteMu.Unlock()
 	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 	return conn.WriteMessage(websocket.TextMessage, data)
 }
@@ -684,13 +1103,16 @@ func (p *Publisher) sendICECandidate(candidate *webrtc.ICECandidate, clientID st
 	}
 
 	candidateJSON := candidate.ToJSON()
-	msg := map[string]interface{}{
-		"type":     "candidate",
-		"clientId": clientID,
-		"candidate": map[string]interface{}{
-			"candidate":     candidateJSON.Candidate,
-			"sdpMLineIndex": candidateJSON.SDPMLineIndex,
-			"sdpMid":        candidateJSON.SDPMid,
+	msg := &protocol.Candidate{
+		Header: protocol.NewHeader(protocol.TypeCandidate),
+		Routing: protocol.Routing{
+			ClientID:       clientID,
+			TargetClientID: clientID,
+		},
+		Candidate: &protocol.ICECandidate{
+			Candidate:     candidateJSON.Candidate,
+			SDPMLineIndex: candidateJSON.SDPMLineIndex,
+			SDPMid:        candidateJSON.SDPMid,
 		},
 	}
 
@@ -708,23 +1130,42 @@ func (p *Publisher) sendICECandidate(candidate *webrtc.ICECandidate, clientID st
 }
 
 func (p *Publisher) StartStreaming() error {
-	log.Println("🎬 Starting video stream...")
+	log.Printf("🎬 [%s] Starting video stream...", p.stream)
 	log.Println("   Video will be sent to all connected viewers")
 	log.Println("   (Streaming will start regardless of connection state - WebRTC handles buffering)")
 
-	// Get actual frame rate from capturer (detected from stream)
+	// Audio packets are written as they arrive - ffmpeg emits them in real time next to the video
+	if audio := p.capturer.Audio(); audio != nil && p.audioTrack != nil {
+		go p.streamAudio(audio)
+	}
+
+	// With several layers each viewer is switched to the one its estimate allows. A single
+	// encoding is shared by all viewers, so it is never restarted to follow one of them.
+	if len(p.layers) > 1 {
+		for layer := 1; layer < len(p.layers); layer++ {
+			go p.streamLayer(layer)
+		}
+		if config.AppConfig.Video.AdaptiveBitrate {
+			go p.selectLayers()
+		}
+	} else if config.AppConfig.Video.AdaptiveBitrate {
+		log.Printf("📶 [%s] One encoding for all viewers - bandwidth estimates are reported, but only VIDEO_RENDITIONS lets weak links get a lower bitrate", p.stream)
+	}
+
+	// Packets from an RTP source are forwarded as they arrive - no frame assembly involved
+	if source := p.capturer.RTP(); source != nil {
+		return p.forwardRTP(source)
+	}
+
+	// Frames are sent when their timestamps say so (see video.Pacer) - no fixed-rate ticker
+	// CaptureFrame blocks until the next frame, riding out FFmpeg restarts and camera reconnects
 	actualFPS := p.capturer.GetFrameRate()
 	if actualFPS <= 0 {
 		actualFPS = config.AppConfig.Video.FPS
 	}
+	pacer := &video.Pacer{}
 
-	// Calculate frame interval for precise timing
-	frameRate := time.Second / time.Duration(actualFPS)
-	// Use high-precision ticker for perfect real-time streaming
-	ticker := time.NewTicker(frameRate)
-	defer ticker.Stop()
-
-	log.Printf("⏱️ Frame rate: %d FPS (interval: %v) - Real-time streaming enabled", actualFPS, frameRate)
+	log.Printf("⏱️ Frame rate: %d FPS - pacing and RTP timestamps follow the source's frame timestamps", actualFPS)
 
 	frameCount := 0
 	errorCount := 0
@@ -735,10 +1176,7 @@ func (p *Publisher) StartStreaming() error {
 	log.Println("   Total wait time: 15-45 seconds before video appears")
 	log.Println("   Connection will be checked continuously - frames will buffer if not ready")
 
-	lastFrameTime := time.Now()
-	maxFrameWait := 15 * time.Second // Max time to wait for first frame
-
-	for range ticker.C {
+	for {
 		// Check active viewers
 		p.viewersMu.RLock()
 		viewerCount := len(p.viewers)
@@ -746,173 +1184,69 @@ func (p *Publisher) StartStreaming() error {
 
 		// Log active viewers periodically
 		if frameCount%300 == 0 && viewerCount > 0 {
-			log.Printf("📊 Active viewers: %d", viewerCount)
+			log.Printf("📊 [%s] Active viewers: %d", p.stream, viewerCount)
 		}
 
-		sample, err := p.capturer.CaptureFrame()
+		frame, err := p.capturer.CaptureFrame()
 		if err != nil {
-			errorCount++
-
-			// Check if error indicates FFmpeg has failed permanently
-			// Only treat as fatal if it's an actual FFmpeg process failure, not temporary "no frame available"
-			errStr := err.Error()
-			isFatalError := false
-
-			// Only treat these specific error patterns as fatal (actual FFmpeg failures):
-			// - "FFmpeg process exited"
-			// - "FFmpeg critical error"
-			// - "FFmpeg stdout closed"
-			// - "FFmpeg may have failed or exited" (from channel closed errors)
-			// - "channel closed" (when it indicates FFmpeg failure)
-			// - "FFmpeg restart failed" (after max attempts)
-			// BUT NOT: "no frame available" which is just a temporary condition
-			// BUT NOT: "temporarily unavailable" which is a temporary condition
-			// BUT NOT: "restarting" or "appears stuck" which triggers automatic restart
-			if strings.Contains(errStr, "restarting") || strings.Contains(errStr, "appears stuck") {
-				// FFmpeg is restarting - this is expected and will recover
-				log.Printf("⏳ FFmpeg is restarting, waiting for recovery...")
-				isFatalError = false // Don't treat restart as fatal
-			} else if strings.Contains(errStr, "FFmpeg process exited") ||
-				strings.Contains(errStr, "FFmpeg critical error") ||
-				strings.Contains(errStr, "FFmpeg stdout closed") ||
-				strings.Contains(errStr, "FFmpeg may have failed") ||
-				strings.Contains(errStr, "FFmpeg restart failed") ||
-				(strings.Contains(errStr, "channel closed") &&
-					!strings.Contains(errStr, "no frame available")) {
-				isFatalError = true
-			}
-
-			// For fatal errors, log immediately and check if we should stop
-			if isFatalError {
-				log.Printf("❌ Fatal error detected (count: %d): %v", errorCount, err)
-				log.Printf("   FFmpeg process appears to have failed - check RTSP stream availability")
-
-				// If we haven't received any frames and error persists, stop after threshold
-				if frameCount == 0 && errorCount >= 60 { // ~2 seconds at 30fps
-					log.Printf("❌ Stopping stream: FFmpeg failed and no frames received after %d attempts", errorCount)
-					return fmt.Errorf("FFmpeg failed: %w (no frames captured after %d attempts)", err, errorCount)
-				}
-			}
-
-			// Check if we've been waiting too long for first frame
-			if frameCount == 0 && time.Since(lastFrameTime) > maxFrameWait {
-				log.Printf("⚠️ No frames captured after %.0f seconds", maxFrameWait.Seconds())
-				log.Printf("   This might mean:")
-				log.Printf("   1) FFmpeg transcoding is still initializing (HEVC→H.264 takes time)")
-				log.Printf("   2) RTSP stream is not accessible")
-				log.Printf("   3) FFmpeg encountered an error")
-				log.Printf("   Error: %v", err)
-
-				// If it's a fatal error and we've waited too long, stop
-				if isFatalError {
-					log.Printf("❌ FFmpeg fatal error persists - stopping stream")
-					return fmt.Errorf("FFmpeg fatal error after waiting %.0f seconds: %w", maxFrameWait.Seconds(), err)
-				}
-
-				log.Printf("   Will continue waiting...")
-				lastFrameTime = time.Now() // Reset timer
-			}
-
-			// For continuous streaming, don't log every error (reduces spam)
-			// Log fatal errors immediately, but for temporary errors (like "no frame available"),
-			// only log periodically to avoid spam, especially if we're already streaming successfully
-			if isFatalError {
-				// Always log fatal errors immediately
-				log.Printf("❌ Error capturing frame (count: %d): %v", errorCount, err)
-				// For fatal errors after streaming has started, wait a bit to see if FFmpeg restarts
-				if frameCount > 0 {
-					log.Printf("   FFmpeg may restart automatically - will continue attempting frames...")
-					// Reset error count after a delay to give restart time
-					if errorCount%100 == 0 {
-						log.Printf("   Still waiting for FFmpeg recovery after %d errors...", errorCount)
-					}
-				}
-			} else if strings.Contains(errStr, "restarting") {
-				// FFmpeg is restarting - just wait
-				if errorCount%30 == 0 {
-					log.Printf("⏳ Waiting for FFmpeg to restart (attempt %d)...", errorCount)
-				}
-			} else if frameCount == 0 {
-				// During initialization, log temporary errors periodically
-				if errorCount%30 == 0 {
-					log.Printf("⚠️ Temporary error capturing frame (count: %d): %v", errorCount, err)
-					log.Printf("   Continuing stream - will retry next frame...")
-				}
-			} else {
-				// After we've successfully streamed frames, suppress "no frame available" errors
-				// as they're just temporary gaps between frames
-				if !strings.Contains(errStr, "no frame available") && !strings.Contains(errStr, "temporarily unavailable") {
-					// Log other temporary errors periodically
-					if errorCount%60 == 0 {
-						log.Printf("⚠️ Temporary error capturing frame (count: %d): %v", errorCount, err)
-						log.Printf("   Continuing stream - will retry next frame...")
-					}
-				}
-				// Completely suppress "no frame available" and "temporarily unavailable" errors when already streaming
+			// A finite source (file playback without looping) has nothing more to send
+			if errors.Is(err, io.EOF) {
+				log.Printf("🏁 [%s] Video source finished after %d frames", p.stream, frameCount)
+				return nil
 			}
-			// Don't skip ticker - continue immediately to keep frame rate consistent
-			// The stream will recover automatically when FFmpeg restarts or frames become available
-			continue
-		}
-
-		// Reset frame timer on success
-		if frameCount == 0 {
-			lastFrameTime = time.Now()
-		}
-
-		// Verify sample data is valid
-		if len(sample.Data) == 0 {
-			if errorCount%30 == 0 {
-				log.Printf("⚠️ Empty sample received (frame %d)", frameCount)
+			// Close stopped the source under us - nothing failed
+			if errors.Is(err, video.ErrSourceClosed) || p.stopped() {
+				log.Printf("🏁 [%s] Streaming stopped after %d frames", p.stream, frameCount)
+				return nil
 			}
-			errorCount++
-			continue
+			// The source gave up (FFmpeg could not be restarted, the camera is gone for good)
+			log.Printf("❌ [%s] Video source failed after %d frames: %v", p.stream, frameCount, err)
+			return fmt.Errorf("video source failed after %d frames: %w", frameCount, err)
 		}
 
 		// Log first frame details
 		if frameCount == 0 {
-			log.Printf("🎉 FIRST FRAME CAPTURED! %d bytes, duration: %v", len(sample.Data), sample.Duration)
+			log.Printf("🎉 FIRST FRAME CAPTURED! %d bytes, PTS: %v", len(frame.Data), frame.PTS)
 			log.Printf("   ✅ RTSP→FFmpeg→H.264 parsing pipeline is WORKING!")
 			log.Printf("   Next step: Frame will be written to WebRTC track")
 		}
 
-		// Write sample to track (non-blocking, zero-latency real-time streaming)
+		// Hold the frame until it is due, then write it to the track
 		// Always attempt write - WebRTC handles buffering internally
-		// The same track instance is used for all viewers - writing once sends to all
-		writeErr := p.track.WriteSample(sample)
+		pacer.Wait(frame.PTS)
+		writeErr := p.writeFrame(0, frame)
 		if writeErr != nil {
 			errorCount++
 			// Minimal logging for uninterrupted streaming - only log significant issues
 			if errorCount <= 3 || errorCount%100 == 0 {
-				log.Printf("❌ Error writing sample (count: %d): %v", errorCount, writeErr)
+				log.Printf("❌ Error writing frame (count: %d): %v", errorCount, writeErr)
 				log.Printf("   Active viewers: %d", viewerCount)
 			}
-			// Continue immediately - never block, maintain perfect frame timing
-			// WebRTC's internal buffers handle temporary connection issues
+			// Continue immediately - WebRTC's internal buffers handle temporary connection issues
 			continue
 		}
 
-		// Successfully wrote sample
+		// Successfully wrote frame
 		errorCount = 0 // Reset error count on success
 		frameCount++
 
 		if frameCount == 1 {
-			log.Printf("✅ First frame written successfully! Size: %d bytes", len(sample.Data))
+			log.Printf("✅ First frame written successfully! Size: %d bytes", len(frame.Data))
 			log.Printf("   Active viewers: %d", viewerCount)
 
 			// Verify H264 format
-			if len(sample.Data) >= 4 {
-				if sample.Data[0] == 0x00 && sample.Data[1] == 0x00 && sample.Data[2] == 0x00 && sample.Data[3] == 0x01 {
+			if len(frame.Data) >= 4 {
+				if frame.Data[0] == 0x00 && frame.Data[1] == 0x00 && frame.Data[2] == 0x00 && frame.Data[3] == 0x01 {
 					log.Printf("   ✅ Valid 4-byte H264 Annex-B start code")
-				} else if sample.Data[0] == 0x00 && sample.Data[1] == 0x00 && sample.Data[2] == 0x01 {
+				} else if frame.Data[0] == 0x00 && frame.Data[1] == 0x00 && frame.Data[2] == 0x01 {
 					log.Printf("   ✅ Valid 3-byte H264 Annex-B start code")
 				}
 			}
 		}
 
 		if frameCount%30 == 0 {
-			log.Printf("✅ Streamed %d frames successfully (viewers: %d, last size: %d bytes)",
-				frameCount, viewerCount, len(sample.Data))
+			log.Printf("✅ [%s] Streamed %d frames successfully (viewers: %d, last size: %d bytes)",
+				p.stream, frameCount, viewerCount, len(frame.Data))
 		}
 
 		// Log when streaming starts
@@ -924,59 +1258,1031 @@ func (p *Publisher) StartStreaming() error {
 			log.Printf("   3) Browser codec support (Chrome/Edge recommended for H264)")
 		}
 	}
+}
 
-	return nil
+// writeFrame packetizes a frame of one layer and writes its packets to the viewers
+func (p *Publisher) writeFrame(layer int, frame video.Frame) error {
+	var errs []error
+	for _, packet := range p.layers[layer].packetizer.Packetize(frame) {
+		if err := p.writeVideoPacket(layer, packet); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
 
-func (p *Publisher) Close() {
-	// Set stop flag to prevent reconnection
-	p.stopMu.Lock()
-	p.shouldStop = true
-	p.stopMu.Unlock()
+// writeVideoPacket writes one packet of a layer of the live stream to every viewer's video track
+// (viewers on other layers skip it). Each layer's packets are written by one goroutine (its frame
+// loop or forwardRTP), so frameStart needs no lock.
+func (p *Publisher) writeVideoPacket(layer int, packet *rtp.Packet) error {
+	videoLayer := p.layers[layer]
+	frameStart := videoLayer.frameStart
+	videoLayer.frameStart = packet.Marker
 
-	if p.capturer != nil {
-		p.capturer.Close()
+	var errs []error
+	var switched []*ViewerConnection
+	p.viewersMu.RLock()
+	for _, viewer := range p.viewers {
+		changed, err := viewer.writeVideo(layer, packet, frameStart, videoLayer.keyframes)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if changed {
+			switched = append(switched, viewer)
+		}
 	}
+	p.viewersMu.RUnlock()
 
-	// Close all viewer connections
-	p.viewersMu.Lock()
-	for clientID, viewer := range p.viewers {
-		if viewer.pc != nil {
-			viewer.pc.Close()
-		}
-		log.Printf("Closed connection for viewer: %s", clientID)
+	for _, viewer := range switched {
+		log.Printf("📚 [%s] Viewer %s switched to the %s layer", p.stream, viewer.clientID, videoLayer.name)
+		go p.sendLayers(viewer)
 	}
-	p.viewers = make(map[string]*ViewerConnection)
-	p.viewersMu.Unlock()
 
-	p.wsConnMu.Lock()
+	// Cached after writing, so a viewer never gets the same keyframe twice
+	if videoLayer.keyframes != nil {
+		videoLayer.keyframes.Add(packet)
+	}
+	return errors.Join(errs...)
+}
+
+// writeVideo sends a packet of the live stream to this viewer if it is on the packet's layer.
+// Nothing is sent until the connection is up (packets written earlier are silently dropped by
+// Pion) and a frame starts. A viewer that joins mid-GOP is sent the cached keyframe at once, so
+// it has a picture, and then the live stream from its next keyframe on.
+// It reports whether the viewer was switched to this layer by the packet.
+func (v *ViewerConnection) writeVideo(layer int, packet *rtp.Packet, frameStart bool, keyframes *video.KeyframeCache) (bool, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	switched := false
+	if layer != v.layer {
+		switch {
+		case layer != v.targetLayer:
+			return false, nil
+		case !v.videoStarted:
+			// Nothing was sent yet - start on the wanted layer right away
+			v.layer = layer
+		case !frameStart || !rtsp.IsKeyframeStart(packet.Payload):
+			// Another layer can only take over where it starts a keyframe, or the picture breaks up
+			return false, nil
+		default:
+			v.switchLayer(layer, packet)
+			switched = true
+		}
+	}
+
+	if !v.videoStarted {
+		if !v.connected || !frameStart {
+			return false, nil
+		}
+		v.videoStarted = true
+		if keyframes != nil {
+			if cached := keyframes.Before(packet); cached != nil {
+				log.Printf("🖼️ [%s] Sending the cached keyframe (%d packets), the live stream follows from its next keyframe", v.clientID, len(cached))
+				for _, cachedPacket := range cached {
+					if err := v.writeRTP(cachedPacket); err != nil {
+						return false, err
+					}
+				}
+				v.awaitingKeyframe = true
+			}
+		}
+	}
+
+	if v.awaitingKeyframe {
+		if !frameStart || !rtsp.IsKeyframeStart(packet.Payload) {
+			return switched, nil
+		}
+		// Number the keyframe right after the cached one, so the skipped packets don't look lost
+		v.seqOffset = v.lastSeq + 1 - packet.SequenceNumber
+		v.awaitingKeyframe = false
+	}
+	return switched, v.writeRTP(packet)
+}
+
+// maxEstimateKbps is the highest bandwidth estimate congestion control reports: VIDEO_BITRATE,
+// or the top rendition's bitrate if that is higher, so its viewers can be sent that layer
+func maxEstimateKbps() int {
+	videoConfig := config.AppConfig.Video
+	if len(videoConfig.Renditions) > 1 {
+		return max(videoConfig.Bitrate, videoConfig.Renditions[0].Bitrate)
+	}
+	return videoConfig.Bitrate
+}
+
+// switchLayer moves the viewer to another layer, starting with packet (a keyframe start).
+// The new layer's packets are renumbered to follow the last packet sent, and stamped after it
+// if their timestamps lag behind.
+func (v *ViewerConnection) switchLayer(layer int, packet *rtp.Packet) {
+	v.seqOffset = v.lastSeq + 1 - packet.SequenceNumber
+	if timestamp := packet.Timestamp + v.tsOffset; int32(timestamp-v.lastTS) <= 0 {
+		v.tsOffset = v.lastTS + 3000 - packet.Timestamp // One frame at 30 fps on the 90 kHz clock
+	}
+	v.layer = layer
+}
+
+// writeRTP writes a packet to the viewer's track with its layer switch offsets applied
+// The packet is shared with the other viewers, so a rewritten copy is sent.
+func (v *ViewerConnection) writeRTP(packet *rtp.Packet) error {
+	if v.seqOffset != 0 || v.tsOffset != 0 {
+		rewritten := *packet
+		rewritten.SequenceNumber += v.seqOffset
+		rewritten.Timestamp += v.tsOffset
+		packet = &rewritten
+	}
+	v.lastSeq = packet.SequenceNumber
+	v.lastTS = packet.Timestamp
+	return v.videoTrack.WriteRTP(packet)
+}
+
+// streamLayer sends the frames of one of the lower layers until the source closes
+// Layer 0 is sent by StartStreaming, which also reports what goes wrong with the source.
+func (p *Publisher) streamLayer(layer int) {
+	videoLayer := p.layers[layer]
+	log.Printf("🎥 [%s] Starting the %s layer (%d kbps)", p.stream, videoLayer.name, videoLayer.bitrate)
+
+	pacer := &video.Pacer{}
+
+	frameCount := 0
+	errorCount := 0
+	for {
+		if p.stopped() {
+			return
+		}
+
+		frame, err := p.capturer.CaptureLayerFrame(layer)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, video.ErrSourceClosed) || p.stopped() {
+				log.Printf("🏁 [%s] The %s layer finished after %d frames", p.stream, videoLayer.name, frameCount)
+			} else {
+				log.Printf("❌ [%s] The %s layer stopped after %d frames: %v", p.stream, videoLayer.name, frameCount, err)
+			}
+			return
+		}
+
+		pacer.Wait(frame.PTS)
+		if err := p.writeFrame(layer, frame); err != nil {
+			errorCount++
+			if errorCount <= 3 || errorCount%100 == 0 {
+				log.Printf("❌ [%s] Error writing %s frame (count: %d): %v", p.stream, videoLayer.name, errorCount, err)
+			}
+			continue
+		}
+
+		frameCount++
+		if frameCount == 1 {
+			log.Printf("✅ [%s] First %s frame written (%d bytes)", p.stream, videoLayer.name, len(frame.Data))
+		}
+	}
+}
+
+// selectLayers moves every viewer in auto mode to the best layer its bandwidth estimate allows
+// A viewer goes down a layer as soon as its estimate drops below the layer's bitrate, but only
+// goes back up with 15% headroom and at most once per VIDEO_BITRATE_INTERVAL, so a link near
+// a layer's bitrate doesn't flap between two layers.
+func (p *Publisher) selectLayers() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if p.stopped() {
+			return
+		}
+
+		p.viewersMu.RLock()
+		viewers := make([]*ViewerConnection, 0, len(p.viewers))
+		for _, viewer := range p.viewers {
+			viewers = append(viewers, viewer)
+		}
+		p.viewersMu.RUnlock()
+
+		for _, viewer := range viewers {
+			if viewer.estimator == nil {
+				continue
+			}
+			kbps := viewer.estimator.GetTargetBitrate() / 1000
+
+			viewer.mu.Lock()
+			if viewer.connected && viewer.autoLayer {
+				if target := p.layerFor(kbps, viewer.targetLayer, time.Since(viewer.layerChanged)); target != viewer.targetLayer {
+					log.Printf("📚 [%s] Viewer %s bandwidth estimate is %d kbps - moving it from the %s to the %s layer",
+						p.stream, viewer.clientID, kbps, p.layers[viewer.targetLayer].name, p.layers[target].name)
+					viewer.targetLayer = target
+					viewer.layerChanged = time.Now()
+				}
+			}
+			viewer.mu.Unlock()
+		}
+	}
+}
+
+// layerFor picks the layer for a viewer with the given bandwidth estimate (kbps) that is on
+// layer current, which it was moved to sinceChange ago
+func (p *Publisher) layerFor(kbps, current int, sinceChange time.Duration) int {
+	// The highest layer the estimate covers, or the lowest one when it covers none
+	wanted := len(p.layers) - 1
+	for i, layer := range p.layers {
+		if layer.bitrate <= kbps {
+			wanted = i
+			break
+		}
+	}
+	if wanted >= current {
+		return wanted
+	}
+
+	// Going up: the estimate is capped at maxEstimateKbps, so reaching it counts as headroom
+	if sinceChange < config.AppConfig.Video.BitrateInterval {
+		return current
+	}
+	for i := wanted; i < current; i++ {
+		if kbps*100 >= p.layers[i].bitrate*115 || kbps >= maxEstimateKbps() {
+			return i
+		}
+	}
+	return current
+}
+
+// selectLayer handles a viewer's select_layer message: a layer name pins the viewer to that
+// layer, "auto" hands the choice back to its bandwidth estimate
+func (p *Publisher) selectLayer(clientID, name string) {
+	p.viewersMu.RLock()
+	viewer, exists := p.viewers[clientID]
+	p.viewersMu.RUnlock()
+	if !exists {
+		log.Printf("⚠️ Received layer selection from unknown viewer: %s", clientID)
+		return
+	}
+	if len(p.layers) < 2 {
+		log.Printf("⚠️ [%s] Viewer %s asked for the %s layer, but this stream has a single encoding", p.stream, clientID, name)
+		return
+	}
+
+	viewer.mu.Lock()
+	if name == protocol.LayerAuto {
+		viewer.autoLayer = true
+		log.Printf("📚 [%s] Viewer %s switched to automatic layer selection", p.stream, clientID)
+	} else {
+		layer := -1
+		for i, videoLayer := range p.layers {
+			if videoLayer.name == name {
+				layer = i
+				break
+			}
+		}
+		if layer < 0 {
+			viewer.mu.Unlock()
+			log.Printf("⚠️ [%s] Viewer %s asked for unknown layer %q", p.stream, clientID, name)
+			p.sendLayers(viewer)
+			return
+		}
+		viewer.autoLayer = false
+		viewer.targetLayer = layer
+		viewer.layerChanged = time.Now()
+		log.Printf("📚 [%s] Viewer %s asked for the %s layer", p.stream, clientID, name)
+	}
+	viewer.mu.Unlock()
+
+	// Confirms the choice; the viewer hears again once it is switched (at the next keyframe)
+	p.sendLayers(viewer)
+}
+
+// sendLayers tells a viewer which layers there are and which one it is being sent
+func (p *Publisher) sendLayers(viewer *ViewerConnection) {
+	if viewer.whep {
+		return // WHEP players always get the automatic choice
+	}
+	viewer.mu.Lock()
+	current := p.layers[viewer.layer].name
+	auto := viewer.autoLayer
+	viewer.mu.Unlock()
+
+	layers := make([]protocol.LayerInfo, len(p.layers))
+	for i, layer := range p.layers {
+		layers[i] = protocol.LayerInfo{Name: layer.name, Height: layer.height, Bitrate: layer.bitrate}
+	}
+	msg := &protocol.Layers{
+		Header: protocol.NewHeader(protocol.TypeLayers),
+		Routing: protocol.Routing{
+			ClientID:       viewer.clientID,
+			TargetClientID: viewer.clientID,
+		},
+		Layers:  layers,
+		Current: current,
+		Auto:    auto,
+	}
+	if err := p.sendMessage(msg); err != nil {
+		log.Printf("❌ [%s] Error sending layers: %v", viewer.clientID, err)
+	}
+}
+
+// forwardRTP writes the source's packets to the viewers' video tracks as they arrive
+// The source has already rewritten their headers into one continuous stream; each track then sets
+// its viewer's negotiated SSRC and payload type
+func (p *Publisher) forwardRTP(source video.RTPSource) error {
+	log.Printf("⚡ [%s] Forwarding RTP packets from the source - no frame assembly or re-packetization", p.stream)
+
+	packetCount := 0
+	errorCount := 0
+	for {
+		packet, err := source.ReadRTP()
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, video.ErrSourceClosed) || p.stopped() {
+				log.Printf("🏁 [%s] Video source closed after %d packets", p.stream, packetCount)
+				return nil
+			}
+			return fmt.Errorf("failed to read RTP from source: %w", err)
+		}
+
+		if err := p.writeVideoPacket(0, packet); err != nil {
+			errorCount++
+			if errorCount <= 3 || errorCount%100 == 0 {
+				log.Printf("❌ [%s] Error writing RTP packet (count: %d): %v", p.stream, errorCount, err)
+			}
+			continue
+		}
+
+		packetCount++
+		if packetCount == 1 {
+			log.Printf("✅ [%s] First RTP packet forwarded (%d bytes)", p.stream, len(packet.Payload))
+		}
+		if packetCount%3000 == 0 {
+			p.viewersMu.RLock()
+			viewerCount := len(p.viewers)
+			p.viewersMu.RUnlock()
+			log.Printf("✅ [%s] Forwarded %d RTP packets (viewers: %d)", p.stream, packetCount, viewerCount)
+		}
+	}
+}
+
+// streamAudio forwards the source's Opus packets to the audio track until the source closes
+func (p *Publisher) streamAudio(audio video.AudioSource) {
+	log.Printf("🔊 [%s] Starting audio stream...", p.stream)
+
+	packetCount := 0
+	for {
+		sample, err := audio.ReadAudio()
+		if err != nil {
+			log.Printf("🔇 [%s] Audio stream stopped after %d packets", p.stream, packetCount)
+			return
+		}
+
+		if err := p.audioTrack.WriteSample(sample); err != nil {
+			if packetCount%500 == 0 {
+				log.Printf("❌ [%s] Error writing audio sample: %v", p.stream, err)
+			}
+			continue
+		}
+
+		packetCount++
+		if packetCount == 1 {
+			log.Printf("✅ [%s] First audio packet written (%d bytes, %v)", p.stream, len(sample.Data), sample.Duration)
+		}
+	}
+}
+
+func (p *Publisher) Close() {
+	// Set stop flag to prevent reconnection
+	p.stopMu.Lock()
+	if !p.shouldStop {
+		p.shouldStop = true
+		close(p.done)
+	}
+	p.stopMu.Unlock()
+
+	if p.capturer != nil {
+		p.capturer.Close()
+	}
+
+	// Close all viewer connections
+	p.viewersMu.Lock()
+	for clientID, viewer := range p.viewers {
+		if viewer.pc != nil {
+			viewer.pc.Close()
+		}
+		log.Printf("Closed connection for viewer: %s", clientID)
+	}
+	p.viewers = make(map[string]*ViewerConnection)
+	p.viewersMu.Unlock()
+
+	p.closeSignaling()
+}
+
+// closeSignaling leaves the signaling server. The normal close tells it we won't resume, so our
+// viewers learn right away that we went offline.
+func (p *Publisher) closeSignaling() {
+	p.wsConnMu.Lock()
 	if p.wsConn != nil {
 		// Send proper close message before closing
+		p.wsWriteMu.Lock()
 		p.wsConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		p.wsWriteMu.Unlock()
 		p.wsConn.Close()
 		p.wsConn = nil
 	}
 	p.wsConnMu.Unlock()
 }
 
+// maxSDPSize bounds the SDP offers and fragments WHEP players send
+const maxSDPSize = 64 * 1024
+
+// whepGatherTimeout bounds how long a WHEP answer waits for our ICE candidates
+const whepGatherTimeout = 10 * time.Second
+
+// viewerStatus describes a viewer connection for the control API
+type viewerStatus struct {
+	ClientID      string `json:"clientId"`
+	WHEP          bool   `json:"whep,omitempty"`          // Watching over WHEP instead of the web viewer
+	State         string `json:"state"`                   // Peer connection state
+	ICEState      string `json:"iceState"`                // ICE connection state
+	Layer         string `json:"layer,omitempty"`         // Rendition the viewer is sent (simulcast only)
+	EstimatedKbps int    `json:"estimatedKbps,omitempty"` // GCC bandwidth estimate (adaptive bitrate only)
+}
+
+// streamStatus describes a stream for the control API
+type streamStatus struct {
+	Stream    string             `json:"stream"`
+	Signaling bool               `json:"signaling"` // Connected to the signaling server
+	Viewers   int                `json:"viewers"`
+	Source    video.SourceStatus `json:"source"`
+}
+
+func (p *Publisher) status() streamStatus {
+	p.wsConnMu.RLock()
+	signaling := p.wsConn != nil
+	p.wsConnMu.RUnlock()
+	p.viewersMu.RLock()
+	viewers := len(p.viewers)
+	p.viewersMu.RUnlock()
+
+	return streamStatus{
+		Stream:    p.stream,
+		Signaling: signaling,
+		Viewers:   viewers,
+		Source:    p.capturer.Status(),
+	}
+}
+
+// viewerStatuses lists the stream's viewers, sorted by client ID
+func (p *Publisher) viewerStatuses() []viewerStatus {
+	p.viewersMu.RLock()
+	defer p.viewersMu.RUnlock()
+
+	statuses := make([]viewerStatus, 0, len(p.viewers))
+	for clientID, viewer := range p.viewers {
+		status := viewerStatus{ClientID: clientID, WHEP: viewer.whep}
+		if viewer.pc != nil {
+			status.State = viewer.pc.ConnectionState().String()
+			status.ICEState = viewer.pc.ICEConnectionState().String()
+		}
+		if len(p.layers) > 1 {
+			viewer.mu.Lock()
+			status.Layer = p.layers[viewer.layer].name
+			viewer.mu.Unlock()
+		}
+		if viewer.estimator != nil {
+			status.EstimatedKbps = viewer.estimator.GetTargetBitrate() / 1000
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ClientID < statuses[j].ClientID })
+	return statuses
+}
+
+// controlAPI is the publisher's HTTP API for operators: which viewers are connected, kicking
+// one, and the status and restart of each stream's source
+//
+//	GET    /api/streams                          streams with their source status
+//	GET    /api/streams/{stream}/viewers         the stream's viewers and their connection states
+//	DELETE /api/streams/{stream}/viewers/{id}    disconnect a viewer
+//	GET    /api/streams/{stream}/source          source type, encoder, frame rate, restarts
+//	POST   /api/streams/{stream}/source/restart  reconnect the camera / restart the encoder
+//
+// With SIGNALING_AUTH_SECRET set every request needs a publisher token for the stream it touches.
+// The same server plays the streams to WHEP players (see handleWHEP).
+type controlAPI struct {
+	publishers map[string]*Publisher
+	names      []string // Stream names in configuration order
+}
+
+func newControlAPI(publishers []*Publisher) *controlAPI {
+	api := &controlAPI{publishers: make(map[string]*Publisher, len(publishers))}
+	for _, publisher := range publishers {
+		api.publishers[publisher.stream] = publisher
+		api.names = append(api.names, publisher.stream)
+	}
+	return api
+}
+
+// serveControlAPI serves the control API and WHEP on PUBLISHER_SERVER_HOST:PUBLISHER_SERVER_PORT
+// in the background. Streaming goes on without it if the address can't be used.
+// It returns nil when the control API is turned off.
+func serveControlAPI(publishers []*Publisher) *http.Server {
+	serverConfig := config.AppConfig.PublisherServer
+	if serverConfig.Port == 0 {
+		log.Println("Control API and WHEP disabled (PUBLISHER_SERVER_PORT=0)")
+		return nil
+	}
+
+	addr := fmt.Sprintf("%s:%d", serverConfig.Host, serverConfig.Port)
+	log.Printf("🛠️  Control API listening on http://%s/api/streams", addr)
+	log.Printf("▶️  WHEP playback on http://%s/whep/<stream>", addr)
+	server := &http.Server{Addr: addr, Handler: newControlAPI(publishers).handler()}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("❌ Control API stopped: %v", err)
+		}
+	}()
+	return server
+}
+
+func (api *controlAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+	mux.HandleFunc("/api/streams", api.handleStreams)
+	mux.HandleFunc("/api/streams/", api.handleStream)
+	mux.HandleFunc("/whep/", api.handleWHEP)
+	return mux
+}
+
+// checkToken checks the request's token against a role on a stream (auth.AnyStream asks for
+// a token that covers every stream). Unless SIGNALING_AUTH_REQUIRED is on every request passes.
+func checkToken(r *http.Request, role, stream string) error {
+	authConfig := config.AppConfig.Auth
+	if !authConfig.Required {
+		return nil
+	}
+	claims, err := auth.ParseToken([]byte(authConfig.Secret), auth.TokenFromRequest(r))
+	if err != nil {
+		return err
+	}
+	if !claims.Allows(role, stream) {
+		return fmt.Errorf("token is not valid for stream %q", stream)
+	}
+	return nil
+}
+
+// authorized asks for a publisher token for the stream and answers 401 when it doesn't fit
+func (api *controlAPI) authorized(w http.ResponseWriter, r *http.Request, stream string) bool {
+	if err := checkToken(r, protocol.RolePublisher, stream); err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="publisher"`)
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func (api *controlAPI) handleStreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !api.authorized(w, r, auth.AnyStream) {
+		return
+	}
+
+	statuses := make([]streamStatus, 0, len(api.names))
+	for _, name := range api.names {
+		statuses = append(statuses, api.publishers[name].status())
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// handleStream serves everything below /api/streams/{stream}
+func (api *controlAPI) handleStream(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/streams/"), "/")
+	publisher, exists := api.publishers[parts[0]]
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, "unknown stream")
+		return
+	}
+	if !api.authorized(w, r, publisher.stream) {
+		return
+	}
+
+	route := strings.Join(parts[1:], "/")
+	switch {
+	case route == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, publisher.status())
+
+	case route == "viewers" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, publisher.viewerStatuses())
+
+	case len(parts) == 3 && parts[1] == "viewers" && r.Method == http.MethodDelete:
+		clientID := parts[2]
+		publisher.viewersMu.RLock()
+		_, exists := publisher.viewers[clientID]
+		publisher.viewersMu.RUnlock()
+		if !exists {
+			writeJSONError(w, http.StatusNotFound, "unknown viewer")
+			return
+		}
+		log.Printf("👢 [%s] Disconnecting viewer %s on request", publisher.stream, clientID)
+		publisher.removeViewer(clientID)
+		w.WriteHeader(http.StatusNoContent)
+
+	case route == "source" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, publisher.capturer.Status())
+
+	case route == "source/restart" && r.Method == http.MethodPost:
+		if err := publisher.capturer.Restart(); errors.Is(err, video.ErrRestartUnsupported) {
+			writeJSONError(w, http.StatusNotImplemented, err.Error())
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "restarting"})
+
+	default:
+		writeJSONError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// handleWHEP plays a stream to a WHEP player (OBS, ffplay, GStreamer's whepsrc...) as an
+// ordinary viewer of the stream: it gets its own track, the cached keyframe and a rendition
+// picked from its bandwidth estimate, just without the signaling server.
+//
+//	POST   /whep/{stream}       the player's SDP offer, answered with 201, our SDP answer and a Location
+//	PATCH  /whep/{stream}/{id}  trickle ICE: the player's candidates as an SDP fragment
+//	DELETE /whep/{stream}/{id}  leave
+//
+// With authentication required the player needs a viewer token for the stream, and a session
+// only takes requests made with the token that started it. A stream plays to at most
+// WHEP_MAX_SESSIONS players at a time.
+func (api *controlAPI) handleWHEP(w http.ResponseWriter, r *http.Request) {
+	allowCORS(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/whep/"), "/")
+	publisher, exists := api.publishers[parts[0]]
+	if !exists || len(parts) > 2 {
+		http.Error(w, "unknown stream", http.StatusNotFound)
+		return
+	}
+	if err := checkToken(r, protocol.RoleViewer, publisher.stream); err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="whep"`)
+		http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if len(parts) == 1 {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		publisher.startWHEP(w, r)
+		return
+	}
+
+	// Only the token that started the session may change it; any other caller gets the same
+	// 404 as for an unknown session, so session IDs can't be probed
+	clientID := "whep-" + parts[1]
+	publisher.viewersMu.RLock()
+	viewer, exists := publisher.viewers[clientID]
+	publisher.viewersMu.RUnlock()
+	if !exists || !viewer.whep || (config.AppConfig.Auth.Required &&
+		subtle.ConstantTimeCompare([]byte(viewer.whepToken), []byte(auth.TokenFromRequest(r))) != 1) {
+		http.Error(w, "unknown WHEP session", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPatch:
+		publisher.trickleWHEP(w, r, viewer)
+	case http.MethodDelete:
+		log.Printf("▶️  [%s] WHEP player %s left", publisher.stream, clientID)
+		publisher.removeViewer(clientID)
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// startWHEP answers a WHEP player's offer with a new viewer connection
+func (p *Publisher) startWHEP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/sdp") {
+		http.Error(w, "expected an application/sdp offer", http.StatusUnsupportedMediaType)
+		return
+	}
+	offer, err := io.ReadAll(io.LimitReader(r.Body, maxSDPSize))
+	if err != nil {
+		http.Error(w, "failed to read offer", http.StatusBadRequest)
+		return
+	}
+
+	// Hold a slot while the offer is answered, so a burst of offers can't get past the limit
+	if !p.reserveWHEPSession() {
+		log.Printf("⚠️ [%s] WHEP offer refused: %d players already watching", p.stream, config.AppConfig.PublisherServer.WHEPMaxSessions)
+		http.Error(w, "too many WHEP sessions on this stream", http.StatusServiceUnavailable)
+		return
+	}
+	defer func() {
+		p.viewersMu.Lock()
+		p.whepPending--
+		p.viewersMu.Unlock()
+	}()
+
+	sessionID := uuid.NewString()
+	clientID := "whep-" + sessionID
+	viewer, err := p.createViewerConnection(clientID, true)
+	if err != nil {
+		log.Printf("❌ [%s] Failed to create peer connection for WHEP player: %v", p.stream, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if config.AppConfig.Auth.Required {
+		viewer.whepToken = auth.TokenFromRequest(r)
+	}
+
+	// Our tracks take the player's recvonly transceivers
+	answer, err := func() (string, error) {
+		if err := viewer.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(offer)}); err != nil {
+			return "", fmt.Errorf("invalid offer: %w", err)
+		}
+		answer, err := viewer.pc.CreateAnswer(nil)
+		if err != nil {
+			return "", fmt.Errorf("failed to create answer: %w", err)
+		}
+		// The player can trickle its candidates, ours all go in the answer
+		gathered := webrtc.GatheringCompletePromise(viewer.pc)
+		if err := viewer.pc.SetLocalDescription(answer); err != nil {
+			return "", fmt.Errorf("failed to set local description: %w", err)
+		}
+		timer := time.NewTimer(whepGatherTimeout)
+		defer timer.Stop()
+		select {
+		case <-gathered:
+		case <-timer.C:
+			return "", errWHEPGatherTimeout
+		case <-r.Context().Done():
+			return "", r.Context().Err()
+		}
+		return viewer.pc.LocalDescription().SDP, nil
+	}()
+	if err != nil {
+		log.Printf("❌ [%s] WHEP offer rejected: %v", p.stream, err)
+		viewer.pc.Close()
+		status := http.StatusBadRequest
+		if errors.Is(err, errWHEPGatherTimeout) {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	p.viewersMu.Lock()
+	p.viewers[clientID] = viewer
+	viewerCount := len(p.viewers)
+	p.viewersMu.Unlock()
+	log.Printf("▶️  [%s] WHEP player %s joined (active viewers: %d)", p.stream, clientID, viewerCount)
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whep/"+p.stream+"/"+sessionID)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer)
+}
+
+// errWHEPGatherTimeout is returned when our ICE candidates aren't gathered in whepGatherTimeout
+var errWHEPGatherTimeout = errors.New("timed out gathering ICE candidates")
+
+// reserveWHEPSession takes one of the stream's WHEP_MAX_SESSIONS slots for an offer being
+// answered; it returns false when they are all taken by players and offers in progress
+func (p *Publisher) reserveWHEPSession() bool {
+	p.viewersMu.Lock()
+	defer p.viewersMu.Unlock()
+	sessions := p.whepPending
+	for _, viewer := range p.viewers {
+		if viewer.whep {
+			sessions++
+		}
+	}
+	if limit := config.AppConfig.PublisherServer.WHEPMaxSessions; limit > 0 && sessions >= limit {
+		return false
+	}
+	p.whepPending++
+	return true
+}
+
+// trickleWHEP adds the candidates of a PATCH (an SDP fragment, RFC 8840) to the player's
+// connection. ICE restarts aren't supported - the player has to start a new session.
+func (p *Publisher) trickleWHEP(w http.ResponseWriter, r *http.Request, viewer *ViewerConnection) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/trickle-ice-sdpfrag") {
+		http.Error(w, "expected an application/trickle-ice-sdpfrag body", http.StatusUnsupportedMediaType)
+		return
+	}
+	fragment, err := io.ReadAll(io.LimitReader(r.Body, maxSDPSize))
+	if err != nil {
+		http.Error(w, "failed to read candidates", http.StatusBadRequest)
+		return
+	}
+
+	remoteUfrag := sdpAttribute(viewer.pc.RemoteDescription().SDP, "ice-ufrag")
+	ufrag, mid := "", ""
+	for _, line := range strings.Split(string(fragment), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+			if ufrag != remoteUfrag {
+				http.Error(w, "ICE restarts are not supported, start a new session", http.StatusUnprocessableEntity)
+				return
+			}
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidate := webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a=")}
+			if mid != "" {
+				candidate.SDPMid = &mid
+			}
+			if ufrag != "" {
+				candidate.UsernameFragment = &ufrag
+			}
+			if err := viewer.pc.AddICECandidate(candidate); err != nil {
+				log.Printf("❌ [%s] Error adding ICE candidate from WHEP player: %v", viewer.clientID, err)
+			}
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sdpAttribute returns the value of the first a=<name>: line of an SDP
+func sdpAttribute(sdp, name string) string {
+	for _, line := range strings.Split(sdp, "\n") {
+		if value, found := strings.CutPrefix(strings.TrimSpace(line), "a="+name+":"); found {
+			return value
+		}
+	}
+	return ""
+}
+
+// allowCORS lets browser-based WHEP players on an allowed origin (ALLOWED_ORIGINS) read the
+// answer and the session's Location
+func allowCORS(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	for _, allowed := range config.AppConfig.CORS.AllowedOrigins {
+		if origin != "" && origin == allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "POST, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match")
+			w.Header().Set("Access-Control-Expose-Headers", "Location")
+			w.Header().Add("Vary", "Origin")
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Failed to write control API response: %v", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// streamConfigs returns the streams to serve: VIDEO_STREAMS, or a single stream named
+// after SIGNALING_ROOM that uses the VIDEO_SOURCE selection
+func streamConfigs() []config.StreamConfig {
+	if streams := config.AppConfig.Video.Streams; len(streams) > 0 {
+		return streams
+	}
+	return []config.StreamConfig{{Name: config.AppConfig.SignalingServer.Room}}
+}
+
 func main() {
 	// Load configuration
 	if err := config.LoadConfig(); err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	publisher, err := NewPublisher()
+	api, err := newWebRTCAPI()
 	if err != nil {
-		log.Fatalf("Failed to create publisher: %v", err)
+		log.Fatalf("Failed to create WebRTC API: %v", err)
 	}
-	defer publisher.Close()
 
-	if err := publisher.Connect(); err != nil {
-		log.Fatalf("Failed to connect: %v", err)
+	// One publisher (source, track, viewers and signaling connection) per stream
+	streams := streamConfigs()
+	publishers := make([]*Publisher, 0, len(streams))
+	for _, stream := range streams {
+		var source video.VideoSource
+		if stream.URL == "" {
+			source, err = video.NewVideoSource()
+		} else {
+			source, err = video.NewStreamVideoSource(stream)
+		}
+		if err != nil {
+			// log.Fatalf skips deferred calls - stop the sources (and their FFmpeg) we already started
+			closePublishers(publishers)
+			log.Fatalf("Failed to create video source for stream %s: %v", stream.Name, err)
+		}
+
+		publisher, err := NewPublisher(api, stream.Name, source)
+		if err != nil {
+			source.Close()
+			closePublishers(publishers)
+			log.Fatalf("Failed to create publisher for stream %s: %v", stream.Name, err)
+		}
+		publishers = append(publishers, publisher)
 	}
+	log.Printf("📺 Serving %d stream(s)", len(publishers))
+	controlServer := serveControlAPI(publishers)
+
+	// A signaling server that isn't up yet doesn't stop us: the stream keeps trying in the background
+	for _, publisher := range publishers {
+		if err := publisher.Connect(); err != nil {
+			log.Printf("❌ [%s] Failed to connect to signaling: %v", publisher.stream, err)
+			go publisher.reconnect(0)
+		}
+	}
+
+	// Stream every source in parallel; one failing camera does not stop the others
+	var wg sync.WaitGroup
+	var failedMu sync.Mutex
+	failed := 0
+	for _, publisher := range publishers {
+		wg.Add(1)
+		go func(p *Publisher) {
+			defer wg.Done()
+			if err := p.StartStreaming(); err != nil {
+				log.Printf("❌ [%s] Streaming stopped: %v", p.stream, err)
+				failedMu.Lock()
+				failed++
+				failedMu.Unlock()
+			}
+		}(publisher)
+	}
+	streaming := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(streaming)
+	}()
+
+	// Run until every stream has ended or we get SIGINT/SIGTERM (Ctrl+C, docker stop, a deploy)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case <-ctx.Done():
+		stop() // A second signal kills the process right away
+		log.Printf("🛑 Shutting down (up to %v)...", config.AppConfig.Shutdown.Timeout)
+	case <-streaming:
+	}
+	shutdown(publishers, controlServer, streaming)
+
+	failedMu.Lock()
+	defer failedMu.Unlock()
+	if failed > 0 {
+		log.Fatalf("Failed to stream %d of %d stream(s)", failed, len(publishers))
+	}
+}
+
+// shutdown stops the control API and closes every publisher: viewers' peer connections,
+// the signaling connection (so viewers hear right away that the stream went offline) and the
+// source with its FFmpeg process. It waits for the streaming loops to finish, but for no longer
+// than SHUTDOWN_TIMEOUT - a stuck camera must not keep the process around.
+func shutdown(publishers []*Publisher, controlServer *http.Server, streaming <-chan struct{}) {
+	timeout := config.AppConfig.Shutdown.Timeout
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if controlServer != nil {
+			// Lets requests in flight finish (a WHEP answer waits for ICE gathering)
+			if err := controlServer.Shutdown(ctx); err != nil {
+				log.Printf("⚠️ Control API did not stop in time: %v", err)
+			}
+		}
+		closePublishers(publishers)
+		<-streaming
+	}()
+
+	select {
+	case <-done:
+		log.Printf("👋 Publisher stopped")
+	case <-ctx.Done():
+		log.Printf("⚠️ Shutdown did not finish within %v, exiting anyway", timeout)
+	}
+}
 
-	// Start streaming
-	if err := publisher.StartStreaming(); err != nil {
-		log.Fatalf("Failed to start streaming: %v", err)
+// closePublishers closes the publishers in parallel, so one slow FFmpeg doesn't hold up the rest
+func closePublishers(publishers []*Publisher) {
+	var wg sync.WaitGroup
+	for _, publisher := range publishers {
+		wg.Add(1)
+		go func(p *Publisher) {
+			defer wg.Done()
+			p.Close()
+		}(publisher)
 	}
+	wg.Wait()
 }
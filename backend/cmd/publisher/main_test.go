@@ -0,0 +1,219 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"webrtc-streaming/internal/auth"
+	"webrtc-streaming/internal/config"
+	"webrtc-streaming/internal/protocol"
+	"webrtc-streaming/internal/video"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestLayerFor(t *testing.T) {
+	config.AppConfig = &config.Config{Video: config.VideoConfig{
+		Bitrate:         2500,
+		BitrateInterval: 5 * time.Second,
+		Renditions: []config.RenditionConfig{
+			{Name: "1080p", Height: 1080, Bitrate: 4000},
+			{Name: "540p", Height: 540, Bitrate: 1200},
+			{Name: "270p", Height: 270, Bitrate: 400},
+		},
+	}}
+	p := &Publisher{layers: []*videoLayer{
+		{name: "1080p", height: 1080, bitrate: 4000},
+		{name: "540p", height: 540, bitrate: 1200},
+		{name: "270p", height: 270, bitrate: 400},
+	}}
+
+	tests := []struct {
+		name        string
+		kbps        int
+		current     int
+		sinceChange time.Duration
+		want        int
+	}{
+		{name: "estimate covers the top layer", kbps: 6000, current: 0, want: 0},
+		{name: "down right away", kbps: 1500, current: 0, want: 1},
+		{name: "down to the lowest when no layer fits", kbps: 100, current: 1, want: 2},
+		{name: "up waits for the interval", kbps: 3000, current: 2, sinceChange: time.Second, want: 2},
+		{name: "up needs 15% headroom", kbps: 1300, current: 2, sinceChange: time.Minute, want: 2},
+		{name: "up with headroom", kbps: 1400, current: 2, sinceChange: time.Minute, want: 1},
+		{name: "up several layers at once", kbps: 4700, current: 2, sinceChange: time.Minute, want: 0},
+		{name: "estimate at its cap counts as headroom", kbps: 4000, current: 1, sinceChange: time.Minute, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.layerFor(tt.kbps, tt.current, tt.sinceChange); got != tt.want {
+				t.Errorf("layerFor(%d kbps, layer %d, %v) = %d, want %d", tt.kbps, tt.current, tt.sinceChange, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteVideoHoldsLiveStreamAfterCachedKeyframe(t *testing.T) {
+	idr := []byte{0x65, 0x88, 0x84}
+	pFrame := []byte{0x41, 0x9a, 0x02}
+	packet := func(seq uint16, timestamp uint32, payload []byte) *rtp.Packet {
+		return &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: timestamp, Marker: true}, Payload: payload}
+	}
+
+	keyframes := video.NewKeyframeCache()
+	keyframes.Add(packet(10, 3000, idr))
+	keyframes.Add(packet(11, 6000, pFrame))
+
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "test")
+	if err != nil {
+		t.Fatalf("NewTrackLocalStaticRTP: %v", err)
+	}
+	viewer := &ViewerConnection{clientID: "viewer", videoTrack: track, connected: true}
+
+	// The viewer's last packet is the cached keyframe (numbered 99) until the live stream's next
+	// keyframe, which continues right after it
+	steps := []struct {
+		packet  *rtp.Packet
+		lastSeq uint16
+	}{
+		{packet(100, 9000, pFrame), 99},
+		{packet(101, 12000, pFrame), 99},
+		{packet(102, 15000, idr), 100},
+		{packet(103, 18000, pFrame), 101},
+	}
+	for _, step := range steps {
+		if _, err := viewer.writeVideo(0, step.packet, true, keyframes); err != nil {
+			t.Fatalf("writeVideo(seq %d): %v", step.packet.SequenceNumber, err)
+		}
+		if viewer.lastSeq != step.lastSeq {
+			t.Errorf("after seq %d the viewer's last packet is %d, want %d", step.packet.SequenceNumber, viewer.lastSeq, step.lastSeq)
+		}
+	}
+	if viewer.lastTS != 18000 {
+		t.Errorf("last timestamp = %d, want 18000 (live timestamps are kept)", viewer.lastTS)
+	}
+}
+
+// whepOffer returns the SDP offer of a player that receives one video track
+func whepOffer(t *testing.T) string {
+	t.Helper()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("NewPeerConnection: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatalf("AddTransceiverFromKind: %v", err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("CreateOffer: %v", err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatalf("SetLocalDescription: %v", err)
+	}
+	<-gathered
+	return pc.LocalDescription().SDP
+}
+
+func TestWHEPSessions(t *testing.T) {
+	secret := []byte("test-secret")
+	config.AppConfig = &config.Config{
+		PublisherServer: config.PublisherServerConfig{WHEPMaxSessions: 1},
+		Auth:            config.AuthConfig{Secret: string(secret), Required: true},
+	}
+	api, err := newWebRTCAPI()
+	if err != nil {
+		t.Fatalf("newWebRTCAPI: %v", err)
+	}
+	publisher := &Publisher{
+		viewers:    make(map[string]*ViewerConnection),
+		stream:     "cam",
+		api:        api,
+		videoCodec: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000},
+	}
+	t.Cleanup(func() {
+		publisher.viewersMu.RLock()
+		clientIDs := make([]string, 0, len(publisher.viewers))
+		for clientID := range publisher.viewers {
+			clientIDs = append(clientIDs, clientID)
+		}
+		publisher.viewersMu.RUnlock()
+		for _, clientID := range clientIDs {
+			publisher.removeViewer(clientID)
+		}
+	})
+	server := httptest.NewServer(newControlAPI([]*Publisher{publisher}).handler())
+	t.Cleanup(server.Close)
+
+	token := func(stream string) string {
+		t.Helper()
+		token, err := auth.NewToken(secret, protocol.RoleViewer, stream, time.Hour)
+		if err != nil {
+			t.Fatalf("NewToken: %v", err)
+		}
+		return token
+	}
+	request := func(method, path, contentType, token, body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		return res
+	}
+
+	owner := token("cam")
+	res := request(http.MethodPost, "/whep/cam", "application/sdp", owner, whepOffer(t))
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("POST status = %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+	location := res.Header.Get("Location")
+	if res := request(http.MethodPost, "/whep/cam", "application/sdp", owner, whepOffer(t)); res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("POST past WHEP_MAX_SESSIONS status = %d, want %d", res.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		want   int
+	}{
+		{"DELETE without a token", http.MethodDelete, "", http.StatusUnauthorized},
+		{"DELETE with a token for another stream", http.MethodDelete, token("garage"), http.StatusUnauthorized},
+		{"DELETE with another viewer's token", http.MethodDelete, token(auth.AnyStream), http.StatusNotFound},
+		{"PATCH with another viewer's token", http.MethodPatch, token(auth.AnyStream), http.StatusNotFound},
+		{"PATCH with the session's token", http.MethodPatch, owner, http.StatusNoContent},
+		{"DELETE with the session's token", http.MethodDelete, owner, http.StatusOK},
+		{"DELETE again", http.MethodDelete, owner, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if res := request(tt.method, location, "application/trickle-ice-sdpfrag", tt.token, ""); res.StatusCode != tt.want {
+				t.Errorf("%s status = %d, want %d", tt.method, res.StatusCode, tt.want)
+			}
+		})
+	}
+
+	// Leaving frees the slot
+	if res := request(http.MethodPost, "/whep/cam", "application/sdp", owner, whepOffer(t)); res.StatusCode != http.StatusCreated {
+		t.Errorf("POST after DELETE status = %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	"webrtc-streaming/internal/config"
 	"webrtc-streaming/internal/signaling"
@@ -28,6 +32,9 @@ func main() {
 	// WebSocket endpoint
 	mux.HandleFunc("/ws", signalServer.HandleWebSocket)
 
+	// WHIP ingest: any WHIP encoder (OBS, GStreamer, a browser) can publish a stream
+	mux.HandleFunc("/whip/", signalServer.HandleWHIP)
+
 	// Health check endpoint
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -49,10 +56,10 @@ func main() {
 		// File server for static files
 		fileServer := http.FileServer(http.Dir(staticPath))
 
-		// Serve static files, but exclude /ws and /health
+		// Serve static files, but exclude /ws, /whip and /health
 		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			// Don't serve static files for WebSocket and health endpoints
-			if strings.HasPrefix(r.URL.Path, "/ws") || strings.HasPrefix(r.URL.Path, "/health") {
+			// Don't serve static files for WebSocket, WHIP and health endpoints
+			if strings.HasPrefix(r.URL.Path, "/ws") || strings.HasPrefix(r.URL.Path, "/whip") || strings.HasPrefix(r.URL.Path, "/health") {
 				http.NotFound(w, r)
 				return
 			}
@@ -84,7 +91,30 @@ func main() {
 	log.Printf("WebSocket endpoint: ws://%s/ws", addr)
 	log.Printf("Frontend will be served at: http://%s", addr)
 
-	if err := http.ListenAndServe(addr, mux); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	// Run until SIGINT/SIGTERM (Ctrl+C, docker stop, a rolling deploy), then drain
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	stop() // A second signal kills the process right away
+
+	shutdownConfig := config.AppConfig.Shutdown
+	log.Printf("🛑 Shutting down (up to %v)...", shutdownConfig.Timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownConfig.Timeout)
+	defer cancel()
+
+	// Clients are told to come back first, then the listener closes and in-flight requests finish
+	if err := signalServer.Shutdown(shutdownCtx, shutdownConfig.RetryAfter); err != nil {
+		log.Printf("⚠️ Clients did not disconnect in time: %v", err)
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("⚠️ HTTP server did not stop in time: %v", err)
 	}
+	log.Printf("👋 Signaling server stopped")
 }
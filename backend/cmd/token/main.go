@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"webrtc-streaming/internal/auth"
+	"webrtc-streaming/internal/config"
+)
+
+// token mints a signaling token signed with SIGNALING_AUTH_SECRET, e.g.
+//
+//	go run cmd/token/main.go -role viewer -stream cam-3 -ttl 24h
+func main() {
+	role := flag.String("role", "viewer", "Role the token grants: publisher or viewer")
+	stream := flag.String("stream", "default", "Stream the token is valid for (* for any stream)")
+	ttl := flag.Duration("ttl", time.Hour, "How long the token stays valid")
+	flag.Parse()
+
+	// Load configuration
+	if err := config.LoadConfig(); err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	if *role != "publisher" && *role != "viewer" {
+		log.Fatalf("Invalid role %q: must be publisher or viewer", *role)
+	}
+	if config.AppConfig.Auth.Secret == "" {
+		log.Fatalf("SIGNALING_AUTH_SECRET is not set - nothing to sign tokens with")
+	}
+
+	token, err := auth.NewToken([]byte(config.AppConfig.Auth.Secret), *role, *stream, *ttl)
+	if err != nil {
+		log.Fatalf("Failed to create token: %v", err)
+	}
+	fmt.Println(token)
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseToken(t *testing.T) {
+	secret := []byte("test-secret")
+	valid, err := NewToken(secret, "viewer", "lobby", time.Hour)
+	if err != nil {
+		t.Fatalf("NewToken: %v", err)
+	}
+	expired, err := NewToken(secret, "viewer", "lobby", -time.Minute)
+	if err != nil {
+		t.Fatalf("NewToken: %v", err)
+	}
+	payload, signature, _ := strings.Cut(valid, ".")
+	otherPayload, _, _ := strings.Cut(expired, ".")
+
+	tests := []struct {
+		name    string
+		secret  []byte
+		token   string
+		wantErr error
+	}{
+		{name: "valid", secret: secret, token: valid},
+		{name: "missing", secret: secret, token: "", wantErr: ErrMissingToken},
+		{name: "no signature", secret: secret, token: payload, wantErr: ErrInvalidToken},
+		{name: "signed with another secret", secret: []byte("other-secret"), token: valid, wantErr: ErrInvalidToken},
+		{name: "payload swapped under the signature", secret: secret, token: otherPayload + "." + signature, wantErr: ErrInvalidToken},
+		{name: "signature tampered", secret: secret, token: payload + "." + strings.ToUpper(signature), wantErr: ErrInvalidToken},
+		{name: "signed garbage", secret: secret, token: "bm90LWpzb24." + sign(secret, "bm90LWpzb24"), wantErr: ErrInvalidToken},
+		{name: "expired", secret: secret, token: expired, wantErr: ErrTokenExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := ParseToken(tt.secret, tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseToken() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && (claims.Role != "viewer" || claims.Stream != "lobby") {
+				t.Errorf("ParseToken() claims = %+v, want viewer on lobby", claims)
+			}
+		})
+	}
+}
+
+func TestNewTokenRequiresSecret(t *testing.T) {
+	if _, err := NewToken(nil, "viewer", "lobby", time.Hour); err == nil {
+		t.Error("NewToken() with an empty secret succeeded")
+	}
+}
+
+func TestClaimsAllows(t *testing.T) {
+	tests := []struct {
+		claims Claims
+		role   string
+		stream string
+		want   bool
+	}{
+		{Claims{Role: "viewer", Stream: "lobby"}, "viewer", "lobby", true},
+		{Claims{Role: "viewer", Stream: "lobby"}, "viewer", "garage", false},
+		{Claims{Role: "viewer", Stream: "lobby"}, "publisher", "lobby", false},
+		{Claims{Role: "publisher", Stream: AnyStream}, "publisher", "garage", true},
+		{Claims{Role: "viewer", Stream: AnyStream}, "publisher", "garage", false},
+	}
+	for _, tt := range tests {
+		if got := tt.claims.Allows(tt.role, tt.stream); got != tt.want {
+			t.Errorf("%+v.Allows(%q, %q) = %v, want %v", tt.claims, tt.role, tt.stream, got, tt.want)
+		}
+	}
+}
+
+func TestTokenFromRequest(t *testing.T) {
+	tests := []struct {
+		name          string
+		url           string
+		authorization string
+		want          string
+	}{
+		{name: "bearer header", url: "/ws", authorization: "Bearer abc.def", want: "abc.def"},
+		{name: "query parameter", url: "/ws?token=abc.def", want: "abc.def"},
+		{name: "header wins over the query", url: "/ws?token=query", authorization: "Bearer header", want: "header"},
+		{name: "other scheme falls back to the query", url: "/ws?token=query", authorization: "Basic dXNlcg==", want: "query"},
+		{name: "none", url: "/ws", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.url, nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			if got := TokenFromRequest(r); got != tt.want {
+				t.Errorf("TokenFromRequest() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,8 +3,10 @@ package config
 import (
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -14,18 +16,34 @@ type Config struct {
 	PublisherServer PublisherServerConfig
 	WebRTC          WebRTCConfig
 	Video           VideoConfig
+	Audio           AudioConfig
 	CORS            CORSConfig
 	StaticFiles     StaticFilesConfig
+	Auth            AuthConfig
+	Shutdown        ShutdownConfig
 }
 
 type SignalingServerConfig struct {
 	Host string
 	Port int
+	Room string // Room the publisher joins on the signaling server (one room per stream)
+	// How long a disconnected client's identity is kept for resumption with its resume token
+	ResumeGracePeriod time.Duration
+	// Signaling servers the publisher connects to, tried in turn when one fails
+	// (ws://Host:Port/ws when empty)
+	URLs []string
+	// Publisher reconnects back off exponentially (with jitter) between these delays
+	ReconnectMinDelay time.Duration
+	ReconnectMaxDelay time.Duration
 }
 
+// PublisherServerConfig is where the publisher serves its control API
 type PublisherServerConfig struct {
 	Host string
-	Port int
+	Port int // 0 turns the control API off
+	// Most WHEP players a stream plays to at once, counting offers still being answered
+	// (0 for no limit)
+	WHEPMaxSessions int
 }
 
 type WebRTCConfig struct {
@@ -35,11 +53,55 @@ type WebRTCConfig struct {
 }
 
 type VideoConfig struct {
-	DeviceIndex int
+	Source      string // Which source to stream: auto, rtsp, file, v4l2 or testpattern
+	DeviceIndex int    // V4L2 device number (/dev/videoN)
+	InputFormat string // V4L2 pixel format to request (e.g. mjpeg), empty for the driver default
 	Width       int
 	Height      int
 	FPS         int
+	Bitrate     int    // Target bitrate in kbps for video we encode ourselves (test pattern), and the adaptive bitrate ceiling
+	TestPattern string // Pattern the mock source renders when no camera/stream is configured ("bars" or "solid")
 	RTSPURL     string
+	Passthrough string // RTSP H.264 passthrough: auto (probe the camera), always or never
+	// RTSP ingest: auto (built-in Go client when no transcoding is needed), native or ffmpeg
+	RTSPClient    string
+	RTSPTransport string // Transport of the built-in client: tcp (interleaved) or udp
+	ForwardRTP    bool   // Built-in client: forward the camera's RTP packets instead of re-packetizing frames
+	// Minimum time between keyframes forced for viewers' PLI/FIR requests (0 ignores the requests)
+	KeyframeMinInterval time.Duration
+	KeyframeCache       bool // Send late-joining viewers the latest H.264 keyframe before the live stream
+	// Congestion control: drive the encoder's bitrate from the viewers' bandwidth estimates
+	AdaptiveBitrate bool
+	MinBitrate      int           // Lowest bandwidth estimate in kbps congestion control reports
+	BitrateInterval time.Duration // Minimum time between a viewer's moves up to a better rendition
+	// Local file playback (MP4, MKV, raw .h264), used when RTSPURL is empty
+	File            string
+	FileLoop        bool
+	FileStartOffset time.Duration
+	// Renditions (simulcast layers) transcoded RTSP cameras are encoded at, highest first
+	// (VIDEO_RENDITIONS); with fewer than two every viewer gets the single encoding
+	Renditions []RenditionConfig
+	// Named streams served by one publisher process (VIDEO_STREAMS); when empty the
+	// publisher serves a single stream named after SIGNALING_ROOM from the source above
+	Streams []StreamConfig
+}
+
+// StreamConfig is one camera/file served by a multi-stream publisher
+type StreamConfig struct {
+	Name string // Stream (signaling room) viewers join to watch it
+	URL  string // rtsp:// or rtsps:// URL, a local file path, or "testpattern"
+}
+
+// RenditionConfig is one encoding of a camera, e.g. 540p at 1200 kbps
+type RenditionConfig struct {
+	Name    string // What viewers ask for, e.g. "540p"
+	Height  int    // Output height in pixels (the width keeps the aspect ratio)
+	Bitrate int    // Target bitrate in kbps
+}
+
+type AudioConfig struct {
+	Enabled bool // Pull the RTSP camera's audio and publish it as an Opus track
+	Bitrate int  // Opus bitrate in kbps
 }
 
 type CORSConfig struct {
@@ -50,6 +112,19 @@ type StaticFilesConfig struct {
 	Path string
 }
 
+type AuthConfig struct {
+	Secret   string // HMAC secret used to sign and verify signaling tokens
+	Required bool   // Reject WebSocket connections without a valid token
+	Token    string // Token the publisher presents (minted from Secret when empty)
+	TokenTTL time.Duration
+}
+
+// ShutdownConfig controls how both binaries drain on SIGINT/SIGTERM
+type ShutdownConfig struct {
+	Timeout    time.Duration // The process exits after this even if draining isn't done
+	RetryAfter time.Duration // When clients are told to reconnect (server_shutdown)
+}
+
 var AppConfig *Config
 
 func LoadConfig() error {
@@ -61,12 +136,18 @@ func LoadConfig() error {
 
 	AppConfig = &Config{
 		SignalingServer: SignalingServerConfig{
-			Host: getEnv("SIGNALING_SERVER_HOST", "localhost"),
-			Port: getEnvAsInt("SIGNALING_SERVER_PORT", 8080),
+			Host:              getEnv("SIGNALING_SERVER_HOST", "localhost"),
+			Port:              getEnvAsInt("SIGNALING_SERVER_PORT", 8080),
+			Room:              getEnv("SIGNALING_ROOM", "default"),
+			ResumeGracePeriod: getEnvAsDuration("SIGNALING_RESUME_GRACE_PERIOD", 30*time.Second),
+			URLs:              parseStringSlice(getEnv("SIGNALING_URLS", ""), ","),
+			ReconnectMinDelay: getEnvAsDuration("SIGNALING_RECONNECT_MIN_DELAY", time.Second),
+			ReconnectMaxDelay: getEnvAsDuration("SIGNALING_RECONNECT_MAX_DELAY", 30*time.Second),
 		},
 		PublisherServer: PublisherServerConfig{
-			Host: getEnv("PUBLISHER_SERVER_HOST", "localhost"),
-			Port: getEnvAsInt("PUBLISHER_SERVER_PORT", 8081),
+			Host:            getEnv("PUBLISHER_SERVER_HOST", "localhost"),
+			Port:            getEnvAsInt("PUBLISHER_SERVER_PORT", 8082),
+			WHEPMaxSessions: getEnvAsInt("WHEP_MAX_SESSIONS", 10),
 		},
 		WebRTC: WebRTCConfig{
 			ICEServerURLs:       parseStringSlice(getEnv("ICE_SERVER_URLS", "stun:stun.l.google.com:19302"), ","),
@@ -74,11 +155,31 @@ func LoadConfig() error {
 			ICEServerCredential: getEnv("ICE_SERVER_CREDENTIAL", ""),
 		},
 		Video: VideoConfig{
-			DeviceIndex: getEnvAsInt("VIDEO_DEVICE_INDEX", 0),
-			Width:       getEnvAsInt("VIDEO_WIDTH", 1280),
-			Height:      getEnvAsInt("VIDEO_HEIGHT", 720),
-			FPS:         getEnvAsInt("VIDEO_FPS", 30),
-			RTSPURL:     getEnv("RTSP_URL", ""),
+			Source:              getEnv("VIDEO_SOURCE", "auto"),
+			DeviceIndex:         getEnvAsInt("VIDEO_DEVICE_INDEX", 0),
+			InputFormat:         getEnv("VIDEO_INPUT_FORMAT", ""),
+			Width:               getEnvAsInt("VIDEO_WIDTH", 1280),
+			Height:              getEnvAsInt("VIDEO_HEIGHT", 720),
+			FPS:                 getEnvAsInt("VIDEO_FPS", 30),
+			Bitrate:             getEnvAsInt("VIDEO_BITRATE", 1500),
+			TestPattern:         getEnv("VIDEO_TEST_PATTERN", "bars"),
+			RTSPURL:             getEnv("RTSP_URL", ""),
+			Passthrough:         getEnv("VIDEO_PASSTHROUGH", "auto"),
+			RTSPClient:          getEnv("VIDEO_RTSP_CLIENT", "auto"),
+			RTSPTransport:       getEnv("VIDEO_RTSP_TRANSPORT", "tcp"),
+			ForwardRTP:          getEnvAsBool("VIDEO_FORWARD_RTP", true),
+			KeyframeMinInterval: getEnvAsDuration("VIDEO_KEYFRAME_MIN_INTERVAL", 2*time.Second),
+			KeyframeCache:       getEnvAsBool("VIDEO_KEYFRAME_CACHE", true),
+			AdaptiveBitrate:     getEnvAsBool("VIDEO_ADAPTIVE_BITRATE", true),
+			MinBitrate:          getEnvAsInt("VIDEO_MIN_BITRATE", 300),
+			BitrateInterval:     getEnvAsDuration("VIDEO_BITRATE_INTERVAL", 5*time.Second),
+			File:                getEnv("VIDEO_FILE", ""),
+			FileLoop:            getEnvAsBool("VIDEO_FILE_LOOP", true),
+			FileStartOffset:     getEnvAsDuration("VIDEO_FILE_START_OFFSET", 0),
+		},
+		Audio: AudioConfig{
+			Enabled: getEnvAsBool("AUDIO_ENABLED", false),
+			Bitrate: getEnvAsInt("AUDIO_BITRATE", 64),
 		},
 		CORS: CORSConfig{
 			AllowedOrigins: parseStringSlice(getEnv("ALLOWED_ORIGINS", "http://localhost:5173,http://localhost:3000"), ","),
@@ -86,11 +187,89 @@ func LoadConfig() error {
 		StaticFiles: StaticFilesConfig{
 			Path: getEnv("STATIC_FILES_PATH", "../frontend/dist"),
 		},
+		Shutdown: ShutdownConfig{
+			Timeout:    getEnvAsDuration("SHUTDOWN_TIMEOUT", 10*time.Second),
+			RetryAfter: getEnvAsDuration("SHUTDOWN_RETRY_AFTER", 3*time.Second),
+		},
 	}
 
+	authSecret := getEnv("SIGNALING_AUTH_SECRET", "")
+	AppConfig.Auth = AuthConfig{
+		Secret: authSecret,
+		// Authentication is on as soon as a secret is configured, unless explicitly disabled
+		Required: getEnvAsBool("SIGNALING_AUTH_REQUIRED", authSecret != ""),
+		Token:    getEnv("SIGNALING_TOKEN", ""),
+		TokenTTL: getEnvAsDuration("SIGNALING_TOKEN_TTL", time.Hour),
+	}
+	if AppConfig.Auth.Required && AppConfig.Auth.Secret == "" {
+		return fmt.Errorf("SIGNALING_AUTH_REQUIRED is set but SIGNALING_AUTH_SECRET is empty")
+	}
+
+	streams, err := parseStreams(getEnv("VIDEO_STREAMS", ""))
+	if err != nil {
+		return fmt.Errorf("invalid VIDEO_STREAMS: %w", err)
+	}
+	AppConfig.Video.Streams = streams
+
+	renditions, err := parseRenditions(getEnv("VIDEO_RENDITIONS", ""))
+	if err != nil {
+		return fmt.Errorf("invalid VIDEO_RENDITIONS: %w", err)
+	}
+	AppConfig.Video.Renditions = renditions
+
 	return nil
 }
 
+// parseRenditions parses a comma-separated list of <height>p:<kbps> entries, e.g.
+// "1080p:4000,540p:1200,270p:400", and sorts them from the highest resolution down
+func parseRenditions(value string) ([]RenditionConfig, error) {
+	var renditions []RenditionConfig
+	seen := make(map[int]bool)
+	for _, entry := range parseStringSlice(value, ",") {
+		name, bitrateStr, ok := strings.Cut(entry, ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+		height, err := strconv.Atoi(strings.TrimSuffix(name, "p"))
+		if !ok || !strings.HasSuffix(name, "p") || err != nil || height <= 0 {
+			return nil, fmt.Errorf("entry %q is not in <height>p:<kbps> form", entry)
+		}
+		bitrate, err := strconv.Atoi(strings.TrimSpace(bitrateStr))
+		if err != nil || bitrate <= 0 {
+			return nil, fmt.Errorf("entry %q has no valid bitrate", entry)
+		}
+		if seen[height] {
+			return nil, fmt.Errorf("rendition %s is listed twice", name)
+		}
+		seen[height] = true
+		renditions = append(renditions, RenditionConfig{Name: name, Height: height, Bitrate: bitrate})
+	}
+	sort.Slice(renditions, func(i, j int) bool {
+		return renditions[i].Height > renditions[j].Height
+	})
+	return renditions, nil
+}
+
+// parseStreams parses a comma-separated list of name=url pairs, e.g.
+// "lobby=rtsp://10.0.0.5/stream1,garage=rtsp://10.0.0.6/stream1"
+func parseStreams(value string) ([]StreamConfig, error) {
+	var streams []StreamConfig
+	seen := make(map[string]bool)
+	for _, entry := range parseStringSlice(value, ",") {
+		// Split on the first '=' only - RTSP URLs often carry query parameters
+		name, streamURL, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		streamURL = strings.TrimSpace(streamURL)
+		if !ok || name == "" || streamURL == "" {
+			return nil, fmt.Errorf("entry %q is not in name=url form", entry)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("stream %q is listed twice", name)
+		}
+		seen[name] = true
+		streams = append(streams, StreamConfig{Name: name, URL: streamURL})
+	}
+	return streams, nil
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -110,6 +289,30 @@ func getEnvAsInt(key string, defaultValue int) int {
 	return value
 }
 
+func getEnvAsBool(key string, defaultValue bool) bool {
+	valueStr := os.Getenv(key)
+	if valueStr == "" {
+		return defaultValue
+	}
+	value, err := strconv.ParseBool(valueStr)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
+	valueStr := os.Getenv(key)
+	if valueStr == "" {
+		return defaultValue
+	}
+	value, err := time.ParseDuration(valueStr)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
 func parseStringSlice(value string, separator string) []string {
 	if value == "" {
 		return []string{}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRenditions(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []RenditionConfig
+		wantErr bool
+	}{
+		{name: "empty", value: ""},
+		{
+			name:  "sorted from the highest resolution down",
+			value: "270p:400, 1080P:4000,540p:1200",
+			want: []RenditionConfig{
+				{Name: "1080p", Height: 1080, Bitrate: 4000},
+				{Name: "540p", Height: 540, Bitrate: 1200},
+				{Name: "270p", Height: 270, Bitrate: 400},
+			},
+		},
+		{name: "missing bitrate", value: "540p", wantErr: true},
+		{name: "missing p suffix", value: "540:1200", wantErr: true},
+		{name: "zero height", value: "0p:1200", wantErr: true},
+		{name: "negative bitrate", value: "540p:-5", wantErr: true},
+		{name: "bitrate with a unit", value: "540p:1.2M", wantErr: true},
+		{name: "listed twice", value: "540p:1200,540p:800", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRenditions(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRenditions(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseRenditions(%q) = %+v, want %+v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseStreams(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []StreamConfig
+		wantErr bool
+	}{
+		{name: "empty", value: ""},
+		{
+			name:  "order is kept",
+			value: "lobby=rtsp://10.0.0.5/stream1, garage = testpattern",
+			want: []StreamConfig{
+				{Name: "lobby", URL: "rtsp://10.0.0.5/stream1"},
+				{Name: "garage", URL: "testpattern"},
+			},
+		},
+		{
+			name:  "query parameters in the URL",
+			value: "door=rtsp://admin:pw@10.0.0.7/live?channel=1&subtype=0",
+			want:  []StreamConfig{{Name: "door", URL: "rtsp://admin:pw@10.0.0.7/live?channel=1&subtype=0"}},
+		},
+		{name: "no URL", value: "lobby", wantErr: true},
+		{name: "empty name", value: "=rtsp://10.0.0.5/stream1", wantErr: true},
+		{name: "empty URL", value: "lobby=", wantErr: true},
+		{name: "listed twice", value: "lobby=testpattern,lobby=rtsp://10.0.0.5/stream1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseStreams(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseStreams(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseStreams(%q) = %+v, want %+v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,379 @@
+// Package protocol defines the signaling messages exchanged between the signaling server,
+// the publisher and viewers. Every message is a JSON object with a "type" and a protocol
+// "version"; Decode turns raw frames into the typed structs below and validates them.
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Version is the signaling protocol version spoken by this build.
+// Messages without a version are treated as version 1 (clients that predate versioning).
+const Version = 1
+
+// Message types
+const (
+	TypeWelcome            = "welcome"
+	TypeJoin               = "join"
+	TypeJoined             = "joined"
+	TypeOffer              = "offer"
+	TypeAnswer             = "answer"
+	TypeCandidate          = "candidate"
+	TypeViewerConnected    = "viewer_connected"
+	TypeViewerDisconnected = "viewer_disconnected"
+	TypePublisherOnline    = "publisher_online"
+	TypePublisherOffline   = "publisher_offline"
+	TypeLayers             = "layers"
+	TypeSelectLayer        = "select_layer"
+	TypeServerShutdown     = "server_shutdown"
+	TypeError              = "error"
+)
+
+// LayerAuto asks the publisher to choose the layer from the viewer's bandwidth estimate
+const LayerAuto = "auto"
+
+// Roles a client can declare in its join message
+const (
+	RolePublisher = "publisher"
+	RoleViewer    = "viewer"
+)
+
+// Error codes used in Error messages
+const (
+	ErrorCodeMalformedMessage   = "malformed_message"   // Not JSON, or a field has the wrong type
+	ErrorCodeUnknownType        = "unknown_type"        // Missing type, or a type the receiver doesn't accept
+	ErrorCodeUnsupportedVersion = "unsupported_version" // Sent with a newer protocol version than ours
+	ErrorCodeInvalidMessage     = "invalid_message"     // Well-formed but missing required fields
+	ErrorCodeTargetNotFound     = "target_not_found"
+	ErrorCodeNotJoined          = "not_joined"
+	ErrorCodeAlreadyJoined      = "already_joined"
+	ErrorCodeInvalidJoin        = "invalid_join"
+	ErrorCodeStreamHasPublisher = "stream_has_publisher"
+	ErrorCodeForbidden          = "forbidden"
+)
+
+// Message is implemented by every signaling message
+type Message interface {
+	MessageType() string
+	Validate() error
+}
+
+// Header carries the fields every message has
+type Header struct {
+	Version int    `json:"version,omitempty"`
+	Type    string `json:"type"`
+}
+
+// NewHeader returns a header for an outgoing message of the given type at the current version
+func NewHeader(messageType string) Header {
+	return Header{Version: Version, Type: messageType}
+}
+
+func (h Header) MessageType() string {
+	return h.Type
+}
+
+// Routing holds the addressing fields of messages relayed between clients (offer, answer, candidate,
+// layers, select_layer).
+// The signaling server fills in FromClientID; TargetClientID addresses a single client.
+type Routing struct {
+	ClientID       string `json:"clientId,omitempty"`
+	FromClientID   string `json:"fromClientId,omitempty"`
+	TargetClientID string `json:"targetClientId,omitempty"`
+}
+
+// Route gives the signaling server access to the addressing fields of a relayed message
+func (r *Routing) Route() *Routing {
+	return r
+}
+
+// Sender returns who sent the message: fromClientId (set by the server), falling back to
+// clientId for senders that predate fromClientId
+func (r *Routing) Sender() string {
+	if r.FromClientID != "" {
+		return r.FromClientID
+	}
+	return r.ClientID
+}
+
+// Relayed is implemented by the messages the signaling server forwards between clients
+type Relayed interface {
+	Message
+	Route() *Routing
+}
+
+// SessionDescription mirrors the browser's RTCSessionDescriptionInit
+type SessionDescription struct {
+	Type string `json:"type"`
+	SDP  string `json:"sdp"`
+}
+
+// ICECandidate mirrors the browser's RTCIceCandidateInit
+type ICECandidate struct {
+	Candidate        string  `json:"candidate"`
+	SDPMid           *string `json:"sdpMid,omitempty"`
+	SDPMLineIndex    *uint16 `json:"sdpMLineIndex,omitempty"`
+	UsernameFragment *string `json:"usernameFragment,omitempty"`
+}
+
+// Welcome is the first message sent on every connection, telling the client its identity
+type Welcome struct {
+	Header
+	ClientID    string `json:"clientId"`
+	ResumeToken string `json:"resumeToken"`
+	Room        string `json:"room"`
+	Resumed     bool   `json:"resumed"`
+}
+
+// Join declares the sender's role and the stream it belongs to
+type Join struct {
+	Header
+	Role   string `json:"role"`
+	Stream string `json:"stream,omitempty"` // Defaults to the room the client connected to
+}
+
+// Joined acknowledges a join. Publishers get the viewers already waiting,
+// viewers get the publisher's ID if it is online.
+type Joined struct {
+	Header
+	ClientID    string   `json:"clientId"`
+	Role        string   `json:"role"`
+	Stream      string   `json:"stream"`
+	PublisherID string   `json:"publisherId,omitempty"`
+	Viewers     []string `json:"viewers,omitempty"`
+}
+
+// Offer carries the publisher's SDP offer to a viewer
+type Offer struct {
+	Header
+	Routing
+	Offer *SessionDescription `json:"offer"`
+}
+
+// Answer carries a viewer's SDP answer back to the publisher
+type Answer struct {
+	Header
+	Routing
+	Answer *SessionDescription `json:"answer"`
+}
+
+// Candidate carries a trickled ICE candidate in either direction
+type Candidate struct {
+	Header
+	Routing
+	Candidate *ICECandidate `json:"candidate"`
+}
+
+// LayerInfo describes one simulcast layer (rendition) of a stream
+type LayerInfo struct {
+	Name    string `json:"name"`    // e.g. "540p"
+	Height  int    `json:"height"`  // Pixels
+	Bitrate int    `json:"bitrate"` // Target bitrate in kbps
+}
+
+// Layers tells a viewer which layers the publisher encodes and which one it is being sent
+// Sent when the viewer connects and after every switch.
+type Layers struct {
+	Header
+	Routing
+	Layers  []LayerInfo `json:"layers"`
+	Current string      `json:"current"`
+	Auto    bool        `json:"auto"` // The publisher picks the layer from the viewer's bandwidth
+}
+
+// SelectLayer asks the publisher for a specific layer, or LayerAuto to hand the choice back
+type SelectLayer struct {
+	Header
+	Routing
+	Layer string `json:"layer"`
+}
+
+// PeerEvent announces that the other side of a stream came or went
+// (viewer_connected, viewer_disconnected, publisher_online, publisher_offline)
+type PeerEvent struct {
+	Header
+	ClientID string `json:"clientId"`
+	Stream   string `json:"stream,omitempty"`
+}
+
+// ServerShutdown is sent to every client before the signaling server goes down (e.g. for a
+// deploy); the connection is closed right after it
+type ServerShutdown struct {
+	Header
+	Reason       string `json:"reason,omitempty"`
+	RetryAfterMs int64  `json:"retryAfterMs"` // How long to wait before reconnecting
+}
+
+// Error is sent back when the receiver cannot handle a message
+type Error struct {
+	Header
+	Code           string `json:"code"`
+	Message        string `json:"message"`
+	TargetClientID string `json:"targetClientId,omitempty"`
+}
+
+// NewError builds an error message; targetID names the client a failed directed message was for
+func NewError(code, message, targetID string) *Error {
+	return &Error{
+		Header:         NewHeader(TypeError),
+		Code:           code,
+		Message:        message,
+		TargetClientID: targetID,
+	}
+}
+
+func (m *Welcome) Validate() error {
+	if m.ClientID == "" || m.ResumeToken == "" {
+		return fmt.Errorf("welcome requires clientId and resumeToken")
+	}
+	return nil
+}
+
+func (m *Join) Validate() error {
+	if m.Role != RolePublisher && m.Role != RoleViewer {
+		return fmt.Errorf("unknown role %q (expected %q or %q)", m.Role, RolePublisher, RoleViewer)
+	}
+	return nil
+}
+
+func (m *Joined) Validate() error {
+	if m.ClientID == "" || m.Stream == "" {
+		return fmt.Errorf("joined requires clientId and stream")
+	}
+	return nil
+}
+
+func (m *Offer) Validate() error {
+	// Offers are always addressed to one viewer (older publishers put the target in clientId)
+	if m.TargetClientID == "" && m.ClientID == "" {
+		return fmt.Errorf("offer requires targetClientId")
+	}
+	return validateSessionDescription("offer", m.Offer)
+}
+
+func (m *Answer) Validate() error {
+	return validateSessionDescription("answer", m.Answer)
+}
+
+func (m *Candidate) Validate() error {
+	// An empty candidate string is allowed - browsers use it to signal end-of-candidates
+	if m.Candidate == nil {
+		return fmt.Errorf("candidate message requires a candidate object")
+	}
+	return nil
+}
+
+func (m *Layers) Validate() error {
+	if len(m.Layers) == 0 || m.Current == "" {
+		return fmt.Errorf("layers requires layers and current")
+	}
+	return nil
+}
+
+func (m *SelectLayer) Validate() error {
+	// Only the publisher can act on it, so it must not be broadcast to the other viewers
+	if m.TargetClientID == "" {
+		return fmt.Errorf("select_layer requires targetClientId")
+	}
+	if m.Layer == "" {
+		return fmt.Errorf("select_layer requires layer")
+	}
+	return nil
+}
+
+func (m *PeerEvent) Validate() error {
+	if m.ClientID == "" {
+		return fmt.Errorf("%s requires clientId", m.Type)
+	}
+	return nil
+}
+
+func (m *ServerShutdown) Validate() error {
+	if m.RetryAfterMs < 0 {
+		return fmt.Errorf("server_shutdown has a negative retryAfterMs")
+	}
+	return nil
+}
+
+func (m *Error) Validate() error {
+	if m.Code == "" {
+		return fmt.Errorf("error requires code")
+	}
+	return nil
+}
+
+// validateSessionDescription checks that an offer/answer carries an SDP of the expected type
+func validateSessionDescription(expectedType string, desc *SessionDescription) error {
+	if desc == nil {
+		return fmt.Errorf("%s message requires an %s object", expectedType, expectedType)
+	}
+	if desc.Type != expectedType {
+		return fmt.Errorf("%s has SDP type %q", expectedType, desc.Type)
+	}
+	if desc.SDP == "" {
+		return fmt.Errorf("%s has an empty SDP", expectedType)
+	}
+	return nil
+}
+
+// DecodeError explains why a frame was rejected; Code is one of the ErrorCode* constants
+// and can be sent back to the peer as-is
+type DecodeError struct {
+	Code   string
+	Reason string
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Reason)
+}
+
+// Decode parses and validates a signaling frame, returning one of the message structs above.
+// Errors are always *DecodeError.
+func Decode(data []byte) (Message, error) {
+	var header Header
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, &DecodeError{Code: ErrorCodeMalformedMessage, Reason: fmt.Sprintf("invalid JSON: %v", err)}
+	}
+	if header.Version > Version {
+		return nil, &DecodeError{Code: ErrorCodeUnsupportedVersion, Reason: fmt.Sprintf("protocol version %d is not supported (max %d)", header.Version, Version)}
+	}
+
+	var msg Message
+	switch header.Type {
+	case TypeWelcome:
+		msg = &Welcome{}
+	case TypeJoin:
+		msg = &Join{}
+	case TypeJoined:
+		msg = &Joined{}
+	case TypeOffer:
+		msg = &Offer{}
+	case TypeAnswer:
+		msg = &Answer{}
+	case TypeCandidate:
+		msg = &Candidate{}
+	case TypeViewerConnected, TypeViewerDisconnected, TypePublisherOnline, TypePublisherOffline:
+		msg = &PeerEvent{}
+	case TypeLayers:
+		msg = &Layers{}
+	case TypeSelectLayer:
+		msg = &SelectLayer{}
+	case TypeServerShutdown:
+		msg = &ServerShutdown{}
+	case TypeError:
+		msg = &Error{}
+	case "":
+		return nil, &DecodeError{Code: ErrorCodeUnknownType, Reason: "message has no type"}
+	default:
+		return nil, &DecodeError{Code: ErrorCodeUnknownType, Reason: fmt.Sprintf("unknown message type %q", header.Type)}
+	}
+
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, &DecodeError{Code: ErrorCodeMalformedMessage, Reason: fmt.Sprintf("invalid %s message: %v", header.Type, err)}
+	}
+	if err := msg.Validate(); err != nil {
+		return nil, &DecodeError{Code: ErrorCodeInvalidMessage, Reason: err.Error()}
+	}
+	return msg, nil
+}
@@ -0,0 +1,130 @@
+package protocol
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name     string
+		frame    string
+		wantType string // Type of the decoded message, empty when decoding must fail
+		wantCode string // DecodeError code when it fails
+	}{
+		{
+			name:     "offer",
+			frame:    `{"version":1,"type":"offer","targetClientId":"v1","offer":{"type":"offer","sdp":"v=0"}}`,
+			wantType: "*protocol.Offer",
+		},
+		{
+			name:     "offer addressed with clientId by an older publisher",
+			frame:    `{"type":"offer","clientId":"v1","offer":{"type":"offer","sdp":"v=0"}}`,
+			wantType: "*protocol.Offer",
+		},
+		{
+			name:     "end-of-candidates",
+			frame:    `{"version":1,"type":"candidate","candidate":{"candidate":""}}`,
+			wantType: "*protocol.Candidate",
+		},
+		{
+			name:     "peer event",
+			frame:    `{"version":1,"type":"publisher_offline","clientId":"p1"}`,
+			wantType: "*protocol.PeerEvent",
+		},
+		{
+			name:     "server shutdown",
+			frame:    `{"version":1,"type":"server_shutdown","retryAfterMs":3000}`,
+			wantType: "*protocol.ServerShutdown",
+		},
+		{
+			name:     "not JSON",
+			frame:    `offer`,
+			wantCode: ErrorCodeMalformedMessage,
+		},
+		{
+			name:     "field of the wrong type",
+			frame:    `{"version":1,"type":"join","role":7}`,
+			wantCode: ErrorCodeMalformedMessage,
+		},
+		{
+			name:     "newer protocol version",
+			frame:    `{"version":2,"type":"join","role":"viewer"}`,
+			wantCode: ErrorCodeUnsupportedVersion,
+		},
+		{
+			name:     "no type",
+			frame:    `{"version":1}`,
+			wantCode: ErrorCodeUnknownType,
+		},
+		{
+			name:     "unknown type",
+			frame:    `{"version":1,"type":"subscribe"}`,
+			wantCode: ErrorCodeUnknownType,
+		},
+		{
+			name:     "unknown role",
+			frame:    `{"version":1,"type":"join","role":"admin"}`,
+			wantCode: ErrorCodeInvalidMessage,
+		},
+		{
+			name:     "offer without a target",
+			frame:    `{"version":1,"type":"offer","offer":{"type":"offer","sdp":"v=0"}}`,
+			wantCode: ErrorCodeInvalidMessage,
+		},
+		{
+			name:     "answer carrying an offer",
+			frame:    `{"version":1,"type":"answer","answer":{"type":"offer","sdp":"v=0"}}`,
+			wantCode: ErrorCodeInvalidMessage,
+		},
+		{
+			name:     "select_layer without a target",
+			frame:    `{"version":1,"type":"select_layer","layer":"540p"}`,
+			wantCode: ErrorCodeInvalidMessage,
+		},
+		{
+			name:     "negative retry delay",
+			frame:    `{"version":1,"type":"server_shutdown","retryAfterMs":-1}`,
+			wantCode: ErrorCodeInvalidMessage,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := Decode([]byte(tt.frame))
+			if tt.wantCode != "" {
+				var decodeErr *DecodeError
+				if !errors.As(err, &decodeErr) {
+					t.Fatalf("Decode() error = %v, want a DecodeError with code %s", err, tt.wantCode)
+				}
+				if decodeErr.Code != tt.wantCode {
+					t.Errorf("Decode() error code = %s, want %s (%s)", decodeErr.Code, tt.wantCode, decodeErr.Reason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if got := reflect.TypeOf(msg).String(); got != tt.wantType {
+				t.Errorf("Decode() returned %s, want %s", got, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestRoutingSender(t *testing.T) {
+	tests := []struct {
+		routing Routing
+		want    string
+	}{
+		{Routing{FromClientID: "server-set", ClientID: "self-declared"}, "server-set"},
+		{Routing{ClientID: "legacy"}, "legacy"},
+		{Routing{}, ""},
+	}
+	for _, tt := range tests {
+		if got := tt.routing.Sender(); got != tt.want {
+			t.Errorf("%+v.Sender() = %q, want %q", tt.routing, got, tt.want)
+		}
+	}
+}
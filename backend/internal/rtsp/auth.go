@@ -0,0 +1,129 @@
+package rtsp
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// authenticator answers a camera's 401 challenge with Basic or Digest credentials
+type authenticator struct {
+	username string
+	password string
+	scheme   string // "Basic" or "Digest", empty until the server challenged us
+	realm    string
+	nonce    string
+	opaque   string
+	qop      string // "auth" when the server asked for it
+	nc       int    // Nonce count for qop=auth
+}
+
+// challenge records the server's WWW-Authenticate headers, preferring Digest over Basic
+func (a *authenticator) challenge(headers []string) error {
+	var basic, digest string
+	for _, header := range headers {
+		scheme, params, _ := strings.Cut(strings.TrimSpace(header), " ")
+		switch strings.ToLower(scheme) {
+		case "digest":
+			digest = params
+		case "basic":
+			basic = params
+		}
+	}
+
+	switch {
+	case digest != "":
+		params := parseAuthParams(digest)
+		a.scheme = "Digest"
+		a.realm = params["realm"]
+		a.nonce = params["nonce"]
+		a.opaque = params["opaque"]
+		a.qop = ""
+		a.nc = 0
+		for _, qop := range strings.Split(params["qop"], ",") {
+			if strings.TrimSpace(qop) == "auth" {
+				a.qop = "auth"
+			}
+		}
+		if algorithm := params["algorithm"]; algorithm != "" && !strings.EqualFold(algorithm, "MD5") {
+			return fmt.Errorf("unsupported digest algorithm %q", algorithm)
+		}
+	case basic != "":
+		a.scheme = "Basic"
+		a.realm = parseAuthParams(basic)["realm"]
+	default:
+		return fmt.Errorf("no supported authentication scheme in %q", headers)
+	}
+	return nil
+}
+
+// authorization returns the Authorization header for a request, or "" before any challenge
+func (a *authenticator) authorization(method, uri string) string {
+	switch a.scheme {
+	case "Basic":
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(a.username+":"+a.password))
+	case "Digest":
+		ha1 := md5Hex(a.username + ":" + a.realm + ":" + a.password)
+		ha2 := md5Hex(method + ":" + uri)
+
+		header := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, a.username, a.realm, a.nonce, uri)
+		if a.qop == "auth" {
+			a.nc++
+			nc := fmt.Sprintf("%08x", a.nc)
+			cnonce := newCnonce()
+			response := md5Hex(ha1 + ":" + a.nonce + ":" + nc + ":" + cnonce + ":auth:" + ha2)
+			header += fmt.Sprintf(`, response="%s", qop=auth, nc=%s, cnonce="%s"`, response, nc, cnonce)
+		} else {
+			header += fmt.Sprintf(`, response="%s"`, md5Hex(ha1+":"+a.nonce+":"+ha2))
+		}
+		if a.opaque != "" {
+			header += fmt.Sprintf(`, opaque="%s"`, a.opaque)
+		}
+		return header
+	}
+	return ""
+}
+
+// parseAuthParams splits `realm="x", nonce="y", qop="auth,auth-int"` into a map
+func parseAuthParams(value string) map[string]string {
+	params := make(map[string]string)
+	for len(value) > 0 {
+		key, rest, found := strings.Cut(value, "=")
+		if !found {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(strings.TrimLeft(key, ", ")))
+		rest = strings.TrimLeft(rest, " ")
+
+		var val string
+		if strings.HasPrefix(rest, `"`) {
+			// Quoted values may contain commas
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				val, rest = rest[1:], ""
+			} else {
+				val, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			val, rest, _ = strings.Cut(rest, ",")
+			val = strings.TrimSpace(val)
+		}
+		params[key] = val
+		value = strings.TrimLeft(rest, ", ")
+	}
+	return params
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func newCnonce() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
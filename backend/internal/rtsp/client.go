@@ -0,0 +1,574 @@
+// Package rtsp is a small RTSP 1.0 client that pulls one H.264 video stream from an IP camera
+// (DESCRIBE, SETUP, PLAY) over TCP interleaved or UDP transport, without FFmpeg
+package rtsp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// Transports selectable with VIDEO_RTSP_TRANSPORT
+const (
+	TransportTCP = "tcp" // RTP interleaved on the RTSP connection (works through NAT and firewalls)
+	TransportUDP = "udp" // RTP on its own UDP port pair (lower overhead on a clean LAN)
+)
+
+const userAgent = "webrtc-streaming"
+
+// Default RTSP session timeout when the server doesn't announce one (RFC 2326 section 12.37)
+const defaultSessionTimeout = 60 * time.Second
+
+// Largest message body we accept - SDPs and parameters are a few KB, so anything bigger is
+// a broken or hostile server and is refused before allocating
+const maxBodySize = 64 * 1024
+
+// Response is an RTSP response
+type Response struct {
+	StatusCode int
+	Status     string
+	Header     textproto.MIMEHeader
+	Body       []byte
+}
+
+// Client is a connection to one RTSP server, used for a single video stream
+type Client struct {
+	url       *url.URL // Request URL, credentials removed
+	transport string
+	timeout   time.Duration
+
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex // Keepalives are written while packets are being read
+	cseq    int
+	auth    *authenticator
+
+	session        string
+	sessionTimeout time.Duration
+	channel        byte // Interleaved channel of our RTP stream (TCP transport)
+	media          *VideoMedia
+
+	// UDP transport
+	rtpConn  *net.UDPConn
+	rtcpConn *net.UDPConn
+
+	pending    []*rtp.Packet // Packets that arrived while we waited for the PLAY response
+	controlMu  sync.Mutex
+	controlErr error // Why the control connection failed (UDP transport)
+	stopChan   chan struct{}
+	closeOnce  sync.Once
+}
+
+// Dial connects to the RTSP server of rawURL. Credentials in the URL are used to answer
+// Basic or Digest challenges. timeout bounds every request and every packet read.
+func Dial(rawURL string, transport string, timeout time.Duration) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RTSP URL: %w", err)
+	}
+	if u.Scheme != "rtsp" {
+		return nil, fmt.Errorf("unsupported scheme %q (only rtsp:// is supported natively)", u.Scheme)
+	}
+	if transport != TransportTCP && transport != TransportUDP {
+		return nil, fmt.Errorf("unknown RTSP transport %q (expected %q or %q)", transport, TransportTCP, TransportUDP)
+	}
+
+	auth := &authenticator{}
+	if u.User != nil {
+		auth.username = u.User.Username()
+		auth.password, _ = u.User.Password()
+		u.User = nil
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "554")
+	}
+	conn, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", host, err)
+	}
+
+	return &Client{
+		url:       u,
+		transport: transport,
+		timeout:   timeout,
+		conn:      conn,
+		reader:    bufio.NewReaderSize(conn, 64*1024),
+		auth:      auth,
+		stopChan:  make(chan struct{}),
+	}, nil
+}
+
+// Describe asks the server for the session description and returns its H.264 video stream
+func (c *Client) Describe() (*VideoMedia, error) {
+	res, err := c.do("DESCRIBE", c.url.String(), map[string]string{"Accept": "application/sdp"})
+	if err != nil {
+		return nil, err
+	}
+
+	// Control URLs are relative to Content-Base (or Content-Location, or the request URL)
+	base := res.Header.Get("Content-Base")
+	if base == "" {
+		base = res.Header.Get("Content-Location")
+	}
+	if base == "" {
+		base = c.url.String()
+	}
+
+	media, err := parseSDP(string(res.Body), base)
+	if err != nil {
+		return nil, err
+	}
+	c.media = media
+	return media, nil
+}
+
+// Setup negotiates the transport for the video stream returned by Describe
+func (c *Client) Setup() error {
+	if c.media == nil {
+		return fmt.Errorf("SETUP before DESCRIBE")
+	}
+
+	var transport string
+	if c.transport == TransportTCP {
+		transport = "RTP/AVP/TCP;unicast;interleaved=0-1"
+	} else {
+		if err := c.listenUDP(); err != nil {
+			return err
+		}
+		rtpPort := c.rtpConn.LocalAddr().(*net.UDPAddr).Port
+		transport = fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d", rtpPort, rtpPort+1)
+	}
+
+	res, err := c.do("SETUP", c.media.Control, map[string]string{"Transport": transport})
+	if err != nil {
+		return err
+	}
+
+	// Session: 12345678;timeout=60
+	session, params, _ := strings.Cut(res.Header.Get("Session"), ";")
+	c.session = strings.TrimSpace(session)
+	if c.session == "" {
+		return fmt.Errorf("SETUP response has no Session header")
+	}
+	c.sessionTimeout = defaultSessionTimeout
+	for _, param := range strings.Split(params, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if strings.EqualFold(key, "timeout") {
+			if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+				c.sessionTimeout = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+
+	// The server may move us to other interleaved channels
+	if c.transport == TransportTCP {
+		for _, param := range strings.Split(res.Header.Get("Transport"), ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if key == "interleaved" {
+				first, _, _ := strings.Cut(value, "-")
+				if channel, err := strconv.Atoi(first); err == nil {
+					c.channel = byte(channel)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// listenUDP opens an even/odd UDP port pair for RTP and RTCP
+func (c *Client) listenUDP() error {
+	for attempt := 0; attempt < 10; attempt++ {
+		rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			return fmt.Errorf("failed to open RTP port: %w", err)
+		}
+		port := rtpConn.LocalAddr().(*net.UDPAddr).Port
+		if port%2 != 0 {
+			rtpConn.Close()
+			continue
+		}
+		rtcpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port + 1})
+		if err != nil {
+			rtpConn.Close()
+			continue
+		}
+		// Big receive buffer - keyframes arrive as bursts of packets
+		rtpConn.SetReadBuffer(4 * 1024 * 1024)
+		c.rtpConn = rtpConn
+		c.rtcpConn = rtcpConn
+		return nil
+	}
+	return fmt.Errorf("failed to find a free RTP/RTCP port pair")
+}
+
+// Play starts the stream; packets are then read with ReadPacket
+func (c *Client) Play() error {
+	if c.session == "" {
+		return fmt.Errorf("PLAY before SETUP")
+	}
+	if _, err := c.do("PLAY", c.url.String(), map[string]string{"Range": "npt=0.000-"}); err != nil {
+		return err
+	}
+
+	go c.keepAlive()
+	if c.transport == TransportUDP {
+		go c.readControl()
+		go c.drainRTCP()
+	}
+	return nil
+}
+
+// ReadPacket returns the next RTP packet of the video stream
+func (c *Client) ReadPacket() (*rtp.Packet, error) {
+	if len(c.pending) > 0 {
+		packet := c.pending[0]
+		c.pending = c.pending[1:]
+		return packet, nil
+	}
+
+	if c.transport == TransportUDP {
+		return c.readUDPPacket()
+	}
+
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+		channel, payload, err := c.readInterleaved()
+		if err != nil {
+			return nil, err
+		}
+		if channel != c.channel {
+			continue // RTCP from the server
+		}
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(payload); err != nil {
+			continue
+		}
+		if c.media != nil && packet.PayloadType != c.media.PayloadType {
+			continue
+		}
+		return packet, nil
+	}
+}
+
+func (c *Client) readUDPPacket() (*rtp.Packet, error) {
+	buf := make([]byte, 2048)
+	for {
+		c.controlMu.Lock()
+		controlErr := c.controlErr
+		c.controlMu.Unlock()
+		if controlErr != nil {
+			return nil, controlErr
+		}
+
+		c.rtpConn.SetReadDeadline(time.Now().Add(c.timeout))
+		n, _, err := c.rtpConn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, fmt.Errorf("no RTP packets for %v (is UDP blocked? try VIDEO_RTSP_TRANSPORT=tcp)", c.timeout)
+			}
+			return nil, err
+		}
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(append([]byte(nil), buf[:n]...)); err != nil {
+			continue
+		}
+		if c.media != nil && packet.PayloadType != c.media.PayloadType {
+			continue
+		}
+		return packet, nil
+	}
+}
+
+// readInterleaved reads the next $-framed packet, skipping RTSP messages in between
+// (keepalive replies, and requests the server sends on its own)
+func (c *Client) readInterleaved() (byte, []byte, error) {
+	for {
+		first, err := c.reader.Peek(1)
+		if err != nil {
+			return 0, nil, err
+		}
+		if first[0] != '$' {
+			if _, err := c.readMessage(); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return 0, nil, err
+		}
+		payload := make([]byte, int(header[2])<<8|int(header[3]))
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return 0, nil, err
+		}
+		return header[1], payload, nil
+	}
+}
+
+// keepAlive refreshes the session well before the server's timeout
+func (c *Client) keepAlive() {
+	ticker := time.NewTicker(c.sessionTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stopChan:
+			return
+		case <-ticker.C:
+			// GET_PARAMETER is the usual keepalive, but OPTIONS is the one every camera accepts
+			if err := c.writeRequest("OPTIONS", c.url.String(), nil); err != nil {
+				log.Printf("⚠️ RTSP keepalive failed: %v", err)
+				return
+			}
+		}
+	}
+}
+
+// readControl consumes keepalive replies and server requests on the RTSP connection (UDP transport)
+// and notices when it drops
+func (c *Client) readControl() {
+	for {
+		c.conn.SetReadDeadline(time.Time{})
+		if _, err := c.readMessage(); err != nil {
+			select {
+			case <-c.stopChan:
+			default:
+				c.controlMu.Lock()
+				c.controlErr = fmt.Errorf("RTSP connection lost: %w", err)
+				c.controlMu.Unlock()
+				c.rtpConn.SetReadDeadline(time.Now()) // Wake ReadPacket
+			}
+			return
+		}
+	}
+}
+
+// drainRTCP reads the server's sender reports so they don't pile up in the socket
+func (c *Client) drainRTCP() {
+	buf := make([]byte, 1500)
+	for {
+		if _, _, err := c.rtcpConn.ReadFromUDP(buf); err != nil {
+			return
+		}
+	}
+}
+
+// do sends a request and reads its response, answering one authentication challenge
+func (c *Client) do(method, requestURL string, headers map[string]string) (*Response, error) {
+	for attempt := 0; ; attempt++ {
+		if err := c.writeRequest(method, requestURL, headers); err != nil {
+			return nil, err
+		}
+		res, err := c.readResponseFor(method)
+		if err != nil {
+			return nil, err
+		}
+
+		if res.StatusCode == 401 && attempt == 0 && c.auth.username != "" {
+			if err := c.auth.challenge(res.Header.Values("Www-Authenticate")); err != nil {
+				return nil, fmt.Errorf("%s: %w", method, err)
+			}
+			continue
+		}
+		if res.StatusCode == 401 {
+			return nil, fmt.Errorf("%s: 401 Unauthorized (check the credentials in the RTSP URL)", method)
+		}
+		if res.StatusCode != 200 {
+			return nil, fmt.Errorf("%s: %d %s", method, res.StatusCode, res.Status)
+		}
+		return res, nil
+	}
+}
+
+func (c *Client) writeRequest(method, requestURL string, headers map[string]string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.cseq++
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s RTSP/1.0\r\n", method, requestURL)
+	fmt.Fprintf(&b, "CSeq: %d\r\n", c.cseq)
+	fmt.Fprintf(&b, "User-Agent: %s\r\n", userAgent)
+	if c.session != "" {
+		fmt.Fprintf(&b, "Session: %s\r\n", c.session)
+	}
+	if authorization := c.auth.authorization(method, requestURL); authorization != "" {
+		fmt.Fprintf(&b, "Authorization: %s\r\n", authorization)
+	}
+	for key, value := range headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", key, value)
+	}
+	b.WriteString("\r\n")
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write([]byte(b.String()))
+	return err
+}
+
+// readResponseFor reads the response to a request, keeping any RTP that arrives first
+// (servers may start streaming before they answer PLAY)
+func (c *Client) readResponseFor(method string) (*Response, error) {
+	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	for {
+		first, err := c.reader.Peek(1)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", method, err)
+		}
+		if first[0] != '$' {
+			res, err := c.readMessage()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", method, err)
+			}
+			if res == nil {
+				continue // A request from the server, already answered
+			}
+			return res, nil
+		}
+
+		channel, payload, err := c.readInterleaved()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", method, err)
+		}
+		packet := &rtp.Packet{}
+		if channel == c.channel && packet.Unmarshal(payload) == nil {
+			c.pending = append(c.pending, packet)
+		}
+	}
+}
+
+// readMessage reads the next RTSP message. Responses are returned; requests the server sends
+// on its own (GET_PARAMETER or OPTIONS keepalives, ANNOUNCE, REDIRECT) are answered and
+// return a nil response, so the caller keeps reading.
+func (c *Client) readMessage() (*Response, error) {
+	tp := textproto.NewReader(c.reader)
+	startLine, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+
+	// Responses start with the version (RTSP/1.0 200 OK), requests end with it (OPTIONS * RTSP/1.0)
+	var statusCode int
+	var status, method string
+	if proto, rest, _ := strings.Cut(startLine, " "); strings.HasPrefix(proto, "RTSP/") {
+		code, text, _ := strings.Cut(rest, " ")
+		if statusCode, err = strconv.Atoi(code); err != nil {
+			return nil, fmt.Errorf("malformed RTSP status line %q", startLine)
+		}
+		status = text
+	} else if fields := strings.Fields(startLine); len(fields) == 3 && strings.HasPrefix(fields[2], "RTSP/") {
+		method = fields[0]
+	} else {
+		return nil, fmt.Errorf("malformed RTSP start line %q", startLine)
+	}
+
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.readBody(header)
+	if err != nil {
+		return nil, err
+	}
+
+	if method != "" {
+		return nil, c.answerServerRequest(method, header)
+	}
+	return &Response{StatusCode: statusCode, Status: status, Header: header, Body: body}, nil
+}
+
+// readBody reads a message body of Content-Length bytes, up to maxBodySize
+func (c *Client) readBody(header textproto.MIMEHeader) ([]byte, error) {
+	value := header.Get("Content-Length")
+	if value == "" {
+		return nil, nil
+	}
+	length, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("malformed Content-Length %q", value)
+	}
+	if length > maxBodySize {
+		return nil, fmt.Errorf("RTSP message body of %d bytes exceeds the %d byte limit", length, maxBodySize)
+	}
+	if length == 0 {
+		return nil, nil
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// answerServerRequest replies to a request the server sent us. Keepalives and parameter
+// updates are acknowledged, a new ANNOUNCEd description is ignored (we keep the stream we
+// set up), and REDIRECT ends the session so the caller reconnects.
+func (c *Client) answerServerRequest(method string, header textproto.MIMEHeader) error {
+	cseq := header.Get("CSeq")
+	switch method {
+	case "OPTIONS":
+		return c.writeResponse(cseq, "200 OK", map[string]string{"Public": "OPTIONS, GET_PARAMETER, SET_PARAMETER, ANNOUNCE, REDIRECT"})
+	case "GET_PARAMETER", "SET_PARAMETER", "ANNOUNCE":
+		return c.writeResponse(cseq, "200 OK", nil)
+	case "REDIRECT":
+		c.writeResponse(cseq, "200 OK", nil)
+		return fmt.Errorf("server redirected the session to %q", header.Get("Location"))
+	default:
+		log.Printf("⚠️ Ignoring RTSP %s request from the server", method)
+		return c.writeResponse(cseq, "501 Not Implemented", nil)
+	}
+}
+
+// writeResponse answers a server request, echoing its CSeq
+func (c *Client) writeResponse(cseq, status string, headers map[string]string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "RTSP/1.0 %s\r\n", status)
+	fmt.Fprintf(&b, "CSeq: %s\r\n", cseq)
+	fmt.Fprintf(&b, "User-Agent: %s\r\n", userAgent)
+	if c.session != "" {
+		fmt.Fprintf(&b, "Session: %s\r\n", c.session)
+	}
+	for key, value := range headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", key, value)
+	}
+	b.WriteString("\r\n")
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write([]byte(b.String()))
+	return err
+}
+
+// Close tears the session down and closes all sockets
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.stopChan)
+		if c.session != "" {
+			// Best effort - the camera frees the session on its own after the timeout anyway
+			c.writeRequest("TEARDOWN", c.url.String(), nil)
+		}
+		c.conn.Close()
+		if c.rtpConn != nil {
+			c.rtpConn.Close()
+		}
+		if c.rtcpConn != nil {
+			c.rtcpConn.Close()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,352 @@
+package rtsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	testRealm = "camera"
+	testNonce = "5f2d8c1a"
+	// CSeq of the GET_PARAMETER keepalive the camera sends mid-stream
+	testKeepaliveCSeq = "900"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xe0, 0x1f, 0xda, 0x02, 0x80}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+// fakeCamera is an in-process RTSP server standing in for an IP camera. It answers DESCRIBE,
+// SETUP, PLAY and TEARDOWN, asks for Digest credentials, and after PLAY streams its packets
+// over the negotiated transport with a GET_PARAMETER keepalive of its own in the middle.
+type fakeCamera struct {
+	listener net.Listener
+	username string
+	password string
+	packets  []*rtp.Packet
+
+	bodyLength int // Content-Length announced for the SDP instead of its real length (0 = real)
+
+	mu      sync.Mutex
+	methods []string // Authorized requests, in order
+
+	keepaliveAnswer chan string // Status line of the client's answer to our GET_PARAMETER
+}
+
+func newFakeCamera(t *testing.T, username, password string, packets []*rtp.Packet) *fakeCamera {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	camera := &fakeCamera{
+		listener:        listener,
+		username:        username,
+		password:        password,
+		packets:         packets,
+		keepaliveAnswer: make(chan string, 1),
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go camera.serve(conn)
+		}
+	}()
+	return camera
+}
+
+// url returns the camera's stream URL with the given credentials
+func (s *fakeCamera) url(username, password string) string {
+	return fmt.Sprintf("rtsp://%s:%s@%s/stream1", username, password, s.listener.Addr())
+}
+
+func (s *fakeCamera) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	var writeMu sync.Mutex
+	write := func(message []byte) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		conn.Write(message)
+	}
+
+	var udpConn net.PacketConn
+	var udpAddr net.Addr
+	defer func() {
+		if udpConn != nil {
+			udpConn.Close()
+		}
+	}()
+
+	for {
+		tp := textproto.NewReader(reader)
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		header, err := tp.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		if strings.HasPrefix(line, "RTSP/") {
+			// The client answering our keepalive
+			if header.Get("CSeq") == testKeepaliveCSeq {
+				s.keepaliveAnswer <- line
+			}
+			continue
+		}
+
+		fields := strings.Fields(line)
+		method, uri := fields[0], fields[1]
+		cseq := header.Get("CSeq")
+		if !s.authorized(method, uri, header.Get("Authorization")) {
+			challenge := fmt.Sprintf(`Digest realm="%s", nonce="%s", qop="auth"`, testRealm, testNonce)
+			write(testResponse(cseq, "401 Unauthorized", map[string]string{"WWW-Authenticate": challenge}, ""))
+			continue
+		}
+		s.mu.Lock()
+		s.methods = append(s.methods, method)
+		s.mu.Unlock()
+
+		switch method {
+		case "DESCRIBE":
+			headers := map[string]string{
+				"Content-Base": fmt.Sprintf("rtsp://%s/stream1/", s.listener.Addr()),
+				"Content-Type": "application/sdp",
+			}
+			body := s.sdp()
+			if s.bodyLength > 0 {
+				headers["Content-Length"] = fmt.Sprint(s.bodyLength)
+			}
+			write(testResponse(cseq, "200 OK", headers, body))
+
+		case "SETUP":
+			transport := header.Get("Transport")
+			if _, ports, found := strings.Cut(transport, "client_port="); found {
+				rtpPort, _, _ := strings.Cut(ports, "-")
+				udpAddr, _ = net.ResolveUDPAddr("udp", "127.0.0.1:"+rtpPort)
+				udpConn, _ = net.ListenPacket("udp", "127.0.0.1:0")
+			}
+			write(testResponse(cseq, "200 OK", map[string]string{
+				"Transport": transport,
+				"Session":   "12345678;timeout=60",
+			}, ""))
+
+		case "PLAY":
+			write(testResponse(cseq, "200 OK", map[string]string{"Session": "12345678"}, ""))
+			go s.stream(write, udpConn, udpAddr)
+
+		case "TEARDOWN":
+			write(testResponse(cseq, "200 OK", nil, ""))
+			return
+
+		default:
+			write(testResponse(cseq, "405 Method Not Allowed", nil, ""))
+		}
+	}
+}
+
+// stream sends the packets interleaved on the RTSP connection, or to the client's UDP port
+func (s *fakeCamera) stream(write func([]byte), udpConn net.PacketConn, udpAddr net.Addr) {
+	for i, packet := range s.packets {
+		if i == 1 {
+			write([]byte("GET_PARAMETER rtsp://camera/stream1 RTSP/1.0\r\nCSeq: " + testKeepaliveCSeq + "\r\nSession: 12345678\r\n\r\n"))
+		}
+		raw, err := packet.Marshal()
+		if err != nil {
+			return
+		}
+		if udpConn != nil {
+			udpConn.WriteTo(raw, udpAddr)
+			continue
+		}
+		write(append([]byte{'$', 0, byte(len(raw) >> 8), byte(len(raw))}, raw...))
+	}
+}
+
+// authorized checks a Digest Authorization header (RFC 2617 with qop=auth)
+func (s *fakeCamera) authorized(method, uri, authorization string) bool {
+	scheme, value, _ := strings.Cut(authorization, " ")
+	if scheme != "Digest" {
+		return false
+	}
+	params := parseAuthParams(value)
+	if params["username"] != s.username || params["uri"] != uri || params["nonce"] != testNonce || params["qop"] != "auth" {
+		return false
+	}
+	ha1 := md5Hex(s.username + ":" + testRealm + ":" + s.password)
+	ha2 := md5Hex(method + ":" + uri)
+	return params["response"] == md5Hex(ha1+":"+testNonce+":"+params["nc"]+":"+params["cnonce"]+":auth:"+ha2)
+}
+
+func (s *fakeCamera) sdp() string {
+	return strings.Join([]string{
+		"v=0",
+		"o=- 0 0 IN IP4 127.0.0.1",
+		"s=Camera",
+		"t=0 0",
+		"a=control:*",
+		"m=video 0 RTP/AVP 96",
+		"a=rtpmap:96 H264/90000",
+		"a=fmtp:96 packetization-mode=1;profile-level-id=42e01f;sprop-parameter-sets=" +
+			base64.StdEncoding.EncodeToString(testSPS) + "," + base64.StdEncoding.EncodeToString(testPPS),
+		"a=control:trackID=1",
+		"",
+	}, "\r\n")
+}
+
+func (s *fakeCamera) requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.methods...)
+}
+
+func testResponse(cseq, status string, headers map[string]string, body string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "RTSP/1.0 %s\r\nCSeq: %s\r\n", status, cseq)
+	for key, value := range headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", key, value)
+	}
+	if body != "" && headers["Content-Length"] == "" {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", len(body))
+	}
+	b.WriteString("\r\n")
+	b.WriteString(body)
+	return []byte(b.String())
+}
+
+// testStream is one IDR frame (SPS and PPS in a STAP-A, the slice in FU-A fragments) followed
+// by a P-frame in a single NAL unit packet
+func testStream() (packets []*rtp.Packet, want []AccessUnit) {
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{0xAB}, 2500)...)
+	pFrame := append([]byte{0x41}, bytes.Repeat([]byte{0xCD}, 300)...)
+
+	seq := uint16(65530) // Wraps around mid-stream
+	add := func(timestamp uint32, marker bool, payload []byte) {
+		packets = append(packets, &rtp.Packet{
+			Header:  rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: seq, Timestamp: timestamp, SSRC: 0x1234, Marker: marker},
+			Payload: payload,
+		})
+		seq++
+	}
+
+	add(90000, false, stapA(testSPS, testPPS))
+	fragments := fuA(idr, 1000)
+	for i, fragment := range fragments {
+		add(90000, i == len(fragments)-1, fragment)
+	}
+	add(93000, true, pFrame)
+
+	want = []AccessUnit{
+		{Data: annexB(testSPS, testPPS, idr), Timestamp: 90000, IDR: true},
+		{Data: annexB(pFrame), Timestamp: 93000},
+	}
+	return packets, want
+}
+
+func TestClientPlaysStream(t *testing.T) {
+	for _, transport := range []string{TransportTCP, TransportUDP} {
+		t.Run(transport, func(t *testing.T) {
+			packets, want := testStream()
+			camera := newFakeCamera(t, "admin", "secret", packets)
+
+			client, err := Dial(camera.url("admin", "secret"), transport, 2*time.Second)
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			defer client.Close()
+
+			media, err := client.Describe()
+			if err != nil {
+				t.Fatalf("Describe: %v", err)
+			}
+			if wantControl := fmt.Sprintf("rtsp://%s/stream1/trackID=1", camera.listener.Addr()); media.Control != wantControl {
+				t.Errorf("control = %q, want %q", media.Control, wantControl)
+			}
+			if !bytes.Equal(media.SPS, testSPS) || !bytes.Equal(media.PPS, testPPS) {
+				t.Errorf("parameter sets from the SDP = %x, %x", media.SPS, media.PPS)
+			}
+			if err := client.Setup(); err != nil {
+				t.Fatalf("Setup: %v", err)
+			}
+			if err := client.Play(); err != nil {
+				t.Fatalf("Play: %v", err)
+			}
+
+			depacketizer := NewH264Depacketizer(media.SPS, media.PPS)
+			var got []AccessUnit
+			for len(got) < len(want) {
+				packet, err := client.ReadPacket()
+				if err != nil {
+					t.Fatalf("ReadPacket after %d access units: %v", len(got), err)
+				}
+				units, err := depacketizer.Push(packet)
+				if err != nil {
+					t.Fatalf("Push: %v", err)
+				}
+				got = append(got, units...)
+			}
+			for i := range want {
+				if got[i].IDR != want[i].IDR || got[i].Timestamp != want[i].Timestamp || !bytes.Equal(got[i].Data, want[i].Data) {
+					t.Errorf("access unit %d = {IDR %v, ts %d, %d bytes}, want {IDR %v, ts %d, %d bytes}",
+						i, got[i].IDR, got[i].Timestamp, len(got[i].Data), want[i].IDR, want[i].Timestamp, len(want[i].Data))
+				}
+			}
+
+			select {
+			case status := <-camera.keepaliveAnswer:
+				if status != "RTSP/1.0 200 OK" {
+					t.Errorf("answer to the camera's GET_PARAMETER = %q, want 200 OK", status)
+				}
+			case <-time.After(2 * time.Second):
+				t.Error("the camera's GET_PARAMETER was never answered")
+			}
+
+			if requests := strings.Join(camera.requests(), ","); requests != "DESCRIBE,SETUP,PLAY" {
+				t.Errorf("authorized requests = %s, want DESCRIBE,SETUP,PLAY", requests)
+			}
+		})
+	}
+}
+
+func TestClientRejectsWrongCredentials(t *testing.T) {
+	camera := newFakeCamera(t, "admin", "secret", nil)
+	client, err := Dial(camera.url("admin", "wrong"), TransportTCP, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.Describe(); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("Describe with a wrong password: err = %v, want a 401 error", err)
+	}
+}
+
+func TestClientCapsBodySize(t *testing.T) {
+	camera := newFakeCamera(t, "admin", "secret", nil)
+	camera.bodyLength = maxBodySize + 1
+	client, err := Dial(camera.url("admin", "secret"), TransportTCP, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.Describe(); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Fatalf("Describe with an oversized body: err = %v, want the size limit error", err)
+	}
+}
@@ -0,0 +1,330 @@
+package rtsp
+
+import (
+	"errors"
+
+	"github.com/pion/rtp"
+)
+
+// H.264 NAL unit types (RFC 6184 section 5.2 / ITU-T H.264 table 7-1)
+const (
+	naluTypeIDR   = 5
+	naluTypeSPS   = 7
+	naluTypePPS   = 8
+	naluTypeAUD   = 9
+	naluTypeSTAPA = 24
+	naluTypeFUA   = 28
+)
+
+var annexBStartCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+// errPacketLoss marks an access unit that was dropped because some of its packets never arrived
+var errPacketLoss = errors.New("access unit dropped after packet loss")
+
+// H264Depacketizer reassembles H.264 access units from RTP packets (RFC 6184:
+// single NAL units, STAP-A aggregates and FU-A fragments) and returns them in Annex-B form
+//
+// Access units with missing packets are dropped rather than handed on half-decoded, and
+// nothing is returned until the first IDR frame so a decoder never starts on a P-frame.
+type H264Depacketizer struct {
+	nalus      [][]byte // NAL units of the access unit being assembled
+	timestamp  uint32   // RTP timestamp of the access unit being assembled
+	fragment   []byte   // FU-A fragments of the NAL unit being assembled
+	lastSeq    uint16
+	started    bool // At least one packet seen
+	broken     bool // The current access unit lost a packet
+	sawIDR     bool // An IDR frame has been returned, so P-frames are decodable
+	sps        []byte
+	pps        []byte
+	lostFrames int
+}
+
+// NewH264Depacketizer creates a depacketizer, seeded with the SPS/PPS from the SDP (either may be nil)
+func NewH264Depacketizer(sps, pps []byte) *H264Depacketizer {
+	return &H264Depacketizer{sps: sps, pps: pps}
+}
+
+// Push adds a packet and returns the access units it completed (usually none or one)
+// Each access unit is returned with its RTP timestamp.
+func (d *H264Depacketizer) Push(packet *rtp.Packet) ([]AccessUnit, error) {
+	var completed []AccessUnit
+	var err error
+
+	if d.started && packet.SequenceNumber != d.lastSeq+1 {
+		// A gap: the access unit being assembled (and any fragment) is incomplete
+		d.broken = true
+		d.fragment = nil
+	}
+	if d.started && packet.Timestamp != d.timestamp {
+		// A new timestamp starts a new access unit, even if the marker bit was lost
+		if au, ok, flushErr := d.flush(); ok {
+			completed = append(completed, au)
+		} else if flushErr != nil {
+			err = flushErr
+		}
+	}
+	d.started = true
+	d.lastSeq = packet.SequenceNumber
+	d.timestamp = packet.Timestamp
+
+	d.depacketize(packet.Payload)
+
+	// The marker bit is set on the last packet of an access unit
+	if packet.Marker {
+		if au, ok, flushErr := d.flush(); ok {
+			completed = append(completed, au)
+		} else if flushErr != nil {
+			err = flushErr
+		}
+	}
+	return completed, err
+}
+
+// AccessUnit is one complete video frame in Annex-B form
+type AccessUnit struct {
+	Data      []byte
+	Timestamp uint32 // RTP timestamp (ClockRate units)
+	IDR       bool
+}
+
+// LostFrames returns how many access units were dropped because of packet loss
+func (d *H264Depacketizer) LostFrames() int {
+	return d.lostFrames
+}
+
+func (d *H264Depacketizer) depacketize(payload []byte) {
+	if len(payload) == 0 {
+		return
+	}
+
+	switch naluType := payload[0] & 0x1F; {
+	case naluType >= 1 && naluType <= 23:
+		d.addNALU(payload)
+
+	case naluType == naluTypeSTAPA:
+		// STAP-A: 1-byte header, then [2-byte size][NAL unit] repeated
+		offset := 1
+		for offset+2 <= len(payload) {
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			offset += 2
+			if size == 0 || offset+size > len(payload) {
+				d.broken = true
+				return
+			}
+			d.addNALU(payload[offset : offset+size])
+			offset += size
+		}
+
+	case naluType == naluTypeFUA:
+		// FU-A: indicator, header (start/end bits + real type), then a slice of the NAL unit
+		if len(payload) < 2 {
+			d.broken = true
+			return
+		}
+		start := payload[1]&0x80 != 0
+		end := payload[1]&0x40 != 0
+		if start {
+			// Rebuild the original NAL header from the indicator's NRI and the FU header's type
+			d.fragment = append(d.fragment[:0], payload[0]&0xE0|payload[1]&0x1F)
+		} else if d.fragment == nil {
+			// Middle of a NAL unit whose start we never saw
+			d.broken = true
+			return
+		}
+		d.fragment = append(d.fragment, payload[2:]...)
+		if end {
+			d.addNALU(d.fragment)
+			d.fragment = nil
+		}
+
+	default:
+		// STAP-B, MTAP and FU-B are not used by cameras in non-interleaved mode
+		d.broken = true
+	}
+}
+
+func (d *H264Depacketizer) addNALU(nalu []byte) {
+	d.nalus = append(d.nalus, append([]byte(nil), nalu...))
+}
+
+// flush finishes the access unit being assembled
+func (d *H264Depacketizer) flush() (AccessUnit, bool, error) {
+	nalus := d.nalus
+	broken := d.broken || d.fragment != nil
+	d.nalus = nil
+	d.fragment = nil
+	d.broken = false
+
+	if len(nalus) == 0 && !broken {
+		return AccessUnit{}, false, nil
+	}
+	if broken {
+		// Also when nothing survived, e.g. a frame sent as one FU-A NAL unit lost a fragment
+		d.lostFrames++
+		if d.sawIDR {
+			// Later P-frames reference the lost one - wait for the next IDR
+			d.sawIDR = false
+		}
+		return AccessUnit{}, false, errPacketLoss
+	}
+
+	var hasIDR, hasSPS, hasPPS bool
+	for _, nalu := range nalus {
+		switch nalu[0] & 0x1F {
+		case naluTypeIDR:
+			hasIDR = true
+		case naluTypeSPS:
+			hasSPS = true
+			d.sps = nalu
+		case naluTypePPS:
+			hasPPS = true
+			d.pps = nalu
+		}
+	}
+
+	if !hasIDR && !d.sawIDR {
+		// Nothing can be decoded until the first keyframe
+		return AccessUnit{}, false, nil
+	}
+
+	var data []byte
+	if hasIDR {
+		d.sawIDR = true
+		// Cameras often send SPS/PPS only in the SDP - put them in front of every IDR
+		if !hasSPS && d.sps != nil {
+			data = append(append(data, annexBStartCode...), d.sps...)
+		}
+		if !hasPPS && d.pps != nil {
+			data = append(append(data, annexBStartCode...), d.pps...)
+		}
+	}
+	for _, nalu := range nalus {
+		if nalu[0]&0x1F == naluTypeAUD {
+			continue
+		}
+		data = append(append(data, annexBStartCode...), nalu...)
+	}
+
+	return AccessUnit{Data: data, Timestamp: d.timestamp, IDR: hasIDR}, true, nil
+}
+
+// The helpers below work on single RTP payloads, for forwarding packets without reassembling frames
+
+// IsKeyframeStart reports whether a payload can start a decodable stream: it carries an SPS or
+// the start of an IDR slice (on its own, in a STAP-A, or as the first FU-A fragment)
+func IsKeyframeStart(payload []byte) bool {
+	return startsNALU(payload, func(naluType byte) bool {
+		return naluType == naluTypeIDR || naluType == naluTypeSPS
+	})
+}
+
+// IsIDRStart reports whether a payload carries the start of an IDR slice
+func IsIDRStart(payload []byte) bool {
+	return startsNALU(payload, func(naluType byte) bool { return naluType == naluTypeIDR })
+}
+
+// startsNALU reports whether a payload starts a NAL unit whose type matches
+func startsNALU(payload []byte, match func(naluType byte) bool) bool {
+	if len(payload) == 0 {
+		return false
+	}
+	switch naluType := payload[0] & 0x1F; naluType {
+	case naluTypeSTAPA:
+		found := false
+		forEachAggregated(payload, func(nalu []byte) {
+			found = found || match(nalu[0]&0x1F)
+		})
+		return found
+	case naluTypeFUA:
+		return len(payload) >= 2 && payload[1]&0x80 != 0 && match(payload[1]&0x1F)
+	default:
+		return match(naluType)
+	}
+}
+
+// ParameterSets returns the SPS and PPS carried in a single NAL unit or STAP-A payload (nil if absent)
+func ParameterSets(payload []byte) (sps, pps []byte) {
+	take := func(nalu []byte) {
+		switch nalu[0] & 0x1F {
+		case naluTypeSPS:
+			sps = append([]byte(nil), nalu...)
+		case naluTypePPS:
+			pps = append([]byte(nil), nalu...)
+		}
+	}
+	switch {
+	case len(payload) == 0:
+	case payload[0]&0x1F == naluTypeSTAPA:
+		forEachAggregated(payload, take)
+	default:
+		take(payload)
+	}
+	return sps, pps
+}
+
+// ParameterSetsPayload builds a STAP-A payload carrying the SPS and PPS, to send in front of an IDR
+func ParameterSetsPayload(sps, pps []byte) []byte {
+	payload := []byte{(sps[0]|pps[0])&0x60 | naluTypeSTAPA}
+	for _, nalu := range [][]byte{sps, pps} {
+		payload = append(payload, byte(len(nalu)>>8), byte(len(nalu)))
+		payload = append(payload, nalu...)
+	}
+	return payload
+}
+
+// SplitPayload breaks a payload larger than maxSize into FU-A fragments (a STAP-A is unpacked into
+// its NAL units first). Smaller payloads come back unchanged. Cameras on TCP interleaved transport
+// aren't bound by the network MTU, but packets forwarded to browsers are.
+func SplitPayload(payload []byte, maxSize int) [][]byte {
+	if len(payload) <= maxSize || len(payload) < 2 {
+		return [][]byte{payload}
+	}
+
+	switch naluType := payload[0] & 0x1F; {
+	case naluType == naluTypeSTAPA:
+		var parts [][]byte
+		forEachAggregated(payload, func(nalu []byte) {
+			parts = append(parts, SplitPayload(nalu, maxSize)...)
+		})
+		return parts
+	case naluType == naluTypeFUA:
+		start := payload[1]&0x80 != 0
+		end := payload[1]&0x40 != 0
+		return fragment(payload[0], payload[1]&0x1F, payload[2:], start, end, maxSize)
+	case naluType >= 1 && naluType <= 23:
+		return fragment(payload[0]&0xE0|naluTypeFUA, naluType, payload[1:], true, true, maxSize)
+	}
+	return [][]byte{payload}
+}
+
+// fragment cuts NAL unit data into FU-A payloads; start and end say whether the data begins and
+// ends the NAL unit, so only the outermost fragments carry the S and E bits
+func fragment(indicator, naluType byte, data []byte, start, end bool, maxSize int) [][]byte {
+	chunkSize := maxSize - 2
+	var parts [][]byte
+	for offset := 0; offset < len(data); offset += chunkSize {
+		header := naluType
+		if start && offset == 0 {
+			header |= 0x80
+		}
+		if end && offset+chunkSize >= len(data) {
+			header |= 0x40
+		}
+		parts = append(parts, append([]byte{indicator, header}, data[offset:min(offset+chunkSize, len(data))]...))
+	}
+	return parts
+}
+
+// forEachAggregated calls fn with every NAL unit of a STAP-A payload
+func forEachAggregated(payload []byte, fn func(nalu []byte)) {
+	offset := 1
+	for offset+2 <= len(payload) {
+		size := int(payload[offset])<<8 | int(payload[offset+1])
+		offset += 2
+		if size == 0 || offset+size > len(payload) {
+			return
+		}
+		fn(payload[offset : offset+size])
+		offset += size
+	}
+}
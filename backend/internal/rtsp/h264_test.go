@@ -0,0 +1,188 @@
+package rtsp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+// stapA aggregates NAL units into one STAP-A payload
+func stapA(nalus ...[]byte) []byte {
+	payload := []byte{naluTypeSTAPA}
+	for _, nalu := range nalus {
+		payload = append(payload, byte(len(nalu)>>8), byte(len(nalu)))
+		payload = append(payload, nalu...)
+	}
+	return payload
+}
+
+// fuA splits a NAL unit into FU-A payloads carrying up to size bytes of it each
+func fuA(nalu []byte, size int) [][]byte {
+	indicator := nalu[0]&0xE0 | naluTypeFUA
+	var payloads [][]byte
+	for data := nalu[1:]; len(data) > 0; {
+		n := min(size, len(data))
+		header := nalu[0] & 0x1F
+		if len(payloads) == 0 {
+			header |= 0x80
+		}
+		if n == len(data) {
+			header |= 0x40
+		}
+		payloads = append(payloads, append([]byte{indicator, header}, data[:n]...))
+		data = data[n:]
+	}
+	return payloads
+}
+
+func annexB(nalus ...[]byte) []byte {
+	var data []byte
+	for _, nalu := range nalus {
+		data = append(append(data, annexBStartCode...), nalu...)
+	}
+	return data
+}
+
+func TestH264Depacketizer(t *testing.T) {
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{0x11}, 40)...)
+	pFrame := []byte{0x41, 0x22, 0x22, 0x22}
+	aud := []byte{0x09, 0xF0}
+	idrFragments := fuA(idr, 16)
+
+	type packet struct {
+		seq       uint16
+		timestamp uint32
+		marker    bool
+		payload   []byte
+	}
+	tests := []struct {
+		name     string
+		sps, pps []byte // From the SDP
+		packets  []packet
+		want     []AccessUnit
+		wantLost int
+	}{
+		{
+			name: "single NAL unit IDR gets the SDP parameter sets in front",
+			sps:  testSPS, pps: testPPS,
+			packets: []packet{{1, 3000, true, idr}},
+			want:    []AccessUnit{{Data: annexB(testSPS, testPPS, idr), Timestamp: 3000, IDR: true}},
+		},
+		{
+			name: "STAP-A parameter sets and FU-A slice",
+			packets: []packet{
+				{1, 3000, false, stapA(testSPS, testPPS)},
+				{2, 3000, false, idrFragments[0]},
+				{3, 3000, false, idrFragments[1]},
+				{4, 3000, true, idrFragments[2]},
+				{5, 6000, true, pFrame},
+			},
+			want: []AccessUnit{
+				{Data: annexB(testSPS, testPPS, idr), Timestamp: 3000, IDR: true},
+				{Data: annexB(pFrame), Timestamp: 6000},
+			},
+		},
+		{
+			name: "access unit delimiters are dropped",
+			packets: []packet{
+				{1, 3000, true, stapA(aud, testSPS, testPPS, idr)},
+			},
+			want: []AccessUnit{{Data: annexB(testSPS, testPPS, idr), Timestamp: 3000, IDR: true}},
+		},
+		{
+			name: "P-frames before the first IDR are dropped",
+			sps:  testSPS, pps: testPPS,
+			packets: []packet{
+				{1, 3000, true, pFrame},
+				{2, 6000, true, idr},
+			},
+			want: []AccessUnit{{Data: annexB(testSPS, testPPS, idr), Timestamp: 6000, IDR: true}},
+		},
+		{
+			name: "a new timestamp ends an access unit whose marker was lost",
+			sps:  testSPS, pps: testPPS,
+			packets: []packet{
+				{1, 3000, false, idr},
+				{2, 6000, true, pFrame},
+			},
+			want: []AccessUnit{
+				{Data: annexB(testSPS, testPPS, idr), Timestamp: 3000, IDR: true},
+				{Data: annexB(pFrame), Timestamp: 6000},
+			},
+		},
+		{
+			name: "a lost FU-A fragment drops the frame and the P-frames after it",
+			sps:  testSPS, pps: testPPS,
+			packets: []packet{
+				{1, 3000, false, idrFragments[0]},
+				{3, 3000, true, idrFragments[2]}, // Fragment 2 lost
+				{4, 6000, true, pFrame},
+				{5, 9000, true, idr},
+				{6, 12000, true, pFrame},
+			},
+			want: []AccessUnit{
+				{Data: annexB(testSPS, testPPS, idr), Timestamp: 9000, IDR: true},
+				{Data: annexB(pFrame), Timestamp: 12000},
+			},
+			wantLost: 1,
+		},
+		{
+			name: "a P-frame that loses a fragment stops the stream until the next IDR",
+			sps:  testSPS, pps: testPPS,
+			packets: []packet{
+				{1, 3000, true, idr},
+				{2, 6000, false, fuA(pFrame, 1)[0]},
+				{4, 6000, true, fuA(pFrame, 1)[2]}, // Fragment 2 lost
+				{5, 9000, true, pFrame},
+				{6, 12000, true, idr},
+			},
+			want: []AccessUnit{
+				{Data: annexB(testSPS, testPPS, idr), Timestamp: 3000, IDR: true},
+				{Data: annexB(testSPS, testPPS, idr), Timestamp: 12000, IDR: true},
+			},
+			wantLost: 1,
+		},
+		{
+			name: "sequence numbers wrap around",
+			sps:  testSPS, pps: testPPS,
+			packets: []packet{
+				{65535, 3000, false, idrFragments[0]},
+				{0, 3000, false, idrFragments[1]},
+				{1, 3000, true, idrFragments[2]},
+			},
+			want: []AccessUnit{{Data: annexB(testSPS, testPPS, idr), Timestamp: 3000, IDR: true}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			depacketizer := NewH264Depacketizer(tt.sps, tt.pps)
+			var got []AccessUnit
+			for _, p := range tt.packets {
+				units, err := depacketizer.Push(&rtp.Packet{
+					Header:  rtp.Header{SequenceNumber: p.seq, Timestamp: p.timestamp, Marker: p.marker},
+					Payload: p.payload,
+				})
+				if err != nil && !errors.Is(err, errPacketLoss) {
+					t.Fatalf("Push: %v", err)
+				}
+				got = append(got, units...)
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d access units, want %d", len(got), len(tt.want))
+			}
+			for i := range tt.want {
+				if got[i].IDR != tt.want[i].IDR || got[i].Timestamp != tt.want[i].Timestamp || !bytes.Equal(got[i].Data, tt.want[i].Data) {
+					t.Errorf("access unit %d = {IDR %v, ts %d, %x}, want {IDR %v, ts %d, %x}",
+						i, got[i].IDR, got[i].Timestamp, got[i].Data, tt.want[i].IDR, tt.want[i].Timestamp, tt.want[i].Data)
+				}
+			}
+			if lost := depacketizer.LostFrames(); lost != tt.wantLost {
+				t.Errorf("LostFrames() = %d, want %d", lost, tt.wantLost)
+			}
+		})
+	}
+}
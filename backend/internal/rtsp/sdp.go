@@ -0,0 +1,203 @@
+package rtsp
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// VideoMedia describes the camera's H.264 video stream, as announced in the DESCRIBE response
+type VideoMedia struct {
+	Control        string  // URL to SETUP the stream with (resolved against Content-Base)
+	PayloadType    uint8   // Dynamic RTP payload type the camera uses for H.264
+	ClockRate      uint32  // RTP timestamp clock, 90000 for video
+	ProfileLevelID string  // fmtp profile-level-id, e.g. "42e01f"
+	SPS            []byte  // Sequence parameter set from sprop-parameter-sets (may be nil)
+	PPS            []byte  // Picture parameter set from sprop-parameter-sets (may be nil)
+	FrameRate      float64 // a=framerate, 0 when the camera doesn't announce it
+	HasAudio       bool    // The session also has an audio stream (not pulled by this client)
+}
+
+// parseSDP finds the first H.264 video stream in a session description
+// It is a deliberately forgiving line parser: camera SDP is often not quite to spec
+func parseSDP(body string, baseURL string) (*VideoMedia, error) {
+	var (
+		media          *VideoMedia
+		inMedia        bool // Past the session section
+		inVideo        bool
+		sessionControl string
+		codec          string
+		hasAudio       bool
+	)
+
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if len(line) < 2 || line[1] != '=' {
+			continue
+		}
+		value := line[2:]
+
+		if line[0] == 'm' {
+			inMedia = true
+			if strings.HasPrefix(value, "audio ") {
+				hasAudio = true
+			}
+			// Only the first video section is used
+			inVideo = media == nil && strings.HasPrefix(value, "video ")
+			if inVideo {
+				media = &VideoMedia{ClockRate: 90000}
+				fields := strings.Fields(value)
+				if len(fields) >= 4 {
+					if pt, err := strconv.Atoi(fields[3]); err == nil {
+						media.PayloadType = uint8(pt)
+					}
+				}
+			}
+			continue
+		}
+
+		if line[0] != 'a' {
+			continue
+		}
+		name, attr, _ := strings.Cut(value, ":")
+
+		if !inVideo {
+			// Attributes before the first media section belong to the session
+			if name == "control" && !inMedia {
+				sessionControl = attr
+			}
+			continue
+		}
+
+		switch name {
+		case "control":
+			media.Control = attr
+		case "rtpmap":
+			// a=rtpmap:96 H264/90000
+			pt, encoding, _ := strings.Cut(attr, " ")
+			if p, err := strconv.Atoi(pt); err == nil && uint8(p) == media.PayloadType {
+				parts := strings.Split(encoding, "/")
+				codec = strings.ToUpper(parts[0])
+				if len(parts) > 1 {
+					if rate, err := strconv.ParseUint(parts[1], 10, 32); err == nil {
+						media.ClockRate = uint32(rate)
+					}
+				}
+			}
+		case "fmtp":
+			// a=fmtp:96 packetization-mode=1;profile-level-id=42e01f;sprop-parameter-sets=Z0IAH...,aM4...
+			_, params, _ := strings.Cut(attr, " ")
+			for _, param := range strings.Split(params, ";") {
+				key, val, _ := strings.Cut(strings.TrimSpace(param), "=")
+				switch strings.ToLower(key) {
+				case "profile-level-id":
+					media.ProfileLevelID = strings.ToLower(val)
+				case "sprop-parameter-sets":
+					media.parseParameterSets(val)
+				}
+			}
+		case "framerate":
+			if fps, err := strconv.ParseFloat(strings.TrimSpace(attr), 64); err == nil {
+				media.FrameRate = fps
+			}
+		}
+	}
+
+	if media == nil {
+		return nil, fmt.Errorf("no video stream in SDP")
+	}
+	if codec != "H264" {
+		if codec == "" {
+			codec = "unknown"
+		}
+		return nil, fmt.Errorf("video codec is %s, only H264 can be pulled without FFmpeg", codec)
+	}
+	media.HasAudio = hasAudio
+
+	media.Control = resolveControl(baseURL, sessionControl, media.Control)
+	return media, nil
+}
+
+// parseParameterSets decodes the base64 SPS and PPS from sprop-parameter-sets
+func (m *VideoMedia) parseParameterSets(value string) {
+	for _, encoded := range strings.Split(value, ",") {
+		nalu, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1F {
+		case naluTypeSPS:
+			m.SPS = nalu
+		case naluTypePPS:
+			m.PPS = nalu
+		}
+	}
+}
+
+// BrowserCompatible reports whether browsers can decode the stream as is: H.264 in the
+// Baseline or Constrained Baseline profile (the profile WebRTC mandates)
+func (m *VideoMedia) BrowserCompatible() bool {
+	profile, constraints, ok := m.profile()
+	if !ok {
+		return false
+	}
+	switch profile {
+	case 66: // Baseline (Constrained Baseline when constraint_set1 is set)
+		return true
+	case 77: // Main with constraint_set0 is Constrained Baseline
+		return constraints&0x80 != 0
+	case 88: // Extended with constraint_set0 and constraint_set1 is Constrained Baseline
+		return constraints&0xC0 == 0xC0
+	}
+	return false
+}
+
+// profile returns profile_idc and the constraint flags from profile-level-id, falling back to the SPS
+func (m *VideoMedia) profile() (byte, byte, bool) {
+	if id, err := hex.DecodeString(m.ProfileLevelID); err == nil && len(id) == 3 {
+		return id[0], id[1], true
+	}
+	if len(m.SPS) >= 3 {
+		return m.SPS[1], m.SPS[2], true
+	}
+	return 0, 0, false
+}
+
+func (m *VideoMedia) String() string {
+	description := "H264"
+	if profile, _, ok := m.profile(); ok {
+		description += fmt.Sprintf(" (profile_idc %d", profile)
+		if m.BrowserCompatible() {
+			description += ", browser-compatible"
+		}
+		description += ")"
+	}
+	if m.FrameRate > 0 {
+		description += fmt.Sprintf(" @ %.2f fps", m.FrameRate)
+	}
+	if m.HasAudio {
+		description += " with audio"
+	}
+	return description
+}
+
+// resolveControl turns a media's a=control into an absolute URL, the way most servers expect:
+// absolute URLs are used as is, anything else is appended to the base URL
+func resolveControl(baseURL, sessionControl, control string) string {
+	base := baseURL
+	if strings.Contains(sessionControl, "://") {
+		base = sessionControl
+	}
+	switch {
+	case control == "" || control == "*":
+		return base
+	case strings.Contains(control, "://"):
+		return control
+	case strings.HasSuffix(base, "/"):
+		return base + control
+	default:
+		return base + "/" + control
+	}
+}
@@ -1,42 +1,79 @@
 package signaling
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"webrtc-streaming/internal/auth"
 	"webrtc-streaming/internal/config"
+	"webrtc-streaming/internal/protocol"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
+// DefaultRoom is used when a client connects without a room query parameter
+// and doesn't name a stream in its join message
+const DefaultRoom = "default"
+
+// maxRoomNameLength bounds the room names accepted from the query string
+const maxRoomNameLength = 64
+
 type SignalingServer struct {
-	clients    map[*Client]bool
-	broadcast  chan Message
+	rooms      map[string]*Room    // Active rooms by name, created on demand and removed when empty
+	lobby      map[*Client]bool    // Connected clients that haven't joined a stream yet
+	sessions   map[string]*session // Client identities by resume token
+	broadcast  chan []byte
 	register   chan *Client
 	unregister chan *Client
 	mu         sync.RWMutex
 	config     *config.Config
+
+	whipSessions map[string]*whipSession // Streams published over WHIP, by session (resource) ID
+
+	draining    bool           // Shutdown has begun: new connections and WHIP sessions are turned away
+	retryAfter  time.Duration  // When Shutdown told clients to come back
+	connections sync.WaitGroup // Running writePumps, so Shutdown can wait for the goodbyes to go out
 }
 
-type Client struct {
-	conn     *websocket.Conn
-	server   *SignalingServer
-	send     chan []byte
-	clientID string
+// Room groups the clients (one publisher and its viewers) that signal for the same stream
+type Room struct {
+	name      string
+	clients   map[*Client]bool
+	publisher *Client // The stream's publisher, nil while it is offline
+	// A publisher whose connection dropped may resume within the grace period. Until then its
+	// viewers aren't told it went offline, so their peer connections (which don't go through
+	// us) survive the blip.
+	awaitedPublisher string      // Client ID of the publisher expected back
+	offlineTimer     *time.Timer // Sends publisher_offline when the grace period runs out
+}
+
+// session ties a client identity to a resume token so a reconnecting client can get its old ID back
+type session struct {
+	clientID       string
+	client         *Client   // Live connection holding this identity, nil while disconnected
+	disconnectedAt time.Time // When the last connection went away (zero while connected)
 }
 
-type Message struct {
-	Type      string      `json:"type"`
-	ClientID  string      `json:"clientId,omitempty"`
-	Payload   interface{} `json:"payload,omitempty"`
-	Offer     interface{} `json:"offer,omitempty"`
-	Answer    interface{} `json:"answer,omitempty"`
-	Candidate interface{} `json:"candidate,omitempty"`
+type Client struct {
+	conn        *websocket.Conn
+	server      *SignalingServer
+	send        chan []byte
+	clientID    string
+	room        string       // Stream (room) name - the ?room= default until the client joins
+	role        string       // protocol.RolePublisher or protocol.RoleViewer once joined, empty while in the lobby
+	resumeToken string       // Token the client can present on reconnect to keep its clientID
+	resumed     bool         // True if this connection reclaimed an earlier identity
+	claims      *auth.Claims // Role/stream the client's token grants (nil when auth is disabled)
+	leaving     bool         // The client closed its WebSocket on purpose, it won't resume
 }
 
 var upgrader = websocket.Upgrader{
@@ -78,98 +115,585 @@ var upgrader = websocket.Upgrader{
 
 func NewSignalingServer() *SignalingServer {
 	return &SignalingServer{
-		clients:    make(map[*Client]bool),
-		broadcast:  make(chan Message),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		config:     config.AppConfig,
+		rooms:        make(map[string]*Room),
+		lobby:        make(map[*Client]bool),
+		sessions:     make(map[string]*session),
+		whipSessions: make(map[string]*whipSession),
+		broadcast:    make(chan []byte),
+		register:     make(chan *Client),
+		unregister:   make(chan *Client),
+		config:       config.AppConfig,
 	}
 }
 
 func (s *SignalingServer) Run() {
+	// Periodically forget identities whose grace period has passed
+	sessionTicker := time.NewTicker(s.resumeGracePeriod())
+	defer sessionTicker.Stop()
+
 	for {
 		select {
 		case client := <-s.register:
 			s.mu.Lock()
-			// Check if there are existing clients before adding this one
-			hasExistingClients := len(s.clients) > 0
-			s.clients[client] = true
-			clientCount := len(s.clients)
-			existingClientIDs := make([]string, 0, len(s.clients))
-			for c := range s.clients {
-				existingClientIDs = append(existingClientIDs, c.clientID)
-			}
-			s.mu.Unlock()
-			log.Printf("Client connected: %s (total clients: %d, existing: %v)", client.clientID, clientCount, existingClientIDs)
-
-			// Notify existing clients (likely publisher) about the new viewer
-			if hasExistingClients {
-				notifyMsg := map[string]interface{}{
-					"type":     "viewer_connected",
-					"clientId": client.clientID,
+			// A resumed identity may still be held by a connection the server hasn't noticed is dead yet.
+			// The new connection wins - drop the stale one so the ID stays unique.
+			if client.resumed {
+				for other := range s.lobby {
+					if other != client && other.clientID == client.clientID {
+						log.Printf("🔁 Client %s resumed on a new connection, dropping the stale one", client.clientID)
+						s.removeClientLocked(other)
+					}
 				}
-				notifyBytes, _ := json.Marshal(notifyMsg)
-				log.Printf("Broadcasting viewer_connected message for %s to %d existing client(s)", client.clientID, len(s.clients)-1)
-				s.mu.RLock()
-				notifiedCount := 0
-				for otherClient := range s.clients {
-					if otherClient != client {
-						select {
-						case otherClient.send <- notifyBytes:
-							log.Printf("✅ Notified client %s about new viewer %s", otherClient.clientID, client.clientID)
-							notifiedCount++
-						default:
-							log.Printf("⚠️ Warning: Could not notify client %s (channel full), closing connection", otherClient.clientID)
-							// Channel is full, client might be stuck - close it to force cleanup
-							close(otherClient.send)
-							delete(s.clients, otherClient)
+				for _, otherRoom := range s.rooms {
+					for other := range otherRoom.clients {
+						if other != client && other.clientID == client.clientID {
+							log.Printf("🔁 Client %s resumed on a new connection, dropping the stale one", client.clientID)
+							s.removeClientLocked(other)
 						}
 					}
 				}
-				s.mu.RUnlock()
-				log.Printf("Sent viewer_connected notification to %d client(s)", notifiedCount)
-			} else {
-				log.Printf("No existing clients, new client %s will wait for publisher/viewer to connect", client.clientID)
 			}
+			if sess, ok := s.sessions[client.resumeToken]; ok {
+				sess.client = client
+				sess.disconnectedAt = time.Time{}
+			}
+
+			// New clients wait in the lobby until they send a join message declaring their role
+			s.lobby[client] = true
+			if s.draining {
+				// Shutdown began while the connection was being set up
+				s.removeClientLocked(client)
+			}
+			lobbyCount := len(s.lobby)
+			s.mu.Unlock()
+			log.Printf("Client connected: %s (resumed: %v, waiting to join, clients in lobby: %d)", client.clientID, client.resumed, lobbyCount)
 
 		case client := <-s.unregister:
 			s.mu.Lock()
-			if _, ok := s.clients[client]; ok {
-				delete(s.clients, client)
-				close(client.send)
-				log.Printf("Client disconnected: %s", client.clientID)
+			if s.removeClientLocked(client) {
+				log.Printf("Client disconnected: %s (room: %s, role: %s)", client.clientID, client.room, client.role)
+			}
+			// Start the grace period - unless a newer connection already took the identity over
+			if sess, ok := s.sessions[client.resumeToken]; ok && sess.client == client {
+				sess.client = nil
+				sess.disconnectedAt = time.Now()
 			}
 			s.mu.Unlock()
 
+		case <-sessionTicker.C:
+			s.expireSessions()
+
 		// Broadcast channel is no longer needed, but kept for compatibility
 		case <-s.broadcast:
 		}
 	}
 }
 
+// sendToRoom delivers a message to the other side of the sender's stream: a viewer's
+// message goes to the publisher, a publisher's message goes to every viewer.
+// Clients whose send buffer is full are considered stuck and are dropped.
+// Returns the number of clients the message was delivered to.
+func (s *SignalingServer) sendToRoom(sender *Client, message []byte) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room, exists := s.rooms[sender.room]
+	if !exists {
+		return 0
+	}
+
+	delivered := 0
+	for client := range room.clients {
+		if client == sender || client.role == sender.role {
+			continue
+		}
+		select {
+		case client.send <- message:
+			delivered++
+		default:
+			log.Printf("⚠️ Warning: Could not deliver to client %s (channel full), closing connection", client.clientID)
+			// Channel is full, client might be stuck - close it to force cleanup
+			s.removeClientLocked(client)
+		}
+	}
+	return delivered
+}
+
+// Reasons sendToClient can fail
+var (
+	errTargetNotFound = errors.New("target not connected")
+	errTargetSameRole = errors.New("target has the sender's role")
+)
+
+// relayedFrom names the only role that may send each relayed message type. Candidates go both
+// ways; everything else has a direction, so a viewer can't pose as the publisher to another viewer.
+var relayedFrom = map[string]string{
+	protocol.TypeOffer:       protocol.RolePublisher,
+	protocol.TypeLayers:      protocol.RolePublisher,
+	protocol.TypeAnswer:      protocol.RoleViewer,
+	protocol.TypeSelectLayer: protocol.RoleViewer,
+}
+
+// sendToClient delivers a message to a single client in the sender's room. Like sendToRoom it
+// only crosses between publisher and viewers: a target with the sender's role is refused
+// (errTargetSameRole). errTargetNotFound means no client with that ID is in the room (or it
+// had to be dropped).
+func (s *SignalingServer) sendToClient(sender *Client, targetID string, message []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room, exists := s.rooms[sender.room]
+	if !exists {
+		return errTargetNotFound
+	}
+
+	for client := range room.clients {
+		if client.clientID != targetID {
+			continue
+		}
+		if client.role == sender.role {
+			return errTargetSameRole
+		}
+		select {
+		case client.send <- message:
+			return nil
+		default:
+			log.Printf("⚠️ Warning: Could not deliver to client %s (channel full), closing connection", client.clientID)
+			s.removeClientLocked(client)
+			return errTargetNotFound
+		}
+	}
+	return errTargetNotFound
+}
+
+// sendError sends a structured error frame back to a single client
+func (c *Client) sendError(code, message, targetID string) {
+	errorBytes, err := json.Marshal(protocol.NewError(code, message, targetID))
+	if err != nil {
+		log.Printf("Error marshaling error message: %v", err)
+		return
+	}
+
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	if !c.server.isConnectedLocked(c) {
+		return
+	}
+	c.server.notifyLocked(c, errorBytes)
+}
+
+// isConnectedLocked reports whether the client is still registered (in the lobby or a room).
+// Caller must hold s.mu.
+func (s *SignalingServer) isConnectedLocked(client *Client) bool {
+	if s.lobby[client] {
+		return true
+	}
+	room, exists := s.rooms[client.room]
+	return exists && room.clients[client]
+}
+
+// notifyLocked queues a server event for a client without blocking. Unlike relayed
+// messages, a full buffer doesn't drop the client here - the relay path will.
+// Caller must hold s.mu.
+func (s *SignalingServer) notifyLocked(client *Client, message []byte) {
+	select {
+	case client.send <- message:
+	default:
+		log.Printf("⚠️ Warning: Could not notify client %s (channel full)", client.clientID)
+	}
+}
+
+// handleJoin moves a client from the lobby into the room for its stream with the declared role.
+// The publisher learns about viewers (viewer_connected) and viewers about the publisher
+// (publisher_online); a stream can only have one publisher at a time.
+// The role was already checked by protocol.Decode.
+func (s *SignalingServer) handleJoin(c *Client, join *protocol.Join) {
+	role, stream := join.Role, join.Stream
+	if stream == "" {
+		stream = c.room
+	}
+	if !isValidRoomName(stream) {
+		c.sendError(protocol.ErrorCodeInvalidJoin, fmt.Sprintf("invalid stream name %q", stream), "")
+		return
+	}
+	// The token decides what the client may join - a viewer token can't publish and vice versa
+	if c.claims != nil && !c.claims.Allows(role, stream) {
+		log.Printf("⚠️ Client %s denied joining stream %s as %s (token grants %s on %s)", c.clientID, stream, role, c.claims.Role, c.claims.Stream)
+		c.sendError(protocol.ErrorCodeForbidden, fmt.Sprintf("token does not allow joining stream %s as %s", stream, role), "")
+		return
+	}
+
+	s.mu.Lock()
+	if !s.lobby[c] {
+		s.mu.Unlock()
+		c.sendError(protocol.ErrorCodeAlreadyJoined, fmt.Sprintf("already joined stream %s as %s", c.room, c.role), "")
+		return
+	}
+
+	room, exists := s.rooms[stream]
+	if role == protocol.RolePublisher && exists && room.publisher != nil && room.publisher.clientID != c.clientID {
+		publisherID := room.publisher.clientID
+		s.mu.Unlock()
+		log.Printf("⚠️ Client %s tried to publish stream %s, which already has publisher %s", c.clientID, stream, publisherID)
+		c.sendError(protocol.ErrorCodeStreamHasPublisher, fmt.Sprintf("stream %s already has a publisher", stream), "")
+		return
+	}
+	if !exists {
+		room = &Room{
+			name:    stream,
+			clients: make(map[*Client]bool),
+		}
+		s.rooms[stream] = room
+		log.Printf("🏠 Created room: %s (total rooms: %d)", room.name, len(s.rooms))
+	}
+
+	delete(s.lobby, c)
+	c.room = stream
+	c.role = role
+	room.clients[c] = true
+
+	joined := protocol.Joined{
+		Header:   protocol.NewHeader(protocol.TypeJoined),
+		ClientID: c.clientID,
+		Role:     role,
+		Stream:   stream,
+	}
+
+	// Collect the events for the other side of the stream; the joiner's ack is queued first
+	var notifyTargets []*Client
+	var notifyMsg protocol.PeerEvent
+	if role == protocol.RolePublisher {
+		if awaited := room.awaitedPublisher; awaited != "" {
+			room.offlineTimer.Stop()
+			room.awaitedPublisher = ""
+			if awaited == c.clientID {
+				log.Printf("🔁 Publisher %s is back on stream %s, viewers keep their connections", c.clientID, stream)
+			} else {
+				// Someone else took over - the viewers' connections to the old publisher are dead
+				s.notifyPublisherOfflineLocked(room, awaited)
+			}
+		}
+		room.publisher = c
+		for client := range room.clients {
+			if client.role == protocol.RoleViewer {
+				joined.Viewers = append(joined.Viewers, client.clientID)
+				notifyTargets = append(notifyTargets, client)
+			}
+		}
+		notifyMsg = protocol.PeerEvent{
+			Header:   protocol.NewHeader(protocol.TypePublisherOnline),
+			ClientID: c.clientID,
+			Stream:   stream,
+		}
+	} else {
+		if room.publisher != nil {
+			joined.PublisherID = room.publisher.clientID
+			notifyTargets = append(notifyTargets, room.publisher)
+		}
+		notifyMsg = protocol.PeerEvent{
+			Header:   protocol.NewHeader(protocol.TypeViewerConnected),
+			ClientID: c.clientID,
+		}
+	}
+
+	if joinedBytes, err := json.Marshal(joined); err == nil {
+		s.notifyLocked(c, joinedBytes)
+	}
+	notifyBytes, _ := json.Marshal(notifyMsg)
+	for _, target := range notifyTargets {
+		s.notifyLocked(target, notifyBytes)
+	}
+	clientCount := len(room.clients)
+	s.mu.Unlock()
+
+	log.Printf("✅ Client %s joined stream %s as %s (clients in room: %d, notified: %d)", c.clientID, stream, role, clientCount, len(notifyTargets))
+}
+
+// removeClientLocked removes a client from the lobby or its room and closes its send channel.
+// The other side of the stream is told (viewer_disconnected / publisher_offline) and the
+// room is torn down once it is empty. Caller must hold s.mu.
+// Returns false if the client was already removed.
+func (s *SignalingServer) removeClientLocked(client *Client) bool {
+	if s.lobby[client] {
+		delete(s.lobby, client)
+		close(client.send)
+		return true
+	}
+
+	room, exists := s.rooms[client.room]
+	if !exists {
+		return false
+	}
+	if _, ok := room.clients[client]; !ok {
+		return false
+	}
+
+	delete(room.clients, client)
+	close(client.send)
+
+	if room.publisher == client {
+		room.publisher = nil
+		if client.resumeToken != "" && !client.leaving {
+			s.awaitPublisherLocked(room, client.clientID)
+		} else {
+			s.notifyPublisherOfflineLocked(room, client.clientID)
+		}
+	} else if client.role == protocol.RoleViewer && room.publisher != nil {
+		disconnectedBytes, _ := json.Marshal(protocol.PeerEvent{
+			Header:   protocol.NewHeader(protocol.TypeViewerDisconnected),
+			ClientID: client.clientID,
+		})
+		s.notifyLocked(room.publisher, disconnectedBytes)
+	}
+
+	if len(room.clients) == 0 {
+		delete(s.rooms, room.name)
+		log.Printf("🏚️ Room %s is empty, removed (total rooms: %d)", room.name, len(s.rooms))
+	}
+	return true
+}
+
+// awaitPublisherLocked gives a publisher whose connection dropped the resume grace period to
+// come back before its viewers are told it went offline. Caller must hold s.mu.
+func (s *SignalingServer) awaitPublisherLocked(room *Room, publisherID string) {
+	gracePeriod := s.resumeGracePeriod()
+	log.Printf("⏳ Publisher %s of stream %s dropped, waiting up to %v for it to resume", publisherID, room.name, gracePeriod)
+	room.awaitedPublisher = publisherID
+	room.offlineTimer = time.AfterFunc(gracePeriod, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.rooms[room.name] != room || room.awaitedPublisher != publisherID {
+			return
+		}
+		room.awaitedPublisher = ""
+		log.Printf("Publisher %s of stream %s did not come back", publisherID, room.name)
+		s.notifyPublisherOfflineLocked(room, publisherID)
+	})
+}
+
+// notifyPublisherOfflineLocked tells a room's viewers that its publisher is gone.
+// Caller must hold s.mu.
+func (s *SignalingServer) notifyPublisherOfflineLocked(room *Room, publisherID string) {
+	offlineBytes, _ := json.Marshal(protocol.PeerEvent{
+		Header:   protocol.NewHeader(protocol.TypePublisherOffline),
+		ClientID: publisherID,
+		Stream:   room.name,
+	})
+	for viewer := range room.clients {
+		s.notifyLocked(viewer, offlineBytes)
+	}
+}
+
+// resumeGracePeriod returns how long a disconnected client's identity is kept
+func (s *SignalingServer) resumeGracePeriod() time.Duration {
+	if s.config == nil || s.config.SignalingServer.ResumeGracePeriod <= 0 {
+		return 30 * time.Second
+	}
+	return s.config.SignalingServer.ResumeGracePeriod
+}
+
+// expireSessions forgets disconnected identities whose grace period has passed
+func (s *SignalingServer) expireSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	gracePeriod := s.resumeGracePeriod()
+	for token, sess := range s.sessions {
+		if sess.client == nil && time.Since(sess.disconnectedAt) > gracePeriod {
+			delete(s.sessions, token)
+			log.Printf("Session for client %s expired (not resumed within %v)", sess.clientID, gracePeriod)
+		}
+	}
+}
+
+// resolveIdentityLocked returns the client ID and resume token for a new connection.
+// A valid resume token presented within the grace period yields the old ID.
+// Otherwise a fresh UUID-based identity is issued. Caller must hold s.mu.
+func (s *SignalingServer) resolveIdentityLocked(resumeToken string) (clientID, token string, resumed bool) {
+	if resumeToken != "" {
+		if sess, ok := s.sessions[resumeToken]; ok {
+			if sess.client != nil || time.Since(sess.disconnectedAt) <= s.resumeGracePeriod() {
+				return sess.clientID, resumeToken, true
+			}
+			log.Printf("Resume token for client %s rejected (grace period expired)", sess.clientID)
+		}
+	}
+
+	clientID = uuid.NewString()
+	token = uuid.NewString()
+	s.sessions[token] = &session{
+		clientID: clientID,
+	}
+	return clientID, token, false
+}
+
+// Shutdown drains the server before the process exits. New connections and WHIP sessions are
+// turned away, WHIP sessions are closed, and every client is sent server_shutdown with a hint
+// of when to come back before it is disconnected. It returns once the goodbyes have gone out,
+// or when ctx is done.
+func (s *SignalingServer) Shutdown(ctx context.Context, retryAfter time.Duration) error {
+	shutdownBytes, _ := json.Marshal(protocol.ServerShutdown{
+		Header:       protocol.NewHeader(protocol.TypeServerShutdown),
+		Reason:       "server is shutting down",
+		RetryAfterMs: retryAfter.Milliseconds(),
+	})
+
+	s.mu.Lock()
+	s.draining = true
+	s.retryAfter = retryAfter
+	clients := make([]*Client, 0, len(s.lobby))
+	for client := range s.lobby {
+		clients = append(clients, client)
+	}
+	for _, room := range s.rooms {
+		// Everyone is going, so nobody needs to hear that the publisher left
+		room.publisher = nil
+		room.awaitedPublisher = ""
+		if room.offlineTimer != nil {
+			room.offlineTimer.Stop()
+		}
+		for client := range room.clients {
+			clients = append(clients, client)
+		}
+	}
+	// server_shutdown is the last message on each send channel; writePump sends it, then the
+	// close frame once the channel is closed
+	for _, client := range clients {
+		s.notifyLocked(client, shutdownBytes)
+		s.removeClientLocked(client)
+	}
+	sessions := make([]*whipSession, 0, len(s.whipSessions))
+	for _, session := range s.whipSessions {
+		sessions = append(sessions, session)
+	}
+	s.mu.Unlock()
+	log.Printf("👋 Sent server_shutdown to %d client(s) (retry after %v)", len(clients), retryAfter)
+
+	// WHIP encoders have no signaling connection to warn - their peer connections just close
+	for _, session := range sessions {
+		session.close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.connections.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// refuseWhileDraining answers 503 (with a Retry-After) once Shutdown has begun, so clients
+// reconnect to another instance or to this one after the restart
+func (s *SignalingServer) refuseWhileDraining(w http.ResponseWriter) bool {
+	s.mu.RLock()
+	draining, retryAfter := s.draining, s.retryAfter
+	s.mu.RUnlock()
+	if !draining {
+		return false
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Round(time.Second).Seconds())))
+	http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+	return true
+}
+
+// isValidRoomName reports whether a room name is safe to use as a map key and in logs
+func isValidRoomName(name string) bool {
+	if name == "" || len(name) > maxRoomNameLength {
+		return false
+	}
+	for _, ch := range name {
+		isLetter := (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+		isDigit := ch >= '0' && ch <= '9'
+		if !isLetter && !isDigit && ch != '-' && ch != '_' && ch != '.' {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *SignalingServer) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if s.refuseWhileDraining(w) {
+		return
+	}
+
+	// Resolve the room before upgrading so invalid names get a plain HTTP error
+	roomName := r.URL.Query().Get("room")
+	if roomName == "" {
+		roomName = DefaultRoom
+	}
+	if !isValidRoomName(roomName) {
+		log.Printf("WebSocket connection rejected - invalid room name '%s'", roomName)
+		http.Error(w, "invalid room name", http.StatusBadRequest)
+		return
+	}
+
+	// Authenticate before upgrading so rejected clients get a plain HTTP 401
+	var claims *auth.Claims
+	if s.config.Auth.Required {
+		var err error
+		claims, err = auth.ParseToken([]byte(s.config.Auth.Secret), auth.TokenFromRequest(r))
+		if err != nil {
+			log.Printf("WebSocket connection rejected - authentication failed: %v", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="signaling"`)
+			http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade error: %v", err)
 		return
 	}
 
-	// Get client count atomically to ensure unique IDs
+	// Issue a collision-free identity, or hand back the old one if the client presented a valid resume token
 	s.mu.Lock()
-	clientCount := len(s.clients)
-	clientID := fmt.Sprintf("client-%d", clientCount+1)
+	clientCount := len(s.lobby)
+	for _, room := range s.rooms {
+		clientCount += len(room.clients)
+	}
+	if s.draining {
+		// Shutdown began while we were upgrading
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	clientID, resumeToken, resumed := s.resolveIdentityLocked(r.URL.Query().Get("resumeToken"))
+	s.connections.Add(1) // For the writePump started below
 	s.mu.Unlock()
-	
+
 	client := &Client{
-		conn:     conn,
-		server:   s,
-		send:     make(chan []byte, 256),
-		clientID: clientID,
+		conn:        conn,
+		server:      s,
+		send:        make(chan []byte, 256),
+		clientID:    clientID,
+		room:        roomName,
+		resumeToken: resumeToken,
+		resumed:     resumed,
+		claims:      claims,
 	}
 
-	log.Printf("Creating new client: %s (before registration, total clients: %d)", clientID, clientCount)
+	log.Printf("Creating new client: %s in room %s (resumed: %v, before registration, total clients: %d)", clientID, roomName, resumed, clientCount)
 
-	// Register client (notification will be sent in Run() goroutine after registration)
+	// Tell the client who it is before anything else is queued on its send channel
+	welcomeBytes, err := json.Marshal(protocol.Welcome{
+		Header:      protocol.NewHeader(protocol.TypeWelcome),
+		ClientID:    clientID,
+		ResumeToken: resumeToken,
+		Room:        roomName,
+		Resumed:     resumed,
+	})
+	if err == nil {
+		client.send <- welcomeBytes
+	}
+
+	// Register client - it waits in the lobby until it sends a join message
 	client.server.register <- client
 
 	go client.writePump()
@@ -198,6 +722,11 @@ func (c *Client) readPump() {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseNoStatusReceived) {
 				log.Printf("WebSocket read error: %v", err)
 			}
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				c.server.mu.Lock()
+				c.leaving = true
+				c.server.mu.Unlock()
+			}
 			// Break out of loop on any read error - the defer will handle cleanup
 			break
 		}
@@ -205,50 +734,98 @@ func (c *Client) readPump() {
 		// Reset read deadline on successful read
 		c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 
-		// Parse as generic map first to preserve structure
-		var rawMsg map[string]interface{}
-		if err := json.Unmarshal(messageBytes, &rawMsg); err != nil {
-			log.Printf("Error unmarshaling message: %v", err)
+		// Decode into a typed message - malformed, unknown or invalid frames are answered
+		// with an error instead of being relayed to the other side of the stream
+		msg, err := protocol.Decode(messageBytes)
+		if err != nil {
+			var decodeErr *protocol.DecodeError
+			if errors.As(err, &decodeErr) {
+				log.Printf("⚠️ Rejected message from client %s: %v", c.clientID, decodeErr)
+				c.sendError(decodeErr.Code, decodeErr.Reason, "")
+			}
 			continue
 		}
 
-		// Add sender's client ID as "fromClientId" to preserve target "clientId" if present
-		// If clientId is not already in the message (from sender), add it as the sender's ID
-		if _, exists := rawMsg["clientId"]; !exists {
-			rawMsg["clientId"] = c.clientID
-		}
-		// Always include sender ID for routing
-		rawMsg["fromClientId"] = c.clientID
+		c.handleMessage(msg)
+	}
+}
 
-		// Convert back to JSON and create Message
-		messageBytes, err = json.Marshal(rawMsg)
-		if err != nil {
-			log.Printf("Error marshaling message: %v", err)
-			continue
-		}
+// handleMessage acts on a decoded message from the client: a join is handled by the server,
+// offers, answers, candidates and layer messages are relayed to the other side of the stream
+func (c *Client) handleMessage(msg protocol.Message) {
+	// The join handshake is handled by the server itself
+	if join, ok := msg.(*protocol.Join); ok {
+		c.server.handleJoin(c, join)
+		return
+	}
 
-		// Broadcast to all other clients
-		c.server.mu.RLock()
-		for client := range c.server.clients {
-			if client != c { // Don't send to sender
-				select {
-				case client.send <- messageBytes:
-				default:
-					close(client.send)
-					delete(c.server.clients, client)
-				}
-			}
-		}
-		c.server.mu.RUnlock()
+	// Only messages between publisher and viewers are relayed (offers, answers, candidates,
+	// layer info and selection) - everything else is server-to-client only
+	relayed, ok := msg.(protocol.Relayed)
+	if !ok {
+		log.Printf("⚠️ Client %s sent %q, which clients may not send", c.clientID, msg.MessageType())
+		c.sendError(protocol.ErrorCodeUnknownType, fmt.Sprintf("message type %q is not accepted from clients", msg.MessageType()), "")
+		return
+	}
+
+	// Relaying needs a role and a stream
+	c.server.mu.RLock()
+	role := c.role
+	c.server.mu.RUnlock()
+	if role == "" {
+		log.Printf("⚠️ Client %s sent %q before joining a stream", c.clientID, msg.MessageType())
+		c.sendError(protocol.ErrorCodeNotJoined, "send a join message with a role and stream first", "")
+		return
+	}
+	if from, ok := relayedFrom[msg.MessageType()]; ok && from != role {
+		log.Printf("⚠️ Client %s (%s) sent %q, which only a %s may send", c.clientID, role, msg.MessageType(), from)
+		c.sendError(protocol.ErrorCodeForbidden, fmt.Sprintf("a %s may not send %q", role, msg.MessageType()), "")
+		return
+	}
 
-		// Note: viewer_connected notification is now sent in HandleWebSocket when client registers
-		// This ensures publisher is notified immediately when viewer connects, not waiting for a message
+	// Resolve the target: an explicit targetClientId wins, otherwise a clientId that
+	// names another client (how the publisher addresses offers to a viewer)
+	route := relayed.Route()
+	targetID := route.TargetClientID
+	if targetID == "" && route.ClientID != "" && route.ClientID != c.clientID {
+		targetID = route.ClientID
+	}
+
+	// Add sender's client ID as "fromClientId" to preserve target "clientId" if present
+	// If clientId is not already in the message (from sender), add it as the sender's ID
+	if route.ClientID == "" {
+		route.ClientID = c.clientID
+	}
+	// Always include sender ID for routing
+	route.FromClientID = c.clientID
+
+	// Relay the message re-encoded from its typed form, so only known fields reach the receiver
+	messageBytes, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Error marshaling message: %v", err)
+		return
+	}
+
+	// Directed messages go to their target only; everything else goes to the
+	// other clients in the sender's room
+	if targetID != "" {
+		switch err := c.server.sendToClient(c, targetID, messageBytes); err {
+		case errTargetSameRole:
+			log.Printf("⚠️ Client %s (%s) addressed %q to client %s with the same role", c.clientID, role, msg.MessageType(), targetID)
+			c.sendError(protocol.ErrorCodeForbidden, fmt.Sprintf("client %s is not on the other side of the stream", targetID), targetID)
+		case errTargetNotFound:
+			log.Printf("⚠️ Target client %s not found in room %s (from %s)", targetID, c.room, c.clientID)
+			c.sendError(protocol.ErrorCodeTargetNotFound, fmt.Sprintf("client %s is not connected", targetID), targetID)
+		}
+	} else {
+		c.server.sendToRoom(c, messageBytes)
 	}
 }
 
 func (c *Client) writePump() {
 	ticker := time.NewTicker(54 * time.Second)
 	closeSent := false
+	defer c.server.connections.Done()
 	defer func() {
 		ticker.Stop()
 		// Send close message before closing connection (only if not already sent)
@@ -0,0 +1,128 @@
+package signaling
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"webrtc-streaming/internal/config"
+	"webrtc-streaming/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// testClient is a signaling client that has joined a stream
+type testClient struct {
+	t    *testing.T
+	conn *websocket.Conn
+	id   string
+}
+
+func newTestServer(t *testing.T) string {
+	t.Helper()
+	config.AppConfig = &config.Config{}
+	server := NewSignalingServer()
+	go server.Run()
+	httpServer := httptest.NewServer(http.HandlerFunc(server.HandleWebSocket))
+	t.Cleanup(httpServer.Close)
+	return "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/ws?room=cam"
+}
+
+func joinStream(t *testing.T, url, role string) *testClient {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := &testClient{t: t, conn: conn}
+	welcome := c.expect(protocol.TypeWelcome)
+	c.id = welcome["clientId"].(string)
+	c.send(map[string]interface{}{"type": protocol.TypeJoin, "role": role})
+	c.expect(protocol.TypeJoined)
+	return c
+}
+
+func (c *testClient) send(message map[string]interface{}) {
+	c.t.Helper()
+	message["version"] = protocol.Version
+	if err := c.conn.WriteJSON(message); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+}
+
+// expect reads messages until one of the given type arrives, skipping peer events
+func (c *testClient) expect(messageType string) map[string]interface{} {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var message map[string]interface{}
+		if err := c.conn.ReadJSON(&message); err != nil {
+			c.t.Fatalf("waiting for %s: %v", messageType, err)
+		}
+		if message["type"] == messageType {
+			return message
+		}
+	}
+}
+
+// next returns the next message that isn't a peer event
+func (c *testClient) next() map[string]interface{} {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var message map[string]interface{}
+		if err := c.conn.ReadJSON(&message); err != nil {
+			c.t.Fatalf("read: %v", err)
+		}
+		switch message["type"] {
+		case protocol.TypeViewerConnected, protocol.TypePublisherOnline:
+			continue
+		}
+		return message
+	}
+}
+
+func TestRelayDirection(t *testing.T) {
+	url := newTestServer(t)
+	publisher := joinStream(t, url, protocol.RolePublisher)
+	victim := joinStream(t, url, protocol.RoleViewer)
+	attacker := joinStream(t, url, protocol.RoleViewer)
+
+	sdp := func(sdpType string) map[string]interface{} {
+		return map[string]interface{}{"type": sdpType, "sdp": "v=0\r\n"}
+	}
+	tests := []struct {
+		name    string
+		from    *testClient
+		message map[string]interface{}
+		code    string
+	}{
+		{"viewer offer to viewer", attacker, map[string]interface{}{"type": "offer", "targetClientId": victim.id, "offer": sdp("offer")}, protocol.ErrorCodeForbidden},
+		{"viewer candidate to viewer", attacker, map[string]interface{}{"type": "candidate", "targetClientId": victim.id, "candidate": map[string]interface{}{"candidate": ""}}, protocol.ErrorCodeForbidden},
+		{"viewer layers", attacker, map[string]interface{}{"type": "layers", "layers": []map[string]interface{}{{"name": "720p"}}, "current": "720p"}, protocol.ErrorCodeForbidden},
+		{"publisher answer", publisher, map[string]interface{}{"type": "answer", "targetClientId": victim.id, "answer": sdp("answer")}, protocol.ErrorCodeForbidden},
+		{"publisher select_layer", publisher, map[string]interface{}{"type": "select_layer", "targetClientId": victim.id, "layer": "auto"}, protocol.ErrorCodeForbidden},
+		{"unknown target", attacker, map[string]interface{}{"type": "answer", "targetClientId": "nobody", "answer": sdp("answer")}, protocol.ErrorCodeTargetNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.from.send(tt.message)
+			if code := tt.from.expect(protocol.TypeError)["code"]; code != tt.code {
+				t.Errorf("error code = %v, want %s", code, tt.code)
+			}
+		})
+	}
+
+	// The publisher's offers still reach the viewer (and nothing from the other viewer got
+	// there first), and the viewer's answer reaches the publisher
+	publisher.send(map[string]interface{}{"type": "offer", "targetClientId": victim.id, "offer": sdp("offer")})
+	if message := victim.next(); message["type"] != protocol.TypeOffer || message["fromClientId"] != publisher.id {
+		t.Errorf("viewer got %v from %v, want the publisher's offer", message["type"], message["fromClientId"])
+	}
+	victim.send(map[string]interface{}{"type": "answer", "targetClientId": publisher.id, "answer": sdp("answer")})
+	publisher.expect(protocol.TypeAnswer)
+}
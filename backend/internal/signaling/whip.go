@@ -0,0 +1,567 @@
+package signaling
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"webrtc-streaming/internal/auth"
+	iceutils "webrtc-streaming/internal/ice"
+	"webrtc-streaming/internal/protocol"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// maxSDPSize bounds the SDP offers accepted over HTTP
+const maxSDPSize = 64 * 1024
+
+// whipTrackWait is how long a WHIP session waits for the rest of the negotiated tracks after
+// the first one arrived before viewers are offered what is there (an encoder may negotiate
+// audio and never send any)
+const whipTrackWait = 2 * time.Second
+
+// whipGatherTimeout bounds how long a WHIP answer waits for our ICE candidates
+const whipGatherTimeout = 10 * time.Second
+
+// whipConnectTimeout is how long an encoder has to connect after its offer was answered. A
+// session that never connects would otherwise hold the stream's publisher slot for good.
+const whipConnectTimeout = 30 * time.Second
+
+// whipSession is a stream published over WHIP (RFC 9725) instead of by cmd/publisher.
+// The encoder's peer connection ends here, and the session joins the stream's room as its
+// publisher: waiting viewers get offers exactly as cmd/publisher would send them, and every
+// viewer's peer connection is fed the RTP the encoder sends.
+type whipSession struct {
+	id           string
+	stream       string
+	token        string // Token the session was started with (AUTH_REQUIRED); only it can end the session
+	server       *SignalingServer
+	client       *Client                // The session's identity in the room; its send channel carries viewer events
+	pc           *webrtc.PeerConnection // Connection to the encoder
+	webrtcConfig webrtc.Configuration
+	mu           sync.Mutex
+	tracks       []*webrtc.TrackLocalStaticRTP // Local copies of the encoder's tracks, shared by all viewers
+	videoSSRC    webrtc.SSRC                   // Encoder's video stream, for keyframe requests
+	expected     int                           // Tracks negotiated in the encoder's offer
+	ready        bool                          // All tracks arrived (or whipTrackWait passed) - viewers can be offered
+	waiting      []string                      // Viewers that joined before the session was ready
+	viewers      map[string]*webrtc.PeerConnection
+	lastKeyframe time.Time // When the encoder was last asked for a keyframe
+	connected    bool      // The encoder's connection came up at least once
+	closeOnce    sync.Once
+}
+
+// HandleWHIP serves the WHIP endpoint: POST /whip/{stream} with an SDP offer starts
+// publishing the stream, DELETE on the returned Location ends it. With AUTH_REQUIRED every
+// request needs a token that allows publishing the stream, and a session only takes requests
+// made with the token that started it.
+func (s *SignalingServer) HandleWHIP(w http.ResponseWriter, r *http.Request) {
+	allowCORS(w, r, "POST, DELETE, OPTIONS")
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/whip/"), "/")
+	stream := parts[0]
+	if !isValidRoomName(stream) || len(parts) > 2 {
+		http.Error(w, "invalid stream name", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		if s.refuseWhileDraining(w) {
+			return
+		}
+		s.startWHIPSession(w, r, stream)
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		session, ok := s.authorizeWHIPSession(w, r, stream, parts[1])
+		if !ok {
+			return
+		}
+		log.Printf("📴 [%s] WHIP session %s ended by the encoder", stream, session.id)
+		session.close()
+		w.WriteHeader(http.StatusOK)
+	case len(parts) == 2 && r.Method == http.MethodPatch:
+		if _, ok := s.authorizeWHIPSession(w, r, stream, parts[1]); !ok {
+			return
+		}
+		// Trickle ICE isn't supported: the answer already carries all of our candidates
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "trickle ICE is not supported", http.StatusMethodNotAllowed)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// authorizeWHIP checks that a WHIP request may publish the stream (with AUTH_REQUIRED: a valid
+// token with the publisher role on it) and writes the error response when it may not
+func (s *SignalingServer) authorizeWHIP(w http.ResponseWriter, r *http.Request, stream string) bool {
+	if !s.config.Auth.Required {
+		return true
+	}
+	claims, err := auth.ParseToken([]byte(s.config.Auth.Secret), auth.TokenFromRequest(r))
+	if err != nil {
+		log.Printf("WHIP request for stream %s rejected - authentication failed: %v", stream, err)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="whip"`)
+		http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return false
+	}
+	if !claims.Allows(protocol.RolePublisher, stream) {
+		log.Printf("⚠️ WHIP request for stream %s denied (token grants %s on %s)", stream, claims.Role, claims.Stream)
+		http.Error(w, fmt.Sprintf("token does not allow publishing stream %s", stream), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// authorizeWHIPSession looks up the session a request addresses and checks the request may
+// change it: it passes authorizeWHIP and carries the token that started the session. Any other
+// caller gets the same 404 as for an unknown session, so session IDs can't be probed.
+func (s *SignalingServer) authorizeWHIPSession(w http.ResponseWriter, r *http.Request, stream, id string) (*whipSession, bool) {
+	if !s.authorizeWHIP(w, r, stream) {
+		return nil, false
+	}
+	s.mu.RLock()
+	session, exists := s.whipSessions[id]
+	s.mu.RUnlock()
+	if !exists || session.stream != stream ||
+		subtle.ConstantTimeCompare([]byte(session.token), []byte(auth.TokenFromRequest(r))) != 1 {
+		http.Error(w, "unknown WHIP session", http.StatusNotFound)
+		return nil, false
+	}
+	return session, true
+}
+
+// startWHIPSession answers an encoder's offer and puts the session into the stream's room
+func (s *SignalingServer) startWHIPSession(w http.ResponseWriter, r *http.Request, stream string) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/sdp") {
+		http.Error(w, "expected an application/sdp offer", http.StatusUnsupportedMediaType)
+		return
+	}
+	if !s.authorizeWHIP(w, r, stream) {
+		return
+	}
+	offer, err := io.ReadAll(io.LimitReader(r.Body, maxSDPSize))
+	if err != nil {
+		http.Error(w, "failed to read offer", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.RLock()
+	room, exists := s.rooms[stream]
+	hasPublisher := exists && room.publisher != nil
+	s.mu.RUnlock()
+	if hasPublisher {
+		http.Error(w, fmt.Sprintf("stream %s already has a publisher", stream), http.StatusConflict)
+		return
+	}
+
+	session, answer, err := s.newWHIPSession(r.Context(), stream, string(offer))
+	if err == nil && s.config.Auth.Required {
+		session.token = auth.TokenFromRequest(r)
+	}
+	if err != nil {
+		log.Printf("❌ [%s] WHIP offer rejected: %v", stream, err)
+		status := http.StatusBadRequest
+		if errors.Is(err, context.DeadlineExceeded) {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if !s.joinWHIPSession(session) {
+		session.close()
+		http.Error(w, fmt.Sprintf("stream %s already has a publisher", stream), http.StatusConflict)
+		return
+	}
+
+	time.AfterFunc(whipConnectTimeout, session.closeUnlessConnected)
+
+	log.Printf("📡 [%s] WHIP session %s started, publishing as %s", stream, session.id, session.client.clientID)
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whip/"+stream+"/"+session.id)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer)
+}
+
+// newWHIPSession creates the encoder's peer connection and returns the complete SDP answer.
+// Gathering our candidates gives up after whipGatherTimeout or when ctx (the POST) ends.
+func (s *SignalingServer) newWHIPSession(ctx context.Context, stream, offer string) (*whipSession, string, error) {
+	session := &whipSession{
+		id:           uuid.NewString(),
+		stream:       stream,
+		server:       s,
+		webrtcConfig: iceutils.GetWebRTCConfiguration(),
+		viewers:      make(map[string]*webrtc.PeerConnection),
+	}
+	session.client = &Client{
+		server:   s,
+		send:     make(chan []byte, 256),
+		clientID: uuid.NewString(),
+		room:     stream,
+	}
+
+	pc, err := webrtc.NewPeerConnection(session.webrtcConfig)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create peer connection: %w", err)
+	}
+	session.pc = pc
+	pc.OnTrack(session.forwardTrack)
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Printf("📡 [%s] WHIP encoder connection: %s", stream, state)
+		if state == webrtc.PeerConnectionStateConnected {
+			session.mu.Lock()
+			session.connected = true
+			session.mu.Unlock()
+		}
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			session.close()
+		}
+	})
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		pc.Close()
+		return nil, "", fmt.Errorf("invalid offer: %w", err)
+	}
+	session.expected = len(pc.GetTransceivers())
+	if session.expected == 0 {
+		pc.Close()
+		return nil, "", errors.New("the offer has no audio or video")
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		pc.Close()
+		return nil, "", fmt.Errorf("failed to create answer: %w", err)
+	}
+	// WHIP answers carry every candidate - wait for gathering instead of trickling
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		pc.Close()
+		return nil, "", fmt.Errorf("failed to set local description: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, whipGatherTimeout)
+	defer cancel()
+	select {
+	case <-gathered:
+	case <-ctx.Done():
+		pc.Close()
+		return nil, "", fmt.Errorf("ICE gathering did not finish: %w", ctx.Err())
+	}
+
+	return session, pc.LocalDescription().SDP, nil
+}
+
+// joinWHIPSession puts the session into its stream's room as the publisher. It returns false
+// when another publisher got there first.
+func (s *SignalingServer) joinWHIPSession(session *whipSession) bool {
+	c := session.client
+	s.mu.Lock()
+	s.lobby[c] = true
+	s.whipSessions[session.id] = session
+	s.mu.Unlock()
+
+	// Events for the session (joined, viewer_connected, answers...) queue up on its send
+	// channel like they would for a WebSocket client
+	go session.readEvents()
+	s.handleJoin(c, &protocol.Join{
+		Header: protocol.NewHeader(protocol.TypeJoin),
+		Role:   protocol.RolePublisher,
+		Stream: session.stream,
+	})
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return c.role == protocol.RolePublisher
+}
+
+// readEvents handles the signaling messages addressed to the session until it leaves the room
+func (ws *whipSession) readEvents() {
+	defer ws.close()
+
+	for message := range ws.client.send {
+		msg, err := protocol.Decode(message)
+		if err != nil {
+			log.Printf("⚠️ [%s] WHIP session ignoring invalid message: %v", ws.stream, err)
+			continue
+		}
+
+		switch m := msg.(type) {
+		case *protocol.Joined:
+			for _, viewerID := range m.Viewers {
+				ws.addViewer(viewerID)
+			}
+		case *protocol.PeerEvent:
+			switch m.Type {
+			case protocol.TypeViewerConnected:
+				ws.addViewer(m.ClientID)
+			case protocol.TypeViewerDisconnected:
+				ws.removeViewer(m.ClientID)
+			}
+		case *protocol.Answer:
+			if pc := ws.viewer(m.Sender()); pc != nil {
+				answer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: m.Answer.SDP}
+				if err := pc.SetRemoteDescription(answer); err != nil {
+					log.Printf("❌ [%s] Error setting answer from viewer %s: %v", ws.stream, m.Sender(), err)
+				}
+			}
+		case *protocol.Candidate:
+			if pc := ws.viewer(m.Sender()); pc != nil {
+				if err := pc.AddICECandidate(webrtc.ICECandidateInit{
+					Candidate:        m.Candidate.Candidate,
+					SDPMid:           m.Candidate.SDPMid,
+					SDPMLineIndex:    m.Candidate.SDPMLineIndex,
+					UsernameFragment: m.Candidate.UsernameFragment,
+				}); err != nil {
+					log.Printf("❌ [%s] Error adding ICE candidate from viewer %s: %v", ws.stream, m.Sender(), err)
+				}
+			}
+		case *protocol.Error:
+			if m.Code == protocol.ErrorCodeTargetNotFound && m.TargetClientID != "" {
+				ws.removeViewer(m.TargetClientID)
+			} else if m.Code == protocol.ErrorCodeStreamHasPublisher {
+				log.Printf("❌ [%s] Another publisher is already serving the stream", ws.stream)
+			}
+		}
+	}
+}
+
+// forwardTrack copies one of the encoder's tracks into a local track every viewer is sent
+func (ws *whipSession) forwardTrack(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	local, err := webrtc.NewTrackLocalStaticRTP(remote.Codec().RTPCodecCapability, remote.Kind().String(), ws.stream)
+	if err != nil {
+		log.Printf("❌ [%s] Failed to create %s track: %v", ws.stream, remote.Kind(), err)
+		return
+	}
+	log.Printf("🎬 [%s] WHIP %s track: %s", ws.stream, remote.Kind(), remote.Codec().MimeType)
+
+	ws.mu.Lock()
+	ws.tracks = append(ws.tracks, local)
+	if remote.Kind() == webrtc.RTPCodecTypeVideo {
+		ws.videoSSRC = remote.SSRC()
+	}
+	complete := len(ws.tracks) >= ws.expected
+	first := len(ws.tracks) == 1
+	ws.mu.Unlock()
+	if complete {
+		ws.markReady()
+	} else if first {
+		time.AfterFunc(whipTrackWait, ws.markReady)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := remote.Read(buf)
+		if err != nil {
+			return
+		}
+		// Viewers that went away are skipped by the track itself
+		if _, err := local.Write(buf[:n]); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			log.Printf("⚠️ [%s] Error forwarding %s: %v", ws.stream, remote.Kind(), err)
+		}
+	}
+}
+
+// markReady offers the tracks to the viewers that have been waiting for them
+func (ws *whipSession) markReady() {
+	ws.mu.Lock()
+	if ws.ready {
+		ws.mu.Unlock()
+		return
+	}
+	ws.ready = true
+	waiting := ws.waiting
+	ws.waiting = nil
+	ws.mu.Unlock()
+
+	for _, viewerID := range waiting {
+		ws.addViewer(viewerID)
+	}
+}
+
+// addViewer creates a peer connection for a viewer and sends it an offer through the room
+func (ws *whipSession) addViewer(viewerID string) {
+	ws.mu.Lock()
+	if !ws.ready {
+		ws.waiting = append(ws.waiting, viewerID)
+		ws.mu.Unlock()
+		log.Printf("[%s] Viewer %s waits for the WHIP encoder's tracks", ws.stream, viewerID)
+		return
+	}
+	tracks := ws.tracks
+	old := ws.viewers[viewerID]
+	delete(ws.viewers, viewerID)
+	ws.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+
+	pc, err := webrtc.NewPeerConnection(ws.webrtcConfig)
+	if err != nil {
+		log.Printf("❌ [%s] Failed to create peer connection for viewer %s: %v", ws.stream, viewerID, err)
+		return
+	}
+	for _, track := range tracks {
+		sender, err := pc.AddTrack(track)
+		if err != nil {
+			log.Printf("❌ [%s] Failed to add %s track for viewer %s: %v", ws.stream, track.Kind(), viewerID, err)
+			pc.Close()
+			return
+		}
+		go ws.readViewerRTCP(sender, viewerID)
+	}
+
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+		init := candidate.ToJSON()
+		ws.client.handleMessage(&protocol.Candidate{
+			Header:  protocol.NewHeader(protocol.TypeCandidate),
+			Routing: protocol.Routing{ClientID: viewerID, TargetClientID: viewerID},
+			Candidate: &protocol.ICECandidate{
+				Candidate:     init.Candidate,
+				SDPMid:        init.SDPMid,
+				SDPMLineIndex: init.SDPMLineIndex,
+			},
+		})
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Printf("[%s] WHIP viewer %s: %s", ws.stream, viewerID, state)
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			// Start the viewer with a picture instead of waiting for the encoder's next keyframe
+			ws.requestKeyframe()
+		case webrtc.PeerConnectionStateFailed:
+			ws.removeViewer(viewerID)
+		}
+	})
+
+	offer, err := pc.CreateOffer(nil)
+	if err == nil {
+		err = pc.SetLocalDescription(offer)
+	}
+	if err != nil {
+		log.Printf("❌ [%s] Failed to create offer for viewer %s: %v", ws.stream, viewerID, err)
+		pc.Close()
+		return
+	}
+
+	ws.mu.Lock()
+	ws.viewers[viewerID] = pc
+	ws.mu.Unlock()
+
+	ws.client.handleMessage(&protocol.Offer{
+		Header:  protocol.NewHeader(protocol.TypeOffer),
+		Routing: protocol.Routing{ClientID: viewerID, TargetClientID: viewerID},
+		Offer:   &protocol.SessionDescription{Type: offer.Type.String(), SDP: offer.SDP},
+	})
+	log.Printf("✅ [%s] Sent WHIP stream offer to viewer %s", ws.stream, viewerID)
+}
+
+func (ws *whipSession) viewer(viewerID string) *webrtc.PeerConnection {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.viewers[viewerID]
+}
+
+func (ws *whipSession) removeViewer(viewerID string) {
+	ws.mu.Lock()
+	pc := ws.viewers[viewerID]
+	delete(ws.viewers, viewerID)
+	ws.mu.Unlock()
+	if pc != nil {
+		pc.Close()
+		log.Printf("[%s] Removed WHIP viewer %s", ws.stream, viewerID)
+	}
+}
+
+// readViewerRTCP passes a viewer's keyframe requests (PLI/FIR) on to the encoder
+func (ws *whipSession) readViewerRTCP(sender *webrtc.RTPSender, viewerID string) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				ws.requestKeyframe()
+			}
+		}
+	}
+}
+
+// requestKeyframe sends the encoder a PLI, at most once per VIDEO_KEYFRAME_MIN_INTERVAL
+// across all viewers (0 passes no requests on)
+func (ws *whipSession) requestKeyframe() {
+	interval := ws.server.config.Video.KeyframeMinInterval
+	ws.mu.Lock()
+	ssrc := ws.videoSSRC
+	if interval <= 0 || ssrc == 0 || time.Since(ws.lastKeyframe) < interval {
+		ws.mu.Unlock()
+		return
+	}
+	ws.lastKeyframe = time.Now()
+	ws.mu.Unlock()
+
+	if err := ws.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(ssrc)}}); err != nil {
+		log.Printf("⚠️ [%s] Failed to ask the WHIP encoder for a keyframe: %v", ws.stream, err)
+	}
+}
+
+// closeUnlessConnected ends a session whose encoder never connected (see whipConnectTimeout)
+func (ws *whipSession) closeUnlessConnected() {
+	ws.mu.Lock()
+	connected := ws.connected
+	ws.mu.Unlock()
+	if !connected {
+		log.Printf("⏱️ [%s] WHIP encoder of session %s never connected, ending it", ws.stream, ws.id)
+		ws.close()
+	}
+}
+
+// close ends the session: the encoder and viewer connections are closed and the room learns
+// that its publisher went offline
+func (ws *whipSession) close() {
+	ws.closeOnce.Do(func() {
+		ws.server.mu.Lock()
+		delete(ws.server.whipSessions, ws.id)
+		ws.server.removeClientLocked(ws.client)
+		ws.server.mu.Unlock()
+
+		ws.mu.Lock()
+		viewers := ws.viewers
+		ws.viewers = make(map[string]*webrtc.PeerConnection)
+		ws.mu.Unlock()
+		for _, pc := range viewers {
+			pc.Close()
+		}
+		ws.pc.Close()
+		log.Printf("📴 [%s] WHIP session %s closed", ws.stream, ws.id)
+	})
+}
+
+// allowCORS lets browsers on allowed origins use the HTTP endpoints (WHIP/WHEP) and read the
+// Location of the resource they created
+func allowCORS(w http.ResponseWriter, r *http.Request, methods string) {
+	if r.Header.Get("Origin") == "" || !upgrader.CheckOrigin(r) {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+	w.Header().Set("Access-Control-Allow-Methods", methods)
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+	w.Header().Add("Vary", "Origin")
+}
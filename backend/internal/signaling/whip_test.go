@@ -0,0 +1,144 @@
+package signaling
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"webrtc-streaming/internal/auth"
+	"webrtc-streaming/internal/config"
+	"webrtc-streaming/internal/protocol"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// whipOffer returns the SDP offer of an encoder that sends one video track
+func whipOffer(t *testing.T) string {
+	t.Helper()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("NewPeerConnection: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+		t.Fatalf("AddTransceiverFromKind: %v", err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("CreateOffer: %v", err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatalf("SetLocalDescription: %v", err)
+	}
+	<-gathered
+	return pc.LocalDescription().SDP
+}
+
+func TestWHIPSessionRequiresItsToken(t *testing.T) {
+	secret := []byte("test-secret")
+	config.AppConfig = &config.Config{Auth: config.AuthConfig{Secret: string(secret), Required: true}}
+	server := NewSignalingServer()
+	go server.Run()
+	httpServer := httptest.NewServer(http.HandlerFunc(server.HandleWHIP))
+	t.Cleanup(httpServer.Close)
+
+	token := func(role, stream string) string {
+		t.Helper()
+		token, err := auth.NewToken(secret, role, stream, time.Hour)
+		if err != nil {
+			t.Fatalf("NewToken: %v", err)
+		}
+		return token
+	}
+	request := func(method, path, token, body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, httpServer.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/sdp")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		return res
+	}
+
+	owner := token(protocol.RolePublisher, "cam")
+	res := request(http.MethodPost, "/whip/cam", owner, whipOffer(t))
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("POST status = %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+	location := res.Header.Get("Location")
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		want   int
+	}{
+		{"DELETE without a token", http.MethodDelete, "", http.StatusUnauthorized},
+		{"DELETE with a viewer token", http.MethodDelete, token(protocol.RoleViewer, "cam"), http.StatusForbidden},
+		{"DELETE with a token for another stream", http.MethodDelete, token(protocol.RolePublisher, "garage"), http.StatusForbidden},
+		{"DELETE with another publisher's token", http.MethodDelete, token(protocol.RolePublisher, auth.AnyStream), http.StatusNotFound},
+		{"PATCH without a token", http.MethodPatch, "", http.StatusUnauthorized},
+		{"PATCH with the session's token", http.MethodPatch, owner, http.StatusMethodNotAllowed},
+		{"DELETE with the session's token", http.MethodDelete, owner, http.StatusOK},
+		{"DELETE again", http.MethodDelete, owner, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if res := request(tt.method, location, tt.token, ""); res.StatusCode != tt.want {
+				t.Errorf("%s status = %d, want %d", tt.method, res.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestWHIPSessionThatNeverConnectsFreesTheStream(t *testing.T) {
+	config.AppConfig = &config.Config{}
+	server := NewSignalingServer()
+	go server.Run()
+	httpServer := httptest.NewServer(http.HandlerFunc(server.HandleWHIP))
+	t.Cleanup(httpServer.Close)
+
+	post := func() *http.Response {
+		t.Helper()
+		res, err := http.Post(httpServer.URL+"/whip/cam", "application/sdp", strings.NewReader(whipOffer(t)))
+		if err != nil {
+			t.Fatalf("POST: %v", err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		return res
+	}
+
+	res := post()
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("POST status = %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+	if res := post(); res.StatusCode != http.StatusConflict {
+		t.Fatalf("second POST status = %d, want %d", res.StatusCode, http.StatusConflict)
+	}
+
+	// The encoder never connects: once whipConnectTimeout passes the session is ended
+	location := res.Header.Get("Location")
+	id := location[strings.LastIndex(location, "/")+1:]
+	server.mu.RLock()
+	session := server.whipSessions[id]
+	server.mu.RUnlock()
+	session.closeUnlessConnected()
+
+	if res := post(); res.StatusCode != http.StatusCreated {
+		t.Errorf("POST after the session ended status = %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+}
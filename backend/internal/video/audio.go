@@ -0,0 +1,202 @@
+package video
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/oggreader"
+)
+
+// AudioSource is implemented by video sources that can also deliver the camera's audio as Opus
+type AudioSource interface {
+	HasAudio() bool                   // Whether audio is enabled for this source
+	ReadAudio() (media.Sample, error) // Next Opus packet; io.EOF once the source is closed
+}
+
+// Opus always runs at 48 kHz in RTP and Ogg, whatever the input sample rate
+const opusClockRate = 48000
+
+// How long ffmpeg gets to open its audio output (it connects after probing the input)
+const audioConnectTimeout = 30 * time.Second
+
+// opusReceiver takes the Opus audio an ffmpeg process encodes alongside the video
+// ffmpeg writes Ogg/Opus to a loopback TCP socket (a second output of the same process, so
+// audio and video leave ffmpeg together) and each Ogg page becomes one sample
+type opusReceiver struct {
+	name       string
+	bitrate    int // Opus bitrate in kbps
+	sampleChan chan media.Sample
+	stopChan   chan struct{}
+	mu         sync.Mutex
+	listener   net.Listener
+	conn       net.Conn
+	closed     bool
+}
+
+func newOpusReceiver(name string, bitrateKbps int) *opusReceiver {
+	return &opusReceiver{
+		name:       name,
+		bitrate:    bitrateKbps,
+		sampleChan: make(chan media.Sample, 50), // ~1 second of 20 ms packets
+		stopChan:   make(chan struct{}),
+	}
+}
+
+// listen opens a loopback socket for the next ffmpeg run and returns the ffmpeg output
+// options that send the first audio stream of input 0 there as Opus
+func (o *opusReceiver) listen() ([]string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return nil, fmt.Errorf("%s audio already closed", o.name)
+	}
+
+	// A restarted ffmpeg gets a fresh socket; the previous run's connection is finished
+	if o.listener != nil {
+		o.listener.Close()
+	}
+	if o.conn != nil {
+		o.conn.Close()
+		o.conn = nil
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audio socket: %w", err)
+	}
+	o.listener = listener
+	go o.accept(listener)
+
+	return []string{
+		"-map", "0:a:0",
+		"-c:a", "libopus",
+		"-b:a", strconv.Itoa(o.bitrate) + "k",
+		"-ar", strconv.Itoa(opusClockRate),
+		"-ac", "2",
+		"-application", "lowdelay",
+		"-frame_duration", "20", // 20 ms packets, the WebRTC norm
+		"-page_duration", "20000", // One packet per Ogg page (in microseconds)
+		"-flush_packets", "1",
+		"-f", "ogg",
+		"tcp://" + listener.Addr().String(),
+	}, nil
+}
+
+// accept waits for ffmpeg to connect and reads its Ogg stream until ffmpeg exits
+func (o *opusReceiver) accept(listener net.Listener) {
+	if tcpListener, ok := listener.(*net.TCPListener); ok {
+		tcpListener.SetDeadline(time.Now().Add(audioConnectTimeout))
+	}
+	conn, err := listener.Accept()
+	listener.Close() // ffmpeg connects exactly once
+	if err != nil {
+		if !o.isClosed() {
+			log.Printf("⚠️ %s audio: ffmpeg did not open its audio output: %v", o.name, err)
+		}
+		return
+	}
+
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		conn.Close()
+		return
+	}
+	o.conn = conn
+	o.mu.Unlock()
+
+	o.readPages(conn)
+}
+
+func (o *opusReceiver) readPages(conn net.Conn) {
+	defer conn.Close()
+
+	reader, header, err := oggreader.NewWith(conn)
+	if err != nil {
+		if !o.isClosed() {
+			log.Printf("⚠️ %s audio: no Opus stream from ffmpeg (does the camera have audio?): %v", o.name, err)
+		}
+		return
+	}
+	log.Printf("🔊 %s audio: Opus, %d channel(s), input %d Hz", o.name, header.Channels, header.SampleRate)
+
+	var lastGranule uint64
+	for {
+		page, pageHeader, err := reader.ParseNextPage()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !o.isClosed() {
+				log.Printf("⚠️ %s audio stream ended: %v", o.name, err)
+			}
+			return
+		}
+
+		// The comment header is metadata, not audio
+		if bytes.HasPrefix(page, []byte("OpusTags")) {
+			continue
+		}
+
+		// The granule position counts 48 kHz samples, so the difference is the page duration
+		samples := pageHeader.GranulePosition - lastGranule
+		lastGranule = pageHeader.GranulePosition
+		if len(page) == 0 || samples == 0 {
+			continue
+		}
+
+		sample := media.Sample{
+			Data:     page,
+			Duration: time.Duration(samples) * time.Second / opusClockRate,
+		}
+		select {
+		case o.sampleChan <- sample:
+		default:
+			// Nobody is reading fast enough - drop the oldest packet to keep latency low
+			select {
+			case <-o.sampleChan:
+			default:
+			}
+			o.sampleChan <- sample
+		}
+	}
+}
+
+// ReadAudio blocks until the next Opus packet is available
+func (o *opusReceiver) ReadAudio() (media.Sample, error) {
+	select {
+	case sample := <-o.sampleChan:
+		return sample, nil
+	case <-o.stopChan:
+		return media.Sample{}, io.EOF
+	}
+}
+
+func (o *opusReceiver) isClosed() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.closed
+}
+
+func (o *opusReceiver) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return
+	}
+	o.closed = true
+	close(o.stopChan)
+	if o.listener != nil {
+		o.listener.Close()
+	}
+	if o.conn != nil {
+		o.conn.Close()
+	}
+}
@@ -1,142 +1,387 @@
 package video
 
 import (
+	"errors"
 	"fmt"
+	"log"
+	"strings"
+	"sync"
 	"time"
 
 	"webrtc-streaming/internal/config"
 
-	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4"
 )
 
+// Frame is one encoded video frame with its presentation timestamp
+type Frame struct {
+	Data []byte
+	// Presentation time on the source's clock. Only the differences between frames matter:
+	// the publisher paces frames and derives their RTP timestamps from them.
+	PTS time.Duration
+}
+
+// ErrSourceClosed is returned by the read methods of a source once it was closed
+var ErrSourceClosed = errors.New("video source closed")
+
 // VideoSource represents a video source (camera, file, etc.)
+//
+// ReadFrame blocks until a frame is available, riding out encoder restarts and camera reconnects.
+// It only returns an error when the source has stopped: io.EOF when a finite source (a file
+// played once) has ended, ErrSourceClosed after Close, and any other error when the source
+// failed for good.
 type VideoSource interface {
 	Start() error
-	ReadFrame() ([]byte, error)
+	ReadFrame() (Frame, error)
 	Close() error
-	GetFrameRate() int // Get the actual frame rate of the source
+	GetFrameRate() int   // Get the actual frame rate of the source
+	GetMimeType() string // Codec of the frames ReadFrame returns (webrtc.MimeTypeH264 or webrtc.MimeTypeVP8)
+}
+
+// KeyframeRequester is implemented by sources that can produce a keyframe on demand, for viewers
+// that lost their picture (RTCP PLI/FIR)
+type KeyframeRequester interface {
+	RequestKeyframe() bool // Starts a keyframe soon; false when the source can't force one
+}
+
+// SourceStatus describes a running source, for the publisher's control API
+type SourceStatus struct {
+	Type     string `json:"type"`              // rtsp, rtsp-native, file, v4l2 or testpattern
+	Codec    string `json:"codec"`             // MIME type of the video the source delivers
+	Encoder  string `json:"encoder,omitempty"` // Encoder FFmpeg runs, or "copy" when the camera's H.264 goes out as is
+	FPS      int    `json:"fps"`               // Detected frame rate
+	Restarts int    `json:"restarts"`          // Encoder restarts and camera reconnects since the source started
+}
+
+// StatusReporter is implemented by sources that can describe themselves (see SourceStatus)
+type StatusReporter interface {
+	Status() SourceStatus
 }
 
-// MockVideoSource is a placeholder for actual video capture
-// In production, replace this with actual camera capture using platform-specific libraries
-// (e.g., v4l2 on Linux, AVFoundation on macOS, DirectShow on Windows)
+// Restarter is implemented by sources that can start over on demand: a new camera session or
+// encoder process, as after a failure
+type Restarter interface {
+	Restart() error
+}
+
+// ErrRestartUnsupported is returned by VideoCapturer.Restart for sources without a Restart
+var ErrRestartUnsupported = errors.New("this source can't be restarted")
+
+// LayeredSource is implemented by sources that encode the video several times at different
+// resolutions and bitrates (simulcast layers), so each viewer can get what its connection carries
+type LayeredSource interface {
+	Renditions() []config.RenditionConfig    // Layers, highest first; nil when there is a single encoding
+	ReadLayerFrame(layer int) (Frame, error) // Next frame of a layer above 0 (layer 0 is ReadFrame), blocking like ReadFrame
+}
+
+// MockVideoSource generates a synthetic test pattern and encodes it to VP8
+// Useful as a demo/CI source when no camera or RTSP stream is available
 type MockVideoSource struct {
-	width      int
-	height     int
-	fps        int
-	frameCount int
+	width    int
+	height   int
+	fps      int
+	pattern  *TestPatternGenerator
+	encoder  *VP8Encoder
+	stopChan chan struct{}
+	mu       sync.Mutex
+	closed   bool
 }
 
+// Video source kinds selectable with VIDEO_SOURCE
+const (
+	SourceAuto        = "auto" // RTSP if RTSP_URL is set, then VIDEO_FILE, then the test pattern
+	SourceRTSP        = "rtsp"
+	SourceFile        = "file"
+	SourceV4L2        = "v4l2"
+	SourceTestPattern = "testpattern"
+)
+
 func NewVideoSource() (VideoSource, error) {
-	// Use RTSP if URL is provided
-	if config.AppConfig.Video.RTSPURL != "" {
-		return NewRTSPVideoSource(config.AppConfig.Video.RTSPURL)
+	videoConfig := config.AppConfig.Video
+
+	kind := videoConfig.Source
+	if kind == "" || kind == SourceAuto {
+		switch {
+		case videoConfig.RTSPURL != "":
+			kind = SourceRTSP
+		case videoConfig.File != "":
+			kind = SourceFile
+		default:
+			kind = SourceTestPattern
+		}
+	}
+
+	switch kind {
+	case SourceRTSP:
+		if videoConfig.RTSPURL == "" {
+			return nil, fmt.Errorf("VIDEO_SOURCE=rtsp requires RTSP_URL")
+		}
+		return newRTSPSource(videoConfig.RTSPURL)
+	case SourceFile:
+		if videoConfig.File == "" {
+			return nil, fmt.Errorf("VIDEO_SOURCE=file requires VIDEO_FILE")
+		}
+		return NewFileVideoSource(videoConfig.File, videoConfig.FileLoop, videoConfig.FileStartOffset, videoConfig.FPS)
+	case SourceV4L2:
+		return NewV4L2VideoSource(videoConfig.DeviceIndex, videoConfig.Width, videoConfig.Height, videoConfig.FPS, videoConfig.InputFormat)
+	case SourceTestPattern:
+		return NewMockVideoSource(videoConfig.Width, videoConfig.Height, videoConfig.FPS, videoConfig.TestPattern)
+	default:
+		return nil, fmt.Errorf("unknown VIDEO_SOURCE %q (expected auto, rtsp, file, v4l2 or testpattern)", kind)
+	}
+}
+
+// NewStreamVideoSource creates the source for one named stream of a multi-stream publisher
+// The URL decides the kind: rtsp:// and rtsps:// are cameras, "testpattern" is the synthetic
+// pattern, and anything else is played as a local file
+func NewStreamVideoSource(stream config.StreamConfig) (VideoSource, error) {
+	videoConfig := config.AppConfig.Video
+
+	lowerURL := strings.ToLower(stream.URL)
+	switch {
+	case strings.HasPrefix(lowerURL, "rtsp://"), strings.HasPrefix(lowerURL, "rtsps://"):
+		return newRTSPSource(stream.URL)
+	case lowerURL == SourceTestPattern:
+		return NewMockVideoSource(videoConfig.Width, videoConfig.Height, videoConfig.FPS, videoConfig.TestPattern)
+	default:
+		return NewFileVideoSource(stream.URL, videoConfig.FileLoop, videoConfig.FileStartOffset, videoConfig.FPS)
 	}
+}
 
-	// Otherwise use mock source
+func NewMockVideoSource(width, height, fps int, pattern string) (*MockVideoSource, error) {
+	if fps <= 0 {
+		fps = 30
+	}
+	generator, err := NewTestPatternGenerator(width, height, fps, pattern)
+	if err != nil {
+		return nil, err
+	}
 	return &MockVideoSource{
-		width:  config.AppConfig.Video.Width,
-		height: config.AppConfig.Video.Height,
-		fps:    config.AppConfig.Video.FPS,
+		width:    width,
+		height:   height,
+		fps:      fps,
+		pattern:  generator,
+		encoder:  NewVP8Encoder(width, height, fps, config.AppConfig.Video.Bitrate),
+		stopChan: make(chan struct{}),
 	}, nil
 }
 
 func (m *MockVideoSource) Start() error {
+	if err := m.encoder.Start(); err != nil {
+		return err
+	}
+
+	// Feed raw frames to the encoder at the configured frame rate
+	go m.generateFrames()
 	return nil
 }
 
-func (m *MockVideoSource) ReadFrame() ([]byte, error) {
-	// Generate a simple test pattern
-	// In production, this would read actual video frames from a camera
-	frameSize := m.width * m.height * 3 // RGB
-	frame := make([]byte, frameSize)
-
-	// Simple pattern: alternating colors
-	m.frameCount++
-	for i := 0; i < len(frame); i += 3 {
-		if (m.frameCount/30)%2 == 0 {
-			frame[i] = 255 // R
-			frame[i+1] = 0 // G
-			frame[i+2] = 0 // B
-		} else {
-			frame[i] = 0     // R
-			frame[i+1] = 255 // G
-			frame[i+2] = 0   // B
+// generateFrames renders the test pattern at the source frame rate and hands it to the encoder
+func (m *MockVideoSource) generateFrames() {
+	ticker := time.NewTicker(time.Second / time.Duration(m.fps))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stopChan:
+			return
+		case <-ticker.C:
+			if err := m.encoder.WriteFrame(m.pattern.NextFrame(time.Now())); err != nil {
+				if !m.isClosed() {
+					log.Printf("❌ Test pattern stopped: %v", err)
+				}
+				return
+			}
 		}
 	}
+}
 
-	return frame, nil
+// ReadFrame returns the next encoded VP8 frame, blocking until the encoder delivers it
+func (m *MockVideoSource) ReadFrame() (Frame, error) {
+	select {
+	case frame, ok := <-m.encoder.Frames():
+		if !ok {
+			if m.isClosed() {
+				return Frame{}, ErrSourceClosed
+			}
+			return Frame{}, fmt.Errorf("VP8 encoder stopped")
+		}
+		return frame, nil
+	case err := <-m.encoder.Errors():
+		return Frame{}, err
+	case <-m.stopChan:
+		return Frame{}, ErrSourceClosed
+	}
+}
+
+func (m *MockVideoSource) isClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed
 }
 
 func (m *MockVideoSource) Close() error {
-	return nil
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	close(m.stopChan)
+	m.mu.Unlock()
+
+	return m.encoder.Close()
+}
+
+// RequestKeyframe restarts the VP8 encoder, whose first frame is always a keyframe
+// The pattern keeps rendering in the meantime, so viewers only lose a frame or two.
+func (m *MockVideoSource) RequestKeyframe() bool {
+	if err := m.encoder.Restart(); err != nil {
+		log.Printf("⚠️ Could not restart the VP8 encoder for a keyframe: %v", err)
+		return false
+	}
+	return true
+}
+
+// Restart replaces the VP8 encoder process (the pattern itself has nothing to reconnect)
+func (m *MockVideoSource) Restart() error {
+	log.Printf("🔄 Restarting the VP8 encoder on request")
+	return m.encoder.Restart()
+}
+
+func (m *MockVideoSource) Status() SourceStatus {
+	return SourceStatus{
+		Type:     SourceTestPattern,
+		Codec:    webrtc.MimeTypeVP8,
+		Encoder:  "libvpx",
+		FPS:      m.fps,
+		Restarts: m.encoder.Restarts(),
+	}
 }
 
 func (m *MockVideoSource) GetFrameRate() int {
 	return m.fps
 }
 
+func (m *MockVideoSource) GetMimeType() string {
+	return webrtc.MimeTypeVP8
+}
+
 // VideoCapturer handles video capture and encoding
 type VideoCapturer struct {
-	source    VideoSource
-	frameRate time.Duration
+	source VideoSource
 }
 
-func NewVideoCapturer() (*VideoCapturer, error) {
-	source, err := NewVideoSource()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create video source: %w", err)
-	}
-
+// NewVideoCapturer starts the given source and wraps it for sample capture
+func NewVideoCapturer(source VideoSource) (*VideoCapturer, error) {
 	if err := source.Start(); err != nil {
 		return nil, fmt.Errorf("failed to start video source: %w", err)
 	}
 
-	// Get actual frame rate from source (may differ from config)
-	actualFPS := source.GetFrameRate()
-	if actualFPS <= 0 {
-		actualFPS = config.AppConfig.Video.FPS
-	}
-
 	return &VideoCapturer{
-		source:    source,
-		frameRate: time.Second / time.Duration(actualFPS),
+		source: source,
 	}, nil
 }
 
-func (vc *VideoCapturer) CaptureFrame() (media.Sample, error) {
-	frameData, err := vc.source.ReadFrame()
-	if err != nil {
-		return media.Sample{}, fmt.Errorf("failed to read frame from source: %w", err)
+// CaptureFrame returns the next frame of the source, with the source's timestamp. Like ReadFrame
+// it blocks until there is one; errors wrap io.EOF or ErrSourceClosed when the source stopped.
+func (vc *VideoCapturer) CaptureFrame() (Frame, error) {
+	for {
+		frame, err := vc.source.ReadFrame()
+		if err != nil {
+			return Frame{}, fmt.Errorf("failed to read frame from source: %w", err)
+		}
+
+		// For H264 (from RTSP), frame.Data is already in Annex-B format with access units
+		// For VP8 (mock), frame.Data is one encoded VP8 frame
+		// Either way FramePacketizer handles RTP packetization
+		if len(frame.Data) > 0 {
+			return frame, nil
+		}
 	}
+}
+
+func (vc *VideoCapturer) Close() error {
+	return vc.source.Close()
+}
+
+// GetFrameRate returns the actual frame rate from the video source
+func (vc *VideoCapturer) GetFrameRate() int {
+	return vc.source.GetFrameRate()
+}
 
-	// For H264 (from RTSP), frameData is already in Annex-B format with access units
-	// For VP8 (mock), we would need encoding, but that's not implemented
-	// The data format is correct for H264 - Pion WebRTC will handle RTP packetization
+// GetMimeType returns the codec of the captured samples
+func (vc *VideoCapturer) GetMimeType() string {
+	return vc.source.GetMimeType()
+}
 
-	if len(frameData) == 0 {
-		return media.Sample{}, fmt.Errorf("empty frame data received")
+// RTP returns the source's packet stream when it forwards RTP, or nil when it delivers frames
+func (vc *VideoCapturer) RTP() RTPSource {
+	if source, ok := vc.source.(RTPSource); ok && source.ForwardsRTP() {
+		return source
 	}
+	return nil
+}
 
-	// Update frame rate dynamically if source frame rate changed
-	actualFPS := vc.source.GetFrameRate()
-	if actualFPS > 0 {
-		vc.frameRate = time.Second / time.Duration(actualFPS)
+// RequestKeyframe asks the source for a keyframe. It returns false when the source can't
+// force one (passthrough sources only have the camera's own keyframes). Transcoding FFmpeg
+// sources are not restarted for it - their encoders send a keyframe every second anyway.
+func (vc *VideoCapturer) RequestKeyframe() bool {
+	if source, ok := vc.source.(KeyframeRequester); ok {
+		return source.RequestKeyframe()
 	}
+	return false
+}
 
-	sample := media.Sample{
-		Data:     frameData,
-		Duration: vc.frameRate,
+// Renditions returns the source's simulcast layers, highest first, or nil when it has only one
+func (vc *VideoCapturer) Renditions() []config.RenditionConfig {
+	if source, ok := vc.source.(LayeredSource); ok {
+		return source.Renditions()
 	}
+	return nil
+}
 
-	return sample, nil
+// CaptureLayerFrame returns the next frame of a simulcast layer (layer 0 is CaptureFrame)
+func (vc *VideoCapturer) CaptureLayerFrame(layer int) (Frame, error) {
+	if layer == 0 {
+		return vc.CaptureFrame()
+	}
+	source, ok := vc.source.(LayeredSource)
+	if !ok {
+		return Frame{}, fmt.Errorf("source has no rendition layer %d", layer)
+	}
+	for {
+		frame, err := source.ReadLayerFrame(layer)
+		if err != nil {
+			return Frame{}, fmt.Errorf("failed to read layer %d frame from source: %w", layer, err)
+		}
+		if len(frame.Data) > 0 {
+			return frame, nil
+		}
+	}
 }
 
-func (vc *VideoCapturer) Close() error {
-	return vc.source.Close()
+// Status describes the source. Sources that don't report their own status are described by
+// their codec and frame rate alone.
+func (vc *VideoCapturer) Status() SourceStatus {
+	if reporter, ok := vc.source.(StatusReporter); ok {
+		return reporter.Status()
+	}
+	return SourceStatus{Codec: vc.GetMimeType(), FPS: vc.GetFrameRate()}
 }
 
-// GetFrameRate returns the actual frame rate from the video source
-func (vc *VideoCapturer) GetFrameRate() int {
-	return vc.source.GetFrameRate()
+// Restart starts the source over, or returns ErrRestartUnsupported
+func (vc *VideoCapturer) Restart() error {
+	if source, ok := vc.source.(Restarter); ok {
+		return source.Restart()
+	}
+	return ErrRestartUnsupported
+}
+
+// Audio returns the source's audio stream, or nil when the source has no audio
+func (vc *VideoCapturer) Audio() AudioSource {
+	if audio, ok := vc.source.(AudioSource); ok && audio.HasAudio() {
+		return audio
+	}
+	return nil
 }
@@ -0,0 +1,420 @@
+package video
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/h264reader"
+)
+
+// annexBStartCode prefixes every NAL unit in the access units we hand to the track
+var annexBStartCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+// ffmpegH264Pipeline runs ffmpeg with a source-specific input and reads the H.264 it writes
+// to stdout in MPEG-TS as access units (one per video frame) stamped with their PTS. File and
+// camera sources build on it.
+type ffmpegH264Pipeline struct {
+	name       string   // Source name used in logs
+	inputArgs  []string // Everything up to and including "-i <input>"
+	outputArgs []string // Codec options; the MPEG-TS output flags are appended by Start
+	frameRate  int      // Detected from ffmpeg's stream info (falls back to the configured FPS)
+	cmd        *exec.Cmd
+	frameChan  chan Frame
+	clock      ptsClock      // Stamps frames from their PTS (one timeline across restarts and loops)
+	errChan    chan error    // Wakes ReadFrame when the stream stops
+	err        error         // Why the stream stopped (io.EOF at the end of the input), nil while running
+	done       chan struct{} // Closed when the current ffmpeg process has exited
+	stopped    chan struct{} // Closed by Close, wakes ReadFrame
+	replaced   *exec.Cmd     // Process being stopped by restart; its exit is not an error
+	pending    bool          // The process restart started has not delivered a frame yet
+	restarts   int           // Processes replaced by restart
+	mu         sync.Mutex
+	closed     bool
+}
+
+func newFFmpegH264Pipeline(name string, inputArgs, outputArgs []string, frameRate int) *ffmpegH264Pipeline {
+	return &ffmpegH264Pipeline{
+		name:       name,
+		inputArgs:  inputArgs,
+		outputArgs: outputArgs,
+		frameRate:  frameRate,
+		frameChan:  make(chan Frame, 5),
+		errChan:    make(chan error, 1),
+		stopped:    make(chan struct{}),
+	}
+}
+
+// h264TranscodeArgs returns ffmpeg output options that encode browser-friendly H.264:
+// constrained baseline, no B-frames and a keyframe every second
+func h264TranscodeArgs(fps int) []string {
+	encoder, encoderParams := detectBestEncoder()
+	log.Printf("🎬 Using encoder: %s", encoder)
+
+	args := []string{
+		"-c:v", encoder,
+		"-profile:v", "baseline", // Baseline profile for maximum compatibility
+		"-pix_fmt", "yuv420p",
+		"-bf", "0", // No B-frames (WebRTC requirement for low latency)
+		"-g", strconv.Itoa(fps),
+	}
+	return append(args, encoderParams...)
+}
+
+func (p *ffmpegH264Pipeline) Start() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return fmt.Errorf("%s source already closed", p.name)
+	}
+
+	ffmpegArgs := []string{
+		"-hide_banner",
+		"-copyts", // Keep the input's timestamps - frames are paced and stamped from them
+	}
+	ffmpegArgs = append(ffmpegArgs, p.inputArgs...)
+	ffmpegArgs = append(ffmpegArgs, "-an") // Video only
+	ffmpegArgs = append(ffmpegArgs, p.outputArgs...)
+	ffmpegArgs = append(ffmpegArgs,
+		"-f", "mpegts", // Unlike raw H.264, MPEG-TS carries every frame's PTS
+		"-omit_video_pes_length", "0", // Frames that state their length needn't wait for the next one
+		"-flush_packets", "1", // Flush packets immediately
+		"-", // Output to stdout
+	)
+
+	log.Printf("Running ffmpeg (%s) with args: %v", p.name, ffmpegArgs)
+
+	cmd := exec.Command("ffmpeg", ffmpegArgs...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stdout pipe: %w", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stderr pipe: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+	p.cmd = cmd
+	p.done = make(chan struct{})
+	p.clock.restart() // The new process's PTS start a timeline of their own
+	// Forget why a previous run stopped
+	p.err = nil
+	select {
+	case <-p.errChan:
+	default:
+	}
+
+	go p.logStderr(stderr)
+	go p.readAccessUnits(stdout, cmd, p.done)
+
+	return nil
+}
+
+// logStderr forwards ffmpeg's log and picks up the input frame rate from its stream info
+func (p *ffmpegH264Pipeline) logStderr(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		line := scanner.Text()
+		log.Printf("ffmpeg (%s): %s", p.name, line)
+
+		// Stream info looks like "Stream #0:0: Video: h264 (High), yuv420p, 1920x1080, 25 fps, 25 tbr, ..."
+		if !strings.Contains(line, "Stream #0") || !strings.Contains(line, "Video:") {
+			continue
+		}
+		parts := strings.Fields(line)
+		for i, part := range parts {
+			if strings.TrimSuffix(part, ",") != "fps" || i == 0 {
+				continue
+			}
+			if fps, err := strconv.ParseFloat(parts[i-1], 64); err == nil && fps >= 1 {
+				p.mu.Lock()
+				if p.frameRate != int(fps+0.5) {
+					log.Printf("📊 Detected frame rate from %s: %.2f FPS", p.name, fps)
+					p.frameRate = int(fps + 0.5)
+				}
+				p.mu.Unlock()
+			}
+			break
+		}
+	}
+}
+
+// readAccessUnits demuxes ffmpeg's output into access units and queues them as frames
+func (p *ffmpegH264Pipeline) readAccessUnits(stdout io.Reader, cmd *exec.Cmd, done chan struct{}) {
+	defer close(done)
+
+	err := readTSAccessUnits(stdout, func(accessUnit []byte, pts int64) {
+		p.queueFrame(Frame{Data: accessUnit, PTS: p.clock.stamp(pts)})
+		// The first frame of a restarted process ends the restart
+		p.mu.Lock()
+		if p.pending && p.cmd == cmd {
+			p.pending = false
+		}
+		p.mu.Unlock()
+	})
+	waitErr := cmd.Wait()
+	switch {
+	case p.isReplaced(cmd):
+		// Stopped by restart - the next process takes over
+	case errors.Is(err, io.EOF) && waitErr == nil:
+		p.fail(io.EOF)
+	case waitErr != nil:
+		p.fail(fmt.Errorf("FFmpeg process exited with error: %w", waitErr))
+	default:
+		p.fail(fmt.Errorf("FFmpeg stdout closed: %w", err))
+	}
+}
+
+// readDelimitedAccessUnits reads Annex-B H.264 written with access unit delimiters (FFmpeg's
+// MPEG-TS muxer starts every frame with one) and hands every access unit that holds a picture
+// to emit, without the delimiters.
+// It returns the error that ended the stream (io.EOF when the writer closed it).
+func readDelimitedAccessUnits(stream io.Reader, emit func(accessUnit []byte)) error {
+	reader, err := h264reader.NewReader(stream)
+	if err != nil {
+		return err
+	}
+
+	var accessUnit []byte
+	hasPicture := false
+	for {
+		nal, err := reader.NextNAL()
+		if err != nil {
+			// Flush the last frame before reporting why the stream ended
+			if hasPicture {
+				emit(accessUnit)
+			}
+			return err
+		}
+
+		if nal.UnitType == h264reader.NalUnitTypeAUD {
+			if hasPicture {
+				emit(accessUnit)
+			}
+			accessUnit = nil
+			hasPicture = false
+			continue
+		}
+
+		accessUnit = append(accessUnit, annexBStartCode...)
+		accessUnit = append(accessUnit, nal.Data...)
+		if nal.UnitType == h264reader.NalUnitTypeCodedSliceIdr || nal.UnitType == h264reader.NalUnitTypeCodedSliceNonIdr {
+			hasPicture = true
+		}
+	}
+}
+
+// queueFrame hands a frame to ReadFrame, dropping the oldest queued frame if the consumer is behind
+func (p *ffmpegH264Pipeline) queueFrame(frame Frame) {
+	select {
+	case p.frameChan <- frame:
+	default:
+		select {
+		case <-p.frameChan:
+		default:
+		}
+		p.frameChan <- frame
+	}
+}
+
+// isReplaced reports whether a process was stopped by restart
+func (p *ffmpegH264Pipeline) isReplaced(cmd *exec.Cmd) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.replaced == cmd
+}
+
+// restart stops the running ffmpeg and starts a new one, whose encoder begins with a keyframe
+// Frame timestamps carry on one frame after the old process's last, so the pacer sees no jump. A restart asked for
+// before the new process delivered its first frame is folded into the one in flight.
+func (p *ffmpegH264Pipeline) restart() error {
+	p.mu.Lock()
+	if p.closed || p.cmd == nil {
+		p.mu.Unlock()
+		return fmt.Errorf("%s source is not running", p.name)
+	}
+	if p.pending {
+		p.mu.Unlock()
+		return nil
+	}
+	p.pending = true
+	p.replaced = p.cmd
+	p.restarts++
+	p.mu.Unlock()
+
+	p.stopProcess()
+	if err := p.Start(); err != nil {
+		p.mu.Lock()
+		p.pending = false
+		p.mu.Unlock()
+		// The old process is gone and nothing replaces it - wake ReadFrame with the reason
+		p.fail(fmt.Errorf("failed to restart ffmpeg: %w", err))
+		return err
+	}
+	return nil
+}
+
+// Restart starts ffmpeg over on request. A file plays again from its start offset.
+func (p *ffmpegH264Pipeline) Restart() error {
+	log.Printf("🔄 Restarting the %s source on request", p.name)
+	return p.restart()
+}
+
+// Status reports the encoder from the output arguments and how often ffmpeg was restarted
+func (p *ffmpegH264Pipeline) Status() SourceStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := SourceStatus{
+		Type:     p.name,
+		Codec:    webrtc.MimeTypeH264,
+		FPS:      p.frameRate,
+		Restarts: p.restarts,
+	}
+	for i, arg := range p.outputArgs {
+		if arg == "-c:v" && i+1 < len(p.outputArgs) {
+			status.Encoder = p.outputArgs[i+1]
+		}
+	}
+	return status
+}
+
+// fail records why the stream stopped, unless the source was closed on purpose
+func (p *ffmpegH264Pipeline) fail(reason error) {
+	p.mu.Lock()
+	closed := p.closed
+	if !closed {
+		p.err = reason
+	}
+	p.mu.Unlock()
+	if closed {
+		return
+	}
+
+	if !errors.Is(reason, io.EOF) {
+		log.Printf("❌ %s source: %v", p.name, reason)
+	}
+	select {
+	case p.errChan <- reason:
+	default:
+	}
+}
+
+// ReadFrame returns the next H.264 access unit (Annex-B), blocking until ffmpeg delivers one.
+// It returns io.EOF once ffmpeg has finished its input and all frames were read,
+// ErrSourceClosed after Close, and why ffmpeg failed when it exited with an error.
+func (p *ffmpegH264Pipeline) ReadFrame() (Frame, error) {
+	select {
+	case frame := <-p.frameChan:
+		return frame, nil
+	default:
+	}
+
+	// Queued frames are drained first, then the reason the stream stopped is returned on every call
+	p.mu.Lock()
+	err, closed := p.err, p.closed
+	p.mu.Unlock()
+	if closed {
+		return Frame{}, ErrSourceClosed
+	}
+	if err != nil {
+		return Frame{}, err
+	}
+
+	select {
+	case frame := <-p.frameChan:
+		return frame, nil
+	case err := <-p.errChan:
+		// The last frames may have been queued right before ffmpeg exited (p.err keeps the reason)
+		select {
+		case frame := <-p.frameChan:
+			return frame, nil
+		default:
+		}
+		return Frame{}, err
+	case <-p.stopped:
+		return Frame{}, ErrSourceClosed
+	}
+}
+
+// wait blocks until the current ffmpeg process has exited and its output has been read
+func (p *ffmpegH264Pipeline) wait() {
+	p.mu.Lock()
+	done := p.done
+	p.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// stopProcess kills the current ffmpeg process without closing the pipeline
+func (p *ffmpegH264Pipeline) stopProcess() {
+	p.mu.Lock()
+	cmd := p.cmd
+	p.mu.Unlock()
+	if cmd != nil && cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+	p.wait()
+}
+
+// terminate stops an ffmpeg process for good. SIGTERM lets it shut down properly (an RTSP
+// input sends the camera a TEARDOWN); if it is still running after two seconds it is killed.
+// exited must be closed once the process has been waited for.
+func terminate(cmd *exec.Cmd, exited <-chan struct{}) {
+	if exited == nil || cmd.Process.Signal(syscall.SIGTERM) != nil {
+		// Already gone, or no SIGTERM on this platform
+		cmd.Process.Kill()
+		if exited != nil {
+			<-exited
+		}
+		return
+	}
+
+	select {
+	case <-exited:
+	case <-time.After(2 * time.Second):
+		log.Printf("⚠️ FFmpeg did not exit in time, killing it")
+		cmd.Process.Kill()
+		<-exited
+	}
+}
+
+func (p *ffmpegH264Pipeline) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.stopped)
+	cmd, done := p.cmd, p.done
+	p.mu.Unlock()
+
+	if cmd != nil && cmd.Process != nil {
+		terminate(cmd, done)
+	}
+	return nil
+}
+
+func (p *ffmpegH264Pipeline) GetFrameRate() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.frameRate
+}
+
+func (p *ffmpegH264Pipeline) GetMimeType() string {
+	return webrtc.MimeTypeH264
+}
@@ -0,0 +1,66 @@
+package video
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestFFmpegPipelineReadFrame(t *testing.T) {
+	t.Run("frames queued before the end of the input come first", func(t *testing.T) {
+		p := newFFmpegH264Pipeline("test", nil, nil, 30)
+		p.queueFrame(Frame{Data: testIDR})
+		p.fail(io.EOF)
+
+		if frame, err := p.ReadFrame(); err != nil || len(frame.Data) != len(testIDR) {
+			t.Fatalf("ReadFrame() = %d bytes, %v, want the queued frame", len(frame.Data), err)
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := p.ReadFrame(); !errors.Is(err, io.EOF) {
+				t.Fatalf("ReadFrame() error = %v, want io.EOF", err)
+			}
+		}
+	})
+
+	t.Run("blocks until a frame arrives", func(t *testing.T) {
+		p := newFFmpegH264Pipeline("test", nil, nil, 30)
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			p.queueFrame(Frame{Data: testPFrame})
+		}()
+
+		if _, err := p.ReadFrame(); err != nil {
+			t.Fatalf("ReadFrame() error = %v", err)
+		}
+	})
+
+	t.Run("Close wakes a blocked reader", func(t *testing.T) {
+		p := newFFmpegH264Pipeline("test", nil, nil, 30)
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			p.Close()
+		}()
+
+		if _, err := p.ReadFrame(); !errors.Is(err, ErrSourceClosed) {
+			t.Fatalf("ReadFrame() error = %v, want ErrSourceClosed", err)
+		}
+		if _, err := p.ReadFrame(); !errors.Is(err, ErrSourceClosed) {
+			t.Fatalf("ReadFrame() after Close error = %v, want ErrSourceClosed", err)
+		}
+	})
+
+	t.Run("a restart that can't start ffmpeg ends the stream", func(t *testing.T) {
+		t.Setenv("PATH", t.TempDir()) // No ffmpeg to start
+		p := newFFmpegH264Pipeline("test", nil, nil, 30)
+		p.cmd = exec.Command("ffmpeg") // Stands in for the running process
+
+		if err := p.restart(); err == nil {
+			t.Fatal("restart() succeeded without ffmpeg")
+		}
+		if _, err := p.ReadFrame(); err == nil || errors.Is(err, ErrSourceClosed) {
+			t.Fatalf("ReadFrame() error = %v, want why the restart failed", err)
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package video
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileVideoSource plays a local video file (MP4, MKV, raw Annex-B .h264, ...) at its native pace
+// Playback can start at an offset and loop forever; the video is transcoded to baseline H.264
+type FileVideoSource struct {
+	*ffmpegH264Pipeline
+	path        string
+	loop        bool
+	startOffset time.Duration
+}
+
+func NewFileVideoSource(path string, loop bool, startOffset time.Duration, fps int) (*FileVideoSource, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open video file: %w", err)
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("video file %s is a directory", path)
+	}
+	if startOffset < 0 {
+		return nil, fmt.Errorf("negative start offset %v", startOffset)
+	}
+
+	inputArgs := []string{
+		"-re", // Read at the file's native frame rate instead of as fast as possible
+	}
+	if loop {
+		// Each loop restarts at the beginning of the file (the offset only applies to the first pass)
+		inputArgs = append(inputArgs, "-stream_loop", "-1")
+	}
+	if startOffset > 0 {
+		inputArgs = append(inputArgs, "-ss", strconv.FormatFloat(startOffset.Seconds(), 'f', 3, 64))
+	}
+	if isRawH264File(path) {
+		// Raw Annex-B streams carry no timing - play them at the configured frame rate
+		inputArgs = append(inputArgs, "-f", "h264", "-framerate", strconv.Itoa(fps))
+	}
+	inputArgs = append(inputArgs, "-i", path)
+
+	return &FileVideoSource{
+		ffmpegH264Pipeline: newFFmpegH264Pipeline("file", inputArgs, h264TranscodeArgs(fps), fps),
+		path:               path,
+		loop:               loop,
+		startOffset:        startOffset,
+	}, nil
+}
+
+func (f *FileVideoSource) Start() error {
+	log.Printf("Starting file playback: %s (loop: %v, start offset: %v)", f.path, f.loop, f.startOffset)
+	return f.ffmpegH264Pipeline.Start()
+}
+
+// isRawH264File reports whether a path looks like a raw Annex-B H.264 elementary stream
+func isRawH264File(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".h264", ".264", ".avc":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package video
+
+import (
+	"sync"
+
+	"webrtc-streaming/internal/rtsp"
+
+	"github.com/pion/rtp"
+)
+
+// KeyframeCache keeps the RTP packets of the latest complete H.264 keyframe (SPS/PPS and IDR)
+// from the outgoing stream, so a viewer that joins mid-GOP can be sent a picture straight away
+// instead of P-frames it can't decode
+type KeyframeCache struct {
+	mu         sync.Mutex
+	packets    []*rtp.Packet // Latest complete keyframe
+	pending    []*rtp.Packet // Keyframe being collected
+	pendingTS  uint32
+	lastSeq    uint16
+	lastTS     uint32 // Timestamp of the previous frame, to measure the frame step
+	frameStep  uint32 // Timestamp difference between the last two frames
+	started    bool
+	collecting bool
+}
+
+func NewKeyframeCache() *KeyframeCache {
+	return &KeyframeCache{}
+}
+
+// Add looks at a packet of the outgoing stream and keeps it if it belongs to a keyframe
+// A keyframe only replaces the cached one once all of its packets were seen, in order.
+func (c *KeyframeCache) Add(packet *rtp.Packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.started && packet.Timestamp != c.lastTS {
+		c.frameStep = packet.Timestamp - c.lastTS
+	}
+	c.started = true
+	c.lastTS = packet.Timestamp
+
+	// SPS and IDR slice usually come in separate packets with the same timestamp
+	if rtsp.IsKeyframeStart(packet.Payload) && !(c.collecting && packet.Timestamp == c.pendingTS) {
+		c.collecting = true
+		c.pending = nil
+		c.pendingTS = packet.Timestamp
+		c.lastSeq = packet.SequenceNumber - 1
+	}
+	if !c.collecting {
+		return
+	}
+	if packet.Timestamp != c.pendingTS || packet.SequenceNumber != c.lastSeq+1 {
+		// A lost packet or a keyframe without a marker - wait for the next one
+		c.collecting = false
+		c.pending = nil
+		return
+	}
+
+	c.pending = append(c.pending, packet.Clone())
+	c.lastSeq = packet.SequenceNumber
+	if packet.Marker {
+		c.packets = c.pending
+		c.pending = nil
+		c.collecting = false
+	}
+}
+
+// Before returns copies of the cached keyframe's packets for a new viewer whose live stream would
+// start at next. They are numbered to end right before next and stamped one frame earlier, so
+// the viewer's stream starts with a keyframe; the live frames up to the next keyframe refer to
+// pictures the viewer never got, so the caller holds them back until the next keyframe.
+// It returns nil when no keyframe was cached yet or next starts a keyframe itself.
+func (c *KeyframeCache) Before(next *rtp.Packet) []*rtp.Packet {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.packets) == 0 || rtsp.IsKeyframeStart(next.Payload) {
+		return nil
+	}
+
+	frameStep := c.frameStep
+	if frameStep == 0 || frameStep >= 0x80000000 {
+		frameStep = 3000 // 30 fps at the 90 kHz video clock
+	}
+	seq := next.SequenceNumber - uint16(len(c.packets))
+	packets := make([]*rtp.Packet, len(c.packets))
+	for i, cached := range c.packets {
+		packet := cached.Clone()
+		packet.SequenceNumber = seq + uint16(i)
+		packet.Timestamp = next.Timestamp - frameStep
+		packets[i] = packet
+	}
+	return packets
+}
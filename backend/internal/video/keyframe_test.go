@@ -0,0 +1,112 @@
+package video
+
+import (
+	"bytes"
+	"testing"
+
+	"webrtc-streaming/internal/rtsp"
+
+	"github.com/pion/rtp"
+)
+
+func TestKeyframeCache(t *testing.T) {
+	params := rtsp.ParameterSetsPayload(testSPS, testPPS)
+	otherIDR := []byte{0x65, 0x11, 0x22}
+
+	tests := []struct {
+		name  string
+		added []*rtp.Packet
+		next  *rtp.Packet
+		want  []*rtp.Packet
+	}{
+		{
+			name:  "nothing cached yet",
+			added: []*rtp.Packet{testPacket(1, 0, true, testPFrame)},
+			next:  testPacket(2, 3000, true, testPFrame),
+		},
+		{
+			name: "keyframe renumbered to end right before the next packet",
+			added: []*rtp.Packet{
+				testPacket(10, 1000, false, params),
+				testPacket(11, 1000, true, testIDR),
+				testPacket(12, 4000, true, testPFrame),
+				testPacket(13, 7000, true, testPFrame),
+			},
+			next: testPacket(100, 10000, true, testPFrame),
+			want: []*rtp.Packet{
+				testPacket(98, 7000, false, params),
+				testPacket(99, 7000, true, testIDR),
+			},
+		},
+		{
+			name: "sequence numbers wrap around",
+			added: []*rtp.Packet{
+				testPacket(65535, 1000, false, params),
+				testPacket(0, 1000, true, testIDR),
+				testPacket(1, 4000, true, testPFrame),
+			},
+			next: testPacket(0, 7000, true, testPFrame),
+			want: []*rtp.Packet{
+				testPacket(65534, 4000, false, params),
+				testPacket(65535, 4000, true, testIDR),
+			},
+		},
+		{
+			name: "a keyframe with a lost packet keeps the previous one",
+			added: []*rtp.Packet{
+				testPacket(10, 1000, false, params),
+				testPacket(11, 1000, true, testIDR),
+				testPacket(12, 4000, true, testPFrame),
+				testPacket(13, 7000, false, params),
+				testPacket(15, 7000, true, otherIDR), // 14 lost
+			},
+			next: testPacket(16, 10000, true, testPFrame),
+			want: []*rtp.Packet{
+				testPacket(14, 7000, false, params),
+				testPacket(15, 7000, true, testIDR),
+			},
+		},
+		{
+			name: "a keyframe without its marker is not cached",
+			added: []*rtp.Packet{
+				testPacket(10, 1000, false, params),
+				testPacket(11, 1000, false, testIDR),
+				testPacket(12, 4000, true, testPFrame),
+			},
+			next: testPacket(13, 7000, true, testPFrame),
+		},
+		{
+			name:  "nothing to add when the next packet starts a keyframe",
+			added: []*rtp.Packet{testPacket(10, 1000, true, testIDR)},
+			next:  testPacket(11, 4000, true, testIDR),
+		},
+		{
+			name:  "30 fps is assumed before the frame step is known",
+			added: []*rtp.Packet{testPacket(10, 1000, true, testIDR)},
+			next:  testPacket(11, 9000, true, testPFrame),
+			want:  []*rtp.Packet{testPacket(10, 6000, true, testIDR)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := NewKeyframeCache()
+			for _, packet := range tt.added {
+				cache.Add(packet)
+			}
+			got := cache.Before(tt.next)
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("Before() returned %d packets, want %d", len(got), len(tt.want))
+			}
+			for i, want := range tt.want {
+				if got[i].SequenceNumber != want.SequenceNumber || got[i].Timestamp != want.Timestamp ||
+					got[i].Marker != want.Marker || !bytes.Equal(got[i].Payload, want.Payload) {
+					t.Errorf("packet %d = {seq %d, ts %d, marker %v, %x}, want {seq %d, ts %d, marker %v, %x}",
+						i, got[i].SequenceNumber, got[i].Timestamp, got[i].Marker, got[i].Payload,
+						want.SequenceNumber, want.Timestamp, want.Marker, want.Payload)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package video
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// FFmpeg writes the H.264 it produces for us as MPEG-TS: unlike raw Annex-B it carries every
+// frame's PTS, so frames are paced and stamped on the source's clock rather than on when they
+// happened to come out of the pipe.
+
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+	tsStreamH264 = 0x1b    // PMT stream type of H.264 video
+	tsClockRate  = 90000   // PTS count 90 kHz ticks...
+	tsPTSWrap    = 1 << 33 // ...in 33 bits, so they wrap around after about 26.5 hours
+	// A PTS further than this from the last frame's starts a new timeline
+	ptsMaxJump = 3 * time.Second
+)
+
+// defaultFrameInterval separates a new timeline from the last frame before any interval was seen
+const defaultFrameInterval = time.Second / 30
+
+// readTSAccessUnits reads the first H.264 stream of an MPEG-TS stream and hands every access unit
+// that holds a picture to emit, with its PTS in 90 kHz ticks (as written: 33 bits, wrapping).
+// It returns the error that ended the stream (io.EOF when the writer closed it).
+//
+// FFmpeg writes one frame per PES packet. A PES packet with its length set (-omit_video_pes_length
+// 0, for frames up to 64 KiB) is handed on as soon as it is complete; without one it ends where
+// the next frame starts.
+func readTSAccessUnits(stream io.Reader, emit func(accessUnit []byte, pts int64)) error {
+	reader := bufio.NewReaderSize(stream, 64*tsPacketSize)
+	packet := make([]byte, tsPacketSize)
+	pmtPID, videoPID := -1, -1
+	var pes []byte // PES packet of the video stream being collected
+
+	flush := func() {
+		if payload, pts, ok := parsePES(pes); ok {
+			readDelimitedAccessUnits(bytes.NewReader(payload), func(accessUnit []byte) {
+				emit(accessUnit, pts)
+			})
+		}
+		pes = nil
+	}
+
+	for {
+		if _, err := io.ReadFull(reader, packet); err != nil {
+			flush()
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				err = io.EOF // The writer stopped in the middle of a packet
+			}
+			return err
+		}
+		if packet[0] != tsSyncByte {
+			return errors.New("lost MPEG-TS sync")
+		}
+
+		pid := int(packet[1]&0x1f)<<8 | int(packet[2])
+		unitStart := packet[1]&0x40 != 0
+		payload := packet[4:]
+		if packet[3]&0x20 != 0 { // Adaptation field (PCR, stuffing)
+			if int(payload[0]) >= len(payload) {
+				continue
+			}
+			payload = payload[1+int(payload[0]):]
+		}
+		if packet[3]&0x10 == 0 { // No payload
+			continue
+		}
+
+		switch {
+		case pid == 0 && unitStart:
+			if pid := parsePAT(payload); pid >= 0 {
+				pmtPID = pid
+			}
+		case pid == pmtPID && unitStart:
+			if pid := parsePMT(payload); pid >= 0 {
+				videoPID = pid
+			}
+		case pid == videoPID:
+			if unitStart {
+				flush()
+				pes = append([]byte(nil), payload...)
+			} else if pes != nil {
+				pes = append(pes, payload...)
+			}
+			if pesComplete(pes) {
+				flush()
+			}
+		}
+	}
+}
+
+// psiSection returns the section of a PAT or PMT that starts in a packet's payload, or nil when
+// the payload holds another table. FFmpeg's tables always fit in one packet.
+func psiSection(payload []byte, tableID byte) []byte {
+	pointer := int(payload[0])
+	if 1+pointer+3 > len(payload) {
+		return nil
+	}
+	section := payload[1+pointer:]
+	length := int(section[1]&0x0f)<<8 | int(section[2])
+	if section[0] != tableID || 3+length > len(section) {
+		return nil
+	}
+	return section[:3+length]
+}
+
+// parsePAT returns the PID of the first program's PMT, or -1
+func parsePAT(payload []byte) int {
+	section := psiSection(payload, 0x00)
+	// Programs come after the 8-byte header, before the 4-byte CRC
+	for i := 8; i+4 <= len(section)-4; i += 4 {
+		if program := int(section[i])<<8 | int(section[i+1]); program != 0 {
+			return int(section[i+2]&0x1f)<<8 | int(section[i+3])
+		}
+	}
+	return -1
+}
+
+// parsePMT returns the PID of the program's first H.264 stream, or -1
+func parsePMT(payload []byte) int {
+	section := psiSection(payload, 0x02)
+	if len(section) < 12 {
+		return -1
+	}
+	programInfoLength := int(section[10]&0x0f)<<8 | int(section[11])
+	for i := 12 + programInfoLength; i+5 <= len(section)-4; {
+		streamType := section[i]
+		pid := int(section[i+1]&0x1f)<<8 | int(section[i+2])
+		if streamType == tsStreamH264 {
+			return pid
+		}
+		i += 5 + (int(section[i+3]&0x0f)<<8 | int(section[i+4]))
+	}
+	return -1
+}
+
+// pesComplete reports whether a PES packet with its length set has all of its bytes
+func pesComplete(pes []byte) bool {
+	if len(pes) < 6 {
+		return false
+	}
+	length := int(pes[4])<<8 | int(pes[5])
+	return length != 0 && len(pes) >= 6+length
+}
+
+// parsePES returns the payload of a PES packet and its PTS. ok is false for anything that isn't
+// a complete PES header with a PTS.
+func parsePES(pes []byte) (payload []byte, pts int64, ok bool) {
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return nil, 0, false
+	}
+	headerEnd := 9 + int(pes[8])
+	if pes[7]&0x80 == 0 || headerEnd < 14 || headerEnd > len(pes) {
+		return nil, 0, false
+	}
+	p := pes[9:14]
+	pts = int64(p[0]>>1&0x07)<<30 | int64(p[1])<<22 | int64(p[2]>>1)<<15 | int64(p[3])<<7 | int64(p[4]>>1)
+
+	end := len(pes)
+	if length := int(pes[4])<<8 | int(pes[5]); length != 0 && 6+length < end {
+		end = 6 + length
+	}
+	return pes[headerEnd:end], pts, true
+}
+
+// ptsClock turns the PTS of FFmpeg's output into frame timestamps
+//
+// Every FFmpeg process has a clock of its own, so the first frame of a new process continues one
+// frame after the last frame of the previous one, like the native RTSP client does across
+// reconnects. A PTS that jumps by more than ptsMaxJump (a camera that reset its clock) is
+// treated the same way. All outputs of one process share the clock, which keeps renditions on
+// one timeline.
+type ptsClock struct {
+	mu       sync.Mutex
+	started  bool          // A timestamp was handed out
+	anchored bool          // The current timeline has a frame
+	anchor   int64         // PTS the current timeline starts at (unwrapped: counting on past 2^33)
+	base     time.Duration // Its timestamp
+	latest   int64         // Unwrapped PTS of the timeline's latest frame
+	last     time.Duration // Latest timestamp handed out
+	interval time.Duration // Between the last two frames
+}
+
+// restart starts a new timeline with the next frame (a new FFmpeg process)
+func (c *ptsClock) restart() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.anchored = false
+}
+
+// stamp returns the timestamp of a frame with the given PTS
+func (c *ptsClock) stamp(pts int64) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.anchored {
+		// Signed distance from the latest frame, so the 33-bit PTS can wrap around
+		ticks := (pts - c.latest) & (tsPTSWrap - 1)
+		if ticks >= tsPTSWrap/2 {
+			ticks -= tsPTSWrap
+		}
+		unwrapped := c.latest + ticks
+		elapsed := unwrapped - c.anchor
+		// In two steps, so a day's worth of ticks doesn't overflow
+		stamp := c.base + time.Duration(elapsed/tsClockRate)*time.Second +
+			time.Duration(elapsed%tsClockRate)*time.Second/tsClockRate
+		if stamp-c.last <= ptsMaxJump && c.last-stamp <= ptsMaxJump {
+			c.latest = max(c.latest, unwrapped)
+			c.record(stamp)
+			return stamp
+		}
+		log.Printf("⏱️ Frame timestamps jumped by %v - continuing after the last frame", stamp-c.last)
+	}
+
+	interval := c.interval
+	if interval == 0 {
+		interval = defaultFrameInterval
+	}
+	stamp := time.Duration(0)
+	if c.started {
+		stamp = c.last + interval
+	}
+	c.started, c.anchored = true, true
+	c.anchor, c.latest, c.base = pts, pts, stamp
+	c.record(stamp)
+	return stamp
+}
+
+// record remembers the latest timestamp and the interval that led to it
+func (c *ptsClock) record(stamp time.Duration) {
+	if stamp > c.last {
+		c.interval = stamp - c.last
+		c.last = stamp
+	}
+}
@@ -0,0 +1,169 @@
+package video
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// annexB joins NAL units with start codes
+func annexB(nals ...[]byte) []byte {
+	var accessUnit []byte
+	for _, nal := range nals {
+		accessUnit = append(accessUnit, annexBStartCode...)
+		accessUnit = append(accessUnit, nal...)
+	}
+	return accessUnit
+}
+
+// tsPackets splits a payload into TS packets of one PID, the last one padded with stuffing
+func tsPackets(pid int, payload []byte) []byte {
+	var stream []byte
+	for first := true; first || len(payload) > 0; first = false {
+		header := []byte{tsSyncByte, byte(pid >> 8 & 0x1f), byte(pid), 0x10}
+		if first {
+			header[1] |= 0x40 // Payload unit start
+		}
+		n := min(len(payload), tsPacketSize-4)
+		if n < tsPacketSize-4 {
+			header[3] |= 0x20
+			stuffing := tsPacketSize - 4 - n - 1
+			header = append(header, byte(stuffing))
+			if stuffing > 0 {
+				header = append(header, 0x00)
+				header = append(header, bytes.Repeat([]byte{0xff}, stuffing-1)...)
+			}
+		}
+		stream = append(stream, header...)
+		stream = append(stream, payload[:n]...)
+		payload = payload[n:]
+	}
+	return stream
+}
+
+// tsTables returns a PAT pointing at a PMT on PID 0x1000, which lists an audio stream on 0x101
+// and H.264 on 0x100
+func tsTables() []byte {
+	pat := []byte{0x00, 0x00, 0xb0, 13, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x01, 0xf0, 0x00, 0, 0, 0, 0}
+	pmt := []byte{0x00, 0x02, 0xb0, 23, 0x00, 0x01, 0xc1, 0x00, 0x00, 0xe1, 0x00, 0xf0, 0x00,
+		0x0f, 0xe1, 0x01, 0xf0, 0x00,
+		tsStreamH264, 0xe1, 0x00, 0xf0, 0x00,
+		0, 0, 0, 0}
+	return append(tsPackets(0, pat), tsPackets(0x1000, pmt)...)
+}
+
+// tsFrame returns a video PES packet in TS packets, with or without its length
+func tsFrame(accessUnit []byte, pts int64, withLength bool) []byte {
+	header := []byte{0x00, 0x00, 0x01, 0xe0, 0x00, 0x00, 0x80, 0x80, 0x05,
+		byte(0x21 | pts>>29&0x0e), byte(pts >> 22), byte(pts>>14&0xfe | 1), byte(pts >> 7), byte(pts<<1&0xfe | 1)}
+	if withLength {
+		length := len(header) - 6 + len(accessUnit)
+		header[4], header[5] = byte(length>>8), byte(length)
+	}
+	return tsPackets(0x100, append(header, accessUnit...))
+}
+
+func TestReadTSAccessUnits(t *testing.T) {
+	aud := []byte{0x09, 0xf0}
+	idr := annexB(testSPS, testPPS, append(testIDR, bytes.Repeat([]byte{0x55}, 500)...)) // Spans several packets
+	pFrame := annexB(testPFrame)
+
+	stream := tsTables()
+	stream = append(stream, tsFrame(append(annexB(aud), idr...), 1<<33-3000, true)...)
+	stream = append(stream, tsFrame(append(annexB(aud), pFrame...), 600, false)...)
+	stream = append(stream, tsFrame(pFrame, 4200, false)...)
+
+	type emitted struct {
+		accessUnit []byte
+		pts        int64
+	}
+	var got []emitted
+	err := readTSAccessUnits(bytes.NewReader(stream), func(accessUnit []byte, pts int64) {
+		got = append(got, emitted{accessUnit, pts})
+	})
+	if err != io.EOF {
+		t.Fatalf("readTSAccessUnits() error = %v, want io.EOF", err)
+	}
+
+	want := []emitted{{idr, 1<<33 - 3000}, {pFrame, 600}, {pFrame, 4200}}
+	if len(got) != len(want) {
+		t.Fatalf("got %d access units, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i].accessUnit, want[i].accessUnit) || got[i].pts != want[i].pts {
+			t.Errorf("access unit %d = %x (PTS %d), want %x (PTS %d)", i, got[i].accessUnit, got[i].pts, want[i].accessUnit, want[i].pts)
+		}
+	}
+}
+
+func TestReadTSAccessUnitsHandsOnFramesWithTheirLength(t *testing.T) {
+	reader, writer := io.Pipe()
+	emitted := make(chan int64, 1)
+	go readTSAccessUnits(reader, func(accessUnit []byte, pts int64) { emitted <- pts })
+	defer writer.Close()
+
+	writer.Write(tsTables())
+	writer.Write(tsFrame(annexB(testIDR), 3000, true))
+	select {
+	case pts := <-emitted:
+		if pts != 3000 {
+			t.Errorf("PTS = %d, want 3000", pts)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a frame that states its length waited for the next one")
+	}
+}
+
+func TestPTSClock(t *testing.T) {
+	const frame = 3600 // 40 ms at 90 kHz
+	tests := []struct {
+		name string
+		pts  []int64 // -1 restarts the clock (a new FFmpeg process)
+		want []time.Duration
+	}{
+		{
+			name: "spaced by the PTS, from the first frame",
+			pts:  []int64{900000, 900000 + frame, 900000 + 3*frame},
+			want: []time.Duration{0, 40 * time.Millisecond, 120 * time.Millisecond},
+		},
+		{
+			name: "the PTS wraps around",
+			pts:  []int64{tsPTSWrap - frame, 0, frame},
+			want: []time.Duration{0, 40 * time.Millisecond, 80 * time.Millisecond},
+		},
+		{
+			name: "a new process continues a frame after the last one",
+			pts:  []int64{0, frame, -1, 5000000, 5000000 + frame},
+			want: []time.Duration{0, 40 * time.Millisecond, 80 * time.Millisecond, 120 * time.Millisecond},
+		},
+		{
+			name: "a jump starts a new timeline",
+			pts:  []int64{0, frame, 100 * tsClockRate, 100*tsClockRate + frame},
+			want: []time.Duration{0, 40 * time.Millisecond, 80 * time.Millisecond, 120 * time.Millisecond},
+		},
+		{
+			name: "a frame of a lagging rendition keeps its place",
+			pts:  []int64{0, 2 * frame, frame, 3 * frame},
+			want: []time.Duration{0, 80 * time.Millisecond, 40 * time.Millisecond, 120 * time.Millisecond},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var clock ptsClock
+			var got []time.Duration
+			for _, pts := range tt.pts {
+				if pts < 0 {
+					clock.restart()
+					continue
+				}
+				got = append(got, clock.stamp(pts))
+			}
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Fatalf("stamps = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
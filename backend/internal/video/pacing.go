@@ -0,0 +1,114 @@
+package video
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// Pacer limits
+const (
+	pacerMaxWait = time.Second // A frame due further ahead than this means the timestamps jumped
+	pacerMaxLate = time.Second // So does a frame this late (the source stalled or restarted)
+	// An early frame moves the schedule 1/pacerSlewRate of the way towards it, so a source clock
+	// that runs slightly fast doesn't make frames wait longer and longer
+	pacerSlewRate = 100
+)
+
+// Pacer releases frames when their presentation timestamps say they are due
+//
+// The schedule is anchored at the first frame. A frame that arrives ahead of it (a burst from the
+// encoder, or a source that delivers faster than real time) waits; a late frame goes out at once,
+// so pacing never adds latency to a source that runs behind. The schedule starts over when the
+// timestamps jump.
+type Pacer struct {
+	anchor  time.Time // Wall-clock time at which PTS 0 is due
+	lastPTS time.Duration
+	started bool
+}
+
+// Wait blocks until the frame with the given PTS is due
+func (p *Pacer) Wait(pts time.Duration) {
+	now := time.Now()
+	if !p.started || pts < p.lastPTS {
+		p.reset(now, pts)
+		return
+	}
+	p.lastPTS = pts
+
+	wait := p.anchor.Add(pts).Sub(now)
+	switch {
+	case wait > pacerMaxWait || wait < -pacerMaxLate:
+		p.reset(now, pts)
+	case wait > 0:
+		p.anchor = p.anchor.Add(-wait / pacerSlewRate)
+		time.Sleep(wait - wait/pacerSlewRate)
+	}
+}
+
+func (p *Pacer) reset(now time.Time, pts time.Duration) {
+	p.anchor = now.Add(-pts)
+	p.lastPTS = pts
+	p.started = true
+}
+
+// FramePacketizer splits frames into RTP packets whose timestamps come from the frames' PTS,
+// rather than from a fixed frame duration
+type FramePacketizer struct {
+	packetizer rtp.Packetizer
+	clockRate  uint32
+	base       uint32        // Random RTP timestamp of PTS 0
+	offset     time.Duration // Added to PTS after the source's clock went backwards
+	lastPTS    time.Duration
+	started    bool
+}
+
+// NewFramePacketizer creates a packetizer for frames of the given codec (H.264 or VP8)
+// The SSRC and payload type are placeholders: the track sets each viewer's own when writing.
+func NewFramePacketizer(mimeType string, clockRate uint32) (*FramePacketizer, error) {
+	var payloader rtp.Payloader
+	switch mimeType {
+	case webrtc.MimeTypeH264:
+		payloader = &codecs.H264Payloader{}
+	case webrtc.MimeTypeVP8:
+		payloader = &codecs.VP8Payloader{EnablePictureID: true}
+	default:
+		return nil, fmt.Errorf("no RTP payloader for %s", mimeType)
+	}
+
+	return &FramePacketizer{
+		packetizer: rtp.NewPacketizer(rtpOutboundMTU, 0, 0, payloader, rtp.NewRandomSequencer(), clockRate),
+		clockRate:  clockRate,
+		base:       rand.Uint32(),
+	}, nil
+}
+
+// SyncWith puts this packetizer on the RTP clock of another one, for the simulcast layers of a
+// stream: a viewer switched between them then keeps a timeline that stays in step with audio
+func (f *FramePacketizer) SyncWith(other *FramePacketizer) {
+	f.base = other.base
+}
+
+// Packetize returns the RTP packets of one frame, all stamped with the frame's PTS
+func (f *FramePacketizer) Packetize(frame Frame) []*rtp.Packet {
+	// RTP timestamps must not go backwards: continue a frame after the last one instead
+	pts := frame.PTS + f.offset
+	if f.started && pts <= f.lastPTS {
+		f.offset += f.lastPTS - pts + time.Second/30
+		pts = frame.PTS + f.offset
+	}
+	f.lastPTS = pts
+	f.started = true
+
+	// Rounded: 1/30 s is not a whole number of nanoseconds
+	timestamp := f.base + uint32((int64(pts)*int64(f.clockRate)+int64(time.Second)/2)/int64(time.Second))
+	packets := f.packetizer.Packetize(frame.Data, 0)
+	for _, packet := range packets {
+		packet.Timestamp = timestamp
+	}
+	return packets
+}
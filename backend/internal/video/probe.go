@@ -0,0 +1,110 @@
+package video
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Passthrough modes selectable with VIDEO_PASSTHROUGH
+const (
+	PassthroughAuto   = "auto"   // Probe the camera and copy its H.264 when browsers can decode it as is
+	PassthroughAlways = "always" // Always copy the camera's video (skips the probe)
+	PassthroughNever  = "never"  // Always transcode
+)
+
+// How long ffprobe may take to connect to the camera and read its stream info
+const probeTimeout = 10 * time.Second
+
+// StreamInfo is what ffprobe reports about an input's streams
+type StreamInfo struct {
+	VideoCodec   string // ffprobe codec name, e.g. "h264" or "hevc"
+	VideoProfile string // e.g. "Constrained Baseline", "Main", "High"
+	Width        int
+	Height       int
+	HasAudio     bool
+}
+
+// ffprobeOutput is the subset of `ffprobe -show_streams -of json` we read
+type ffprobeOutput struct {
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+		CodecName string `json:"codec_name"`
+		Profile   string `json:"profile"`
+		Width     int    `json:"width"`
+		Height    int    `json:"height"`
+	} `json:"streams"`
+}
+
+// probeStream asks ffprobe for the codec and profile of an input; inputArgs go before -i
+func probeStream(input string, inputArgs ...string) (*StreamInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	args := []string{"-v", "error"}
+	args = append(args, inputArgs...)
+	args = append(args, "-show_streams", "-of", "json", "-i", input)
+
+	output, err := exec.CommandContext(ctx, "ffprobe", args...).Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("ffprobe timed out after %v", probeTimeout)
+		}
+		return nil, fmt.Errorf("ffprobe failed: %w", err)
+	}
+
+	var probed ffprobeOutput
+	if err := json.Unmarshal(output, &probed); err != nil {
+		return nil, fmt.Errorf("failed to parse ffprobe output: %w", err)
+	}
+
+	info := &StreamInfo{}
+	for _, stream := range probed.Streams {
+		switch stream.CodecType {
+		case "video":
+			// The first video stream is the one we publish
+			if info.VideoCodec == "" {
+				info.VideoCodec = stream.CodecName
+				info.VideoProfile = stream.Profile
+				info.Width = stream.Width
+				info.Height = stream.Height
+			}
+		case "audio":
+			info.HasAudio = true
+		}
+	}
+	if info.VideoCodec == "" {
+		return nil, fmt.Errorf("no video stream found")
+	}
+	return info, nil
+}
+
+// BrowserCompatible reports whether the video can be sent to browsers without transcoding:
+// H.264 in the baseline or constrained baseline profile (no B-frames, decodable everywhere)
+func (s *StreamInfo) BrowserCompatible() bool {
+	if s.VideoCodec != "h264" {
+		return false
+	}
+	switch strings.ToLower(s.VideoProfile) {
+	case "baseline", "constrained baseline":
+		return true
+	}
+	return false
+}
+
+func (s *StreamInfo) String() string {
+	description := s.VideoCodec
+	if s.VideoProfile != "" {
+		description += " (" + s.VideoProfile + ")"
+	}
+	if s.Width > 0 && s.Height > 0 {
+		description += fmt.Sprintf(" %dx%d", s.Width, s.Height)
+	}
+	if s.HasAudio {
+		description += " with audio"
+	}
+	return description
+}
@@ -0,0 +1,138 @@
+package video
+
+import (
+	"math/rand"
+
+	"webrtc-streaming/internal/rtsp"
+
+	"github.com/pion/rtp"
+)
+
+// RTPSource is implemented by video sources that receive RTP themselves (the native RTSP client)
+// Their packets can go to the track as they arrive, instead of being assembled into frames and
+// packetized again.
+type RTPSource interface {
+	ForwardsRTP() bool             // Whether the source is in forwarding mode (ReadFrame is unused then)
+	ReadRTP() (*rtp.Packet, error) // Next rewritten packet, blocking; ErrSourceClosed once the source is closed
+}
+
+// Size of the RTP packets we send, the MTU Pion uses for its own sample tracks
+const rtpOutboundMTU = 1200
+
+// Largest payload that fits: the MTU minus the RTP header
+const rtpMaxPayload = rtpOutboundMTU - 12
+
+// rtpRewriter turns camera RTP into one continuous outgoing stream
+//
+// The outgoing SSRC, sequence numbers and timestamps are our own: a camera reconnect starts a
+// new RTP session with fresh numbers, and viewers must not see a jump or the stream would stall
+// in their jitter buffer. Sequence gaps from lost camera packets are kept, so the browser's
+// decoder still notices the loss. Packets are also cut down to the WebRTC MTU, and SPS/PPS are
+// sent in front of each IDR when the camera only announces them in the SDP.
+type rtpRewriter struct {
+	ssrc      uint32
+	frameStep uint32 // Timestamp increment of one frame, to continue across sessions
+
+	sps []byte
+	pps []byte
+
+	started      bool // A packet has been sent
+	inSession    bool // lastInSeq belongs to the current camera session
+	waitKeyframe bool // Nothing is sent until the session reaches a keyframe
+	lastInSeq    uint16
+	tsOffset     uint32 // Added to camera timestamps
+	lastOutSeq   uint16
+	lastOutTS    uint32
+	paramsTS     uint32 // Timestamp of the last access unit that carried its own SPS
+	paramsInBand bool
+}
+
+func newRTPRewriter() *rtpRewriter {
+	return &rtpRewriter{
+		ssrc:       rand.Uint32(),
+		lastOutSeq: uint16(rand.Uint32()),
+		lastOutTS:  rand.Uint32(),
+	}
+}
+
+// newSession prepares for the packets of a new camera session, seeded with its SDP parameter sets
+func (r *rtpRewriter) newSession(sps, pps []byte, frameStep uint32) {
+	r.sps = sps
+	r.pps = pps
+	r.frameStep = frameStep
+	r.inSession = false
+	r.waitKeyframe = true
+	r.paramsInBand = false
+}
+
+// rewrite returns the packets to send for one camera packet: none (while waiting for a keyframe
+// or for a late duplicate), the packet itself, or several when it had to be split or parameter sets
+// go in front of it
+func (r *rtpRewriter) rewrite(packet *rtp.Packet) []*rtp.Packet {
+	// Sequence number distance from the previous camera packet (1 unless packets were lost)
+	step := uint16(1)
+	if r.inSession {
+		step = packet.SequenceNumber - r.lastInSeq
+		if step == 0 || step >= 0x8000 {
+			// Duplicate, or reordered behind a packet we already sent (UDP)
+			return nil
+		}
+	}
+	r.inSession = true
+	r.lastInSeq = packet.SequenceNumber
+
+	// Parameter sets in the stream replace the ones from the SDP
+	if sps, pps := rtsp.ParameterSets(packet.Payload); sps != nil || pps != nil {
+		if sps != nil {
+			r.sps = sps
+			r.paramsTS = packet.Timestamp
+			r.paramsInBand = true
+		}
+		if pps != nil {
+			r.pps = pps
+		}
+	}
+
+	if r.waitKeyframe {
+		if !rtsp.IsKeyframeStart(packet.Payload) {
+			return nil
+		}
+		// Continue our timestamps one frame after the last packet we sent
+		r.waitKeyframe = false
+		r.tsOffset = r.lastOutTS + r.frameStep - packet.Timestamp
+		if !r.started {
+			r.tsOffset = r.lastOutTS - packet.Timestamp
+		}
+		step = 1
+	}
+
+	var payloads [][]byte
+	if rtsp.IsIDRStart(packet.Payload) && r.sps != nil && r.pps != nil &&
+		!(r.paramsInBand && r.paramsTS == packet.Timestamp) {
+		payloads = append(payloads, rtsp.ParameterSetsPayload(r.sps, r.pps))
+	}
+	payloads = append(payloads, rtsp.SplitPayload(packet.Payload, rtpMaxPayload)...)
+
+	timestamp := packet.Timestamp + r.tsOffset
+	seq := r.lastOutSeq + step - 1
+	out := make([]*rtp.Packet, 0, len(payloads))
+	for i, payload := range payloads {
+		seq++
+		out = append(out, &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         packet.Marker && i == len(payloads)-1,
+				PayloadType:    packet.PayloadType,
+				SequenceNumber: seq,
+				Timestamp:      timestamp,
+				SSRC:           r.ssrc,
+			},
+			Payload: payload,
+		})
+	}
+
+	r.started = true
+	r.lastOutSeq = seq
+	r.lastOutTS = timestamp
+	return out
+}
@@ -0,0 +1,189 @@
+package video
+
+import (
+	"bytes"
+	"testing"
+
+	"webrtc-streaming/internal/rtsp"
+
+	"github.com/pion/rtp"
+)
+
+var (
+	testSPS    = []byte{0x67, 0x42, 0xe0, 0x1f, 0xda}
+	testPPS    = []byte{0x68, 0xce, 0x3c, 0x80}
+	testIDR    = []byte{0x65, 0x88, 0x84, 0x00, 0x33}
+	testPFrame = []byte{0x41, 0x9a, 0x02, 0x11}
+)
+
+func testPacket(seq uint16, timestamp uint32, marker bool, payload []byte) *rtp.Packet {
+	return &rtp.Packet{
+		Header:  rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: seq, Timestamp: timestamp, Marker: marker, SSRC: 0xCAFE},
+		Payload: payload,
+	}
+}
+
+func TestRTPRewriter(t *testing.T) {
+	params := rtsp.ParameterSetsPayload(testSPS, testPPS)
+
+	// input is a camera packet, or the start of a new camera session when packet is nil
+	type input struct {
+		packet   *rtp.Packet
+		sps, pps []byte // SDP parameter sets of a new session
+	}
+	session := func(sps, pps []byte) input { return input{sps: sps, pps: pps} }
+	packet := func(seq uint16, timestamp uint32, marker bool, payload []byte) input {
+		return input{packet: testPacket(seq, timestamp, marker, payload)}
+	}
+	// Sequence numbers and timestamps of the output are relative to the first packet sent
+	type output struct {
+		seq       uint16
+		timestamp uint32
+		marker    bool
+		payload   []byte
+	}
+
+	tests := []struct {
+		name  string
+		input []input
+		want  []output
+	}{
+		{
+			name: "nothing is sent before a keyframe",
+			input: []input{
+				session(nil, nil),
+				packet(1, 0, true, testPFrame),
+				packet(2, 3000, true, testIDR),
+				packet(3, 6000, true, testPFrame),
+			},
+			want: []output{
+				{0, 0, true, testIDR},
+				{1, 3000, true, testPFrame},
+			},
+		},
+		{
+			name: "SDP parameter sets go in front of every IDR",
+			input: []input{
+				session(testSPS, testPPS),
+				packet(1, 0, true, testIDR),
+				packet(2, 3000, true, testPFrame),
+				packet(3, 6000, true, testIDR),
+			},
+			want: []output{
+				{0, 0, false, params},
+				{1, 0, true, testIDR},
+				{2, 3000, true, testPFrame},
+				{3, 6000, false, params},
+				{4, 6000, true, testIDR},
+			},
+		},
+		{
+			name: "in-band parameter sets are not sent twice",
+			input: []input{
+				session(testSPS, testPPS),
+				packet(1, 0, false, params),
+				packet(2, 0, true, testIDR),
+			},
+			want: []output{
+				{0, 0, false, params},
+				{1, 0, true, testIDR},
+			},
+		},
+		{
+			name: "gaps are kept, duplicates and late packets dropped",
+			input: []input{
+				session(nil, nil),
+				packet(10, 0, true, testIDR),
+				packet(11, 3000, true, testPFrame),
+				packet(11, 3000, true, testPFrame),
+				packet(13, 9000, true, testPFrame),
+				packet(12, 6000, true, testPFrame),
+			},
+			want: []output{
+				{0, 0, true, testIDR},
+				{1, 3000, true, testPFrame},
+				{3, 9000, true, testPFrame},
+			},
+		},
+		{
+			name: "a new camera session continues our numbering one frame later",
+			input: []input{
+				session(nil, nil),
+				packet(500, 90000, true, testIDR),
+				packet(501, 93000, true, testPFrame),
+				session(nil, nil),
+				packet(7, 5, true, testPFrame),
+				packet(8, 123456, true, testIDR),
+				packet(9, 126456, true, testPFrame),
+			},
+			want: []output{
+				{0, 0, true, testIDR},
+				{1, 3000, true, testPFrame},
+				{2, 6000, true, testIDR},
+				{3, 9000, true, testPFrame},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rewriter := newRTPRewriter()
+			var got []*rtp.Packet
+			for _, in := range tt.input {
+				if in.packet == nil {
+					rewriter.newSession(in.sps, in.pps, 3000)
+					continue
+				}
+				got = append(got, rewriter.rewrite(in.packet)...)
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d packets, want %d", len(got), len(tt.want))
+			}
+			for i, want := range tt.want {
+				packet := got[i]
+				seq := packet.SequenceNumber - got[0].SequenceNumber
+				timestamp := packet.Timestamp - got[0].Timestamp
+				if seq != want.seq || timestamp != want.timestamp || packet.Marker != want.marker || !bytes.Equal(packet.Payload, want.payload) {
+					t.Errorf("packet %d = {seq +%d, ts +%d, marker %v, %x}, want {seq +%d, ts +%d, marker %v, %x}",
+						i, seq, timestamp, packet.Marker, packet.Payload, want.seq, want.timestamp, want.marker, want.payload)
+				}
+				if packet.SSRC != got[0].SSRC {
+					t.Errorf("packet %d changed the SSRC", i)
+				}
+			}
+		})
+	}
+}
+
+func TestRTPRewriterSplitsToMTU(t *testing.T) {
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{0x5A}, 3*rtpMaxPayload)...)
+
+	rewriter := newRTPRewriter()
+	rewriter.newSession(testSPS, testPPS, 3000)
+	packets := rewriter.rewrite(testPacket(1, 0, true, idr))
+	if len(packets) < 4 {
+		t.Fatalf("got %d packets, want the parameter sets and at least 3 fragments", len(packets))
+	}
+
+	depacketizer := rtsp.NewH264Depacketizer(nil, nil)
+	var units []rtsp.AccessUnit
+	for i, packet := range packets {
+		if len(packet.Payload) > rtpMaxPayload {
+			t.Errorf("packet %d has a %d byte payload, more than %d", i, len(packet.Payload), rtpMaxPayload)
+		}
+		if packet.Marker != (i == len(packets)-1) {
+			t.Errorf("packet %d marker = %v", i, packet.Marker)
+		}
+		au, err := depacketizer.Push(packet)
+		if err != nil {
+			t.Fatalf("Push: %v", err)
+		}
+		units = append(units, au...)
+	}
+
+	want := bytes.Join([][]byte{nil, testSPS, testPPS, idr}, []byte{0, 0, 0, 1})
+	if len(units) != 1 || !bytes.Equal(units[0].Data, want) {
+		t.Errorf("reassembled %d access units, want the original IDR with its parameter sets", len(units))
+	}
+}
@@ -14,6 +14,9 @@ import (
 	"time"
 
 	"webrtc-streaming/internal/config"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
 )
 
 // detectBestEncoder detects and returns the best available H.264 encoder
@@ -88,11 +91,11 @@ func hasVAAPIDevice() bool {
 			break
 		}
 	}
-	
+
 	if !hasDevice {
 		return false
 	}
-	
+
 	// Test if VAAPI actually works by running a simple FFmpeg command
 	// This catches cases where device exists but VAAPI driver isn't functional
 	testCmd := exec.Command("ffmpeg", "-hide_banner", "-f", "lavfi", "-i", "testsrc=duration=0.1:size=320x240:rate=1",
@@ -105,7 +108,7 @@ func hasVAAPIDevice() bool {
 		log.Printf("⚠️ VAAPI device exists but test encoding failed - will use software encoding")
 		return false
 	}
-	
+
 	return true
 }
 
@@ -188,55 +191,128 @@ func getSoftwareEncoderParams() []string {
 	}
 }
 
+// withBitrate replaces the bitrate options in an encoder's ffmpeg arguments with a target of
+// kbps - each rendition is encoded at its fixed VIDEO_RENDITIONS bitrate. The encoder is read
+// from "-c:v".
+func withBitrate(args []string, kbps int) []string {
+	encoder := ""
+	result := make([]string, 0, len(args)+6)
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-b:v", "-maxrate", "-bufsize":
+			i++ // Drop the option and its value
+			continue
+		case "-c:v":
+			if i+1 < len(args) {
+				encoder = args[i+1]
+			}
+		}
+		result = append(result, args[i])
+	}
+
+	rate := fmt.Sprintf("%dk", kbps)
+	result = append(result, "-b:v", rate)
+	if encoder != "h264_videotoolbox" { // VideoToolbox only takes -b:v
+		// Cap the rate with a half-second buffer so keyframes don't burst past the estimate
+		result = append(result, "-maxrate", rate, "-bufsize", fmt.Sprintf("%dk", max(kbps/2, 1)))
+	}
+	return result
+}
+
+// renditionScale returns the -vf filter that scales the camera to a rendition's height
+// (the width keeps the aspect ratio, rounded to an even number as the encoders need)
+func renditionScale(rendition config.RenditionConfig) string {
+	return fmt.Sprintf("scale=-2:%d", rendition.Height)
+}
+
 // RTSPVideoSource handles RTSP stream using ffmpeg
 type RTSPVideoSource struct {
-	rtspURL      string
-	cmd          *exec.Cmd
-	stdout       io.ReadCloser
-	frameChan    chan []byte
-	errChan      chan error
-	mu           sync.Mutex
-	closed       bool
-	accessUnit   []byte // Accumulator for SPS/PPS
-	spsPps       []byte // Persistent copy of SPS/PPS for IDR frames
-	spsPpsFound  bool   // Track if we've received SPS/PPS
-	currentFrame []byte // Accumulator for all NAL units in current access unit
-	frameRate    int    // Detected frame rate from stream (FPS)
-	restartMu       sync.Mutex // Mutex for restart operations
-	restartCount    int        // Track restart attempts
-	lastFrameTime   time.Time  // Track when last frame was received
-	restartInProgress bool    // Flag to prevent concurrent restarts
+	rtspURL           string
+	cmd               *exec.Cmd
+	exited            chan struct{} // Closed once the current FFmpeg process has been waited for
+	stdout            io.ReadCloser
+	frameChan         chan Frame
+	clock             ptsClock      // Stamps frames from their PTS (one timeline across FFmpeg restarts)
+	errChan           chan error    // Why the source gave up (FFmpeg could not be restarted)
+	stopped           chan struct{} // Closed by Close, wakes ReadFrame and ReadLayerFrame
+	mu                sync.Mutex
+	closed            bool
+	closeChannels     sync.Once  // frameChan and errChan are closed once, by the last readFrames
+	frameRate         int        // Detected frame rate from stream (FPS)
+	restartMu         sync.Mutex // Mutex for restart operations
+	restartCount      int        // Track restart attempts
+	lastFrameTime     time.Time  // Track when last frame was received
+	restartInProgress bool       // Flag to prevent concurrent restarts
+	plannedRestart    bool       // FFmpeg was stopped on purpose (Restart) - restart it right away
+	restartPending    bool       // A planned restart's new process has not delivered output yet
+	reprobe           bool       // The planned restart was asked for by an operator: probe the camera again
+	restarts          int        // FFmpeg restarts since the source started, planned ones included
+	// Per-source counters (each camera of a multi-stream publisher has its own)
+	frameReadCount    int64
+	firstFrameSent    bool
+	frameQueueCounter int           // Track frames queued to channel
+	audio             *opusReceiver // Camera audio transcoded to Opus (nil when AUDIO_ENABLED is off)
+	encoder           string        // H.264 encoder of the current run ("copy" in passthrough mode)
+	cameraHasAudio    bool          // From the last probe, reused for planned restarts
+	// Renditions (simulcast layers) to encode, highest first; with fewer than two the camera is
+	// encoded once. Layer 0 comes out of stdout, the others through their own pipes.
+	renditions  []config.RenditionConfig
+	layerFrames []chan Frame // Frames of layers 1 and up (kept across FFmpeg restarts)
 }
 
 func NewRTSPVideoSource(rtspURL string) (*RTSPVideoSource, error) {
+	var audio *opusReceiver
+	if config.AppConfig.Audio.Enabled {
+		audio = newOpusReceiver("RTSP", config.AppConfig.Audio.Bitrate)
+	}
+
+	var renditions []config.RenditionConfig
+	var layerFrames []chan Frame
+	if len(config.AppConfig.Video.Renditions) > 1 {
+		renditions = config.AppConfig.Video.Renditions
+		for range renditions[1:] {
+			layerFrames = append(layerFrames, make(chan Frame, 5))
+		}
+	}
+
 	return &RTSPVideoSource{
 		rtspURL:       rtspURL,
-		frameChan:     make(chan []byte, 5), // Buffer 5 frames to prevent drops during network jitter
+		frameChan:     make(chan Frame, 5), // Buffer 5 frames to prevent drops during network jitter
 		errChan:       make(chan error, 1),
-		accessUnit:    make([]byte, 0, 128*1024), // Further reduced for minimal latency
-		spsPps:        make([]byte, 0, 1024),
-		spsPpsFound:   false,
-		currentFrame:  make([]byte, 0, 64*1024),   // Minimal frame buffer
+		stopped:       make(chan struct{}),
 		frameRate:     config.AppConfig.Video.FPS, // Default to config, will be updated from stream
 		lastFrameTime: time.Now(),
+		audio:         audio,
+		renditions:    renditions,
+		layerFrames:   layerFrames,
 	}, nil
 }
 
 func (r *RTSPVideoSource) Start() error {
+	log.Printf("Starting RTSP stream from: %s", r.rtspURL)
+
+	r.mu.Lock()
+	plannedRestart := r.plannedRestart
+	hasAudio := r.cameraHasAudio
+	r.mu.Unlock()
+
+	// Copy the camera's H.264 when browsers can play it as is, otherwise transcode
+	// (probed before locking - connecting to the camera can take a few seconds)
+	// Planned restarts (keyframe, bitrate) only happen while transcoding, and the camera hasn't changed.
+	passthrough := false
+	if !plannedRestart || r.reprobing() {
+		passthrough, hasAudio = r.choosePipeline()
+	}
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	r.cameraHasAudio = hasAudio
 
 	if r.closed {
 		return fmt.Errorf("RTSP source already closed")
 	}
 
-	log.Printf("Starting RTSP stream from: %s", r.rtspURL)
-
-	// Detect and use hardware acceleration for best performance
-	encoder, encoderParams := detectBestEncoder()
-	log.Printf("🎬 Using encoder: %s", encoder)
-
-	// Build ffmpeg command to decode RTSP and output raw H264 frames
+	// Build ffmpeg command to decode RTSP and output H264 frames with their timestamps
 	// IMPORTANT: The stream might be HEVC/H.265, so we need to transcode to H.264
 	// Browser support for H.264 is universal, but HEVC support is limited
 	ffmpegArgs := []string{
@@ -247,28 +323,105 @@ func (r *RTSPVideoSource) Start() error {
 		"-analyzeduration", "200000", // Reduce analysis time (0.2 second) - faster startup
 		"-probesize", "200000", // Reduce probe size - faster startup
 		"-err_detect", "ignore_err", // Ignore non-critical decoding errors
+		"-copyts", // Keep the camera's timestamps - frames are paced and stamped from them
 		"-i", r.rtspURL,
+	}
+
+	encoder := "copy"
+	var encodeArgs, encoderParams []string
+	if passthrough {
+		// Passthrough: the camera's baseline H.264 goes out untouched - no decode, no encode
+		ffmpegArgs = append(ffmpegArgs, "-c:v", "copy")
+		log.Printf("⚡ Camera already sends browser-compatible H.264 - passing it through without transcoding")
+	} else {
+		// Detect and use hardware acceleration for best performance
+		encoder, encoderParams = detectBestEncoder()
+		log.Printf("🎬 Using encoder: %s", encoder)
+
 		// Transcode to H.264 with optimized settings
-		"-c:v", encoder, // Use detected best encoder (hardware or software)
-		"-profile:v", "baseline", // Baseline profile for maximum compatibility
-		"-level", "3.1", // Level 3.1 for good compatibility
-		"-pix_fmt", "yuv420p", // Pixel format for compatibility
-		"-color_range", "pc", // Use PC range (full range 0-255) for proper color
-		"-colorspace", "bt709", // BT.709 color space (standard for web)
-		"-color_primaries", "bt709", // BT.709 color primaries
-		"-color_trc", "bt709", // BT.709 transfer characteristics
-		"-bf", "0", // No B-frames (WebRTC requirement for low latency)
-		"-g", "15", // GOP size (keyframe every 15 frames, ~1 second at 15fps) - matches actual frame rate for better buffering
-		"-bsf:v", "h264_mp4toannexb", // Convert to Annex-B format (required for raw H264)
-		"-f", "h264", // Raw H264 format
-		"-flush_packets", "1", // Flush packets immediately
+		encodeArgs = []string{
+			"-c:v", encoder, // Use detected best encoder (hardware or software)
+			"-profile:v", "baseline", // Baseline profile for maximum compatibility
+			"-level", "3.1", // Level 3.1 for good compatibility
+			"-pix_fmt", "yuv420p", // Pixel format for compatibility
+			"-color_range", "pc", // Use PC range (full range 0-255) for proper color
+			"-colorspace", "bt709", // BT.709 color space (standard for web)
+			"-color_primaries", "bt709", // BT.709 color primaries
+			"-color_trc", "bt709", // BT.709 transfer characteristics
+			"-bf", "0", // No B-frames (WebRTC requirement for low latency)
+			"-g", "15", // GOP size (keyframe every 15 frames, ~1 second at 15fps) - matches actual frame rate for better buffering
+		}
+		ffmpegArgs = append(ffmpegArgs, encodeArgs...)
+		if len(r.renditions) > 1 {
+			ffmpegArgs = append(ffmpegArgs, "-vf", renditionScale(r.renditions[0]))
+		}
 	}
+	r.encoder = encoder
+
+	ffmpegArgs = append(ffmpegArgs,
+		"-f", "mpegts", // Unlike raw H.264, MPEG-TS carries every frame's PTS (and converts to Annex-B itself)
+		"-omit_video_pes_length", "0", // Frames that state their length needn't wait for the next one
+		"-flush_packets", "1", // Flush packets immediately
+	)
 
 	// Add encoder-specific parameters
 	ffmpegArgs = append(ffmpegArgs, encoderParams...)
+	switch {
+	case passthrough:
+	case len(r.renditions) > 1:
+		ffmpegArgs = withBitrate(ffmpegArgs, r.renditions[0].Bitrate)
+	}
 	ffmpegArgs = append(ffmpegArgs, "-") // Output to stdout
 
-	if encoder != "libx264" {
+	// Further renditions: the same encoder at a lower resolution and bitrate, each written to its
+	// own pipe (fd 3 and up), so the camera is pulled and decoded once for every layer
+	var layerReaders, layerWriters []*os.File
+	closeLayerPipes := func() {
+		for _, pipe := range append(layerReaders, layerWriters...) {
+			pipe.Close()
+		}
+	}
+	if !passthrough {
+		for i, rendition := range r.renditions[min(1, len(r.renditions)):] {
+			reader, writer, err := os.Pipe()
+			if err != nil {
+				closeLayerPipes()
+				return fmt.Errorf("failed to create pipe for the %s rendition: %w", rendition.Name, err)
+			}
+			layerReaders = append(layerReaders, reader)
+			layerWriters = append(layerWriters, writer)
+
+			layerArgs := append([]string{"-map", "0:v:0", "-vf", renditionScale(rendition)}, encodeArgs...)
+			layerArgs = withBitrate(append(layerArgs, encoderParams...), rendition.Bitrate)
+			ffmpegArgs = append(ffmpegArgs, layerArgs...)
+			ffmpegArgs = append(ffmpegArgs,
+				"-f", "mpegts",
+				"-omit_video_pes_length", "0",
+				"-flush_packets", "1",
+				fmt.Sprintf("pipe:%d", 3+i), // ExtraFiles start at fd 3
+			)
+		}
+		if len(layerWriters) > 0 {
+			names := make([]string, len(r.renditions))
+			for i, rendition := range r.renditions {
+				names[i] = fmt.Sprintf("%s@%dk", rendition.Name, rendition.Bitrate)
+			}
+			log.Printf("📚 Encoding %d renditions: %s", len(r.renditions), strings.Join(names, ", "))
+		}
+	}
+
+	// Second output: the camera's audio as Opus, from the same process so it stays in step with the video
+	if r.audio != nil && hasAudio {
+		audioArgs, err := r.audio.listen()
+		if err != nil {
+			return err
+		}
+		ffmpegArgs = append(ffmpegArgs, audioArgs...)
+	}
+
+	if passthrough {
+		log.Println("   Latency and CPU use are as low as they get - the camera's GOP and bitrate are used as is")
+	} else if encoder != "libx264" {
 		log.Printf("✅ Hardware acceleration enabled - latency reduced by ~60-80%%")
 		log.Println("   If source is HEVC/H.265, it will be transcoded to H.264 for browser compatibility")
 	} else {
@@ -279,10 +432,15 @@ func (r *RTSPVideoSource) Start() error {
 	log.Printf("Running ffmpeg with args: %v", ffmpegArgs)
 
 	cmd := exec.Command("ffmpeg", ffmpegArgs...)
+	cmd.ExtraFiles = layerWriters
 	r.cmd = cmd
+	r.clock.restart() // The new process's PTS start a timeline of their own
+	exited := make(chan struct{})
+	r.exited = exited
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
+		closeLayerPipes()
 		return fmt.Errorf("failed to create stdout pipe: %w", err)
 	}
 	r.stdout = stdout
@@ -291,6 +449,7 @@ func (r *RTSPVideoSource) Start() error {
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
 		stdout.Close()
+		closeLayerPipes()
 		return fmt.Errorf("failed to create stderr pipe: %w", err)
 	}
 
@@ -331,7 +490,7 @@ func (r *RTSPVideoSource) Start() error {
 					strings.Contains(lowerLine, "device creation failed") ||
 					strings.Contains(lowerLine, "failed to initialise") ||
 					strings.Contains(lowerLine, "input/output error"))
-				
+
 				if strings.Contains(lowerLine, "404 not found") ||
 					strings.Contains(lowerLine, "connection refused") ||
 					strings.Contains(lowerLine, "failed") ||
@@ -373,12 +532,33 @@ func (r *RTSPVideoSource) Start() error {
 
 	if err := cmd.Start(); err != nil {
 		stdout.Close()
+		closeLayerPipes()
 		return fmt.Errorf("failed to start ffmpeg: %w", err)
 	}
 
+	// FFmpeg has its own copies of the write ends; ours would keep the readers from seeing EOF
+	for _, writer := range layerWriters {
+		writer.Close()
+	}
+	for i, reader := range layerReaders {
+		go r.readLayer(i+1, reader)
+	}
+
 	// Monitor FFmpeg process exit in a separate goroutine
 	go func() {
 		err := cmd.Wait()
+		close(exited)
+
+		r.mu.Lock()
+		plannedRestart := r.plannedRestart && !r.closed
+		r.mu.Unlock()
+		if plannedRestart {
+			// Stopped by Restart - not a failure
+			stdout.Close()
+			go r.restartFFmpeg()
+			return
+		}
+
 		ffmpegErrorMutex.Lock()
 		hasError := ffmpegError != nil
 		storedError := ffmpegError
@@ -404,25 +584,9 @@ func (r *RTSPVideoSource) Start() error {
 		r.mu.Unlock()
 
 		if !isClosed {
-			// Attempt automatic restart if not closed
+			// Attempt automatic restart if not closed - ReadFrame keeps waiting in the meantime
 			log.Printf("🔄 FFmpeg process exited, attempting automatic restart...")
 			go r.restartFFmpeg()
-		} else {
-			// Source is closed, just send error and exit
-			func() {
-				defer func() {
-					if r := recover(); r != nil {
-						// Channel was closed - this is expected
-					}
-				}()
-
-				if storedError != nil {
-					select {
-					case r.errChan <- storedError:
-					default:
-					}
-				}
-			}()
 		}
 
 		// Close stdout to signal readFrames that input is done
@@ -437,20 +601,61 @@ func (r *RTSPVideoSource) Start() error {
 	return nil
 }
 
+// choosePipeline decides between passthrough and transcoding from VIDEO_PASSTHROUGH and a probe
+// of the camera. It also reports whether the camera has audio (assumed when it wasn't probed).
+func (r *RTSPVideoSource) choosePipeline() (passthrough bool, hasAudio bool) {
+	mode := config.AppConfig.Video.Passthrough
+	layered := len(r.renditions) > 1
+	switch mode {
+	case PassthroughAlways:
+		if !layered {
+			return true, true
+		}
+		log.Printf("⚠️ VIDEO_PASSTHROUGH=always is ignored - renditions need transcoding")
+		return false, true
+	case PassthroughNever:
+		return false, true
+	}
+	if mode != PassthroughAuto && mode != "" {
+		log.Printf("⚠️ Unknown VIDEO_PASSTHROUGH %q, probing the stream as with %q", mode, PassthroughAuto)
+	}
+
+	log.Printf("🔍 Probing RTSP stream codec...")
+	info, err := probeStream(r.rtspURL, "-rtsp_transport", "tcp")
+	if err != nil {
+		// Transcoding works for any input, so it's the safe choice when we can't tell
+		log.Printf("⚠️ Could not probe RTSP stream (%v) - transcoding to be safe", err)
+		return false, true
+	}
+	log.Printf("📋 RTSP stream: %s", info)
+
+	if r.audio != nil && !info.HasAudio {
+		log.Printf("🔇 Camera sends no audio - publishing video only")
+	}
+	if layered {
+		log.Printf("   Transcoding into %d renditions (VIDEO_RENDITIONS)", len(r.renditions))
+		return false, info.HasAudio
+	}
+	if !info.BrowserCompatible() {
+		log.Printf("   %s %s is not baseline H.264 - transcoding for browser compatibility", info.VideoCodec, info.VideoProfile)
+	}
+	return info.BrowserCompatible(), info.HasAudio
+}
+
 // restartFFmpeg attempts to restart the FFmpeg process
 func (r *RTSPVideoSource) restartFFmpeg() {
 	r.restartMu.Lock()
-	
+
 	// Check if restart is already in progress
 	if r.restartInProgress {
 		r.restartMu.Unlock()
 		log.Printf("⚠️ Restart already in progress, skipping duplicate restart request")
 		return
 	}
-	
+
 	r.restartInProgress = true
 	r.restartMu.Unlock()
-	
+
 	defer func() {
 		r.restartMu.Lock()
 		r.restartInProgress = false
@@ -460,12 +665,36 @@ func (r *RTSPVideoSource) restartFFmpeg() {
 	// Check if already closed
 	r.mu.Lock()
 	isClosed := r.closed
+	plannedRestart := r.plannedRestart
 	r.mu.Unlock()
 
 	if isClosed {
 		return
 	}
 
+	if plannedRestart {
+		// Nothing went wrong - start over at once without counting an attempt
+		// The new encoder begins with fresh SPS/PPS and a keyframe
+		err := r.Start()
+		if err != nil {
+			// Fall back to the counted retries of an unplanned restart
+			log.Printf("❌ Failed to restart FFmpeg: %v", err)
+			go func() {
+				time.Sleep(5 * time.Second)
+				r.restartFFmpeg()
+			}()
+		}
+		r.mu.Lock()
+		r.plannedRestart = false
+		r.reprobe = false
+		r.lastFrameTime = time.Now()
+		if err == nil {
+			r.restarts++
+		}
+		r.mu.Unlock()
+		return
+	}
+
 	// Limit restart attempts to prevent infinite loops
 	r.restartCount++
 	maxRestarts := 10
@@ -499,42 +728,15 @@ func (r *RTSPVideoSource) restartFFmpeg() {
 	}
 	r.mu.Unlock()
 
-	// Recreate channels if needed (readFrames only closes them if source is closed, but be safe)
+	// Frames the old process left behind are dropped; ReadFrame keeps waiting on the same channels
 	r.mu.Lock()
-	// Always recreate channels to ensure clean state after restart
-	// Close old channels if they exist (they might be closed already, ignore errors)
-	if r.frameChan != nil {
-		// Try to drain any remaining frames
-		for {
-			select {
-			case <-r.frameChan:
-			default:
-				goto frameChanDone
-			}
-		}
-	frameChanDone:
-		// Channel will be recreated below
-	}
-	r.frameChan = make(chan []byte, 5)
-	
-	if r.errChan != nil {
-		// Try to drain any remaining errors
-		for {
-			select {
-			case <-r.errChan:
-			default:
-				goto errChanDone
-			}
+	for drained := false; !drained; {
+		select {
+		case <-r.frameChan:
+		default:
+			drained = true
 		}
-	errChanDone:
-		// Channel will be recreated below
 	}
-	r.errChan = make(chan error, 1)
-	
-	// Reset frame accumulation
-	r.currentFrame = r.currentFrame[:0]
-	r.accessUnit = r.accessUnit[:0]
-	r.spsPpsFound = false
 	r.mu.Unlock()
 
 	// Restart FFmpeg
@@ -551,809 +753,157 @@ func (r *RTSPVideoSource) restartFFmpeg() {
 		// Reset lastFrameTime to give restart time to produce frames
 		r.mu.Lock()
 		r.lastFrameTime = time.Now()
+		r.restarts++
 		r.mu.Unlock()
 	}
 }
 
+// readFrames queues the access units FFmpeg writes to stdout (MPEG-TS), stamped from their PTS
 func (r *RTSPVideoSource) readFrames() {
 	defer func() {
-		// Only close channels if source is actually closed
+		// Only close channels if source is actually closed. We are the one sending on them, so
+		// Close leaves this to us - closing them there raced with the sends below.
 		r.mu.Lock()
-		isClosed := r.closed
-		r.mu.Unlock()
+		defer r.mu.Unlock()
 
-		if isClosed {
-			close(r.frameChan)
-			close(r.errChan)
+		if r.closed {
+			r.closeChannels.Do(func() {
+				close(r.frameChan)
+				close(r.errChan)
+			})
 		}
 	}()
 
-	// H264 NAL Unit start codes: 0x00000001 or 0x000001
-	buffer := make([]byte, 0, 128*1024)              // 128KB initial buffer (minimal for zero-latency)
-	reader := bufio.NewReaderSize(r.stdout, 16*1024) // 16KB read buffer (minimal)
-	chunk := make([]byte, 8*1024)                    // Read 8KB chunks (minimal for real-time)
+	r.mu.Lock()
+	stdout := r.stdout
+	r.mu.Unlock()
 
-	for {
+	err := readTSAccessUnits(stdout, func(accessUnit []byte, pts int64) {
+		frame := Frame{Data: accessUnit, PTS: r.clock.stamp(pts)}
+
+		// Queued under r.mu, so frameChan can't be closed in the middle of it
 		r.mu.Lock()
+		defer r.mu.Unlock()
 		if r.closed {
-			r.mu.Unlock()
-			return
-		}
-		r.mu.Unlock()
-
-		// Read chunk
-		n, err := reader.Read(chunk)
-		if err != nil {
-			// Helper function to safely send to error channel
-			sendErrorSafely := func(errMsg string) {
-				defer func() {
-					if r := recover(); r != nil {
-						// Channel was closed - this is expected during shutdown
-					}
-				}()
-				select {
-				case r.errChan <- fmt.Errorf("%s", errMsg):
-				default:
-					// Channel might be full or closed
-				}
-			}
-
-			// Helper function to safely send frame
-			sendFrameSafely := func(frame []byte) {
-				defer func() {
-					if r := recover(); r != nil {
-						// Channel was closed - this is expected during shutdown
-					}
-				}()
-				select {
-				case r.frameChan <- frame:
-				default:
-					// Channel might be full or closed
-				}
-			}
-
-			if err != io.EOF {
-				// Only send error if channel is not already closed
-				sendErrorSafely(fmt.Sprintf("failed to read from FFmpeg stdout: %v (FFmpeg may have exited)", err))
-			} else {
-				// EOF means FFmpeg closed its stdout
-				// Send error to indicate FFmpeg exited
-				sendErrorSafely("FFmpeg stdout closed (EOF) - process may have exited")
-			}
-			// Process remaining buffer before returning
-			if len(buffer) > 0 {
-				sendFrameSafely(buffer)
-			}
 			return
 		}
-
-		if n == 0 {
-			continue
-		}
-
-		buffer = append(buffer, chunk[:n]...)
-
-		// Log when we start receiving data (log once, then periodically)
-		if !ffmpegDataLogged && len(buffer) > 100 {
-			log.Printf("📥 FFmpeg started producing data: received %d bytes", len(buffer))
-			log.Printf("   Transcoding is working - parsing H.264 NAL units...")
-
-			// Debug: Check first bytes for H.264 start codes
-			if len(buffer) >= 100 {
-				firstBytesLen := 100
-				if len(buffer) < firstBytesLen {
-					firstBytesLen = len(buffer)
-				}
-				firstBytes := buffer[:firstBytesLen]
-				log.Printf("   First %d bytes (hex): %x", firstBytesLen, firstBytes)
-				// Look for start codes in first bytes
-				hasStartCode := false
-				for i := 0; i < len(firstBytes)-3; i++ {
-					if (firstBytes[i] == 0x00 && firstBytes[i+1] == 0x00 && firstBytes[i+2] == 0x00 && firstBytes[i+3] == 0x01) ||
-						(firstBytes[i] == 0x00 && firstBytes[i+1] == 0x00 && firstBytes[i+2] == 0x01) {
-						hasStartCode = true
-						log.Printf("   ✅ Found H.264 start code at position %d", i)
-						break
-					}
-				}
-				if !hasStartCode {
-					log.Printf("   ⚠️ No H.264 start codes found in first 100 bytes!")
-				}
-			}
-			ffmpegDataLogged = true
-		} else if len(buffer) > 50000 && len(buffer)%50000 < 32768 { // Log roughly every 50KB
-			log.Printf("📥 FFmpeg buffer: %d bytes (parsing NAL units...) - still looking for complete frames", len(buffer))
+		// Output from the new process ends a planned restart: further requests may stop it again
+		if r.restartPending && r.stdout == stdout {
+			r.restartPending = false
 		}
+		r.lastFrameTime = time.Now()
 
-		// Parse NAL units from buffer
-		// IMPORTANT: We need at least one complete start code + NAL unit to extract
-		// If buffer is too small, read more data first
-		if len(buffer) < 20 {
-			// Buffer too small, continue reading
-			continue
+		r.frameQueueCounter++
+		if r.frameQueueCounter == 1 {
+			log.Printf("📥 FFmpeg started producing frames")
 		}
-
-		for {
-			found := false
-
-			// Look for start codes (0x00000001 or 0x000001)
-			// Try 4-byte first (more common), then 3-byte
-			startCodeIdx := -1
-			startCodeLen := 0
-
-			if idx := findStartCode4(buffer); idx >= 0 {
-				startCodeIdx = idx
-				startCodeLen = 4
-			} else if idx := findStartCode3(buffer); idx >= 0 {
-				startCodeIdx = idx
-				startCodeLen = 3
+		select {
+		case r.frameChan <- frame:
+			if r.frameQueueCounter <= 10 {
+				log.Printf("📤 Queued complete access unit #%d: %d bytes", r.frameQueueCounter, len(frame.Data))
 			}
-
-			if startCodeIdx >= 0 {
-				// Find the previous start code to determine NAL unit boundaries
-				prevStartCodeIdx := -1
-				prevStartCodeLen := 0
-
-				// Look for previous start code before current one
-				for i := startCodeIdx - 1; i >= 0; i-- {
-					if i >= 3 && buffer[i-3] == 0x00 && buffer[i-2] == 0x00 && buffer[i-1] == 0x00 && buffer[i] == 0x01 {
-						prevStartCodeIdx = i - 3
-						prevStartCodeLen = 4
-						break
-					} else if i >= 2 && buffer[i-2] == 0x00 && buffer[i-1] == 0x00 && buffer[i] == 0x01 {
-						prevStartCodeIdx = i - 2
-						prevStartCodeLen = 3
-						break
-					}
-				}
-
-				var nalUnit []byte
-				var nalStart, nalEnd int
-
-				if prevStartCodeIdx >= 0 {
-					// Extract NAL unit between previous and current start code
-					nalStart = prevStartCodeIdx
-					nalEnd = startCodeIdx
-				} else {
-					// This is the FIRST start code in buffer - extract everything up to next start code
-					// Find the next start code after this one
-					nextStartCodeIdx := -1
-
-					// Use the detected start code length
-					currentStartCodeLen := startCodeLen
-
-					// Search for next start code after current one
-					for i := startCodeIdx + currentStartCodeLen; i < len(buffer)-3; i++ {
-						if i+3 < len(buffer) && buffer[i] == 0x00 && buffer[i+1] == 0x00 && buffer[i+2] == 0x00 && buffer[i+3] == 0x01 {
-							nextStartCodeIdx = i
-							break
-						} else if i+2 < len(buffer) && buffer[i] == 0x00 && buffer[i+1] == 0x00 && buffer[i+2] == 0x01 {
-							// Make sure it's not part of 4-byte code
-							if i == 0 || buffer[i-1] != 0x00 {
-								nextStartCodeIdx = i
-								break
-							}
-						}
-					}
-
-					if nextStartCodeIdx >= 0 {
-						// Extract NAL unit from first start code to next
-						nalStart = startCodeIdx
-						nalEnd = nextStartCodeIdx
-						prevStartCodeLen = currentStartCodeLen
-					} else {
-						// No next start code found yet - need more data
-						// Keep everything including first start code in buffer
-						// Don't process anything yet, break and read more
-						found = false // Don't mark as found, continue reading
-						break
-					}
-				}
-
-				if nalEnd > nalStart && nalEnd-nalStart > prevStartCodeLen {
-					nalUnit = make([]byte, nalEnd-nalStart)
-					copy(nalUnit, buffer[nalStart:nalEnd])
-
-					// Only process non-empty NAL units
-					if len(nalUnit) > prevStartCodeLen+1 {
-						// Extract NAL unit type
-						nalTypeByte := byte(0)
-						if len(nalUnit) >= 5 && nalUnit[0] == 0x00 && nalUnit[1] == 0x00 && nalUnit[2] == 0x00 && nalUnit[3] == 0x01 {
-							nalTypeByte = nalUnit[4] & 0x1F // 4-byte start code
-						} else if len(nalUnit) >= 4 && nalUnit[0] == 0x00 && nalUnit[1] == 0x00 && nalUnit[2] == 0x01 {
-							nalTypeByte = nalUnit[3] & 0x1F // 3-byte start code
-						}
-
-						// NAL unit types:
-						// 7 = SPS (Sequence Parameter Set)
-						// 8 = PPS (Picture Parameter Set)
-						// 5 = IDR (Instantaneous Decoder Refresh) - keyframe
-						// 1 = Non-IDR slice (P/B frame)
-
-						// Debug first few NAL units
-						if frameQueueCounter == 0 {
-							log.Printf("🔍 First NAL unit extracted: type=%d, size=%d bytes", nalTypeByte, len(nalUnit))
-						}
-
-						// Check if this is a picture frame (IDR or P/B) or AUD delimiter
-						isPictureFrame := nalTypeByte == 5 || nalTypeByte == 1
-						isIDR := nalTypeByte == 5
-						isAUD := nalTypeByte == 9 // Access Unit Delimiter
-
-						// Send frame when:
-						// 1. AUD encountered (marks end of access unit)
-						// 2. New picture frame encountered AND we have a previous frame to send
-						// 3. IDR frame encountered (always send IDRs immediately, even if first frame)
-						shouldSendFrame := false
-						if isAUD {
-							// AUD marks end of access unit - send current frame if we have one
-							shouldSendFrame = len(r.currentFrame) > 0
-						} else if isPictureFrame {
-							// For picture frames:
-							// - Always send if it's an IDR (first frame or keyframe)
-							// - Send previous frame if we have one accumulated
-							if isIDR {
-								// IDR frames should be sent immediately (especially the first one)
-								// If we have accumulated data, send it first, then start accumulating the IDR
-								if len(r.currentFrame) > 0 {
-									shouldSendFrame = true
-								} else {
-									// No previous frame, but we should still send this IDR once accumulated
-									// Don't send yet - add the IDR to currentFrame first
-								}
-							} else if len(r.currentFrame) > 0 {
-								// P/B frame encountered - send previous frame
-								shouldSendFrame = true
-							}
-						}
-
-						if shouldSendFrame {
-							// Send the accumulated frame
-							var frameToSend []byte
-
-							// Check if current frame contains an IDR (NAL type 5) anywhere
-							hasIDR := false
-							if len(r.spsPps) > 0 {
-								// Scan through currentFrame to find IDR NAL unit
-								i := 0
-								for i < len(r.currentFrame) {
-									var nalStart int
-									var nalType byte
-
-									// Find start code
-									if i+4 <= len(r.currentFrame) && r.currentFrame[i] == 0x00 && r.currentFrame[i+1] == 0x00 && r.currentFrame[i+2] == 0x00 && r.currentFrame[i+3] == 0x01 {
-										nalStart = i + 4
-										if nalStart < len(r.currentFrame) {
-											nalType = r.currentFrame[nalStart] & 0x1F
-										}
-										i = nalStart + 1
-									} else if i+3 <= len(r.currentFrame) && r.currentFrame[i] == 0x00 && r.currentFrame[i+1] == 0x00 && r.currentFrame[i+2] == 0x01 {
-										nalStart = i + 3
-										if nalStart < len(r.currentFrame) {
-											nalType = r.currentFrame[nalStart] & 0x1F
-										}
-										i = nalStart + 1
-									} else {
-										i++
-										continue
-									}
-
-									if nalType == 5 {
-										hasIDR = true
-										break
-									}
-								}
-							}
-
-							if hasIDR && len(r.spsPps) > 0 {
-								// Prepend SPS/PPS to IDR frame
-								frameToSend = make([]byte, len(r.spsPps)+len(r.currentFrame))
-								copy(frameToSend, r.spsPps)
-								copy(frameToSend[len(r.spsPps):], r.currentFrame)
-							} else {
-								frameToSend = make([]byte, len(r.currentFrame))
-								copy(frameToSend, r.currentFrame)
-							}
-
-							frameQueueCounter++
-							// Send frame with buffering to handle network jitter
-							// Buffer allows smooth playback during temporary network delays
-							// Update last frame time
-							r.mu.Lock()
-							r.lastFrameTime = time.Now()
-							r.mu.Unlock()
-
-							select {
-							case r.frameChan <- frameToSend:
-								// Frame sent successfully
-								if frameQueueCounter <= 10 {
-									log.Printf("📤 Queued complete access unit #%d: %d bytes", frameQueueCounter, len(frameToSend))
-								}
-							default:
-								// Channel is full - drop oldest frame to prevent excessive buffering
-								// This prevents buffer buildup while maintaining smooth playback
-								select {
-								case oldFrame := <-r.frameChan: // Remove and discard old frame
-									_ = oldFrame // Explicitly discard old frame
-									select {
-									case r.frameChan <- frameToSend: // Add newest frame
-										// Successfully replaced old frame with new one
-										if frameQueueCounter%100 == 0 {
-											log.Printf("⚡ Buffer full: Replaced old frame #%d with latest", frameQueueCounter)
-										}
-									default:
-										// Extremely rare - channel filled between operations
-										log.Printf("⚠️ Warning: Frame channel still full after drop")
-									}
-								default:
-									// Channel became empty between checks - send new frame
-									r.frameChan <- frameToSend
-								}
-							}
-
-							// Clear current frame accumulator
-							r.currentFrame = r.currentFrame[:0]
-						}
-
-						if isAUD {
-							// AUD marks end of access unit - frame should have been sent above
-							// Don't add AUD to frame, it's just a delimiter
-							// However, if we have an accumulated frame but haven't sent it, send it now
-							if len(r.currentFrame) > 0 && !shouldSendFrame {
-								// We have a frame but AUD didn't trigger send - send it now
-								var frameToSend []byte
-								if len(r.spsPps) > 0 {
-									// Check if currentFrame has IDR
-									hasIDR := false
-									for i := 0; i < len(r.currentFrame)-3; i++ {
-										if r.currentFrame[i] == 0x00 && r.currentFrame[i+1] == 0x00 && r.currentFrame[i+2] == 0x00 && r.currentFrame[i+3] == 0x01 {
-											if i+4 < len(r.currentFrame) {
-												nalType := r.currentFrame[i+4] & 0x1F
-												if nalType == 5 {
-													hasIDR = true
-													break
-												}
-											}
-										} else if i+2 < len(r.currentFrame) && r.currentFrame[i] == 0x00 && r.currentFrame[i+1] == 0x00 && r.currentFrame[i+2] == 0x01 {
-											if i+3 < len(r.currentFrame) {
-												nalType := r.currentFrame[i+3] & 0x1F
-												if nalType == 5 {
-													hasIDR = true
-													break
-												}
-											}
-										}
-									}
-									if hasIDR {
-										frameToSend = make([]byte, len(r.spsPps)+len(r.currentFrame))
-										copy(frameToSend, r.spsPps)
-										copy(frameToSend[len(r.spsPps):], r.currentFrame)
-									} else {
-										frameToSend = make([]byte, len(r.currentFrame))
-										copy(frameToSend, r.currentFrame)
-									}
-								} else {
-									frameToSend = make([]byte, len(r.currentFrame))
-									copy(frameToSend, r.currentFrame)
-								}
-								// Send the frame
-								select {
-								case r.frameChan <- frameToSend:
-									frameQueueCounter++
-									if frameQueueCounter <= 10 {
-										log.Printf("📤 Queued complete access unit #%d (via AUD): %d bytes", frameQueueCounter, len(frameToSend))
-									}
-								default:
-									// Channel full, replace
-									select {
-									case <-r.frameChan:
-										r.frameChan <- frameToSend
-										frameQueueCounter++
-									default:
-										r.frameChan <- frameToSend
-										frameQueueCounter++
-									}
-								}
-								r.currentFrame = r.currentFrame[:0]
-							}
-						} else if isPictureFrame {
-							// Start accumulating NAL units for this new frame
-							wasEmpty := len(r.currentFrame) == 0
-							r.currentFrame = append(r.currentFrame, nalUnit...)
-
-							// Special case: If this is the first IDR frame and we have SPS/PPS,
-							// we should send it after accumulating (when next NAL or timeout)
-							// But for now, if we just started accumulating an IDR and we have SPS/PPS,
-							// mark that we should check on next iteration
-							if wasEmpty && isIDR && len(r.spsPps) > 0 {
-								// First IDR frame with SPS/PPS - will be sent when next NAL arrives
-								// or after a short delay if no more NALs come
-							}
-						} else if nalTypeByte == 7 || nalTypeByte == 8 {
-							// SPS/PPS - accumulate for next access unit
-							r.accessUnit = append(r.accessUnit, nalUnit...)
-
-							// Check if we have both SPS and PPS now
-							hasSPS := false
-							hasPPS := false
-							for i := 0; i < len(r.accessUnit)-3; i++ {
-								var nalType byte
-								if r.accessUnit[i] == 0x00 && r.accessUnit[i+1] == 0x00 && r.accessUnit[i+2] == 0x00 && r.accessUnit[i+3] == 0x01 {
-									if i+4 < len(r.accessUnit) {
-										nalType = r.accessUnit[i+4] & 0x1F
-									} else {
-										continue
-									}
-								} else if r.accessUnit[i] == 0x00 && r.accessUnit[i+1] == 0x00 && r.accessUnit[i+2] == 0x01 {
-									if i+3 < len(r.accessUnit) {
-										nalType = r.accessUnit[i+3] & 0x1F
-									} else {
-										continue
-									}
-								} else {
-									continue
-								}
-
-								if nalType == 7 {
-									hasSPS = true
-								} else if nalType == 8 {
-									hasPPS = true
-								}
-							}
-
-							if hasSPS && hasPPS {
-								// Save persistent copy of SPS/PPS
-								r.spsPps = make([]byte, len(r.accessUnit))
-								copy(r.spsPps, r.accessUnit)
-								log.Printf("📋 Saved SPS/PPS: %d bytes", len(r.spsPps))
-							}
-
-							if !r.spsPpsFound {
-								log.Printf("📋 Received %s parameter set (size: %d bytes)",
-									map[byte]string{7: "SPS", 8: "PPS"}[nalTypeByte], len(nalUnit))
-							}
-						} else {
-							// Other NAL unit types (AUD=9, SEI=6, etc.) - add to current frame if we're building one
-							if len(r.currentFrame) > 0 {
-								r.currentFrame = append(r.currentFrame, nalUnit...)
-							} else {
-								// Not building a frame yet, accumulate in accessUnit
-								r.accessUnit = append(r.accessUnit, nalUnit...)
-							}
-						}
-					}
-
-					// Remove processed data from buffer
-					if prevStartCodeIdx >= 0 {
-						// Remove from previous start code to current start code
-						buffer = buffer[startCodeIdx:]
-					} else {
-						// Remove from first start code to next start code
-						buffer = buffer[nalEnd:]
-					}
-				} else {
-					// NAL unit too small or invalid, remove start code and continue
-					buffer = buffer[startCodeIdx+4:] // Skip the start code
-				}
-				found = true
+		default:
+			// Channel is full - drop the oldest frame to prevent excessive buffering
+			select {
+			case <-r.frameChan:
+			default:
 			}
-
-			if !found {
-				// No more start codes found in current buffer
-				// Before breaking, check if we have an accumulated IDR frame that should be sent
-				// This handles the case where we've accumulated a complete IDR but haven't encountered
-				// an AUD or next picture frame yet
-				if len(r.currentFrame) > 0 && len(r.spsPps) > 0 && frameQueueCounter == 0 {
-					// Check if currentFrame contains an IDR
-					hasIDR := false
-					for i := 0; i < len(r.currentFrame)-3; i++ {
-						if r.currentFrame[i] == 0x00 && r.currentFrame[i+1] == 0x00 && r.currentFrame[i+2] == 0x00 && r.currentFrame[i+3] == 0x01 {
-							if i+4 < len(r.currentFrame) {
-								nalType := r.currentFrame[i+4] & 0x1F
-								if nalType == 5 {
-									hasIDR = true
-									break
-								}
-							}
-						} else if i+2 < len(r.currentFrame) && r.currentFrame[i] == 0x00 && r.currentFrame[i+1] == 0x00 && r.currentFrame[i+2] == 0x01 {
-							if i+3 < len(r.currentFrame) {
-								nalType := r.currentFrame[i+3] & 0x1F
-								if nalType == 5 {
-									hasIDR = true
-									break
-								}
-							}
-						}
-					}
-					// If we have an IDR frame with sufficient size, send it
-					if hasIDR && len(r.currentFrame) > 100 {
-						frameToSend := make([]byte, len(r.spsPps)+len(r.currentFrame))
-						copy(frameToSend, r.spsPps)
-						copy(frameToSend[len(r.spsPps):], r.currentFrame)
-						select {
-						case r.frameChan <- frameToSend:
-							frameQueueCounter++
-							log.Printf("📤 Queued first IDR frame (complete): %d bytes", len(frameToSend))
-						default:
-							// Channel full, but this is first frame so clear and send
-							select {
-							case <-r.frameChan:
-								r.frameChan <- frameToSend
-								frameQueueCounter++
-								log.Printf("📤 Queued first IDR frame (complete): %d bytes", len(frameToSend))
-							default:
-								r.frameChan <- frameToSend
-								frameQueueCounter++
-								log.Printf("📤 Queued first IDR frame (complete): %d bytes", len(frameToSend))
-							}
-						}
-						r.currentFrame = r.currentFrame[:0]
-					}
-				}
-
-				// If buffer is large but no frames found, log for debugging
-				if len(buffer) > 100000 && frameQueueCounter == 0 {
-					log.Printf("⚠️ Large buffer (%d bytes) but no NAL units extracted yet - may need more data", len(buffer))
-					// Check if there are any start codes at all
-					hasAnyStartCode := false
-					checkLen := 1000
-					if len(buffer) < checkLen {
-						checkLen = len(buffer)
-					}
-					for i := 0; i < checkLen-3; i++ {
-						if (buffer[i] == 0x00 && buffer[i+1] == 0x00 && buffer[i+2] == 0x00 && buffer[i+3] == 0x01) ||
-							(i < len(buffer)-2 && buffer[i] == 0x00 && buffer[i+1] == 0x00 && buffer[i+2] == 0x01) {
-							hasAnyStartCode = true
-							break
-						}
-					}
-					if !hasAnyStartCode {
-						log.Printf("   ❌ No H.264 start codes found in buffer - FFmpeg output may not be in Annex-B format!")
-						log.Printf("   This suggests the h264_mp4toannexb bitstream filter may not be working")
-					} else {
-						log.Printf("   ✅ Start codes found but not forming complete NAL units - continuing to read...")
-					}
+			select {
+			case r.frameChan <- frame:
+				if r.frameQueueCounter%100 == 0 {
+					log.Printf("⚡ Buffer full: Replaced old frame #%d with latest", r.frameQueueCounter)
 				}
-				break
-			}
-
-			// Prevent buffer from growing - aggressive limit for zero-latency
-			if len(buffer) > 512*1024 { // 512KB max (minimal for real-time)
-				// Keep only last 256KB (immediate processing)
-				buffer = buffer[len(buffer)-256*1024:]
+			default:
 			}
 		}
-	}
-}
-
-// findStartCode4 finds 4-byte start code (0x00000001) in buffer
-// Returns index where start code begins, or -1 if not found
-func findStartCode4(buffer []byte) int {
-	for i := 0; i <= len(buffer)-4; i++ {
-		if buffer[i] == 0x00 && buffer[i+1] == 0x00 && buffer[i+2] == 0x00 && buffer[i+3] == 0x01 {
-			return i
-		}
-	}
-	return -1
-}
+	})
 
-// findStartCode3 finds 3-byte start code (0x000001) in buffer
-// Returns index where start code begins, or -1 if not found
-// Only checks after position 0 to avoid false positives from 4-byte codes
-func findStartCode3(buffer []byte) int {
-	start := 1 // Start from position 1 to avoid matching 4-byte codes
-	if start > len(buffer)-3 {
-		return -1
-	}
-	for i := start; i <= len(buffer)-3; i++ {
-		// Make sure it's not part of a 4-byte code
-		if i > 0 && buffer[i-1] == 0x00 {
-			continue
-		}
-		if buffer[i] == 0x00 && buffer[i+1] == 0x00 && buffer[i+2] == 0x01 {
-			return i
-		}
-	}
-	return -1
-}
-
-var (
-	frameReadCount    int64
-	firstFrameSent    bool
-	ffmpegDataLogged  bool // Track if we've logged first data receipt
-	frameQueueCounter int  // Track frames queued to channel (package-level for access from goroutine)
-)
-
-func (r *RTSPVideoSource) ReadFrame() ([]byte, error) {
-	// Check if source is closed first
 	r.mu.Lock()
-	closed := r.closed
+	plannedRestart := r.plannedRestart
 	r.mu.Unlock()
 
-	if closed {
-		return nil, fmt.Errorf("RTSP source is closed")
+	// FFmpeg exited: the exit monitor restarts it, and ReadFrame waits for the new process
+	if !plannedRestart && err != io.EOF && !r.isClosed() {
+		log.Printf("⚠️ Failed to read from FFmpeg stdout: %v", err)
 	}
+}
 
-	// Process health is monitored by the Wait() goroutine which will trigger restart
-	// No need to check here - rely on frame timeout health check below
-
-	// Check if we've been waiting too long for frames (health check)
-	r.mu.Lock()
-	lastFrameTime := r.lastFrameTime
-	timeSinceLastFrame := time.Since(lastFrameTime)
-	cmd := r.cmd
-	r.mu.Unlock()
-
-	// If we've been streaming and haven't received a frame in 30 seconds, FFmpeg is likely stuck
-	// Proactively restart FFmpeg even if process hasn't exited
-	if timeSinceLastFrame > 30*time.Second && !lastFrameTime.IsZero() {
-		// Check if restart is already in progress
-		r.restartMu.Lock()
-		alreadyRestarting := r.restartInProgress
-		r.restartMu.Unlock()
-		
-		if !alreadyRestarting {
-			log.Printf("⚠️ No frames received for %.1f seconds, FFmpeg may be stuck - forcing restart...", timeSinceLastFrame.Seconds())
-			// Force restart FFmpeg - it's likely hung or stuck
-			if cmd != nil && cmd.Process != nil {
-				log.Printf("🔄 Killing stuck FFmpeg process and restarting...")
-				// Kill the process to force restart
-				cmd.Process.Kill()
-				// Give it a moment to exit
-				time.Sleep(1 * time.Second)
-			}
-			// Trigger restart
-			go r.restartFFmpeg()
-		}
-		// Return error so caller knows to retry after restart
-		return nil, fmt.Errorf("FFmpeg appears stuck, restarting...")
-	} else if timeSinceLastFrame > 10*time.Second && !lastFrameTime.IsZero() {
-		// Warning threshold - log but don't restart yet
-		// Only log once per 10 seconds to avoid spam
-		if int(timeSinceLastFrame.Seconds())%10 == 0 {
-			log.Printf("⚠️ No frames received for %.1f seconds, monitoring FFmpeg...", timeSinceLastFrame.Seconds())
-		}
-	}
+// How long ReadFrame waits for a frame before FFmpeg counts as stuck and is restarted
+const frameStallTimeout = 30 * time.Second
 
-	// Real-time streaming: Try to get frame with reasonable timeout
-	// Increased timeout to prevent frame drops during network jitter
-	// Frame rate is 15fps (66ms per frame), so 500ms timeout allows for network delays
-	timeout := time.After(500 * time.Millisecond)
+// ReadFrame returns the next access unit. It blocks while FFmpeg starts, restarts or reconnects
+// to the camera, and only returns an error once the source stopped: ErrSourceClosed after
+// Close, or the reason FFmpeg could not be restarted. An FFmpeg that stops delivering frames
+// without exiting (a camera that went silent) is killed, so the exit monitor restarts it.
+func (r *RTSPVideoSource) ReadFrame() (Frame, error) {
+	stall := time.NewTimer(frameStallTimeout)
+	defer stall.Stop()
 
-	select {
-	case frame, ok := <-r.frameChan:
-		if !ok {
-			// Channel closed - source has failed
-			return nil, fmt.Errorf("frame channel closed - FFmpeg may have failed or exited")
-		}
-		return r.processFrame(frame)
-	case err, ok := <-r.errChan:
-		if !ok {
-			// Error channel closed - source has failed
-			return nil, fmt.Errorf("error channel closed - FFmpeg may have failed or exited")
-		}
-		if err != nil {
-			log.Printf("RTSP error: %v", err)
-			return nil, err
-		}
-		// err is nil but channel is open - this shouldn't happen, but handle it
-		return nil, fmt.Errorf("unexpected nil error from error channel")
-	case <-timeout:
-		// Very short timeout - check if channel has frame now (non-blocking check)
+	for {
 		select {
-		case frame, ok := <-r.frameChan:
+		case stamped, ok := <-r.frameChan:
 			if !ok {
-				// Channel closed while checking
-				return nil, fmt.Errorf("frame channel closed - FFmpeg may have failed or exited")
+				return Frame{}, ErrSourceClosed
+			}
+			if frame, ok := r.processFrame(stamped); ok {
+				return frame, nil
 			}
-			// Got frame immediately after timeout - process it
-			return r.processFrame(frame)
 		case err, ok := <-r.errChan:
 			if !ok {
-				// Error channel closed
-				return nil, fmt.Errorf("error channel closed - FFmpeg may have failed or exited")
+				return Frame{}, ErrSourceClosed
 			}
-			if err != nil {
-				log.Printf("RTSP error: %v", err)
-				return nil, err
-			}
-			// err is nil but channel is open - this shouldn't happen, but handle it
-			return nil, fmt.Errorf("unexpected nil error from error channel")
-		default:
-			// No frame available and no error - check if channels are closed
+			return Frame{}, err
+		case <-r.stopped:
+			return Frame{}, ErrSourceClosed
+		case <-stall.C:
+			// Restarts reset lastFrameTime, so a new process gets the full timeout to deliver
 			r.mu.Lock()
-			isClosed := r.closed
+			sinceLastFrame := time.Since(r.lastFrameTime)
+			cmd := r.cmd
 			r.mu.Unlock()
+			r.restartMu.Lock()
+			restarting := r.restartInProgress
+			r.restartMu.Unlock()
 
-			if isClosed {
-				return nil, fmt.Errorf("RTSP source is closed")
+			if sinceLastFrame < frameStallTimeout || restarting {
+				stall.Reset(max(frameStallTimeout-sinceLastFrame, time.Second))
+				continue
 			}
-
-			// No frame available yet - retry once more with a brief sleep to avoid busy-waiting
-			// but don't recurse infinitely
-			time.Sleep(33 * time.Millisecond) // ~1 frame at 30fps, prevents excessive retries
-			select {
-			case frame, ok := <-r.frameChan:
-				if !ok {
-					return nil, fmt.Errorf("frame channel closed - FFmpeg may have failed or exited")
-				}
-				return r.processFrame(frame)
-			case err, ok := <-r.errChan:
-				if !ok {
-					return nil, fmt.Errorf("error channel closed - FFmpeg may have failed or exited")
-				}
-				if err != nil {
-					return nil, err
-				}
-				// err is nil but channel is open - this shouldn't happen, but handle it
-				return nil, fmt.Errorf("unexpected nil error from error channel")
-			default:
-				// Still no frame - check if channels are closed (indicates FFmpeg died)
-				// If channels are still open, this is just a temporary delay
-				r.mu.Lock()
-				isClosed := r.closed
-				r.mu.Unlock()
-
-				if isClosed {
-					return nil, fmt.Errorf("RTSP source is closed")
-				}
-
-				// Check if we've been waiting too long - if so, trigger restart
-				r.mu.Lock()
-				lastFrameTime := r.lastFrameTime
-				timeSinceLastFrame := time.Since(lastFrameTime)
-				cmd := r.cmd
-				r.mu.Unlock()
-
-				// If no frames for 30+ seconds, force restart
-				if timeSinceLastFrame > 30*time.Second && !lastFrameTime.IsZero() {
-					// Check if restart is already in progress
-					r.mu.Lock()
-					r.mu.Unlock() // Need to check restart flag
-					r.restartMu.Lock()
-					alreadyRestarting := r.restartInProgress
-					r.restartMu.Unlock()
-					
-					if !alreadyRestarting {
-						log.Printf("⚠️ No frames available for %.1f seconds, forcing FFmpeg restart...", timeSinceLastFrame.Seconds())
-						if cmd != nil && cmd.Process != nil {
-							cmd.Process.Kill()
-							time.Sleep(1 * time.Second)
-						}
-						go r.restartFFmpeg()
-					}
-					return nil, fmt.Errorf("FFmpeg appears stuck, restarting...")
-				}
-
-				// Temporary delay - return error but don't stop streaming
-				// The caller should continue and retry
-				return nil, fmt.Errorf("no frame available - FFmpeg may still be initializing or stream may be temporarily unavailable")
+			log.Printf("⚠️ No frames received for %.1f seconds, FFmpeg may be stuck - forcing restart...", sinceLastFrame.Seconds())
+			if cmd != nil && cmd.Process != nil {
+				cmd.Process.Kill()
 			}
+			stall.Reset(frameStallTimeout)
 		}
 	}
 }
 
+func (r *RTSPVideoSource) isClosed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
 // processFrame handles frame processing logic separately for reusability
-func (r *RTSPVideoSource) processFrame(frame []byte) ([]byte, error) {
-	frameReadCount++
-	
+// It reports false for frames that are skipped (empty, too small, or before the first SPS/PPS).
+func (r *RTSPVideoSource) processFrame(stamped Frame) (Frame, bool) {
+	r.frameReadCount++
+	frame := stamped.Data
+
 	// Update last frame time on successful frame receipt
 	r.mu.Lock()
 	r.lastFrameTime = time.Now()
 	r.restartCount = 0 // Reset restart count on successful frame
 	r.mu.Unlock()
 
-	if frame == nil {
-		return nil, fmt.Errorf("frame channel closed")
-	}
 	if len(frame) == 0 {
-		// Skip empty frames, try again immediately
-		return r.ReadFrame()
+		// Skip empty frames
+		return Frame{}, false
 	}
 
 	// For the very first frame, ensure it has SPS/PPS
 	// Pion WebRTC needs SPS/PPS before the first IDR frame
-	if !firstFrameSent && len(frame) >= 8 {
+	if !r.firstFrameSent && len(frame) >= 8 {
 		// Check if this frame starts with SPS/PPS
 		hasSpsPps := false
 		if len(frame) >= 8 {
@@ -1387,28 +937,28 @@ func (r *RTSPVideoSource) processFrame(frame []byte) ([]byte, error) {
 			// First frame doesn't have SPS/PPS
 			// After transcoding starts, libx264 should produce frames with SPS/PPS
 			// But if we wait too long, skip the check after 5 attempts
-			if frameReadCount <= 5 {
-				log.Printf("⚠️ First frame doesn't contain SPS/PPS (attempt %d), skipping and waiting...", frameReadCount)
-				return r.ReadFrame()
+			if r.frameReadCount <= 5 {
+				log.Printf("⚠️ First frame doesn't contain SPS/PPS (attempt %d), skipping and waiting...", r.frameReadCount)
+				return Frame{}, false
 			} else {
 				log.Printf("⚠️ No SPS/PPS found after 5 attempts, sending frame anyway (transcoding may still be initializing)")
 				// Continue anyway - transcoding might need more time
 			}
 		}
-		firstFrameSent = true
+		r.firstFrameSent = true
 		log.Printf("✅ First frame ready: %d bytes (SPS/PPS: %v)", len(frame), hasSpsPps)
 	}
 
 	if len(frame) < 8 {
 		// Skip very small frames (not valid NAL units)
-		if frameReadCount%100 == 0 {
+		if r.frameReadCount%100 == 0 {
 			log.Printf("Skipping small frame: %d bytes", len(frame))
 		}
-		return r.ReadFrame()
+		return Frame{}, false
 	}
 
 	// Log first few frames for debugging
-	if frameReadCount <= 5 || frameReadCount%100 == 0 {
+	if r.frameReadCount <= 5 || r.frameReadCount%100 == 0 {
 		nalTypes := []string{}
 		// Parse all NAL units in the access unit
 		i := 0
@@ -1453,45 +1003,147 @@ func (r *RTSPVideoSource) processFrame(frame []byte) ([]byte, error) {
 				i++
 			}
 		}
-		log.Printf("📹 RTSP access unit #%d: %d bytes, NALs: %v", frameReadCount, len(frame), nalTypes)
+		log.Printf("📹 RTSP access unit #%d: %d bytes, NALs: %v", r.frameReadCount, len(frame), nalTypes)
 	}
 
-	return frame, nil
+	return stamped, true
 }
 
-func (r *RTSPVideoSource) Close() error {
+// RequestKeyframe leaves FFmpeg running: the transcoding encoder already sends a keyframe every
+// GOP (-g 15), sooner than a restart could, which would reconnect the camera and freeze every
+// viewer. In passthrough mode only the camera decides, so it reports false.
+func (r *RTSPVideoSource) RequestKeyframe() bool {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	return !r.closed && r.cmd != nil && r.encoder != "copy"
+}
+
+// Restart reconnects to the camera with a new FFmpeg process on request. The camera is probed
+// again, so a camera that changed its codec or gained audio gets the right pipeline.
+func (r *RTSPVideoSource) Restart() error {
+	r.restartMu.Lock()
+	restarting := r.restartInProgress
+	r.restartMu.Unlock()
+
+	r.mu.Lock()
+	cmd := r.cmd
+	if r.closed || cmd == nil || cmd.Process == nil {
+		r.mu.Unlock()
+		return fmt.Errorf("RTSP source is not running")
+	}
+	r.reprobe = true
+	if restarting || r.plannedRestart || r.restartPending {
+		// A new process is on its way anyway, or has only just started
+		r.mu.Unlock()
+		return nil
+	}
+	r.plannedRestart = true
+	r.restartPending = true
+	r.mu.Unlock()
+
+	log.Println("🔄 Restarting FFmpeg on request...")
+	cmd.Process.Kill()
+	return nil
+}
+
+// reprobing reports whether the next start should probe the camera again (see Restart)
+func (r *RTSPVideoSource) reprobing() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reprobe
+}
+
+func (r *RTSPVideoSource) Status() SourceStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return SourceStatus{
+		Type:     SourceRTSP,
+		Codec:    webrtc.MimeTypeH264,
+		Encoder:  r.encoder,
+		FPS:      r.frameRate,
+		Restarts: r.restarts,
+	}
+}
+
+// readLayer queues the frames of one extra rendition until FFmpeg closes its pipe
+func (r *RTSPVideoSource) readLayer(layer int, pipe *os.File) {
+	defer pipe.Close()
 
+	frames := r.layerFrames[layer-1]
+	readTSAccessUnits(pipe, func(accessUnit []byte, pts int64) {
+		frame := Frame{Data: accessUnit, PTS: r.clock.stamp(pts)} // On the same timeline as layer 0
+		select {
+		case frames <- frame:
+		default:
+			// Nobody is reading fast enough - drop the oldest frame to keep latency low
+			select {
+			case <-frames:
+			default:
+			}
+			select {
+			case frames <- frame:
+			default:
+			}
+		}
+	})
+}
+
+// Renditions returns the layers this source encodes, highest first, or nil when it sends a
+// single encoding (no renditions configured, or the camera's H.264 is passed through)
+func (r *RTSPVideoSource) Renditions() []config.RenditionConfig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.renditions) < 2 || r.encoder == "copy" {
+		return nil
+	}
+	return r.renditions
+}
+
+// ReadLayerFrame returns the next frame of rendition layer (1 and up; layer 0 is ReadFrame),
+// blocking across FFmpeg restarts until a frame arrives or the source is closed
+func (r *RTSPVideoSource) ReadLayerFrame(layer int) (Frame, error) {
+	if layer < 1 || layer > len(r.layerFrames) {
+		return Frame{}, fmt.Errorf("no rendition layer %d", layer)
+	}
+
+	select {
+	case frame := <-r.layerFrames[layer-1]:
+		return frame, nil
+	case <-r.stopped:
+		return Frame{}, ErrSourceClosed
+	}
+}
+
+func (r *RTSPVideoSource) Close() error {
+	r.mu.Lock()
 	if r.closed {
+		r.mu.Unlock()
 		return nil
 	}
 
 	r.closed = true
+	close(r.stopped)
+	cmd, exited, stdout := r.cmd, r.exited, r.stdout
+	r.mu.Unlock()
 
 	// Stop restart attempts
 	r.restartMu.Lock()
 	defer r.restartMu.Unlock()
 
-	if r.cmd != nil && r.cmd.Process != nil {
-		r.cmd.Process.Kill()
-		r.cmd.Wait()
+	// With nobody reading its output FFmpeg must not block writing a frame - it gets EPIPE and
+	// stops along with the SIGTERM
+	if stdout != nil {
+		stdout.Close()
 	}
-
-	if r.stdout != nil {
-		r.stdout.Close()
+	if cmd != nil && cmd.Process != nil {
+		terminate(cmd, exited)
 	}
 
-	// Close channels
-	if r.frameChan != nil {
-		close(r.frameChan)
-		r.frameChan = nil
-	}
-	if r.errChan != nil {
-		close(r.errChan)
-		r.errChan = nil
+	if r.audio != nil {
+		r.audio.close()
 	}
 
+	// frameChan and errChan are closed by readFrames on its way out
 	return nil
 }
 
@@ -1501,3 +1153,23 @@ func (r *RTSPVideoSource) GetFrameRate() int {
 	defer r.mu.Unlock()
 	return r.frameRate
 }
+
+func (r *RTSPVideoSource) GetMimeType() string {
+	return webrtc.MimeTypeH264
+}
+
+// HasAudio reports whether the camera's audio is pulled alongside the video: AUDIO_ENABLED is on
+// and the probe in Start found an audio stream (false until Start has run)
+func (r *RTSPVideoSource) HasAudio() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.audio != nil && r.cameraHasAudio
+}
+
+// ReadAudio returns the next Opus packet from the camera
+func (r *RTSPVideoSource) ReadAudio() (media.Sample, error) {
+	if r.audio == nil {
+		return media.Sample{}, io.EOF
+	}
+	return r.audio.ReadAudio()
+}
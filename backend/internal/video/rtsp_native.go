@@ -0,0 +1,407 @@
+package video
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"webrtc-streaming/internal/config"
+	"webrtc-streaming/internal/rtsp"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// RTSP ingest clients selectable with VIDEO_RTSP_CLIENT
+const (
+	RTSPClientAuto   = "auto"   // Native client when the camera's video can go out as is, FFmpeg otherwise
+	RTSPClientNative = "native" // Always the built-in Go client
+	RTSPClientFFmpeg = "ffmpeg" // Always FFmpeg
+)
+
+// How long the native client waits for the camera to answer or send packets
+const nativeRTSPTimeout = 10 * time.Second
+
+// NativeRTSPVideoSource pulls H.264 from an RTSP camera with the built-in Go client: no FFmpeg
+// process, no decoding or encoding. In forwarding mode (VIDEO_FORWARD_RTP) the camera's RTP
+// packets go out with rewritten headers; otherwise they are reassembled into access units.
+type NativeRTSPVideoSource struct {
+	rtspURL      string
+	transport    string
+	forwardRTP   bool
+	frameChan    chan Frame
+	packetChan   chan *rtp.Packet // Forwarding mode
+	rewriter     *rtpRewriter     // Keeps the outgoing RTP stream continuous across reconnects
+	frameRate    int
+	mu           sync.Mutex
+	client       *rtsp.Client
+	closed       bool
+	stopChan     chan struct{}
+	restartCount int           // Reconnections since the source started
+	nextPTS      time.Duration // Where the next session's timestamps start, so PTS continues across reconnects
+}
+
+func NewNativeRTSPVideoSource(rtspURL string) (*NativeRTSPVideoSource, error) {
+	return &NativeRTSPVideoSource{
+		rtspURL:    rtspURL,
+		transport:  config.AppConfig.Video.RTSPTransport,
+		forwardRTP: config.AppConfig.Video.ForwardRTP,
+		frameChan:  make(chan Frame, 5),
+		// A keyframe is a burst of a few hundred packets
+		packetChan: make(chan *rtp.Packet, 512),
+		rewriter:   newRTPRewriter(),
+		frameRate:  config.AppConfig.Video.FPS, // Replaced by a=framerate or the measured rate
+		stopChan:   make(chan struct{}),
+	}, nil
+}
+
+// newRTSPSource picks the ingest path for a camera: the native client when its video can be sent
+// to browsers as is, FFmpeg when it has to be transcoded or its audio is wanted
+func newRTSPSource(rtspURL string) (VideoSource, error) {
+	videoConfig := config.AppConfig.Video
+
+	switch videoConfig.RTSPClient {
+	case RTSPClientNative:
+		if len(videoConfig.Renditions) > 1 {
+			log.Printf("⚠️ VIDEO_RENDITIONS is ignored - the native RTSP client sends the camera's only encoding")
+		}
+		return NewNativeRTSPVideoSource(rtspURL)
+	case RTSPClientFFmpeg:
+		return NewRTSPVideoSource(rtspURL)
+	case RTSPClientAuto, "":
+	default:
+		return nil, fmt.Errorf("unknown VIDEO_RTSP_CLIENT %q (expected auto, native or ffmpeg)", videoConfig.RTSPClient)
+	}
+
+	if videoConfig.Passthrough == PassthroughNever {
+		return NewRTSPVideoSource(rtspURL)
+	}
+	if len(videoConfig.Renditions) > 1 {
+		log.Printf("📚 Renditions are configured and need transcoding - using FFmpeg")
+		return NewRTSPVideoSource(rtspURL)
+	}
+	if !strings.HasPrefix(strings.ToLower(rtspURL), "rtsp://") {
+		log.Printf("⚠️ Native RTSP client only speaks rtsp:// - using FFmpeg")
+		return NewRTSPVideoSource(rtspURL)
+	}
+
+	log.Printf("🔍 Asking camera for its stream description...")
+	media, err := describeRTSP(rtspURL, videoConfig.RTSPTransport)
+	if err != nil {
+		log.Printf("⚠️ Native RTSP client can't use this camera (%v) - using FFmpeg", err)
+		return NewRTSPVideoSource(rtspURL)
+	}
+	log.Printf("📋 Camera stream: %s", media)
+
+	switch {
+	case config.AppConfig.Audio.Enabled && media.HasAudio:
+		log.Printf("   Audio is enabled and needs transcoding to Opus - using FFmpeg")
+		return NewRTSPVideoSource(rtspURL)
+	case !media.BrowserCompatible() && videoConfig.Passthrough != PassthroughAlways:
+		log.Printf("   Video is not baseline H.264 and needs transcoding - using FFmpeg")
+		return NewRTSPVideoSource(rtspURL)
+	}
+	log.Printf("⚡ Using the native RTSP client - no FFmpeg needed for this camera")
+	return NewNativeRTSPVideoSource(rtspURL)
+}
+
+// describeRTSP connects just long enough to read the camera's stream description
+func describeRTSP(rtspURL, transport string) (*rtsp.VideoMedia, error) {
+	client, err := rtsp.Dial(rtspURL, transport, nativeRTSPTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	return client.Describe()
+}
+
+func (n *NativeRTSPVideoSource) Start() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.closed {
+		return fmt.Errorf("native RTSP source already closed")
+	}
+
+	log.Printf("Starting native RTSP stream from: %s (transport: %s, forward RTP: %v)", redactURL(n.rtspURL), n.transport, n.forwardRTP)
+	go n.run()
+	return nil
+}
+
+// run keeps a session to the camera open, reconnecting with a growing delay when it drops
+func (n *NativeRTSPVideoSource) run() {
+	delay := time.Second
+	for {
+		started := time.Now()
+		err := n.stream()
+		if n.isClosed() {
+			return
+		}
+
+		// A session that ran for a while was healthy - reconnect quickly
+		if time.Since(started) > time.Minute {
+			delay = time.Second
+		}
+		n.mu.Lock()
+		n.restartCount++
+		restarts := n.restartCount
+		n.mu.Unlock()
+		log.Printf("❌ Native RTSP stream stopped: %v - reconnecting in %v (reconnect #%d)", err, delay, restarts)
+
+		select {
+		case <-n.stopChan:
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, 30*time.Second)
+	}
+}
+
+// stream runs one RTSP session until it fails or the source is closed
+func (n *NativeRTSPVideoSource) stream() error {
+	client, err := rtsp.Dial(n.rtspURL, n.transport, nativeRTSPTimeout)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.client = client
+	n.mu.Unlock()
+
+	media, err := client.Describe()
+	if err != nil {
+		return err
+	}
+	if err := client.Setup(); err != nil {
+		return err
+	}
+	if err := client.Play(); err != nil {
+		return err
+	}
+	log.Printf("✅ Native RTSP session playing: %s", media)
+
+	if media.FrameRate >= 1 {
+		n.setFrameRate(int(media.FrameRate + 0.5))
+	}
+	if n.forwardRTP {
+		return n.forward(client, media)
+	}
+
+	depacketizer := rtsp.NewH264Depacketizer(media.SPS, media.PPS)
+	var lastTimestamp uint32
+	var ticks int64 // RTP clock ticks since the session's first frame
+	frameCount := 0
+	ptsBase := n.nextPTS
+	for {
+		packet, err := client.ReadPacket()
+		if err != nil {
+			return err
+		}
+
+		accessUnits, err := depacketizer.Push(packet)
+		if err != nil && depacketizer.LostFrames()%50 == 1 {
+			log.Printf("⚠️ Native RTSP: %v (%d frames lost so far)", err, depacketizer.LostFrames())
+		}
+		for _, au := range accessUnits {
+			if frameCount > 0 {
+				n.measureFrameRate(media, lastTimestamp, au.Timestamp)
+				// Signed difference, so the 32-bit timestamp can wrap around
+				ticks += int64(int32(au.Timestamp - lastTimestamp))
+			}
+			lastTimestamp = au.Timestamp
+			frameCount++
+			if frameCount == 1 {
+				log.Printf("🎉 Native RTSP: first keyframe received (%d bytes)", len(au.Data))
+			}
+			pts := ptsBase + time.Duration(ticks)*time.Second/time.Duration(media.ClockRate)
+			n.nextPTS = pts + time.Second/time.Duration(max(n.GetFrameRate(), 1))
+			n.queueFrame(Frame{Data: au.Data, PTS: pts})
+		}
+	}
+}
+
+// forward sends the session's packets on with rewritten headers, without assembling frames
+func (n *NativeRTSPVideoSource) forward(client *rtsp.Client, media *rtsp.VideoMedia) error {
+	n.rewriter.newSession(media.SPS, media.PPS, media.ClockRate/uint32(max(n.GetFrameRate(), 1)))
+
+	var lastTimestamp uint32
+	frameCount := 0
+	forwarding := false
+	for {
+		packet, err := client.ReadPacket()
+		if err != nil {
+			return err
+		}
+
+		// The marker bit ends a frame
+		if packet.Marker {
+			if frameCount > 0 {
+				n.measureFrameRate(media, lastTimestamp, packet.Timestamp)
+			}
+			lastTimestamp = packet.Timestamp
+			frameCount++
+		}
+
+		packets := n.rewriter.rewrite(packet)
+		if len(packets) > 0 && !forwarding {
+			forwarding = true
+			log.Printf("🎉 Native RTSP: keyframe received, forwarding RTP packets")
+		}
+		for _, out := range packets {
+			n.queuePacket(out)
+		}
+	}
+}
+
+// measureFrameRate updates the frame rate from the timestamps of two consecutive frames,
+// for cameras that don't announce a=framerate
+func (n *NativeRTSPVideoSource) measureFrameRate(media *rtsp.VideoMedia, previous, current uint32) {
+	if media.FrameRate != 0 || current == previous {
+		return
+	}
+	if fps := int(float64(media.ClockRate)/float64(current-previous) + 0.5); fps >= 1 && fps <= 120 {
+		n.setFrameRate(fps)
+	}
+}
+
+// queuePacket hands a packet to ReadRTP, dropping the oldest queued packet if the consumer is behind
+func (n *NativeRTSPVideoSource) queuePacket(packet *rtp.Packet) {
+	select {
+	case n.packetChan <- packet:
+	default:
+		select {
+		case <-n.packetChan:
+		default:
+		}
+		n.packetChan <- packet
+	}
+}
+
+// queueFrame hands an access unit to ReadFrame, dropping the oldest queued frame if the consumer is behind
+func (n *NativeRTSPVideoSource) queueFrame(frame Frame) {
+	select {
+	case n.frameChan <- frame:
+	default:
+		select {
+		case <-n.frameChan:
+		default:
+		}
+		n.frameChan <- frame
+	}
+}
+
+func (n *NativeRTSPVideoSource) setFrameRate(fps int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.frameRate != fps {
+		log.Printf("📊 Detected frame rate from stream: %d FPS (was: %d FPS)", fps, n.frameRate)
+		n.frameRate = fps
+	}
+}
+
+func (n *NativeRTSPVideoSource) isClosed() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.closed
+}
+
+// ReadFrame returns the next H.264 access unit (Annex-B), stamped from its RTP timestamp
+// It blocks across reconnects to the camera until a frame arrives or the source is closed.
+func (n *NativeRTSPVideoSource) ReadFrame() (Frame, error) {
+	select {
+	case frame := <-n.frameChan:
+		return frame, nil
+	case <-n.stopChan:
+		return Frame{}, ErrSourceClosed
+	}
+}
+
+// ForwardsRTP reports whether the source forwards packets (ReadRTP) instead of frames (ReadFrame)
+func (n *NativeRTSPVideoSource) ForwardsRTP() bool {
+	return n.forwardRTP
+}
+
+// ReadRTP returns the next packet to forward, blocking until one arrives
+func (n *NativeRTSPVideoSource) ReadRTP() (*rtp.Packet, error) {
+	select {
+	case packet := <-n.packetChan:
+		return packet, nil
+	case <-n.stopChan:
+		return nil, ErrSourceClosed
+	}
+}
+
+func (n *NativeRTSPVideoSource) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	close(n.stopChan)
+	client := n.client
+	n.mu.Unlock()
+
+	if client != nil {
+		client.Close()
+	}
+	return nil
+}
+
+// Restart drops the current session; run reconnects as it would after a network error
+func (n *NativeRTSPVideoSource) Restart() error {
+	n.mu.Lock()
+	client := n.client
+	closed := n.closed
+	n.mu.Unlock()
+	if closed || client == nil {
+		return fmt.Errorf("native RTSP source is not running")
+	}
+
+	log.Printf("🔄 Reconnecting to the camera on request...")
+	client.Close()
+	return nil
+}
+
+func (n *NativeRTSPVideoSource) Status() SourceStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return SourceStatus{
+		Type:     "rtsp-native",
+		Codec:    webrtc.MimeTypeH264,
+		Encoder:  "copy", // The camera's H.264 goes out as is
+		FPS:      n.frameRate,
+		Restarts: n.restartCount,
+	}
+}
+
+func (n *NativeRTSPVideoSource) GetFrameRate() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.frameRate
+}
+
+func (n *NativeRTSPVideoSource) GetMimeType() string {
+	return webrtc.MimeTypeH264
+}
+
+// redactURL hides the password in an RTSP URL for logging
+func redactURL(rawURL string) string {
+	scheme, rest, ok := strings.Cut(rawURL, "://")
+	if !ok {
+		return rawURL
+	}
+	userinfo, host, ok := strings.Cut(rest, "@")
+	if !ok {
+		return rawURL
+	}
+	user, _, _ := strings.Cut(userinfo, ":")
+	return scheme + "://" + user + ":***@" + host
+}
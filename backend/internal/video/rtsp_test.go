@@ -0,0 +1,30 @@
+package video
+
+import "testing"
+
+func TestRTSPHasAudio(t *testing.T) {
+	tests := []struct {
+		name           string
+		audioEnabled   bool
+		cameraHasAudio bool
+		want           bool
+	}{
+		{"audio enabled, camera sends audio", true, true, true},
+		{"audio enabled, camera sends none", true, false, false},
+		{"audio disabled", false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &RTSPVideoSource{cameraHasAudio: tt.cameraHasAudio}
+			if tt.audioEnabled {
+				r.audio = &opusReceiver{}
+			}
+			if got := r.HasAudio(); got != tt.want {
+				t.Errorf("HasAudio() = %v, want %v", got, tt.want)
+			}
+			if got := (&VideoCapturer{source: r}).Audio() != nil; got != tt.want {
+				t.Errorf("Audio() != nil = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package video
+
+import (
+	"fmt"
+	"time"
+)
+
+// Test patterns selectable with VIDEO_TEST_PATTERN
+const (
+	TestPatternBars  = "bars"  // Color bars, a moving box, a frame counter and a wall-clock timestamp
+	TestPatternSolid = "solid" // Whole frame red or green, switching every 30 frames
+)
+
+// 75% color bars, left to right: white, yellow, cyan, green, magenta, red, blue
+var colorBars = [][3]byte{
+	{191, 191, 191},
+	{191, 191, 0},
+	{0, 191, 191},
+	{0, 191, 0},
+	{191, 0, 191},
+	{191, 0, 0},
+	{0, 0, 191},
+}
+
+var (
+	colorWhite = [3]byte{255, 255, 255}
+	colorTrack = [3]byte{32, 32, 32}
+	colorRed   = [3]byte{255, 0, 0}
+	colorGreen = [3]byte{0, 255, 0}
+)
+
+// Bitmap font metrics, in font pixels (scaled up when drawn)
+const (
+	glyphWidth   = 5
+	glyphHeight  = 7
+	glyphAdvance = glyphWidth + 1 // One column of spacing between characters
+	textLineGap  = 3              // Rows between the counter and timestamp lines
+)
+
+// Wall-clock time burned into every frame, with milliseconds for latency measurements
+const timestampLayout = "15:04:05.000"
+
+// 5x7 bitmap font for the characters burned into the picture; each row uses the low 5 bits
+var glyphs = map[rune][7]byte{
+	'0': {0x0E, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0E},
+	'1': {0x04, 0x0C, 0x04, 0x04, 0x04, 0x04, 0x0E},
+	'2': {0x0E, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1F},
+	'3': {0x1F, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0E},
+	'4': {0x02, 0x06, 0x0A, 0x12, 0x1F, 0x02, 0x02},
+	'5': {0x1F, 0x10, 0x1E, 0x01, 0x01, 0x11, 0x0E},
+	'6': {0x06, 0x08, 0x10, 0x1E, 0x11, 0x11, 0x0E},
+	'7': {0x1F, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	'8': {0x0E, 0x11, 0x11, 0x0E, 0x11, 0x11, 0x0E},
+	'9': {0x0E, 0x11, 0x11, 0x0F, 0x01, 0x02, 0x0C},
+	':': {0x00, 0x0C, 0x0C, 0x00, 0x0C, 0x0C, 0x00},
+	'.': {0x00, 0x00, 0x00, 0x00, 0x00, 0x0C, 0x0C},
+}
+
+// TestPatternGenerator renders raw RGB24 frames of a synthetic test pattern
+// The burned-in frame counter and timestamp make it possible to measure glass-to-glass
+// latency and to spot dropped or repeated frames in the viewer
+type TestPatternGenerator struct {
+	width      int
+	height     int
+	fps        int
+	pattern    string
+	frameCount int
+	background []byte // Pre-rendered static part of the bars pattern
+}
+
+func NewTestPatternGenerator(width, height, fps int, pattern string) (*TestPatternGenerator, error) {
+	if pattern == "" {
+		pattern = TestPatternBars
+	}
+	if pattern != TestPatternBars && pattern != TestPatternSolid {
+		return nil, fmt.Errorf("unknown test pattern %q (expected %q or %q)", pattern, TestPatternBars, TestPatternSolid)
+	}
+
+	g := &TestPatternGenerator{
+		width:   width,
+		height:  height,
+		fps:     fps,
+		pattern: pattern,
+	}
+	if pattern == TestPatternBars {
+		g.background = g.renderBackground()
+	}
+	return g, nil
+}
+
+// NextFrame renders the next frame, stamping it with the given wall-clock time
+func (g *TestPatternGenerator) NextFrame(now time.Time) []byte {
+	g.frameCount++
+	if g.pattern == TestPatternSolid {
+		return g.renderSolid()
+	}
+	return g.renderBars(now)
+}
+
+// renderSolid is the original pattern: alternating colors every 30 frames
+func (g *TestPatternGenerator) renderSolid() []byte {
+	frame := make([]byte, g.width*g.height*3)
+	color := colorRed
+	if (g.frameCount/30)%2 != 0 {
+		color = colorGreen
+	}
+	fillRect(frame, g.width, 0, 0, g.width, g.height, color)
+	return frame
+}
+
+// Layout of the bars pattern: color bars in the top two thirds, a text panel with the
+// frame counter and timestamp below them, and a track along the bottom with a moving box
+func (g *TestPatternGenerator) barsHeight() int  { return g.height * 2 / 3 }
+func (g *TestPatternGenerator) trackHeight() int { return max(g.height/8, 1) }
+
+func (g *TestPatternGenerator) renderBackground() []byte {
+	frame := make([]byte, g.width*g.height*3)
+
+	barsHeight := g.barsHeight()
+	for i, color := range colorBars {
+		x0 := i * g.width / len(colorBars)
+		x1 := (i + 1) * g.width / len(colorBars)
+		fillRect(frame, g.width, x0, 0, x1-x0, barsHeight, color)
+	}
+
+	// Text panel stays black; the track is dark gray so the moving box stands out
+	trackHeight := g.trackHeight()
+	fillRect(frame, g.width, 0, g.height-trackHeight, g.width, trackHeight, colorTrack)
+	return frame
+}
+
+func (g *TestPatternGenerator) renderBars(now time.Time) []byte {
+	frame := make([]byte, len(g.background))
+	copy(frame, g.background)
+
+	// Moving box: bounces across the track, one full crossing every two seconds
+	trackHeight := g.trackHeight()
+	boxSize := trackHeight
+	travel := g.width - boxSize
+	if travel > 0 {
+		period := max(g.fps*2, 1) // Frames per crossing
+		step := g.frameCount % (2 * period)
+		if step > period {
+			step = 2*period - step
+		}
+		x := step * travel / period
+		fillRect(frame, g.width, x, g.height-trackHeight, boxSize, trackHeight, colorWhite)
+	}
+
+	// Frame counter and timestamp, centered in the text panel
+	panelTop := g.barsHeight()
+	panelHeight := g.height - trackHeight - panelTop
+	scale := g.textScale(panelHeight)
+	lines := []string{
+		fmt.Sprintf("%08d", g.frameCount),
+		now.Format(timestampLayout),
+	}
+	textHeight := (2*glyphHeight + textLineGap) * scale
+	y := panelTop + (panelHeight-textHeight)/2
+	for _, line := range lines {
+		lineWidth := len(line) * glyphAdvance * scale
+		drawText(frame, g.width, (g.width-lineWidth)/2, y, scale, line, colorWhite)
+		y += (glyphHeight + textLineGap) * scale
+	}
+
+	return frame
+}
+
+// textScale picks the largest glyph scale at which both text lines fit in the panel
+func (g *TestPatternGenerator) textScale(panelHeight int) int {
+	byHeight := panelHeight / ((2*glyphHeight + textLineGap) + 2)
+	byWidth := g.width / ((len(timestampLayout) + 2) * glyphAdvance)
+	return max(min(byHeight, byWidth), 1)
+}
+
+// fillRect paints a rectangle of an RGB24 frame, clipped to the frame bounds
+func fillRect(frame []byte, width, x, y, w, h int, color [3]byte) {
+	height := len(frame) / (width * 3)
+	x0, y0 := max(x, 0), max(y, 0)
+	x1, y1 := min(x+w, width), min(y+h, height)
+	for row := y0; row < y1; row++ {
+		offset := (row*width + x0) * 3
+		for col := x0; col < x1; col++ {
+			frame[offset] = color[0]
+			frame[offset+1] = color[1]
+			frame[offset+2] = color[2]
+			offset += 3
+		}
+	}
+}
+
+// drawText renders a string with the bitmap font, each font pixel becoming a scale x scale block
+func drawText(frame []byte, width, x, y, scale int, text string, color [3]byte) {
+	for _, ch := range text {
+		if glyph, ok := glyphs[ch]; ok {
+			for row := 0; row < glyphHeight; row++ {
+				for col := 0; col < glyphWidth; col++ {
+					if glyph[row]&(1<<(glyphWidth-1-col)) != 0 {
+						fillRect(frame, width, x+col*scale, y+row*scale, scale, scale, color)
+					}
+				}
+			}
+		}
+		x += glyphAdvance * scale
+	}
+}
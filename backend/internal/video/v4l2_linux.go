@@ -0,0 +1,66 @@
+//go:build linux
+
+package video
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+// V4L2VideoSource captures from a Video4Linux2 device (/dev/videoN), including
+// v4l2loopback devices, and encodes it to baseline H.264 with ffmpeg
+type V4L2VideoSource struct {
+	*ffmpegH264Pipeline
+	device string
+	width  int
+	height int
+	fps    int
+}
+
+func NewV4L2VideoSource(deviceIndex, width, height, fps int, inputFormat string) (*V4L2VideoSource, error) {
+	device := fmt.Sprintf("/dev/video%d", deviceIndex)
+	info, err := os.Stat(device)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open V4L2 device (check VIDEO_DEVICE_INDEX): %w", err)
+	}
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return nil, fmt.Errorf("%s is not a character device", device)
+	}
+
+	// Ask the driver for the configured size and rate; ffmpeg logs it if the driver picks something else
+	inputArgs := []string{
+		"-fflags", "nobuffer",
+		"-flags", "low_delay",
+		"-f", "v4l2",
+		"-framerate", strconv.Itoa(fps),
+		"-video_size", fmt.Sprintf("%dx%d", width, height),
+	}
+	if inputFormat != "" {
+		// e.g. mjpeg - many USB cameras only reach 720p/1080p at full rate in MJPEG
+		inputArgs = append(inputArgs, "-input_format", inputFormat)
+	}
+	inputArgs = append(inputArgs, "-i", device)
+
+	return &V4L2VideoSource{
+		ffmpegH264Pipeline: newFFmpegH264Pipeline("v4l2", inputArgs, h264TranscodeArgs(fps), fps),
+		device:             device,
+		width:              width,
+		height:             height,
+		fps:                fps,
+	}, nil
+}
+
+func (v *V4L2VideoSource) Start() error {
+	log.Printf("Starting V4L2 capture from %s (%dx%d @ %d FPS)", v.device, v.width, v.height, v.fps)
+	return v.ffmpegH264Pipeline.Start()
+}
+
+// RequestKeyframe leaves ffmpeg running: the encoder sends a keyframe every second (-g), sooner
+// than reopening the device would, which also freezes every viewer for a moment
+func (v *V4L2VideoSource) RequestKeyframe() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return !v.closed && v.cmd != nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package video
+
+import "fmt"
+
+// V4L2VideoSource is only available on Linux
+type V4L2VideoSource struct {
+	*ffmpegH264Pipeline
+}
+
+func NewV4L2VideoSource(deviceIndex, width, height, fps int, inputFormat string) (*V4L2VideoSource, error) {
+	return nil, fmt.Errorf("V4L2 capture is only supported on Linux")
+}
@@ -0,0 +1,307 @@
+package video
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4/pkg/media/ivfreader"
+)
+
+// VP8Encoder encodes raw RGB frames to VP8 using ffmpeg (libvpx)
+// Raw frames are written to ffmpeg's stdin and encoded frames are read back from an IVF stream on stdout
+type VP8Encoder struct {
+	width       int
+	height      int
+	fps         int
+	bitrateKbps int
+	cmd         *exec.Cmd
+	stdin       io.WriteCloser
+	frameChan   chan Frame    // Encoded VP8 frames, one per input frame
+	errChan     chan error    // Receives the reason the encoder stopped
+	run         int           // Incremented for every ffmpeg process; output of older runs is ignored
+	nextPTS     time.Duration // PTS the next run starts at, so timestamps continue across restarts
+	mu          sync.Mutex
+	closed      bool
+}
+
+func NewVP8Encoder(width, height, fps, bitrateKbps int) *VP8Encoder {
+	return &VP8Encoder{
+		width:       width,
+		height:      height,
+		fps:         fps,
+		bitrateKbps: bitrateKbps,
+		frameChan:   make(chan Frame, 5),
+		errChan:     make(chan error, 1),
+	}
+}
+
+func (e *VP8Encoder) Start() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return fmt.Errorf("VP8 encoder already closed")
+	}
+
+	log.Printf("🎬 Starting VP8 encoder (%dx%d @ %d FPS, %d kbps)", e.width, e.height, e.fps, e.bitrateKbps)
+	return e.startProcess()
+}
+
+// startProcess runs a new ffmpeg encoder and makes it the current run (e.mu must be held)
+func (e *VP8Encoder) startProcess() error {
+	// Realtime libvpx settings: no lookahead or alt-ref frames so every input frame
+	// comes straight back out, and a keyframe every second so new viewers get a picture quickly
+	ffmpegArgs := []string{
+		"-hide_banner",
+		"-loglevel", "warning",
+		"-f", "rawvideo",
+		"-pix_fmt", "rgb24",
+		"-s", fmt.Sprintf("%dx%d", e.width, e.height),
+		"-r", strconv.Itoa(e.fps),
+		"-i", "-", // Raw frames from stdin
+		"-c:v", "libvpx",
+		"-pix_fmt", "yuv420p",
+		"-deadline", "realtime",
+		"-cpu-used", "8", // Fastest encoding
+		"-lag-in-frames", "0", // No frame buffering
+		"-auto-alt-ref", "0",
+		"-error-resilient", "1", // Better recovery from packet loss
+		"-b:v", fmt.Sprintf("%dk", e.bitrateKbps),
+		"-g", strconv.Itoa(e.fps),
+		"-f", "ivf",
+		"-flush_packets", "1", // Flush packets immediately
+		"-",
+	}
+
+	cmd := exec.Command("ffmpeg", ffmpegArgs...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stdin pipe: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		stdin.Close()
+		return fmt.Errorf("failed to create stdout pipe: %w", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		stdin.Close()
+		return fmt.Errorf("failed to create stderr pipe: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		stdin.Close()
+		return fmt.Errorf("failed to start ffmpeg VP8 encoder (is ffmpeg with libvpx installed?): %w", err)
+	}
+	e.cmd = cmd
+	e.stdin = stdin
+	e.run++
+
+	// Log encoder warnings/errors
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.Printf("ffmpeg (vp8): %s", scanner.Text())
+		}
+	}()
+
+	go e.readFrames(stdout, e.run, e.nextPTS)
+
+	return nil
+}
+
+// Restart replaces the ffmpeg process with a fresh one, whose first frame is a keyframe
+// libvpx can't be asked for a keyframe through ffmpeg while it runs. Raw frames go to the new
+// process from now on and whatever the old one still produces is dropped.
+func (e *VP8Encoder) Restart() error {
+	e.mu.Lock()
+	if e.closed || e.cmd == nil {
+		e.mu.Unlock()
+		return fmt.Errorf("VP8 encoder is not running")
+	}
+	oldCmd, oldStdin := e.cmd, e.stdin
+	if err := e.startProcess(); err != nil {
+		e.mu.Unlock()
+		return err
+	}
+	e.mu.Unlock()
+
+	oldStdin.Close()
+	go func() {
+		oldCmd.Process.Kill()
+		oldCmd.Wait()
+	}()
+	return nil
+}
+
+// Restarts returns how many times the ffmpeg process was replaced
+func (e *VP8Encoder) Restarts() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return max(e.run-1, 0)
+}
+
+// readFrames parses the IVF stream of one ffmpeg run and queues each VP8 frame
+// Frame timestamps start at ptsBase, where the previous run left off.
+func (e *VP8Encoder) readFrames(stdout io.Reader, run int, ptsBase time.Duration) {
+	// Only the current run reports errors and closes the channel - a replaced one just goes away
+	current := func() bool {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return e.run == run
+	}
+	defer func() {
+		if current() {
+			close(e.frameChan)
+		}
+	}()
+
+	reader, ivfHeader, err := ivfreader.NewWith(stdout)
+	if err != nil {
+		if current() {
+			e.stop(fmt.Errorf("VP8 encoder produced no IVF header: %w", err))
+		}
+		return
+	}
+
+	frameDuration := time.Second / time.Duration(max(e.fps, 1))
+	for {
+		payload, frameHeader, err := reader.ParseNextFrame()
+		if err != nil {
+			if !current() {
+				return
+			}
+			if errors.Is(err, io.EOF) {
+				e.stop(fmt.Errorf("VP8 encoder stdout closed"))
+			} else {
+				e.stop(fmt.Errorf("failed to parse VP8 frame: %w", err))
+			}
+			return
+		}
+
+		frame := Frame{Data: payload, PTS: ptsBase + ivfPTS(ivfHeader, frameHeader)}
+		e.mu.Lock()
+		if e.run != run {
+			e.mu.Unlock()
+			continue
+		}
+		e.nextPTS = frame.PTS + frameDuration
+		e.mu.Unlock()
+
+		select {
+		case e.frameChan <- frame:
+		default:
+			// Nobody is reading fast enough - drop the oldest frame to keep latency low
+			select {
+			case <-e.frameChan:
+			default:
+			}
+			e.frameChan <- frame
+		}
+	}
+}
+
+// ivfPTS returns a frame's presentation time from the encoder's IVF timestamps
+// The IVF header holds the time base (1/fps for our input). ivfreader reports the frame
+// timestamp as pts*den/num, so the pts in time base units is Timestamp*num/den.
+func ivfPTS(file *ivfreader.IVFFileHeader, frame *ivfreader.IVFFrameHeader) time.Duration {
+	num := uint64(file.TimebaseNumerator)
+	den := uint64(file.TimebaseDenominator)
+	if num == 0 || den == 0 {
+		return 0
+	}
+	pts := frame.Timestamp * num / den
+	return time.Duration(pts * num * uint64(time.Second) / den)
+}
+
+// stop records why the encoder stopped (unless it was closed on purpose)
+func (e *VP8Encoder) stop(reason error) {
+	e.mu.Lock()
+	closed := e.closed
+	e.mu.Unlock()
+	if closed {
+		return
+	}
+
+	log.Printf("❌ %v", reason)
+	select {
+	case e.errChan <- reason:
+	default:
+	}
+}
+
+// WriteFrame sends one raw RGB24 frame (width*height*3 bytes) to the encoder
+func (e *VP8Encoder) WriteFrame(rgb []byte) error {
+	e.mu.Lock()
+	stdin := e.stdin
+	closed := e.closed
+	e.mu.Unlock()
+
+	if closed || stdin == nil {
+		return fmt.Errorf("VP8 encoder is not running")
+	}
+	if expected := e.width * e.height * 3; len(rgb) != expected {
+		return fmt.Errorf("raw frame is %d bytes, expected %d", len(rgb), expected)
+	}
+	if _, err := stdin.Write(rgb); err != nil {
+		e.mu.Lock()
+		restarted := e.stdin != stdin
+		e.mu.Unlock()
+		if restarted {
+			// The encoder was replaced while we wrote - only this frame is lost
+			return nil
+		}
+		return fmt.Errorf("failed to write frame to VP8 encoder: %w", err)
+	}
+	return nil
+}
+
+// Frames returns the channel of encoded VP8 frames; it is closed when the encoder stops
+func (e *VP8Encoder) Frames() <-chan Frame {
+	return e.frameChan
+}
+
+// Errors returns the channel that receives the reason the encoder stopped unexpectedly
+func (e *VP8Encoder) Errors() <-chan error {
+	return e.errChan
+}
+
+func (e *VP8Encoder) Close() error {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return nil
+	}
+	e.closed = true
+	cmd := e.cmd
+	stdin := e.stdin
+	e.mu.Unlock()
+
+	if stdin != nil {
+		// Closing stdin lets ffmpeg flush and exit on its own
+		stdin.Close()
+	}
+	if cmd == nil || cmd.Process == nil {
+		return nil
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		log.Printf("⚠️ VP8 encoder did not exit in time, killing it")
+		cmd.Process.Kill()
+		<-done
+	}
+	return nil
+}
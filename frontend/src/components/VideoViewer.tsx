@@ -1,8 +1,24 @@
-import React from 'react';
+import React, { useEffect, useState } from 'react';
 import { useWebRTC } from '../hooks/useWebRTC';
 
 const VideoViewer: React.FC = () => {
-  const { isConnected, connectionState, hasTrack, videoRef, connect, disconnect } = useWebRTC();
+  const { isConnected, connectionState, hasTrack, hasAudio, layers, videoRef, connect, disconnect, selectLayer } = useWebRTC();
+  // Playback starts muted (browsers block autoplay with sound) - the viewer unmutes explicitly
+  const [isMuted, setIsMuted] = useState(true);
+
+  // Every new stream starts muted again
+  useEffect(() => {
+    if (!hasTrack) {
+      setIsMuted(true);
+    }
+  }, [hasTrack]);
+
+  const toggleMute = () => {
+    if (videoRef.current) {
+      videoRef.current.muted = !isMuted;
+    }
+    setIsMuted(!isMuted);
+  };
 
   const getConnectionStatusColor = () => {
     switch (connectionState) {
@@ -94,6 +110,52 @@ const VideoViewer: React.FC = () => {
               </span>
             </div>
 
+            {/* Quality Selector (only when the publisher encodes several layers) */}
+            {layers && (
+              <select
+                value={layers.auto ? 'auto' : layers.current}
+                onChange={(e) => selectLayer(e.target.value)}
+                title={`Receiving ${layers.current}`}
+                style={{
+                  padding: '10px 12px',
+                  backgroundColor: '#4b5563',
+                  color: '#ffffff',
+                  borderRadius: '8px',
+                  border: 'none',
+                  cursor: 'pointer',
+                  fontWeight: '600',
+                  fontSize: '14px'
+                }}
+              >
+                <option value="auto">Auto ({layers.current})</option>
+                {layers.layers.map((layer) => (
+                  <option key={layer.name} value={layer.name}>
+                    {layer.name} · {layer.bitrate} kbps
+                  </option>
+                ))}
+              </select>
+            )}
+
+            {/* Mute/Unmute Button (only when the stream has audio) */}
+            {hasAudio && (
+              <button
+                onClick={toggleMute}
+                style={{
+                  padding: '10px 20px',
+                  backgroundColor: '#4b5563',
+                  color: '#ffffff',
+                  borderRadius: '8px',
+                  border: 'none',
+                  cursor: 'pointer',
+                  fontWeight: '600',
+                  fontSize: '14px',
+                  whiteSpace: 'nowrap'
+                }}
+              >
+                {isMuted ? '🔇 Unmute' : '🔊 Mute'}
+              </button>
+            )}
+
             {/* Connect/Disconnect Button */}
             <button
               onClick={isConnected ? disconnect : connect}
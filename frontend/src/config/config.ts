@@ -1,5 +1,7 @@
 interface Config {
   signalingServerUrl: string;
+  room: string;
+  token: string;
 }
 
 // Get WebSocket URL - use same origin in production, or configured URL in development
@@ -31,8 +33,29 @@ const getSignalingUrl = () => {
   return 'ws://localhost:8081/ws';
 };
 
+// Get the signaling room (one room per stream) - ?room= in the page URL wins over the env default
+const getRoom = () => {
+  const roomParam = new URLSearchParams(window.location.search).get('room');
+  if (roomParam) {
+    return roomParam;
+  }
+  return import.meta.env.VITE_SIGNALING_ROOM || 'default';
+};
+
+// Get the signaling auth token - ?token= in the page URL wins over the env default
+// Browsers can't set headers on WebSocket upgrades, so the token is sent as a query param
+const getToken = () => {
+  const tokenParam = new URLSearchParams(window.location.search).get('token');
+  if (tokenParam) {
+    return tokenParam;
+  }
+  return import.meta.env.VITE_SIGNALING_TOKEN || '';
+};
+
 export const config: Config = {
   signalingServerUrl: getSignalingUrl(),
+  room: getRoom(),
+  token: getToken(),
 };
 
 export default config;
@@ -2,22 +2,49 @@ import { useEffect, useRef, useState } from 'react';
 import config from '../config/config';
 import { getWebRTCConfiguration } from '../ice/config';
 
+// Signaling protocol version spoken by this client (see backend/internal/protocol)
+const PROTOCOL_VERSION = 1;
+
 interface CandidateMessage {
+  version: number;
   type: 'candidate';
   candidate: RTCIceCandidateInit;
   clientId?: string;
+  targetClientId?: string;
 }
 
 interface AnswerMessage {
+  version: number;
   type: 'answer';
   answer: RTCSessionDescriptionInit;
   clientId?: string;
+  targetClientId?: string;
+}
+
+// One simulcast layer (rendition) the publisher encodes, e.g. 540p at 1200 kbps
+export interface VideoLayer {
+  name: string;
+  height: number;
+  bitrate: number; // kbps
 }
 
+// The layers the publisher offers and the one we are receiving (see the 'layers' message)
+export interface LayerState {
+  layers: VideoLayer[];
+  current: string;
+  auto: boolean; // The publisher picks the layer from our bandwidth estimate
+}
+
+// Resume tokens are kept per room for the lifetime of the tab, so a reconnect within
+// the server's grace period gets the same client ID back
+const resumeTokenKey = (room: string) => `signaling-resume-token:${room}`;
+
 export const useWebRTC = () => {
   const [isConnected, setIsConnected] = useState(false);
   const [connectionState, setConnectionState] = useState<RTCIceConnectionState>('new');
   const [hasTrack, setHasTrack] = useState(false); // Track if we've received a track
+  const [hasAudio, setHasAudio] = useState(false); // The stream carries camera audio
+  const [layers, setLayers] = useState<LayerState | null>(null); // Null when the stream has a single encoding
   const videoRef = useRef<HTMLVideoElement>(null);
   const peerConnectionRef = useRef<RTCPeerConnection | null>(null);
   const wsRef = useRef<WebSocket | null>(null);
@@ -25,8 +52,10 @@ export const useWebRTC = () => {
   const remoteDescriptionSetRef = useRef(false);
   const mediaStreamRef = useRef<MediaStream | null>(null);
   const clientIdRef = useRef<string | null>(null); // Track our client ID
+  const publisherIdRef = useRef<string | null>(null); // Publisher that sent us the offer (target for answers/candidates)
   const isConnectingRef = useRef(false); // Prevent concurrent connections
   const isDisconnectingRef = useRef(false); // Prevent race conditions during disconnect
+  const retryTimerRef = useRef<ReturnType<typeof setTimeout> | null>(null); // Reconnect after a server shutdown
 
   const createPeerConnection = () => {
     // Get centralized WebRTC configuration (ICE/STUN/TURN)
@@ -47,6 +76,7 @@ export const useWebRTC = () => {
           // Always send candidate - signaling server will add clientId if missing
           // But include it if we know it to help with routing
           const candidateMsg: CandidateMessage = {
+            version: PROTOCOL_VERSION,
             type: 'candidate',
             candidate: {
               candidate: event.candidate.candidate,
@@ -61,6 +91,10 @@ export const useWebRTC = () => {
           } else {
             console.log('📤 Sending ICE candidate (clientId will be set by signaling server)');
           }
+          // Address the candidate to the publisher only, not every client in the room
+          if (publisherIdRef.current) {
+            candidateMsg.targetClientId = publisherIdRef.current;
+          }
           wsRef.current.send(JSON.stringify(candidateMsg));
           console.log('✅ ICE candidate sent');
         } else {
@@ -152,13 +186,27 @@ export const useWebRTC = () => {
       
       // Ensure track is enabled
       event.track.enabled = true;
+
+      // Camera audio joins the current stream - only the video track starts a fresh one
+      if (event.track.kind === 'audio') {
+        if (!mediaStreamRef.current) {
+          mediaStreamRef.current = new MediaStream();
+        }
+        mediaStreamRef.current.addTrack(event.track);
+        setHasAudio(true);
+        console.log('🔊 Audio track added to stream:', { id: event.track.id });
+        return;
+      }
       
       // Always create a fresh stream to avoid stale tracks from previous connections
-      // Remove old stream tracks if they exist
+      // Remove old stream tracks if they exist (tracks of this connection, like its audio, are kept alive)
+      const currentTracks = pc.getReceivers().map(receiver => receiver.track);
       if (mediaStreamRef.current) {
         const oldTracks = mediaStreamRef.current.getTracks();
         oldTracks.forEach(track => {
-          track.stop();
+          if (!currentTracks.includes(track)) {
+            track.stop();
+          }
           mediaStreamRef.current!.removeTrack(track);
         });
       }
@@ -166,6 +214,10 @@ export const useWebRTC = () => {
       // Create new MediaStream
       mediaStreamRef.current = new MediaStream();
       mediaStreamRef.current.addTrack(event.track);
+      // Audio that arrived before the video stays in the stream
+      currentTracks
+        .filter(track => track.kind === 'audio' && track.readyState === 'live')
+        .forEach(track => mediaStreamRef.current!.addTrack(track));
       console.log('🎥 Created new MediaStream with track:', {
         kind: event.track.kind,
         id: event.track.id,
@@ -380,13 +432,26 @@ export const useWebRTC = () => {
     isConnectingRef.current = true;
 
     try {
-      console.log('🔌 Attempting to connect to:', config.signalingServerUrl);
+      // Join the configured room so we only see signaling for our stream
+      const signalingUrl = new URL(config.signalingServerUrl);
+      signalingUrl.searchParams.set('room', config.room);
+      const resumeToken = sessionStorage.getItem(resumeTokenKey(config.room));
+      if (resumeToken) {
+        signalingUrl.searchParams.set('resumeToken', resumeToken);
+      }
+      console.log('🔌 Attempting to connect to:', signalingUrl.toString(), '(room:', config.room + ')');
+      // Added after logging so the token doesn't end up in the console
+      if (config.token) {
+        signalingUrl.searchParams.set('token', config.token);
+      }
       
       // Reset state before connecting
       setIsConnected(false);
       setConnectionState('new');
       setHasTrack(false);
+      setHasAudio(false);
       clientIdRef.current = null;
+      publisherIdRef.current = null;
       remoteDescriptionSetRef.current = false;
       candidateQueueRef.current = [];
       
@@ -410,7 +475,7 @@ export const useWebRTC = () => {
       }
       
       // Connect to signaling server
-      const ws = new WebSocket(config.signalingServerUrl);
+      const ws = new WebSocket(signalingUrl.toString());
       wsRef.current = ws;
 
       ws.onopen = () => {
@@ -448,10 +513,81 @@ export const useWebRTC = () => {
           candidate?: RTCIceCandidateInit | { candidate?: string; sdpMLineIndex?: number; sdpMid?: string };
           clientId?: string;
           fromClientId?: string;
+          targetClientId?: string;
+          code?: string;
+          message?: string;
+          resumeToken?: string;
+          resumed?: boolean;
+          publisherId?: string;
+          stream?: string;
+          layers?: VideoLayer[];
+          current?: string;
+          auto?: boolean;
+          reason?: string;
+          retryAfterMs?: number;
         }
         const message = JSON.parse(event.data) as WebRTCMessage;
         console.log('📥 Received message:', message.type, message);
 
+        // The server announces our identity first - no need to infer it from routed messages
+        if (message.type === 'welcome') {
+          clientIdRef.current = message.clientId ?? null;
+          if (message.resumeToken) {
+            sessionStorage.setItem(resumeTokenKey(config.room), message.resumeToken);
+          }
+          console.log('🪪 Signaling identity:', message.clientId, '(resumed:', message.resumed + ')');
+
+          // Declare ourselves as a viewer of the configured stream - the publisher is only told about joined viewers
+          ws.send(JSON.stringify({ version: PROTOCOL_VERSION, type: 'join', role: 'viewer', stream: config.room }));
+          console.log('📤 Joining stream', config.room, 'as viewer');
+          return;
+        }
+
+        if (message.type === 'joined') {
+          publisherIdRef.current = message.publisherId ?? null;
+          if (message.publisherId) {
+            console.log('✅ Joined stream', message.stream, '- publisher online, waiting for offer...');
+          } else {
+            console.log('✅ Joined stream', message.stream, '- waiting for the publisher to come online...');
+          }
+          return;
+        }
+
+        if (message.type === 'publisher_online') {
+          publisherIdRef.current = message.clientId ?? null;
+          console.log('📡 Publisher came online:', message.clientId, '- waiting for offer...');
+          return;
+        }
+
+        if (message.type === 'publisher_offline') {
+          console.warn('⚠️ Publisher went offline - resetting peer connection and waiting for it to return');
+          publisherIdRef.current = null;
+          if (peerConnectionRef.current) {
+            peerConnectionRef.current.close();
+            peerConnectionRef.current = null;
+          }
+          remoteDescriptionSetRef.current = false;
+          candidateQueueRef.current = [];
+          setHasTrack(false);
+          setHasAudio(false);
+          setLayers(null);
+          setConnectionState('checking');
+          createPeerConnection();
+          return;
+        }
+
+        // The signaling server is going down (e.g. for a deploy) and closes the connection next -
+        // come back when it says it will be ready, with some jitter so viewers don't all arrive at once
+        if (message.type === 'server_shutdown') {
+          const retryAfterMs = (message.retryAfterMs ?? 3000) + Math.random() * 1000;
+          console.warn(`📴 Signaling server is shutting down (${message.reason ?? 'no reason given'}) - reconnecting in ${Math.round(retryAfterMs)} ms`);
+          retryTimerRef.current = setTimeout(() => {
+            retryTimerRef.current = null;
+            connect();
+          }, retryAfterMs);
+          return;
+        }
+
         // Track our client ID from any message (signaling server adds it)
         // Try both clientId (if message is for us) and fromClientId (sender's ID)
         if (!clientIdRef.current) {
@@ -499,6 +635,10 @@ export const useWebRTC = () => {
               break;
             }
             console.log('📥 Received offer from publisher:', message.offer);
+            // Remember who sent the offer so answers/candidates are delivered to that publisher only
+            if (message.fromClientId) {
+              publisherIdRef.current = message.fromClientId;
+            }
             if (message.offer && peerConnectionRef.current) {
               try {
                 console.log('🔧 Setting remote description (offer)...');
@@ -527,13 +667,17 @@ export const useWebRTC = () => {
                 
                 console.log('Sending answer to publisher...');
                 const answerMsg: AnswerMessage = {
+                  version: PROTOCOL_VERSION,
                   type: 'answer',
-                  answer: answer,
+                  answer: { type: answer.type, sdp: answer.sdp },
                 };
                 // Include our client ID if we know it
                 if (clientIdRef.current) {
                   answerMsg.clientId = clientIdRef.current;
                 }
+                if (publisherIdRef.current) {
+                  answerMsg.targetClientId = publisherIdRef.current;
+                }
                 ws.send(JSON.stringify(answerMsg));
                 console.log('✅ Answer sent, waiting for ICE connection...');
               } catch (error) {
@@ -590,6 +734,22 @@ export const useWebRTC = () => {
               }
             }
             break;
+
+          case 'layers':
+            // Sent when we connect and after every layer switch
+            if (message.layers && message.current) {
+              console.log('📚 Receiving the', message.current, 'layer', message.auto ? '(auto)' : '(selected)');
+              setLayers({ layers: message.layers, current: message.current, auto: message.auto ?? false });
+            }
+            break;
+
+          case 'error':
+            if (message.code === 'forbidden') {
+              console.error('🔒 Token does not allow watching this stream:', message.message);
+            } else {
+              console.error('❌ Signaling error:', message.code, message.message);
+            }
+            break;
         }
       };
 
@@ -614,6 +774,12 @@ export const useWebRTC = () => {
     isDisconnectingRef.current = true;
     isConnectingRef.current = false;
 
+    // A disconnect (or a new connect) cancels the reconnect scheduled by server_shutdown
+    if (retryTimerRef.current) {
+      clearTimeout(retryTimerRef.current);
+      retryTimerRef.current = null;
+    }
+
     console.log('🔌 Disconnecting...');
 
     // Close and clean up peer connection
@@ -676,9 +842,12 @@ export const useWebRTC = () => {
     setIsConnected(false);
     setConnectionState('closed');
     setHasTrack(false);
+    setHasAudio(false);
+    setLayers(null);
     
     // Reset all refs
     clientIdRef.current = null;
+    publisherIdRef.current = null;
     remoteDescriptionSetRef.current = false;
     candidateQueueRef.current = [];
 
@@ -690,6 +859,20 @@ export const useWebRTC = () => {
     }, 100);
   };
 
+  // Asks the publisher for a layer by name, or 'auto' to let it follow our bandwidth
+  const selectLayer = (layer: string) => {
+    if (wsRef.current?.readyState !== WebSocket.OPEN || !publisherIdRef.current) {
+      return;
+    }
+    wsRef.current.send(JSON.stringify({
+      version: PROTOCOL_VERSION,
+      type: 'select_layer',
+      layer,
+      targetClientId: publisherIdRef.current,
+    }));
+    console.log('📤 Asked the publisher for the', layer, 'layer');
+  };
+
   useEffect(() => {
     return () => {
       disconnect();
@@ -700,9 +883,12 @@ export const useWebRTC = () => {
     isConnected,
     connectionState,
     hasTrack,
+    hasAudio,
+    layers,
     videoRef,
     connect,
     disconnect,
+    selectLayer,
   };
 };
 